@@ -0,0 +1,217 @@
+package domain
+
+import (
+	"kvdb/storage"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// blockers tracks the sessions blocked by BLPOP, BRPOP, BLMOVE, BZPOPMIN and BZPOPMAX on every key, to wake them
+// up when the key is modified.
+type blockers struct {
+	mu      sync.Mutex
+	waiting map[dbKey]map[chan struct{}]struct{}
+	blocked int // Number of sessions blocked
+}
+
+// block registers a channel signaled when one of the given keys of a database is modified.
+func (b *blockers) block(dbIndex int, keys []string) chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.waiting == nil {
+		b.waiting = make(map[dbKey]map[chan struct{}]struct{})
+	}
+	b.blocked++
+	wake := make(chan struct{}, 1)
+	for _, key := range keys {
+		dk := dbKey{dbIndex: dbIndex, key: key}
+		if b.waiting[dk] == nil {
+			b.waiting[dk] = make(map[chan struct{}]struct{})
+		}
+		b.waiting[dk][wake] = struct{}{}
+	}
+	return wake
+}
+
+// unblock forgets a channel registered by block on the given keys.
+func (b *blockers) unblock(dbIndex int, keys []string, wake chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.blocked--
+	for _, key := range keys {
+		dk := dbKey{dbIndex: dbIndex, key: key}
+		delete(b.waiting[dk], wake)
+		if len(b.waiting[dk]) == 0 {
+			delete(b.waiting, dk)
+		}
+	}
+}
+
+// count returns the number of sessions blocked.
+func (b *blockers) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.blocked
+}
+
+// signal wakes up the sessions blocked on the given keys of a database, it is called once they were modified.
+// A session already woken up is not signaled twice, it checks all its keys again anyway.
+func (b *blockers) signal(dbIndex int, keys ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, key := range keys {
+		for wake := range b.waiting[dbKey{dbIndex: dbIndex, key: key}] {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// signalDB wakes up all the sessions blocked on keys of a database, it is called once the database was replaced.
+func (b *blockers) signalDB(dbIndex int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for dk, waiting := range b.waiting {
+		if dk.dbIndex != dbIndex {
+			continue
+		}
+		for wake := range waiting {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// parseTimeout parses the timeout of a blocking command, in seconds. A timeout of 0 blocks forever.
+func parseTimeout(arg string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds*float64(time.Second) > math.MaxInt64 {
+		return 0, &CommandError{msg: "timeout is not a float or out of range"}
+	}
+	if seconds < 0 {
+		return 0, &CommandError{msg: "timeout is negative"}
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func checkTimeout(c Command) error {
+	_, err := parseTimeout(c.Args[len(c.Args)-1])
+	return err
+}
+
+// blockingKeys returns the keys a blocking command waits for: the source list of BLMOVE and all the keys of
+// the other commands.
+func blockingKeys(cmd Command) []string {
+	keys := cmd.keys()
+	if cmd.Keyword == BLMOVE {
+		return keys[:1]
+	}
+	return keys
+}
+
+// executeBlocking runs a blocking command until it replies something else than a nil reply, its timeout expires or
+// its client disconnects.
+//
+// The command first runs like any other. When none of its keys holds an element, the session waits without
+// holding the lock of the database for one of its keys to be modified, then runs the command again.
+// The session starts waiting before the first run so that it does not miss a modification made in between.
+// Once the Done channel of the session is closed the command stops before popping an element, which would be lost.
+func (k *KeyValueDB) executeBlocking(s *Session, cmd Command) any {
+	timeout, _ := parseTimeout(cmd.Args[len(cmd.Args)-1])
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	dbIndex, keys := s.DbIndex, blockingKeys(cmd)
+	wake := k.blockers.block(dbIndex, keys)
+	defer k.blockers.unblock(dbIndex, keys, wake)
+	for {
+		select {
+		case <-s.Done:
+			return DBResult{DbIndex: dbIndex, Type: NilReply, Response: "(nil)"}
+		default:
+		}
+		k.lock.RLock()
+		result := k.run(s, cmd)
+		k.lock.RUnlock()
+		if res, ok := result.(DBResult); !ok || res.Kind() != NilReply {
+			return result
+		}
+
+		select {
+		case <-wake:
+		case <-expired:
+			return DBResult{DbIndex: dbIndex, Type: NilReply, Response: "(nil)"}
+		case <-s.Done:
+			return DBResult{DbIndex: dbIndex, Type: NilReply, Response: "(nil)"}
+		}
+	}
+}
+
+// bpopCommand handles BLPOP and BRPOP, which pop an element from the first non-empty list of the given keys
+// and return it along with its key. It replies with a nil reply when all the lists are empty.
+func (k *KeyValueDB) bpopCommand(s *Session, cmd Command) any {
+	keys := cmd.keys()
+	for _, key := range keys {
+		popped, err := k.pop(s.DbIndex, key, cmd.Keyword == BLPOP, 1)
+		if err == nil {
+			return DBResult{DbIndex: s.DbIndex, Value: []DBResult{NewBulkResult(key), NewBulkResult(popped[0])}, Type: ArrayReply}
+		}
+		if _, notFound := err.(*storage.KeyNotFoundError); !notFound {
+			return NewErrorResult(err)
+		}
+	}
+	return notFoundResult(s.DbIndex, keys[0], NewNilResult())
+}
+
+func (k *KeyValueDB) blmoveCommand(s *Session, cmd Command) any {
+	return k.lmove(s, cmd.Args[0], cmd.Args[1], cmd.Args[2], cmd.Args[3])
+}
+
+// propagatedCommand returns the command logged to the append-only file and streamed to the replicas once a write
+// command executed.
+//
+// Blocking commands are logged as their non-blocking counterparts, only for the key they modified:
+// replaying them must never block. SPOP is logged as SREM of the members it popped, which are random.
+func propagatedCommand(cmd Command, result any) Command {
+	switch cmd.Keyword {
+	case BLPOP, BRPOP:
+		key := result.(DBResult).Elements()[0].Text()
+		if cmd.Keyword == BLPOP {
+			return NewCommand(LPOP, key)
+		}
+		return NewCommand(RPOP, key)
+	case BLMOVE:
+		return Command{Keyword: LMOVE, Args: cmd.Args[:4]}
+	case BZPOPMIN, BZPOPMAX:
+		key := result.(DBResult).Elements()[0].Text()
+		if cmd.Keyword == BZPOPMIN {
+			return NewCommand(ZPOPMIN, key)
+		}
+		return NewCommand(ZPOPMAX, key)
+	case SPOP:
+		r := result.(DBResult)
+		if r.Type == BulkReply {
+			return NewCommand(SREM, cmd.Args[0], r.Value)
+		}
+		args := []string{cmd.Args[0]}
+		for _, member := range r.Elements() {
+			args = append(args, member.Text())
+		}
+		return Command{Keyword: SREM, Args: args}
+	}
+	return cmd
+}
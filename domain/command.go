@@ -1,19 +1,148 @@
 package domain
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
 
 const (
-	SET        string = "SET"
-	GET        string = "GET"
-	DEL        string = "DEL"
-	INCR       string = "INCR"
-	INCRBY     string = "INCRBY"
-	MULTI      string = "MULTI"
-	DISCARD    string = "DISCARD"
-	EXEC       string = "EXEC"
-	COMPACT    string = "COMPACT"
-	DISCONNECT string = "DISCONNECT"
-	SELECT     string = "SELECT"
+	SET         string = "SET"
+	GET         string = "GET"
+	SETNX       string = "SETNX"
+	SETEX       string = "SETEX"
+	GETSET      string = "GETSET"
+	GETDEL      string = "GETDEL"
+	GETEX       string = "GETEX"
+	APPEND      string = "APPEND"
+	STRLEN      string = "STRLEN"
+	GETRANGE    string = "GETRANGE"
+	SETRANGE    string = "SETRANGE"
+	DEL         string = "DEL"
+	UNLINK      string = "UNLINK"
+	EXISTS      string = "EXISTS"
+	TOUCH       string = "TOUCH"
+	MSET        string = "MSET"
+	MSETNX      string = "MSETNX"
+	MGET        string = "MGET"
+	INCR        string = "INCR"
+	INCRBY      string = "INCRBY"
+	DECR        string = "DECR"
+	DECRBY      string = "DECRBY"
+	INCRBYFLOAT string = "INCRBYFLOAT"
+	LPUSH       string = "LPUSH"
+	RPUSH       string = "RPUSH"
+	LPOP        string = "LPOP"
+	RPOP        string = "RPOP"
+	LRANGE      string = "LRANGE"
+	LLEN        string = "LLEN"
+	LINDEX      string = "LINDEX"
+	LSET        string = "LSET"
+	LREM        string = "LREM"
+	LTRIM       string = "LTRIM"
+	LINSERT     string = "LINSERT"
+	LMOVE       string = "LMOVE"
+	LPOS        string = "LPOS"
+	BLPOP       string = "BLPOP"
+	BRPOP       string = "BRPOP"
+	BLMOVE      string = "BLMOVE"
+	MULTI       string = "MULTI"
+	DISCARD     string = "DISCARD"
+	EXEC        string = "EXEC"
+	COMPACT     string = "COMPACT"
+	DISCONNECT  string = "DISCONNECT"
+	SELECT      string = "SELECT"
+	HELLO       string = "HELLO"
+	CLIENT      string = "CLIENT"
+	PING        string = "PING"
+	WATCH       string = "WATCH"
+	UNWATCH     string = "UNWATCH"
+
+	HSET         string = "HSET"
+	HGET         string = "HGET"
+	HMGET        string = "HMGET"
+	HDEL         string = "HDEL"
+	HEXISTS      string = "HEXISTS"
+	HGETALL      string = "HGETALL"
+	HKEYS        string = "HKEYS"
+	HVALS        string = "HVALS"
+	HLEN         string = "HLEN"
+	HINCRBY      string = "HINCRBY"
+	HINCRBYFLOAT string = "HINCRBYFLOAT"
+	HSETNX       string = "HSETNX"
+	HSTRLEN      string = "HSTRLEN"
+	HSCAN        string = "HSCAN"
+
+	SADD        string = "SADD"
+	SREM        string = "SREM"
+	SMEMBERS    string = "SMEMBERS"
+	SISMEMBER   string = "SISMEMBER"
+	SMISMEMBER  string = "SMISMEMBER"
+	SCARD       string = "SCARD"
+	SPOP        string = "SPOP"
+	SRANDMEMBER string = "SRANDMEMBER"
+	SMOVE       string = "SMOVE"
+	SSCAN       string = "SSCAN"
+	SINTER      string = "SINTER"
+	SUNION      string = "SUNION"
+	SDIFF       string = "SDIFF"
+	SINTERSTORE string = "SINTERSTORE"
+	SUNIONSTORE string = "SUNIONSTORE"
+	SDIFFSTORE  string = "SDIFFSTORE"
+	SINTERCARD  string = "SINTERCARD"
+
+	ZADD        string = "ZADD"
+	ZINCRBY     string = "ZINCRBY"
+	ZSCORE      string = "ZSCORE"
+	ZCARD       string = "ZCARD"
+	ZRANK       string = "ZRANK"
+	ZREVRANK    string = "ZREVRANK"
+	ZRANGE      string = "ZRANGE"
+	ZREM        string = "ZREM"
+	ZCOUNT      string = "ZCOUNT"
+	ZPOPMIN     string = "ZPOPMIN"
+	ZPOPMAX     string = "ZPOPMAX"
+	BZPOPMIN    string = "BZPOPMIN"
+	BZPOPMAX    string = "BZPOPMAX"
+	ZUNIONSTORE string = "ZUNIONSTORE"
+	ZINTERSTORE string = "ZINTERSTORE"
+
+	EXPIRE    string = "EXPIRE"
+	PEXPIRE   string = "PEXPIRE"
+	EXPIREAT  string = "EXPIREAT"
+	PEXPIREAT string = "PEXPIREAT"
+	TTL       string = "TTL"
+	PTTL      string = "PTTL"
+	PERSIST   string = "PERSIST"
+
+	KEYS      string = "KEYS"
+	SCAN      string = "SCAN"
+	TYPE      string = "TYPE"
+	DBSIZE    string = "DBSIZE"
+	RANDOMKEY string = "RANDOMKEY"
+	RENAME    string = "RENAME"
+	RENAMENX  string = "RENAMENX"
+	COPY      string = "COPY"
+	MOVE      string = "MOVE"
+	SWAPDB    string = "SWAPDB"
+	FLUSHDB   string = "FLUSHDB"
+	FLUSHALL  string = "FLUSHALL"
+	OBJECT    string = "OBJECT"
+
+	BGREWRITEAOF string = "BGREWRITEAOF"
+	SAVE         string = "SAVE"
+	BGSAVE       string = "BGSAVE"
+	LASTSAVE     string = "LASTSAVE"
+	COMMAND      string = "COMMAND"
+	INFO         string = "INFO"
+
+	REPLICAOF string = "REPLICAOF"
+	SLAVEOF   string = "SLAVEOF"
+	ROLE      string = "ROLE"
+	SYNC      string = "SYNC"
+	REPLCONF  string = "REPLCONF"
 )
 
 type CommandError struct {
@@ -24,107 +153,301 @@ func (c *CommandError) Error() string {
 	return fmt.Sprintf("(error) ERR %s", c.msg)
 }
 
-type Command struct {
-	Keyword string
-	Key     string
-	Value   any
+// newArityError returns the error of a command given a wrong number of arguments.
+func newArityError(keyword string) error {
+	return &CommandError{msg: fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(keyword))}
 }
 
-func NewCommand(keyword string, args ...any) Command {
-	var key string
-	var value any
+// Options of the SET and GETEX commands setting the expiration time of the key
+const (
+	optEX      string = "EX"
+	optPX      string = "PX"
+	optEXAT    string = "EXAT"
+	optPXAT    string = "PXAT"
+	optKEEPTTL string = "KEEPTTL"
+	optPERSIST string = "PERSIST"
+)
 
-	if len(args) > 0 {
-		key = fmt.Sprintf("%v", args[0])
-	}
+// Options of the SET command setting the key depending on its existence, and returning its previous value
+const (
+	optNX  string = "NX"
+	optXX  string = "XX"
+	optGET string = "GET"
+)
 
-	if len(args) > 1 {
-		value = args[1]
-	}
+// Command is a command sent by a client: its keyword and the arguments following it.
+type Command struct {
+	Keyword string   // Name of the command, upper-cased
+	Args    []string // Arguments following the keyword
+}
 
-	return Command{
-		keyword,
-		key,
-		value,
+// NewCommand returns the command with the given keyword and arguments, which are formatted as strings.
+func NewCommand(keyword string, args ...any) Command {
+	var cmdArgs []string
+	for _, arg := range args {
+		cmdArgs = append(cmdArgs, fmt.Sprintf("%v", arg))
 	}
+	return Command{Keyword: keyword, Args: cmdArgs}
 }
 
 // Validate checks if the command is valid and returns a boolean value and an error.
 //
-// It validates the command based on its keyword and checks if the required arguments are present.
+// It looks up the command in the registry, checks its number of arguments against the arity of the command
+// and runs the argument checks of the command, if any.
 // It returns a boolean value indicating whether the command is valid or not, and an error if any.
 func (c Command) Validate() (bool, error) {
-	var errMsg string
-	var keyword string
+	spec, ok := lookupCommand(c.Keyword)
+	if !ok {
+		return false, &CommandError{msg: fmt.Sprintf("unknown command %s", c.Keyword)}
+	}
 
-	switch c.Keyword {
-	case SET, INCRBY:
-		keyword = SET
-		if c.Keyword == INCRBY {
-			keyword = INCRBY
+	argc := len(c.Args) + 1
+	if (spec.Arity > 0 && argc != spec.Arity) || (spec.Arity < 0 && argc < -spec.Arity) {
+		return false, newArityError(c.Keyword)
+	}
+	if spec.Check != nil {
+		if err := spec.Check(c); err != nil {
+			return false, err
 		}
+	}
+	return true, nil
+}
 
-		if c.Key == "" {
-			errMsg = fmt.Sprintf(
-				"%s command expected 2 arguments but none was given (i.e no Key & value)", keyword)
-			return false, &CommandError{msg: errMsg}
-		}
-		if c.Value == nil {
-			errMsg = fmt.Sprintf("%s command expected 2 arguments but 1 was given (i.e no value)", keyword)
-			return false, &CommandError{msg: errMsg}
-		}
-		return true, nil
-	case GET, DEL, INCR, SELECT:
-		keyword = GET
-		if c.Keyword == DEL {
-			keyword = DEL
-		} else if c.Keyword == INCR {
-			keyword = INCR
-		} else if c.Keyword == SELECT {
-			keyword = SELECT
-		}
+func (c Command) String() string {
+	return fmt.Sprintf("{Keyword: %q, Args: %q}", c.Keyword, c.Args)
+}
 
-		if c.Key == "" {
-			errMsg = fmt.Sprintf("%s command expected 1 argument but none was given (i.e no Key)", keyword)
-			return false, &CommandError{msg: errMsg}
-		}
-		if c.Value != nil {
-			errMsg = fmt.Sprintf("%s command expected 1 argument but 2 was given", keyword)
-			return false, &CommandError{msg: errMsg}
-		}
-		return true, nil
-	case MULTI, DISCARD, EXEC, COMPACT, DISCONNECT:
-		keyword = MULTI
-		if c.Keyword == DISCARD {
-			keyword = DISCARD
-		} else if c.Keyword == EXEC {
-			keyword = EXEC
-		} else if c.Keyword == DISCONNECT {
-			keyword = DISCONNECT
+// Argv returns the command as a list of arguments: the keyword followed by its arguments.
+func (c Command) Argv() []string {
+	return append([]string{c.Keyword}, c.Args...)
+}
+
+// Arg returns the argument at the given position, or an empty string if the command has less arguments.
+func (c Command) Arg(i int) string {
+	if i < len(c.Args) {
+		return c.Args[i]
+	}
+	return ""
+}
+
+// keys returns the keys the command accesses, found at the key positions of its specification
+// or by its Keys function.
+func (c Command) keys() []string {
+	spec, ok := lookupCommand(c.Keyword)
+	if ok && spec.Keys != nil {
+		return spec.Keys(c)
+	}
+	if !ok || spec.FirstKey == 0 {
+		return nil
+	}
+	last := spec.LastKey
+	if last < 0 {
+		last = len(c.Args) + 1 + last
+	}
+	var keys []string
+	for i := spec.FirstKey; i <= last && i <= len(c.Args); i += spec.KeyStep {
+		keys = append(keys, c.Args[i-1])
+	}
+	return keys
+}
+
+// flags returns the flags of the command, none for unknown commands.
+func (c Command) flags() CommandFlag {
+	if spec, ok := lookupCommand(c.Keyword); ok {
+		return spec.Flags
+	}
+	return 0
+}
+
+// isWriteCmd reports whether the command modifies the database and has to be persisted.
+func (c Command) isWriteCmd() bool {
+	return c.flags()&CmdWrite != 0
+}
+
+// isQueuedInMulti reports whether the command is queued, rather than executed, while in a MULTI block.
+func (c Command) isQueuedInMulti() bool {
+	return c.flags()&CmdNoQueue == 0
+}
+
+// isExclusiveCmd reports whether the command needs exclusive access to the database, i.e. no other command
+// may run concurrently: transactions must not be observed partially applied and snapshots must be consistent.
+func (c Command) isExclusiveCmd() bool {
+	return c.flags()&CmdExclusive != 0
+}
+
+// IsBlocking reports whether the command may block the client until one of its keys holds data, in which case the
+// server watches the connection of the client to cancel the command through the Done channel of its session.
+func (c Command) IsBlocking() bool {
+	return c.isBlockingCmd()
+}
+
+// isBlockingCmd reports whether the command blocks the client until one of its keys holds data.
+func (c Command) isBlockingCmd() bool {
+	return c.flags()&CmdBlocking != 0
+}
+
+// setOptions holds the parsed options of a SET or GETEX command.
+type setOptions struct {
+	expiry    string // One of EX, PX, EXAT or PXAT, empty when the key does not expire
+	ttl       int64  // Argument of the expiry option
+	keepTTL   bool
+	persist   bool   // Set by the PERSIST option of GETEX
+	condition string // NX or XX, empty when the key is set unconditionally
+	get       bool   // Set by the GET option of SET, the previous value is returned
+}
+
+// parseSetOptions parses the options of a SET command.
+// The expiry options and KEEPTTL are mutually exclusive, as are NX and XX.
+func parseSetOptions(options []string) (setOptions, error) {
+	var opts setOptions
+	for i := 0; i < len(options); i++ {
+		option := strings.ToUpper(options[i])
+		switch option {
+		case optEX, optPX, optEXAT, optPXAT:
+			if opts.expiry != "" || opts.keepTTL || i+1 >= len(options) {
+				return setOptions{}, &CommandError{msg: "syntax error"}
+			}
+			ttl, err := parseExpiry(SET, option, options[i+1])
+			if err != nil {
+				return setOptions{}, err
+			}
+			opts.expiry, opts.ttl = option, ttl
+			i++
+		case optKEEPTTL:
+			if opts.expiry != "" {
+				return setOptions{}, &CommandError{msg: "syntax error"}
+			}
+			opts.keepTTL = true
+		case optNX, optXX:
+			if opts.condition != "" && opts.condition != option {
+				return setOptions{}, &CommandError{msg: "syntax error"}
+			}
+			opts.condition = option
+		case optGET:
+			opts.get = true
+		default:
+			return setOptions{}, &CommandError{msg: "syntax error"}
 		}
-		if c.Key != "" {
-			errMsg = fmt.Sprintf("%s command expected no argument but was given", keyword)
-			return false, &CommandError{msg: errMsg}
+	}
+	return opts, nil
+}
+
+// parseGetExOptions parses the options of a GETEX command, which sets at most one of the expiry options or PERSIST.
+func parseGetExOptions(options []string) (setOptions, error) {
+	var opts setOptions
+	for i := 0; i < len(options); i++ {
+		option := strings.ToUpper(options[i])
+		if opts.expiry != "" || opts.persist {
+			return setOptions{}, &CommandError{msg: "syntax error"}
 		}
-		if c.Value != nil {
-			errMsg = fmt.Sprintf("%s command expected no argument but was given", keyword)
-			return false, &CommandError{msg: errMsg}
+		switch option {
+		case optEX, optPX, optEXAT, optPXAT:
+			if i+1 >= len(options) {
+				return setOptions{}, &CommandError{msg: "syntax error"}
+			}
+			ttl, err := parseExpiry(GETEX, option, options[i+1])
+			if err != nil {
+				return setOptions{}, err
+			}
+			opts.expiry, opts.ttl = option, ttl
+			i++
+		case optPERSIST:
+			opts.persist = true
+		default:
+			return setOptions{}, &CommandError{msg: "syntax error"}
 		}
-		return true, nil
 	}
-	return false, &CommandError{
-		msg: fmt.Sprintf("unknown command %s", c.Keyword),
+	return opts, nil
+}
+
+// parseExpiry parses the positive argument of an EX, PX, EXAT or PXAT option given to a command.
+func parseExpiry(keyword string, option string, arg string) (int64, error) {
+	ttl, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, &CommandError{msg: "value is not an integer or out of range"}
+	}
+	if _, ok := absoluteTime(option, ttl, time.Now()); ttl <= 0 || !ok {
+		return 0, &CommandError{msg: fmt.Sprintf("invalid expire time in '%s' command", strings.ToLower(keyword))}
 	}
+	return ttl, nil
 }
 
-func (c Command) String() string {
-	return fmt.Sprintf("{Keyword: %q, Key: %q, Value: %v}", c.Keyword, c.Key, c.Value)
+// expireTime returns the absolute expiration time set by an EXPIRE, PEXPIRE, EXPIREAT or PEXPIREAT command.
+func (c Command) expireTime(now time.Time) (time.Time, error) {
+	ttl, err := strconv.ParseInt(c.Arg(1), 10, 64)
+	if err != nil {
+		return time.Time{}, &CommandError{msg: "value is not an integer or out of range"}
+	}
+	expireAt, ok := absoluteTime(c.Keyword, ttl, now)
+	if !ok {
+		return time.Time{}, &CommandError{msg: fmt.Sprintf("invalid expire time in '%s' command", strings.ToLower(c.Keyword))}
+	}
+	return expireAt, nil
 }
 
-func (c Command) isExitMultiBlockCmd() bool {
+// absoluteTime converts the argument of an expiry command or SET option to an absolute time.
+// It reports false when the time cannot be represented as a unix time in milliseconds.
+func absoluteTime(unit string, ttl int64, now time.Time) (time.Time, bool) {
+	ms := ttl
+	switch unit {
+	case EXPIRE, optEX, EXPIREAT, optEXAT:
+		if ttl > math.MaxInt64/1000 || ttl < math.MinInt64/1000 {
+			return time.Time{}, false
+		}
+		ms = ttl * 1000
+	}
+	switch unit {
+	case EXPIRE, optEX, PEXPIRE, optPX:
+		nowMs := now.UnixMilli()
+		if (ms > 0 && nowMs > math.MaxInt64-ms) || (ms < 0 && nowMs < math.MinInt64-ms) {
+			return time.Time{}, false
+		}
+		ms += nowMs
+	}
+	return time.UnixMilli(ms), true
+}
+
+// withAbsoluteExpiry rewrites relative expiration times as absolute unix times in milliseconds,
+// i.e. SET and GETEX options become PXAT, SETEX becomes SET with PXAT and expiry commands become PEXPIREAT.
+//
+// The rewritten command has the same effect whenever it is executed, which is what the append-only
+// file has to log for expiration times to survive a restart.
+func (c Command) withAbsoluteExpiry(now time.Time) Command {
 	switch c.Keyword {
-	case DISCARD, EXEC:
-		return true
+	case SET:
+		opts, err := parseSetOptions(c.Args[2:])
+		if err != nil || opts.expiry == "" {
+			return c
+		}
+		expireAt, _ := absoluteTime(opts.expiry, opts.ttl, now)
+		args := []any{c.Args[0], c.Args[1], optPXAT, expireAt.UnixMilli()}
+		if opts.condition != "" {
+			args = append(args, opts.condition)
+		}
+		if opts.get {
+			args = append(args, optGET)
+		}
+		return NewCommand(SET, args...)
+	case SETEX:
+		ttl, err := parseExpiry(SETEX, optEX, c.Args[1])
+		if err != nil {
+			return c
+		}
+		expireAt, _ := absoluteTime(optEX, ttl, now)
+		return NewCommand(SET, c.Args[0], c.Args[2], optPXAT, expireAt.UnixMilli())
+	case GETEX:
+		opts, err := parseGetExOptions(c.Args[1:])
+		if err != nil || opts.expiry == "" {
+			return c
+		}
+		expireAt, _ := absoluteTime(opts.expiry, opts.ttl, now)
+		return NewCommand(GETEX, c.Args[0], optPXAT, expireAt.UnixMilli())
+	case EXPIRE, PEXPIRE, EXPIREAT:
+		expireAt, err := c.expireTime(now)
+		if err != nil {
+			return c
+		}
+		return NewCommand(PEXPIREAT, c.Args[0], expireAt.UnixMilli())
 	}
-	return false
+	return c
 }
@@ -3,6 +3,7 @@ package domain
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestNewCommand(t *testing.T) {
@@ -23,13 +24,19 @@ func TestNewCommand(t *testing.T) {
 			name:    "Keyword with one argument",
 			keyword: GET,
 			args:    []any{"Key"},
-			want:    Command{Keyword: "GET", Key: "Key"},
+			want:    Command{Keyword: "GET", Args: []string{"Key"}},
 		},
 		{
 			name:    "Keyword with two argument",
 			keyword: SET,
 			args:    []any{"Key", "value"},
-			want:    Command{Keyword: "SET", Key: "Key", Value: "value"},
+			want:    Command{Keyword: "SET", Args: []string{"Key", "value"}},
+		},
+		{
+			name:    "Keyword with options",
+			keyword: SET,
+			args:    []any{"Key", "value", "PX", 100},
+			want:    Command{Keyword: "SET", Args: []string{"Key", "value", "PX", "100"}},
 		},
 	}
 
@@ -69,17 +76,101 @@ func TestCommand_Validate(t *testing.T) {
 			name:          "SET command - no Key and value",
 			command:       Command{Keyword: "SET"},
 			wantValidated: false,
-			wantError:     &CommandError{msg: "SET command expected 2 arguments but none was given (i.e no Key & value)"},
+			wantError:     &CommandError{msg: "wrong number of arguments for 'set' command"},
 		},
 		{
 			name:          "SET command - Key and no value",
-			command:       Command{Keyword: "SET", Key: "key_1"},
+			command:       Command{Keyword: "SET", Args: []string{"key_1"}},
 			wantValidated: false,
-			wantError:     &CommandError{msg: "SET command expected 2 arguments but 1 was given (i.e no value)"},
+			wantError:     &CommandError{msg: "wrong number of arguments for 'set' command"},
 		},
 		{
 			name:          "SET command - valid Key and value",
-			command:       Command{Keyword: "SET", Key: "key_1", Value: "value_1"},
+			command:       Command{Keyword: "SET", Args: []string{"key_1", "value_1"}},
+			wantValidated: true,
+			wantError:     nil,
+		},
+		{
+			name:          "SET command - expiry option",
+			command:       Command{Keyword: "SET", Args: []string{"key_1", "value_1", "ex", "10"}},
+			wantValidated: true,
+			wantError:     nil,
+		},
+		{
+			name:          "SET command - KEEPTTL option",
+			command:       Command{Keyword: "SET", Args: []string{"key_1", "value_1", "KEEPTTL"}},
+			wantValidated: true,
+			wantError:     nil,
+		},
+		{
+			name:          "SET command - unknown option",
+			command:       Command{Keyword: "SET", Args: []string{"key_1", "value_1", "value_2"}},
+			wantValidated: false,
+			wantError:     &CommandError{msg: "syntax error"},
+		},
+		{
+			name:          "SET command - expiry option without time",
+			command:       Command{Keyword: "SET", Args: []string{"key_1", "value_1", "PX"}},
+			wantValidated: false,
+			wantError:     &CommandError{msg: "syntax error"},
+		},
+		{
+			name:          "SET command - expiry and KEEPTTL options",
+			command:       Command{Keyword: "SET", Args: []string{"key_1", "value_1", "EX", "10", "KEEPTTL"}},
+			wantValidated: false,
+			wantError:     &CommandError{msg: "syntax error"},
+		},
+		{
+			name:          "SET command - non-integer expiry time",
+			command:       Command{Keyword: "SET", Args: []string{"key_1", "value_1", "EX", "ten"}},
+			wantValidated: false,
+			wantError:     &CommandError{msg: "value is not an integer or out of range"},
+		},
+		{
+			name:          "SET command - negative expiry time",
+			command:       Command{Keyword: "SET", Args: []string{"key_1", "value_1", "EX", "-1"}},
+			wantValidated: false,
+			wantError:     &CommandError{msg: "invalid expire time in 'set' command"},
+		},
+		{
+			name:          "EXPIRE command - non-integer time",
+			command:       Command{Keyword: "EXPIRE", Args: []string{"key_1", "ten"}},
+			wantValidated: false,
+			wantError:     &CommandError{msg: "value is not an integer or out of range"},
+		},
+		{
+			name:          "EXPIRE command - overflowing time",
+			command:       Command{Keyword: "EXPIRE", Args: []string{"key_1", "9223372036854775807"}},
+			wantValidated: false,
+			wantError:     &CommandError{msg: "invalid expire time in 'expire' command"},
+		},
+		{
+			name:          "EXPIRE command - valid Key and time",
+			command:       Command{Keyword: "EXPIRE", Args: []string{"key_1", "10"}},
+			wantValidated: true,
+			wantError:     nil,
+		},
+		{
+			name:          "TTL command - Key and value",
+			command:       Command{Keyword: "TTL", Args: []string{"key_1", "10"}},
+			wantValidated: false,
+			wantError:     &CommandError{msg: "wrong number of arguments for 'ttl' command"},
+		},
+		{
+			name:          "GET command - too many arguments",
+			command:       Command{Keyword: "GET", Args: []string{"key_1", "value_1", "value_2"}},
+			wantValidated: false,
+			wantError:     &CommandError{msg: "wrong number of arguments for 'get' command"},
+		},
+		{
+			name:          "WATCH command - no Key",
+			command:       Command{Keyword: "WATCH"},
+			wantValidated: false,
+			wantError:     &CommandError{msg: "wrong number of arguments for 'watch' command"},
+		},
+		{
+			name:          "WATCH command - several Keys",
+			command:       NewCommand("WATCH", "key_1", "key_2", "key_3"),
 			wantValidated: true,
 			wantError:     nil,
 		},
@@ -87,43 +178,43 @@ func TestCommand_Validate(t *testing.T) {
 			name:          "GET command - no Key",
 			command:       Command{Keyword: "GET"},
 			wantValidated: false,
-			wantError:     &CommandError{msg: "GET command expected 1 argument but none was given (i.e no Key)"},
+			wantError:     &CommandError{msg: "wrong number of arguments for 'get' command"},
 		},
 		{
 			name:          "GET command - Key and value",
-			command:       Command{Keyword: "GET", Key: "key_1", Value: "value_1"},
+			command:       Command{Keyword: "GET", Args: []string{"key_1", "value_1"}},
 			wantValidated: false,
-			wantError:     &CommandError{msg: "GET command expected 1 argument but 2 was given"},
+			wantError:     &CommandError{msg: "wrong number of arguments for 'get' command"},
 		},
 		{
 			name:          "GET command - valid Key",
-			command:       Command{Keyword: "GET", Key: "key_1"},
+			command:       Command{Keyword: "GET", Args: []string{"key_1"}},
 			wantValidated: true,
 			wantError:     nil,
 		},
 		{
 			name:          "DEL command - valid Key",
-			command:       Command{Keyword: "DEL", Key: "key_1"},
+			command:       Command{Keyword: "DEL", Args: []string{"key_1"}},
 			wantValidated: true,
 			wantError:     nil,
 		},
 		{
 			name:          "INCR command - valid Key",
-			command:       Command{Keyword: "INCR", Key: "key_1"},
+			command:       Command{Keyword: "INCR", Args: []string{"key_1"}},
 			wantValidated: true,
 			wantError:     nil,
 		},
 		{
 			name:          "INCRBY command - valid Key",
-			command:       Command{Keyword: "INCRBY", Key: "key_1", Value: 10},
+			command:       Command{Keyword: "INCRBY", Args: []string{"key_1", "10"}},
 			wantValidated: true,
 			wantError:     nil,
 		},
 		{
 			name:          "MULTI command - Key and value",
-			command:       Command{Keyword: "MULTI", Key: "key_1", Value: "value_1"},
+			command:       Command{Keyword: "MULTI", Args: []string{"key_1", "value_1"}},
 			wantValidated: false,
-			wantError:     &CommandError{msg: "MULTI command expected no argument but was given"},
+			wantError:     &CommandError{msg: "wrong number of arguments for 'multi' command"},
 		},
 		{
 			name:          "MULTI command - valid",
@@ -149,21 +240,33 @@ func TestCommand_Validate(t *testing.T) {
 			wantValidated: true,
 			wantError:     nil,
 		},
+		{
+			name:          "HELLO command - no protocol version",
+			command:       Command{Keyword: "HELLO"},
+			wantValidated: true,
+			wantError:     nil,
+		},
+		{
+			name:          "HELLO command - too many arguments",
+			command:       Command{Keyword: "HELLO", Args: []string{"3", "AUTH"}},
+			wantValidated: false,
+			wantError:     &CommandError{msg: "wrong number of arguments for 'hello' command"},
+		},
 		{
 			name:          "SELECT command - no dbIndex",
 			command:       Command{Keyword: "SELECT"},
 			wantValidated: false,
-			wantError:     &CommandError{msg: "SELECT command expected 1 argument but none was given (i.e no Key)"},
+			wantError:     &CommandError{msg: "wrong number of arguments for 'select' command"},
 		},
 		{
 			name:          "SELECT command - invalid number of arguments",
-			command:       Command{Keyword: "SELECT", Key: "0", Value: "1"},
+			command:       Command{Keyword: "SELECT", Args: []string{"0", "1"}},
 			wantValidated: false,
-			wantError:     &CommandError{msg: "SELECT command expected 1 argument but 2 was given"},
+			wantError:     &CommandError{msg: "wrong number of arguments for 'select' command"},
 		},
 		{
 			name:          "SELECT command - valid index",
-			command:       Command{Keyword: "SELECT", Key: "2"},
+			command:       Command{Keyword: "SELECT", Args: []string{"2"}},
 			wantValidated: true,
 			wantError:     nil,
 		},
@@ -183,3 +286,59 @@ func TestCommand_Validate(t *testing.T) {
 	}
 
 }
+
+func TestCommand_keys(t *testing.T) {
+	testCases := []struct {
+		command Command
+		want    []string
+	}{
+		{command: NewCommand("GET", "key"), want: []string{"key"}},
+		{command: NewCommand("SET", "key", "value", "EX", "10"), want: []string{"key"}},
+		{command: NewCommand("WATCH", "key_1", "key_2", "key_3"), want: []string{"key_1", "key_2", "key_3"}},
+		{command: NewCommand("SINTERCARD", "2", "key_1", "key_2", "LIMIT", "1"), want: []string{"key_1", "key_2"}},
+		{command: NewCommand("SINTERCARD", "3", "key_1"), want: nil},
+		{command: NewCommand("ZUNIONSTORE", "dst", "2", "key_1", "key_2", "WEIGHTS", "1", "2"), want: []string{"dst", "key_1", "key_2"}},
+		{command: NewCommand("SELECT", "1"), want: nil},
+		{command: NewCommand("PUT", "key"), want: nil},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.command.keys(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Command.keys(%v) = %q, want %q", tc.command, got, tc.want)
+		}
+	}
+}
+
+func TestCommand_withAbsoluteExpiry(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	testCases := []struct {
+		cmd  Command
+		want Command
+	}{
+		{
+			cmd:  NewCommand("SET", "key", "value", "NX", "EX", "10", "GET"),
+			want: NewCommand("SET", "key", "value", "PXAT", "1700000010000", "NX", "GET"),
+		},
+		{
+			cmd:  NewCommand("SET", "key", "value", "XX"),
+			want: NewCommand("SET", "key", "value", "XX"),
+		},
+		{
+			cmd:  NewCommand("SETEX", "key", "10", "value"),
+			want: NewCommand("SET", "key", "value", "PXAT", "1700000010000"),
+		},
+		{
+			cmd:  NewCommand("GETEX", "key", "PX", "500"),
+			want: NewCommand("GETEX", "key", "PXAT", "1700000000500"),
+		},
+		{
+			cmd:  NewCommand("GETEX", "key", "PERSIST"),
+			want: NewCommand("GETEX", "key", "PERSIST"),
+		},
+	}
+	for _, tc := range testCases {
+		if got := tc.cmd.withAbsoluteExpiry(now); got.String() != tc.want.String() {
+			t.Errorf("Command.withAbsoluteExpiry(%v) = %v, want %v", tc.cmd, got, tc.want)
+		}
+	}
+}
@@ -2,26 +2,44 @@ package domain
 
 import (
 	"fmt"
+	"kvdb/persistence"
 	"kvdb/storage"
+	"math"
+	"math/big"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Version of the key value database server, reported to clients by HELLO
+const Version = "0.2.0"
+
+// KeyValueDB is the database engine shared by all clients, each one executing commands through its own Session.
+//
+// It must not be copied once created.
 type KeyValueDB struct {
-	storage            storage.Storage
-	cmdQueue           []Command
-	multiCommandActive bool
+	storage   storage.Storage
+	lock      sync.RWMutex // Held by every command, exclusively taken by transactions and to snapshot the databases
+	writes    sync.Mutex   // Held by write commands while they are propagated, so in the order they modified the keys
+	aof       *persistence.AOF
+	snapshots *snapshotter
+	watchers  watchers
+	blockers  blockers
+	repl      replication
+	clientID  atomic.Int64 // Last session id handed out
 }
 
-func NewKeyValueDB(storage storage.Storage) KeyValueDB {
-	return KeyValueDB{storage: storage}
+func NewKeyValueDB(storage storage.Storage) *KeyValueDB {
+	return &KeyValueDB{storage: storage}
 }
 
 type DBResult struct {
 	DbIndex  int
 	Value    any
-	Type     string
+	Type     ReplyType
 	Response string
 	Err      error
 }
@@ -34,157 +52,424 @@ func (m *MultiBlockError) Error() string {
 	return fmt.Sprintf("(error) ERR %s without MULTI", m.cmd)
 }
 
+// ExecAbortError is returned by EXEC when a command of the transaction was rejected while being queued
+type ExecAbortError struct{}
+
+func (e *ExecAbortError) Error() string {
+	return "(error) EXECABORT Transaction discarded because of previous errors."
+}
+
+// SimpleMsg returns the human-readable representation of the result used by the text protocol.
+//
+// It mimics the output of redis-cli: scalar replies are prefixed by their type where ambiguous (e.g. "(integer) 1"),
+// strings are quoted, and aggregate replies are listed one element per line with nested aggregates indented.
 func (d DBResult) SimpleMsg() any {
-	value := d.Value
-	err := d.Err
+	switch d.Kind() {
+	case ErrorReply:
+		if d.Err != nil {
+			return d.Err.Error()
+		}
+		return d.Value
+	case NilReply:
+		return "(nil)"
+	case StatusReply:
+		return d.Response
+	case IntegerReply, DoubleReply, BigNumberReply:
+		return fmt.Sprintf("(%s) %s", d.Kind(), d.Text())
+	case BooleanReply:
+		if d.Value == true {
+			return "(true)"
+		}
+		return "(false)"
+	case VerbatimReply:
+		return d.Text()
+	case ArrayReply, SetReply, MapReply, PushReply:
+		return d.aggregateMsg()
+	}
+	if d.Value != nil && isString(d.Value) && d.Err == nil {
+		return fmt.Sprintf("%q", d.Value)
+	}
+	return d.Value
+}
 
-	if d.Response == "" {
-		if isString(d.Value) && err == nil {
-			value = fmt.Sprintf("%q", d.Value)
+func (d DBResult) aggregateMsg() string {
+	elems := d.Elements()
+	if len(elems) == 0 {
+		if d.Kind() == MapReply {
+			return "(empty hash)"
 		}
-	} else {
-		value = d.Response
+		return "(empty array)"
 	}
-	if d.Type != "" {
-		value = fmt.Sprintf("(%s) %v", d.Type, value)
+
+	marker := ")"
+	step := 1
+	switch d.Kind() {
+	case SetReply:
+		marker = "~"
+	case MapReply:
+		marker = "#"
+		step = 2
+	}
+
+	var lines []string
+	for i := 0; i < len(elems); i += step {
+		label := fmt.Sprintf("%d%s ", i/step+1, marker)
+		msg := fmt.Sprintf("%v", elems[i].SimpleMsg())
+		if step == 2 && i+1 < len(elems) {
+			msg = fmt.Sprintf("%s => %v", msg, elems[i+1].SimpleMsg())
+		}
+		msg = strings.ReplaceAll(msg, "\n", "\n"+strings.Repeat(" ", len(label)))
+		lines = append(lines, label+msg)
 	}
-	return value
+	return strings.Join(lines, "\n")
 }
 
 func (d DBResult) String() string {
 	return fmt.Sprintf("{Value: %v, Type: %q, Response: %q, Err: %v}", d.Value, d.Type, d.Response, d.Err)
 }
 
-func (k *KeyValueDB) Execute(dbIndex int, cmd Command) any {
+// Execute runs a command on behalf of the client owning the given session and returns its result.
+//
+// Commands run against the database selected by the session, or are queued while it is in a MULTI block.
+// Commands run concurrently, except write commands which run one at a time while they are propagated, and transactions
+// and snapshots which get exclusive access to the database. The writes are thus propagated in the order they were
+// applied, transactions included.
+// Commands that may use more memory first evict keys when the keys hold more memory than the limit.
+// The clients of a read-only replica cannot run write commands, only the session applying the stream of its master can.
+func (k *KeyValueDB) Execute(s *Session, cmd Command) any {
 	_, err := cmd.Validate()
 	if err != nil {
-		return DBResult{Value: err.Error(), Response: "", Err: err}
+		if s.Has(FlagMulti) {
+			// The transaction is discarded by EXEC
+			s.set(FlagDirtyExec)
+		}
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
 	}
 
-	if k.multiCommandActive && !cmd.isExitMultiBlockCmd() {
-		k.cmdQueue = append(k.cmdQueue, cmd)
-		return DBResult{Value: "", Response: "QUEUED"}
+	if cmd.isWriteCmd() && !k.repl.acceptsWrites(s) {
+		if s.Has(FlagMulti) {
+			// The transaction is discarded by EXEC
+			s.set(FlagDirtyExec)
+		}
+		return NewErrorResult(&ReadOnlyError{})
 	}
 
-	switch cmd.Keyword {
-	case SET:
-		err := k.storage.Set(dbIndex, cmd.Key, cmd.Value)
-		if err != nil {
-			return DBResult{Value: err.Error(), Err: err}
-		}
-		return DBResult{DbIndex: dbIndex, Value: "", Response: "OK"}
-	case GET:
-		result, err := k.storage.Get(dbIndex, cmd.Key)
-		if err != nil {
-			return DBResult{Value: err.Error(), Response: "(nil)", Err: err}
-		}
-		return DBResult{DbIndex: dbIndex, Value: result, Response: ""}
-	case DEL:
-		err := k.storage.Delete(dbIndex, cmd.Key)
-		if err != nil {
-			return DBResult{Value: err.Error(), Type: "integer", Response: "0", Err: err}
-		}
-		return DBResult{DbIndex: dbIndex, Value: "", Type: "integer", Response: "1"}
-	case INCR, INCRBY:
-		result, err := k.storage.Get(dbIndex, cmd.Key)
-		if err != nil {
-			return DBResult{Value: err.Error(), Response: "(nil)", Err: err}
-		}
-		intValue, err := convertToInt(result)
-		if err != nil {
-			return DBResult{Value: err.Error(), Response: "", Err: err}
-		}
-		change := 1
-		if cmd.Keyword == INCRBY {
-			intSetValue, err := convertToInt(cmd.Value)
-			if err != nil {
-				return DBResult{Value: err.Error(), Response: "", Err: err}
+	// Replicas leave the eviction of keys to their master, which streams the keys it evicts
+	if s.master == nil && cmd.needsMemory(s) {
+		if err := k.freeMemory(); err != nil {
+			if s.Has(FlagMulti) {
+				// The transaction is discarded by EXEC
+				s.set(FlagDirtyExec)
+			}
+			if cmd.Keyword != EXEC {
+				return NewErrorResult(err)
 			}
-			change = intSetValue
-		}
-		newValue := intValue + change
-		err = k.storage.Set(dbIndex, cmd.Key, newValue)
-		if err != nil {
-			return DBResult{Value: err.Error(), Err: err}
 		}
+	}
 
-		return DBResult{DbIndex: dbIndex, Value: newValue, Type: "integer", Response: ""}
-	case MULTI:
-		k.multiCommandActive = true
-		return DBResult{DbIndex: dbIndex, Value: "", Response: "OK"}
-	case DISCARD:
-		if !k.multiCommandActive {
-			err = &MultiBlockError{cmd: DISCARD}
-			return DBResult{Value: err.Error(), Response: "", Err: err}
-		}
-		k.multiCommandActive = false
-		k.cmdQueue = nil
-		return DBResult{DbIndex: dbIndex, Value: "", Response: "OK"}
-	case EXEC:
-		if !k.multiCommandActive {
-			err = &MultiBlockError{cmd: EXEC}
-			return DBResult{Value: err.Error(), Response: "", Err: err}
-		}
-		k.multiCommandActive = false
-		return k.executeQueuedCmds(dbIndex)
-	case COMPACT:
-		var results []DBResult
-		for kv := range k.storage.FetchAll(dbIndex) {
-			cmdKey := kv[0].(string)
-			value := kv[1]
-
-			if len(strings.Fields(cmdKey)) > 1 {
-				cmdKey = fmt.Sprintf("%q", cmdKey)
-			}
+	if s.Has(FlagMulti) && cmd.isQueuedInMulti() {
+		s.cmdQueue = append(s.cmdQueue, cmd)
+		return DBResult{Value: "", Type: StatusReply, Response: "QUEUED"}
+	}
 
-			switch v := value.(type) {
-			case int:
-				value = v
-			case string:
-				value = fmt.Sprintf("%q", value)
-			}
+	if cmd.isBlockingCmd() {
+		return k.executeBlocking(s, cmd)
+	}
+	result := k.runLocked(s, cmd)
+	if s.reclaim {
+		s.reclaim = false
+		k.reclaim(false)
+	}
+	return result
+}
 
-			dbRes := DBResult{DbIndex: dbIndex, Response: fmt.Sprintf("SET %s %v", cmdKey, value)}
-			results = append(results, dbRes)
-		}
-		return results
-	case SELECT:
-		dbIndex, err := k.storage.Select(cmd.Key)
-		if err != nil {
-			return DBResult{Value: err.Error(), Err: err}
-		}
-		return DBResult{DbIndex: dbIndex, Value: "", Response: "OK"}
+// runLocked runs a validated command while holding the lock of the database, exclusively for the commands that
+// need exclusive access.
+func (k *KeyValueDB) runLocked(s *Session, cmd Command) any {
+	if cmd.isExclusiveCmd() {
+		k.lock.Lock()
+		defer k.lock.Unlock()
+	} else {
+		k.lock.RLock()
+		defer k.lock.RUnlock()
+	}
+	return k.run(s, cmd)
+}
+
+// run executes a validated command while holding the lock of the database.
+//
+// The changes made by write commands are reported to the watchers of the modified keys, to the persistence and to
+// the replicas, see lockWrites.
+func (k *KeyValueDB) run(s *Session, cmd Command) any {
+	if !cmd.isWriteCmd() {
+		return k.execute(s, cmd)
+	}
+	defer k.lockWrites()()
+
+	// Relative expiration times are resolved now so that the logged command has the same effect when replayed
+	cmd = cmd.withAbsoluteExpiry(time.Now())
+
+	dbIndex := s.DbIndex
+	result := k.execute(s, cmd)
+	if res, ok := result.(DBResult); !ok || res.Err != nil {
+		return result
 	}
-	return DBResult{}
+	k.touchKeys(dbIndex, cmd.keys()...)
+	k.blockers.signal(dbIndex, cmd.keys()...)
+	k.snapshots.markDirty()
+	return k.propagate(dbIndex, propagatedCommand(cmd, result), result)
 }
 
-// executeQueuedCmds executes the queued commands in the KeyValueDB.
+// lockWrites takes the writes lock when write commands are propagated and returns the function releasing it.
 //
-// It iterates over the cmdQueue and executes each command using the Execute method of KeyValueDB. The results of each execution are stored in the results slice. After executing all the commands, the cmdQueue is set to nil. The function then returns the results slice.
-// Returns []ExecuteReturnValue.
-func (k *KeyValueDB) executeQueuedCmds(dbIndex int) []DBResult {
+// Write commands then run one at a time, otherwise two of them modifying the same key could be logged or streamed in
+// the opposite order than the one they were applied in. Without an append-only file nor replicas they run
+// concurrently, the storage locking the keys they modify. It must be called while holding the lock of the database:
+// replicas are only added while holding it exclusively, and the append-only file is enabled before commands run.
+func (k *KeyValueDB) lockWrites() func() {
+	if k.aof == nil && !k.repl.streaming.Load() {
+		return func() {}
+	}
+	k.writes.Lock()
+	return k.writes.Unlock
+}
+
+// execute runs a validated command against the database selected by the session and returns its result.
+func (k *KeyValueDB) execute(s *Session, cmd Command) any {
+	spec, _ := lookupCommand(cmd.Keyword)
+	return spec.Handler(k, s, cmd)
+}
+
+// Storage returns the storage holding the databases, for the handlers of the commands registered by applications.
+func (k *KeyValueDB) Storage() storage.Storage {
+	return k.storage
+}
+
+// delCommand handles DEL and UNLINK, which frees the memory of the keys right away as well.
+func (k *KeyValueDB) delCommand(s *Session, cmd Command) any {
+	dbIndex := s.DbIndex
+	deleted := k.storage.DeleteKeys(dbIndex, cmd.Args...)
+	if deleted == 0 {
+		err := storage.NewKeyNotFoundError(cmd.Args[0])
+		return DBResult{Value: err.Error(), Type: IntegerReply, Response: "0", Err: err}
+	}
+	return DBResult{DbIndex: dbIndex, Value: deleted, Type: IntegerReply}
+}
+
+// existsCommand handles EXISTS and TOUCH, the storage keeps no access time so touching a key only reads it.
+func (k *KeyValueDB) existsCommand(s *Session, cmd Command) any {
+	return DBResult{DbIndex: s.DbIndex, Value: k.storage.Exists(s.DbIndex, cmd.Args...), Type: IntegerReply}
+}
+
+// expireCommand handles EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT.
+func (k *KeyValueDB) expireCommand(s *Session, cmd Command) any {
+	dbIndex := s.DbIndex
+	expireAt, err := cmd.expireTime(time.Now())
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	err = k.storage.Expire(dbIndex, cmd.Args[0], expireAt)
+	if err != nil {
+		return DBResult{DbIndex: dbIndex, Value: err.Error(), Type: IntegerReply, Response: "0", Err: err}
+	}
+	return DBResult{DbIndex: dbIndex, Value: "", Type: IntegerReply, Response: "1"}
+}
+
+// ttlCommand handles TTL and PTTL.
+func (k *KeyValueDB) ttlCommand(s *Session, cmd Command) any {
+	dbIndex := s.DbIndex
+	expireAt, err := k.storage.ExpireTime(dbIndex, cmd.Args[0])
+	if err != nil {
+		return DBResult{DbIndex: dbIndex, Value: -2, Type: IntegerReply}
+	}
+	if expireAt.IsZero() {
+		return DBResult{DbIndex: dbIndex, Value: -1, Type: IntegerReply}
+	}
+	ttl := time.Until(expireAt).Milliseconds()
+	if cmd.Keyword == TTL {
+		ttl = (ttl + 500) / 1000
+	}
+	return DBResult{DbIndex: dbIndex, Value: int(max(ttl, 0)), Type: IntegerReply}
+}
+
+func (k *KeyValueDB) persistCommand(s *Session, cmd Command) any {
+	dbIndex := s.DbIndex
+	persisted, err := k.storage.Persist(dbIndex, cmd.Args[0])
+	if err != nil {
+		return DBResult{DbIndex: dbIndex, Value: err.Error(), Type: IntegerReply, Response: "0", Err: err}
+	}
+	if !persisted {
+		return DBResult{DbIndex: dbIndex, Value: 0, Type: IntegerReply}
+	}
+	return DBResult{DbIndex: dbIndex, Value: 1, Type: IntegerReply}
+}
+
+func (k *KeyValueDB) multiCommand(s *Session, _ Command) any {
+	if s.Has(FlagMulti) {
+		err := &CommandError{msg: "MULTI calls can not be nested"}
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	s.set(FlagMulti)
+	return DBResult{DbIndex: s.DbIndex, Value: "", Type: StatusReply, Response: "OK"}
+}
+
+func (k *KeyValueDB) discardCommand(s *Session, _ Command) any {
+	if !s.Has(FlagMulti) {
+		err := &MultiBlockError{cmd: DISCARD}
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	s.clear(FlagMulti | FlagDirtyExec)
+	s.cmdQueue = nil
+	k.unwatch(s)
+	return DBResult{DbIndex: s.DbIndex, Value: "", Type: StatusReply, Response: "OK"}
+}
+
+func (k *KeyValueDB) execCommand(s *Session, _ Command) any {
+	return k.exec(s)
+}
+
+func (k *KeyValueDB) compactCommand(s *Session, _ Command) any {
+	cmds, err := k.compactCommands(s.DbIndex)
+	if err != nil {
+		return NewErrorResult(&CommandError{msg: err.Error()})
+	}
 	var results []DBResult
-	for _, cmd := range k.cmdQueue {
-		dbRes := k.Execute(dbIndex, cmd)
-		results = append(results, dbRes.(DBResult))
+	for _, compactCmd := range cmds {
+		dbRes := DBResult{DbIndex: s.DbIndex, Type: StatusReply, Response: formatCompactCmd(compactCmd)}
+		results = append(results, dbRes)
+	}
+	return results
+}
+
+// exec executes the transaction of the session, it must be called while holding the lock exclusively.
+//
+// No other client runs commands while the transaction executes, so none observes it partially applied.
+// The transaction is discarded when one of its commands was rejected while being queued, and aborted
+// with a nil reply when one of the keys watched by the session changed since WATCH.
+func (k *KeyValueDB) exec(s *Session) any {
+	if !s.Has(FlagMulti) {
+		err := &MultiBlockError{cmd: EXEC}
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	queue := s.cmdQueue
+	discarded := s.Has(FlagDirtyExec)
+	s.cmdQueue = nil
+	s.clear(FlagMulti | FlagDirtyExec)
+
+	aborted := k.watchedKeysChanged(s)
+	k.unwatch(s)
+	if discarded {
+		err := &ExecAbortError{}
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	if aborted {
+		return DBResult{DbIndex: s.DbIndex, Type: NilReply, Response: "(nil)"}
+	}
+	return k.executeQueuedCmds(s, queue)
+}
+
+// executeQueuedCmds executes the commands queued in a transaction.
+//
+// It iterates over the queue and executes each command, the results of each execution are stored in the results slice,
+// the ones of commands returning several results being wrapped in an array reply. The write commands of the transaction
+// are propagated between MULTI and EXEC, so that the append-only file and the replicas apply it as a whole or not at all.
+// Returns []DBResult.
+func (k *KeyValueDB) executeQueuedCmds(s *Session, queue []Command) []DBResult {
+	logged := false
+	for _, cmd := range queue {
+		logged = logged || cmd.isWriteCmd()
+	}
+	if logged {
+		k.propagate(s.DbIndex, NewCommand(MULTI), nil)
+	}
+
+	results := []DBResult{}
+	for _, cmd := range queue {
+		switch res := k.run(s, cmd).(type) {
+		case DBResult:
+			results = append(results, res)
+		case []DBResult:
+			results = append(results, NewArrayResult(res...))
+		}
+	}
+
+	if logged {
+		k.propagate(s.DbIndex, NewCommand(EXEC), nil)
 	}
-	k.cmdQueue = nil
 	return results
 }
 
-func convertToInt(value any) (int, error) {
+// formatCompactCmd formats a command returned by compactCommands the way COMPACT displays it,
+// quoting keys made of several words and values that are not integers. The options of SET are left as is.
+func formatCompactCmd(cmd Command) string {
+	args := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		switch {
+		case i == 0 && len(strings.Fields(arg)) > 1:
+			arg = fmt.Sprintf("%q", arg)
+		case i > 0 && (cmd.Keyword != SET || i == 1):
+			if _, err := strconv.Atoi(arg); err != nil {
+				arg = fmt.Sprintf("%q", arg)
+			}
+		}
+		args[i] = arg
+	}
+	return fmt.Sprintf("%s %s", cmd.Keyword, strings.Join(args, " "))
+}
+
+// convertToInt64 converts a value holding a 64-bit integer, either as a string or an int, to an int64.
+func convertToInt64(value any) (int64, error) {
 	switch v := value.(type) {
 	case int:
-		return v, nil
+		return int64(v), nil
 	case string:
-		intValue, err := strconv.Atoi(value.(string))
+		intValue, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
-			return 0, fmt.Errorf("(error) ERR value is not an integer")
+			return 0, &CommandError{msg: "value is not an integer or out of range"}
 		}
 		return intValue, nil
 	default:
-		return 0, fmt.Errorf("(error) ERR value is neither string nor int")
+		return 0, &WrongTypeError{}
+	}
+}
+
+// convertToFloat converts a value holding a number, either as a string or an int, to a float64.
+func convertToFloat(value any) (float64, error) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), nil
+	case string:
+		floatValue, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(floatValue) {
+			return 0, &CommandError{msg: "value is not a valid float"}
+		}
+		return floatValue, nil
+	default:
+		return 0, &WrongTypeError{}
+	}
+}
+
+// Precision of the long double of C, which Redis increments floats with
+const longDoublePrec = 64
+
+// addFloats adds two floats given in decimal form the way INCRBYFLOAT and HINCRBYFLOAT do in Redis: with the precision
+// of a long double, the sum being formatted with 17 decimals without trailing zeros. The sum of 0.1 and 0.2 is thus
+// 0.3 rather than the 0.30000000000000004 of a float64, and integers keep all their digits up to 2^64.
+// Both floats must parse as a float64, the sum fails when it does not fit in one.
+func addFloats(x, y string) (string, error) {
+	a, _, errX := big.ParseFloat(x, 0, longDoublePrec, big.ToNearestEven)
+	b, _, errY := big.ParseFloat(y, 0, longDoublePrec, big.ToNearestEven)
+	if errX != nil || errY != nil {
+		return "", &CommandError{msg: "value is not a valid float"}
+	}
+	if a.IsInf() || b.IsInf() {
+		return "", &CommandError{msg: "increment would produce NaN or Infinity"}
+	}
+	sum := new(big.Float).SetPrec(longDoublePrec).Add(a, b)
+	if f, _ := sum.Float64(); math.IsInf(f, 0) {
+		return "", &CommandError{msg: "increment would produce NaN or Infinity"}
 	}
+	return strings.TrimSuffix(strings.TrimRight(sum.Text('f', 17), "0"), "."), nil
 }
 
 func isString(obj any) bool {
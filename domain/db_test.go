@@ -2,8 +2,15 @@ package domain
 
 import (
 	"errors"
+	"fmt"
+	"kvdb/persistence"
 	"kvdb/storage"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -23,8 +30,8 @@ func TestKeyValueDB_Execute(t *testing.T) {
 		{
 			name:        "Invalid SET command",
 			cmds:        []Command{NewCommand("SET", "key")},
-			wantResults: []any{"(error) ERR SET command expected 2 arguments but 1 was given (i.e no value)"},
-			wantErrMsgs: []string{"(error) ERR SET command expected 2 arguments but 1 was given (i.e no value)"},
+			wantResults: []any{"(error) ERR wrong number of arguments for 'set' command"},
+			wantErrMsgs: []string{"(error) ERR wrong number of arguments for 'set' command"},
 		},
 		{
 			name:        "Get non-existing key",
@@ -53,14 +60,50 @@ func TestKeyValueDB_Execute(t *testing.T) {
 				NewCommand("SET", "key", "value"),
 				NewCommand("DEL", "key"),
 			},
-			wantResults: []any{"OK", "1"},
+			wantResults: []any{"OK", 1},
 			wantErrMsgs: []string{"", ""},
 		},
+		{
+			name: "Delete several keys",
+			cmds: []Command{
+				NewCommand("MSET", "key_1", "value", "key_2", "value"),
+				NewCommand("DEL", "key_1", "missing", "key_2"),
+				NewCommand("UNLINK", "key_1", "key_2"),
+			},
+			wantResults: []any{"OK", 2, "0"},
+			wantErrMsgs: []string{"", "", "Key \"key_1\" not found in storage"},
+		},
+		{
+			name: "Count existing keys",
+			cmds: []Command{
+				NewCommand("SET", "key", "value"),
+				NewCommand("EXISTS", "key", "missing", "key"),
+				NewCommand("TOUCH", "key", "missing"),
+			},
+			wantResults: []any{"OK", 2, 1},
+			wantErrMsgs: []string{"", "", ""},
+		},
+		{
+			name: "Set several keys unless one exists",
+			cmds: []Command{
+				NewCommand("MSETNX", "key_1", "value", "key_2", "value"),
+				NewCommand("MSETNX", "key_3", "value", "key_2", "value"),
+				NewCommand("EXISTS", "key_3"),
+			},
+			wantResults: []any{1, 0, 0},
+			wantErrMsgs: []string{"", "", ""},
+		},
+		{
+			name:        "Set keys without values",
+			cmds:        []Command{NewCommand("MSET", "key_1", "value", "key_2")},
+			wantResults: []any{"(error) ERR wrong number of arguments for 'mset' command"},
+			wantErrMsgs: []string{"(error) ERR wrong number of arguments for 'mset' command"},
+		},
 		{
 			name:        "Increase non-existing key",
 			cmds:        []Command{NewCommand("INCR", "non-existing_key")},
-			wantResults: []any{"(nil)"},
-			wantErrMsgs: []string{"Key \"non-existing_key\" not found in storage"},
+			wantResults: []any{1},
+			wantErrMsgs: []string{""},
 		},
 		{
 			name: "Increase non-integer value",
@@ -68,8 +111,8 @@ func TestKeyValueDB_Execute(t *testing.T) {
 				NewCommand("SET", "key", "abc"),
 				NewCommand("INCR", "key"),
 			},
-			wantResults: []any{"OK", "(error) ERR value is not an integer"},
-			wantErrMsgs: []string{"", "(error) ERR value is not an integer"},
+			wantResults: []any{"OK", "(error) ERR value is not an integer or out of range"},
+			wantErrMsgs: []string{"", "(error) ERR value is not an integer or out of range"},
 		},
 		{
 			name: "Increase valid-integer value",
@@ -83,8 +126,8 @@ func TestKeyValueDB_Execute(t *testing.T) {
 		{
 			name:        "IncreaseBy non-existing key",
 			cmds:        []Command{NewCommand("INCRBY", "non-existing_key", "10")},
-			wantResults: []any{"(nil)"},
-			wantErrMsgs: []string{"Key \"non-existing_key\" not found in storage"},
+			wantResults: []any{10},
+			wantErrMsgs: []string{""},
 		},
 		{
 			name: "IncreaseBy non-integer value",
@@ -92,8 +135,8 @@ func TestKeyValueDB_Execute(t *testing.T) {
 				NewCommand("SET", "key", "10"),
 				NewCommand("INCRBY", "key", "abc"),
 			},
-			wantResults: []any{"OK", "(error) ERR value is not an integer"},
-			wantErrMsgs: []string{"", "(error) ERR value is not an integer"},
+			wantResults: []any{"OK", "(error) ERR value is not an integer or out of range"},
+			wantErrMsgs: []string{"", "(error) ERR value is not an integer or out of range"},
 		},
 		{
 			name: "IncreaseBy valid-integer value",
@@ -115,6 +158,39 @@ func TestKeyValueDB_Execute(t *testing.T) {
 			wantResults: []any{"OK", "QUEUED", "QUEUED", "QUEUED"},
 			wantErrMsgs: []string{"", "", "", ""},
 		},
+		{
+			name: "Multi - nested",
+			cmds: []Command{
+				NewCommand("MULTI"),
+				NewCommand("MULTI"),
+			},
+			wantResults: []any{"OK", "(error) ERR MULTI calls can not be nested"},
+			wantErrMsgs: []string{"", "(error) ERR MULTI calls can not be nested"},
+		},
+		{
+			name: "Exec - with a command rejected while queued",
+			cmds: []Command{
+				NewCommand("MULTI"),
+				NewCommand("SET", "key", "5"),
+				NewCommand("SET", "key"),
+				NewCommand("EXEC"),
+				NewCommand("GET", "key"),
+			},
+			wantResults: []any{
+				"OK",
+				"QUEUED",
+				"(error) ERR wrong number of arguments for 'set' command",
+				"(error) EXECABORT Transaction discarded because of previous errors.",
+				"(nil)",
+			},
+			wantErrMsgs: []string{
+				"",
+				"",
+				"(error) ERR wrong number of arguments for 'set' command",
+				"(error) EXECABORT Transaction discarded because of previous errors.",
+				"Key \"key\" not found in storage",
+			},
+		},
 		{
 			name:        "Discard - without MULTI block",
 			cmds:        []Command{NewCommand("DISCARD")},
@@ -156,11 +232,12 @@ func TestKeyValueDB_Execute(t *testing.T) {
 	for _, tc := range testCases {
 		inMemoryStorage := storage.NewInMemoryStorage(5)
 		db := NewKeyValueDB(inMemoryStorage)
+		session := newSession(1)
 
 		t.Run(tc.name, func(t *testing.T) {
 
 			for i, cmd := range tc.cmds {
-				got := db.Execute(1, cmd).(DBResult)
+				got := db.Execute(session, cmd).(DBResult)
 				gotErr := got.Err
 
 				if gotErr == nil {
@@ -188,15 +265,33 @@ func TestKeyValueDB_Execute(t *testing.T) {
 	}
 }
 
+func TestKeyValueDB_Execute_MGetCommand(t *testing.T) {
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	session := db.NewSession()
+	db.Execute(session, NewCommand("MSET", "key_1", "value_1", "key_2", "10"))
+
+	got := db.Execute(session, NewCommand("MGET", "key_1", "missing", "key_2")).(DBResult)
+	want := []string{"\"value_1\"", "(nil)", "\"10\""}
+	elems := got.Elements()
+	if got.Kind() != ArrayReply || len(elems) != len(want) {
+		t.Fatalf("MGET key_1 missing key_2 = %v, want %d elements", got, len(want))
+	}
+	for i, elem := range elems {
+		if elem.SimpleMsg() != want[i] {
+			t.Errorf("MGET element %d = %v, want %v", i, elem.SimpleMsg(), want[i])
+		}
+	}
+}
+
 func TestKeyValueDB_Execute_ExecCommand(t *testing.T) {
 	inMemoryStorage := storage.NewInMemoryStorage(5)
 	db := NewKeyValueDB(inMemoryStorage)
-	dbIndex := 0
+	session := db.NewSession()
 
 	want := []DBResult{
-		{Value: "", Response: "OK"},
-		{Value: 6, Type: "integer"},
-		{Value: 11, Type: "integer"},
+		{Value: "", Type: StatusReply, Response: "OK"},
+		{Value: 6, Type: IntegerReply},
+		{Value: 11, Type: IntegerReply},
 	}
 
 	var cmds []Command = []Command{
@@ -207,14 +302,14 @@ func TestKeyValueDB_Execute_ExecCommand(t *testing.T) {
 	}
 
 	for _, cmd := range cmds {
-		got := db.Execute(dbIndex, cmd).(DBResult)
+		got := db.Execute(session, cmd).(DBResult)
 		gotErr := got.Err
 		if gotErr != nil {
 			t.Fatalf("Unexpected error: %v", gotErr)
 		}
 	}
 
-	got := db.Execute(dbIndex, NewCommand("EXEC")).([]DBResult)
+	got := db.Execute(session, NewCommand("EXEC")).([]DBResult)
 
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("EXEC command got %v, want %v", got, want)
@@ -228,9 +323,15 @@ func TestKeyValueDB_Execute_CompactCommand(t *testing.T) {
 	dbIndex := 3
 
 	want := []DBResult{
-		{Response: "SET key1 11"},
-		{Response: "SET key2 \"test us\""},
-		{Response: "SET \"key 3\" \"test 3\""},
+		{DbIndex: dbIndex, Type: StatusReply, Response: "SET key1 11"},
+		{DbIndex: dbIndex, Type: StatusReply, Response: "SET key2 \"test us\""},
+		{DbIndex: dbIndex, Type: StatusReply, Response: "SET \"key 3\" \"test 3\""},
+		{DbIndex: dbIndex, Type: StatusReply, Response: "SET key4 \"test 4\" PXAT 4102444800000"},
+		{DbIndex: dbIndex, Type: StatusReply, Response: "RPUSH list \"a\" \"b c\" 3"},
+		{DbIndex: dbIndex, Type: StatusReply, Response: "PEXPIREAT list 4102444800000"},
+		{DbIndex: dbIndex, Type: StatusReply, Response: "HSET user \"age\" 36 \"name\" \"Ada Lovelace\""},
+		{DbIndex: dbIndex, Type: StatusReply, Response: "SADD tags 1 \"a\" \"b c\""},
+		{DbIndex: dbIndex, Type: StatusReply, Response: "ZADD board \"-inf\" \"linus\" \"1.5\" \"ada\" 2 \"grace\""},
 	}
 
 	var cmds []Command = []Command{
@@ -239,20 +340,416 @@ func TestKeyValueDB_Execute_CompactCommand(t *testing.T) {
 		NewCommand("INCRBY", "key1", "5"),
 		NewCommand("SET", "key2", "test us"),
 		NewCommand("SET", "key 3", "test 3"),
+		NewCommand("SET", "key4", "test 4", "EXAT", "4102444800"),
+		NewCommand("SET", "expired", "value"),
+		NewCommand("PEXPIREAT", "expired", "1"),
+		NewCommand("RPUSH", "list", "a", "b c", "3"),
+		NewCommand("EXPIREAT", "list", "4102444800"),
+		NewCommand("HSET", "user", "name", "Ada Lovelace", "age", "36"),
+		NewCommand("SADD", "tags", "b c", "a", "1", "a"),
+		NewCommand("ZADD", "board", "2", "grace", "1.5", "ada", "-inf", "linus"),
 	}
 
 	for _, cmd := range cmds {
-		got := db.Execute(dbIndex, cmd).(DBResult)
+		got := db.Execute(newSession(dbIndex), cmd).(DBResult)
 		gotErr := got.Err
 		if gotErr != nil {
 			t.Fatalf("Unexpected error: %v", gotErr)
 		}
 	}
 
-	got := db.Execute(dbIndex, NewCommand("COMPACT")).([]DBResult)
+	got := db.Execute(newSession(dbIndex), NewCommand("COMPACT")).([]DBResult)
+
+	// Storage iteration order is not guaranteed, compare the results regardless of their order
+	sortResults := func(results []DBResult) {
+		sort.Slice(results, func(i, j int) bool { return results[i].Response < results[j].Response })
+	}
+	sortResults(got)
+	sortResults(want)
 
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("EXEC command got %v, want %v", got, want)
 	}
 
 }
+
+func TestKeyValueDB_Execute_ExpireCommands(t *testing.T) {
+	testCases := []struct {
+		name        string
+		cmds        []Command
+		wantResults []string
+	}{
+		{
+			name:        "TTL of non-existing key",
+			cmds:        []Command{NewCommand("TTL", "key"), NewCommand("PTTL", "key")},
+			wantResults: []string{"-2", "-2"},
+		},
+		{
+			name:        "TTL of persistent key",
+			cmds:        []Command{NewCommand("SET", "key", "value"), NewCommand("TTL", "key")},
+			wantResults: []string{"OK", "-1"},
+		},
+		{
+			name:        "SET with EX option",
+			cmds:        []Command{NewCommand("SET", "key", "value", "EX", "100"), NewCommand("TTL", "key")},
+			wantResults: []string{"OK", "100"},
+		},
+		{
+			name:        "SET with PX option",
+			cmds:        []Command{NewCommand("SET", "key", "value", "px", "100000"), NewCommand("TTL", "key")},
+			wantResults: []string{"OK", "100"},
+		},
+		{
+			name: "SET removes expiration time",
+			cmds: []Command{
+				NewCommand("SET", "key", "value", "EX", "100"),
+				NewCommand("SET", "key", "other"),
+				NewCommand("TTL", "key"),
+			},
+			wantResults: []string{"OK", "OK", "-1"},
+		},
+		{
+			name: "SET with KEEPTTL option",
+			cmds: []Command{
+				NewCommand("SET", "key", "value", "EX", "100"),
+				NewCommand("SET", "key", "other", "KEEPTTL"),
+				NewCommand("TTL", "key"),
+				NewCommand("GET", "key"),
+			},
+			wantResults: []string{"OK", "OK", "100", "other"},
+		},
+		{
+			name:        "EXPIRE non-existing key",
+			cmds:        []Command{NewCommand("EXPIRE", "key", "100")},
+			wantResults: []string{"0"},
+		},
+		{
+			name: "EXPIRE and PERSIST",
+			cmds: []Command{
+				NewCommand("SET", "key", "value"),
+				NewCommand("EXPIRE", "key", "100"),
+				NewCommand("TTL", "key"),
+				NewCommand("PERSIST", "key"),
+				NewCommand("TTL", "key"),
+				NewCommand("PERSIST", "key"),
+			},
+			wantResults: []string{"OK", "1", "100", "1", "-1", "0"},
+		},
+		{
+			name: "PEXPIRE",
+			cmds: []Command{
+				NewCommand("SET", "key", "value"),
+				NewCommand("PEXPIRE", "key", "100000"),
+				NewCommand("TTL", "key"),
+			},
+			wantResults: []string{"OK", "1", "100"},
+		},
+		{
+			name: "EXPIRE in the past deletes the key",
+			cmds: []Command{
+				NewCommand("SET", "key", "value"),
+				NewCommand("EXPIRE", "key", "-1"),
+				NewCommand("GET", "key"),
+				NewCommand("TTL", "key"),
+			},
+			wantResults: []string{"OK", "1", "(nil)", "-2"},
+		},
+		{
+			name: "EXPIREAT in the past deletes the key",
+			cmds: []Command{
+				NewCommand("SET", "key", "value"),
+				NewCommand("EXPIREAT", "key", "1"),
+				NewCommand("GET", "key"),
+			},
+			wantResults: []string{"OK", "1", "(nil)"},
+		},
+		{
+			name: "INCR keeps expiration time",
+			cmds: []Command{
+				NewCommand("SET", "key", "10", "EX", "100"),
+				NewCommand("INCR", "key"),
+				NewCommand("TTL", "key"),
+			},
+			wantResults: []string{"OK", "11", "100"},
+		},
+	}
+
+	for _, tc := range testCases {
+		db := NewKeyValueDB(storage.NewInMemoryStorage(5))
+
+		t.Run(tc.name, func(t *testing.T) {
+			for i, cmd := range tc.cmds {
+				got := db.Execute(newSession(1), cmd).(DBResult)
+				if got.Kind() == ErrorReply {
+					t.Fatalf("KeyValueDB.Execute(%v) = %v, want %v", cmd, got, tc.wantResults[i])
+				}
+				gotText := got.Text()
+				if got.Kind() == NilReply {
+					gotText = got.Response
+				}
+				if gotText != tc.wantResults[i] {
+					t.Errorf("KeyValueDB.Execute(%v) = %q, want %q", cmd, gotText, tc.wantResults[i])
+				}
+			}
+		})
+	}
+}
+
+func TestKeyValueDB_Execute_Sessions(t *testing.T) {
+	db := NewKeyValueDB(storage.NewInMemoryStorage(5))
+	first, second := db.NewSession(), db.NewSession()
+	if first.ID == second.ID {
+		t.Fatalf("Sessions share the id %d", first.ID)
+	}
+
+	db.Execute(first, NewCommand("SELECT", "2"))
+	db.Execute(first, NewCommand("MULTI"))
+	db.Execute(first, NewCommand("SET", "key", "first"))
+	if got := db.Execute(second, NewCommand("SET", "key", "second")).(DBResult); got.Response != "OK" {
+		t.Errorf("SET in a session not in MULTI = %v, want OK", got)
+	}
+	if got := db.Execute(second, NewCommand("EXEC")).(DBResult); got.Kind() != ErrorReply {
+		t.Errorf("EXEC in a session not in MULTI = %v, want an error", got)
+	}
+
+	results := db.Execute(first, NewCommand("EXEC")).([]DBResult)
+	if len(results) != 1 || results[0].Response != "OK" {
+		t.Fatalf("EXEC = %v, want [OK]", results)
+	}
+	if first.DbIndex != 2 || second.DbIndex != 0 {
+		t.Errorf("Selected databases = %d, %d, want 2, 0", first.DbIndex, second.DbIndex)
+	}
+	for _, c := range []struct {
+		session *Session
+		want    string
+	}{{first, "first"}, {second, "second"}} {
+		if got := db.Execute(c.session, NewCommand("GET", "key")).(DBResult); got.Value != c.want {
+			t.Errorf("GET key in db %d = %v, want %v", c.session.DbIndex, got.Value, c.want)
+		}
+	}
+
+	// A failed SELECT keeps the selected database, the connection used to fall back to database 0
+	db.Execute(first, NewCommand("SELECT", "10"))
+	db.Execute(first, NewCommand("GET", "missing"))
+	if first.DbIndex != 2 {
+		t.Errorf("Selected database after errors = %d, want 2", first.DbIndex)
+	}
+}
+
+func TestKeyValueDB_Execute_ClientCommand(t *testing.T) {
+	db := NewKeyValueDB(storage.NewInMemoryStorage(5))
+	session := db.NewSession()
+
+	testCases := []struct {
+		cmd        Command
+		want       string
+		wantErrMsg string
+	}{
+		{cmd: NewCommand("CLIENT", "ID"), want: fmt.Sprint(session.ID)},
+		{cmd: NewCommand("CLIENT", "GETNAME"), want: "(nil)"},
+		{cmd: NewCommand("CLIENT", "SETNAME", "worker-1"), want: "OK"},
+		{cmd: NewCommand("CLIENT", "getname"), want: "worker-1"},
+		{
+			cmd:        NewCommand("CLIENT", "SETNAME", "worker 1"),
+			wantErrMsg: "(error) ERR Client names cannot contain spaces, newlines or special characters.",
+		},
+		{cmd: NewCommand("CLIENT", "KILL"), wantErrMsg: "(error) ERR unknown subcommand 'KILL'"},
+		{cmd: NewCommand("CLIENT"), wantErrMsg: "(error) ERR wrong number of arguments for 'client' command"},
+	}
+	for _, tc := range testCases {
+		got := db.Execute(session, tc.cmd).(DBResult)
+		if tc.wantErrMsg != "" {
+			if got.Err == nil || got.Err.Error() != tc.wantErrMsg {
+				t.Errorf("KeyValueDB.Execute(%v) = %v, want Error %v", tc.cmd, got.Err, tc.wantErrMsg)
+			}
+			continue
+		}
+		if got.Text() != tc.want {
+			t.Errorf("KeyValueDB.Execute(%v) = %q, want %q", tc.cmd, got.Text(), tc.want)
+		}
+	}
+}
+
+func TestKeyValueDB_Execute_HelloCommand(t *testing.T) {
+	testCases := []struct {
+		name        string
+		cmd         Command
+		current     int
+		wantVersion int
+		wantErrMsg  string
+	}{
+		{
+			name:        "No protocol version keeps the current one",
+			cmd:         NewCommand(HELLO),
+			current:     3,
+			wantVersion: 3,
+		},
+		{
+			name:        "Switch to RESP3",
+			cmd:         NewCommand(HELLO, "3"),
+			current:     2,
+			wantVersion: 3,
+		},
+		{
+			name:        "Switch back to RESP2",
+			cmd:         NewCommand(HELLO, "2"),
+			current:     3,
+			wantVersion: 2,
+		},
+		{
+			name:        "Unsupported protocol version",
+			cmd:         NewCommand(HELLO, "4"),
+			current:     2,
+			wantVersion: 2,
+			wantErrMsg:  "(error) NOPROTO unsupported protocol version",
+		},
+		{
+			name:        "Invalid protocol version",
+			cmd:         NewCommand(HELLO, "three"),
+			current:     2,
+			wantVersion: 2,
+			wantErrMsg:  "(error) ERR Protocol version is not an integer or out of range",
+		},
+	}
+
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			session := db.NewSession()
+			session.Protocol = tc.current
+			got := db.Execute(session, tc.cmd).(DBResult)
+
+			if session.Protocol != tc.wantVersion {
+				t.Errorf("KeyValueDB.Execute(%v) protocol = %d, want %d", tc.cmd, session.Protocol, tc.wantVersion)
+			}
+
+			if tc.wantErrMsg != "" {
+				if got.Err == nil || got.Err.Error() != tc.wantErrMsg {
+					t.Fatalf("KeyValueDB.Execute(%v) = %v, want Error %v", tc.cmd, got.Err, tc.wantErrMsg)
+				}
+				return
+			}
+
+			if got.Kind() != MapReply {
+				t.Fatalf("KeyValueDB.Execute(%v) reply type = %q, want %q", tc.cmd, got.Kind(), MapReply)
+			}
+			elems := got.Elements()
+			if elems[4].Text() != "proto" || elems[5].Value != tc.wantVersion {
+				t.Errorf("KeyValueDB.Execute(%v) proto = %v, want %d", tc.cmd, elems[5].Value, tc.wantVersion)
+			}
+		})
+	}
+}
+
+func TestKeyValueDB_Execute_ExecIsolation(t *testing.T) {
+	db := NewKeyValueDB(storage.NewInMemoryStorage(5))
+	writer := db.NewSession()
+	db.Execute(writer, NewCommand("SET", "first", "0"))
+	db.Execute(writer, NewCommand("SET", "second", "0"))
+
+	transactions := 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < transactions; i++ {
+			db.Execute(writer, NewCommand("MULTI"))
+			db.Execute(writer, NewCommand("INCR", "first"))
+			db.Execute(writer, NewCommand("INCR", "second"))
+			db.Execute(writer, NewCommand("EXEC"))
+		}
+	}()
+
+	// Both keys are incremented by the same transactions, another client must never see them differ
+	reader := db.NewSession()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		db.Execute(reader, NewCommand("MULTI"))
+		db.Execute(reader, NewCommand("GET", "first"))
+		db.Execute(reader, NewCommand("GET", "second"))
+		got := db.Execute(reader, NewCommand("EXEC")).([]DBResult)
+		if got[0].Value != got[1].Value {
+			t.Fatalf("Values read in a transaction = %v, %v, want equal values", got[0].Value, got[1].Value)
+		}
+	}
+
+	got := db.Execute(reader, NewCommand("GET", "second")).(DBResult)
+	if got.Value != fmt.Sprint(transactions) {
+		t.Errorf("GET second after the transactions = %v, want %d", got.Value, transactions)
+	}
+}
+
+// newSession returns the session of a client having selected the given database
+func newSession(dbIndex int) *Session {
+	return &Session{DbIndex: dbIndex}
+}
+
+func TestKeyValueDB_Execute_ConcurrentClients(t *testing.T) {
+	inMemoryStorage := storage.NewInMemoryStorage(5)
+	db := NewKeyValueDB(inMemoryStorage)
+	db.Execute(newSession(0), NewCommand("SET", "counter", "0"))
+
+	clients := 32
+	iterations := 200
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		// Every connection has its own session on the shared database, as the TCP server does
+		go func(client int) {
+			defer wg.Done()
+			session := db.NewSession()
+			key := fmt.Sprintf("key_%d", client)
+			for i := 0; i < iterations; i++ {
+				session.DbIndex = 0
+				db.Execute(session, NewCommand("INCRBY", "counter", "2"))
+				db.Execute(session, NewCommand("SELECT", "1"))
+				db.Execute(session, NewCommand("SET", key, "value"))
+				db.Execute(session, NewCommand("GET", key))
+				db.Execute(session, NewCommand("DEL", key))
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	got := db.Execute(newSession(0), NewCommand("GET", "counter")).(DBResult)
+	if want := fmt.Sprint(clients * iterations * 2); got.Value != want {
+		t.Errorf("GET counter after concurrent INCRBY = %v, want %v", got.Value, want)
+	}
+}
+
+func BenchmarkKeyValueDB_Execute_ParallelSet(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		aof  bool
+	}{
+		{name: "Concurrent writes"},
+		{name: "Writes propagated to the AOF", aof: true},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			dataStorage := storage.NewInMemoryStorage(1)
+			defer dataStorage.Close()
+			db := NewKeyValueDB(dataStorage)
+			if bm.aof {
+				aof, err := persistence.OpenAOF(filepath.Join(b.TempDir(), "appendonly.aof"), persistence.FsyncNo)
+				if err != nil {
+					b.Fatalf("Unexpected error opening AOF: %v", err)
+				}
+				defer aof.Close()
+				db.EnableAOF(aof)
+			}
+
+			var clients atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				session := newSession(0)
+				prefix := fmt.Sprintf("key_%d_", clients.Add(1))
+				for i := 0; pb.Next(); i++ {
+					db.Execute(session, NewCommand("SET", prefix+strconv.Itoa(i%10000), "value"))
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package domain
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// hash is the value of the keys set by the hash commands: a map from fields to their string value, modified in
+// place.
+type hash map[string]string
+
+// Clone returns a copy of the hash.
+func (h hash) Clone() any {
+	clone := make(hash, len(h))
+	for field, value := range h {
+		clone[field] = value
+	}
+	return clone
+}
+
+// fields returns the fields of the hash, sorted so that replies are stable.
+func (h hash) fields() []string {
+	fields := make([]string, 0, len(h))
+	for field := range h {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// hashValue returns the hash held by a value, nil for the value of a missing key.
+func hashValue(value any) (hash, error) {
+	if value == nil {
+		return nil, nil
+	}
+	h, ok := value.(hash)
+	if !ok {
+		return nil, &WrongTypeError{}
+	}
+	return h, nil
+}
+
+// viewHash calls fn with the hash of a key while holding its lock, a missing key being an empty hash.
+func (k *KeyValueDB) viewHash(dbIndex int, key string, fn func(h hash)) error {
+	return k.storage.View(dbIndex, key, func(value any, _ bool) error {
+		h, err := hashValue(value)
+		if err != nil {
+			return err
+		}
+		fn(h)
+		return nil
+	})
+}
+
+// updateHash calls fn with the hash of a key while holding its lock, creating the hash if the key does not exist.
+// The key is deleted when the hash is left empty.
+func (k *KeyValueDB) updateHash(dbIndex int, key string, fn func(h hash) error) error {
+	_, err := k.storage.Update(dbIndex, key, func(value any, _ bool) (any, error) {
+		h, err := hashValue(value)
+		if err != nil {
+			return nil, err
+		}
+		if h == nil {
+			h = hash{}
+		}
+		if err := fn(h); err != nil {
+			return nil, err
+		}
+		if len(h) == 0 {
+			return nil, nil
+		}
+		return h, nil
+	})
+	return err
+}
+
+// checkFieldValuePairs rejects commands whose arguments following the key are not field value pairs.
+func checkFieldValuePairs(c Command) error {
+	if len(c.Args)%2 != 1 {
+		return newArityError(c.Keyword)
+	}
+	return nil
+}
+
+// hsetCommand sets fields of a hash, creating it if the key does not exist, and returns the number of fields added.
+func (k *KeyValueDB) hsetCommand(s *Session, cmd Command) any {
+	added := 0
+	err := k.updateHash(s.DbIndex, cmd.Args[0], func(h hash) error {
+		for i := 1; i+1 < len(cmd.Args); i += 2 {
+			if _, ok := h[cmd.Args[i]]; !ok {
+				added++
+			}
+			h[cmd.Args[i]] = cmd.Args[i+1]
+		}
+		return nil
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: added, Type: IntegerReply}
+}
+
+// hsetnxCommand sets a field of a hash only if it does not exist.
+func (k *KeyValueDB) hsetnxCommand(s *Session, cmd Command) any {
+	field := cmd.Args[1]
+	set := false
+	err := k.updateHash(s.DbIndex, cmd.Args[0], func(h hash) error {
+		if _, ok := h[field]; !ok {
+			h[field], set = cmd.Args[2], true
+		}
+		return nil
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	if !set {
+		return notFoundResult(s.DbIndex, cmd.Args[0], NewIntegerResult(0))
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: 1, Type: IntegerReply}
+}
+
+func (k *KeyValueDB) hgetCommand(s *Session, cmd Command) any {
+	var value string
+	found := false
+	err := k.viewHash(s.DbIndex, cmd.Args[0], func(h hash) {
+		value, found = h[cmd.Args[1]]
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	if !found {
+		return DBResult{DbIndex: s.DbIndex, Type: NilReply, Response: "(nil)"}
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: value, Type: BulkReply}
+}
+
+func (k *KeyValueDB) hmgetCommand(s *Session, cmd Command) any {
+	var values []DBResult
+	err := k.viewHash(s.DbIndex, cmd.Args[0], func(h hash) {
+		for _, field := range cmd.Args[1:] {
+			if value, ok := h[field]; ok {
+				values = append(values, NewBulkResult(value))
+			} else {
+				values = append(values, NewNilResult())
+			}
+		}
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: values, Type: ArrayReply}
+}
+
+// hdelCommand removes fields from a hash and returns the number of fields removed, the key is deleted
+// along with the last field.
+func (k *KeyValueDB) hdelCommand(s *Session, cmd Command) any {
+	removed := 0
+	err := k.updateHash(s.DbIndex, cmd.Args[0], func(h hash) error {
+		for _, field := range cmd.Args[1:] {
+			if _, ok := h[field]; ok {
+				delete(h, field)
+				removed++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	if removed == 0 {
+		return notFoundResult(s.DbIndex, cmd.Args[0], NewIntegerResult(0))
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: removed, Type: IntegerReply}
+}
+
+func (k *KeyValueDB) hexistsCommand(s *Session, cmd Command) any {
+	exists := 0
+	err := k.viewHash(s.DbIndex, cmd.Args[0], func(h hash) {
+		if _, ok := h[cmd.Args[1]]; ok {
+			exists = 1
+		}
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: exists, Type: IntegerReply}
+}
+
+func (k *KeyValueDB) hlenCommand(s *Session, cmd Command) any {
+	length := 0
+	if err := k.viewHash(s.DbIndex, cmd.Args[0], func(h hash) { length = len(h) }); err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: length, Type: IntegerReply}
+}
+
+func (k *KeyValueDB) hstrlenCommand(s *Session, cmd Command) any {
+	length := 0
+	if err := k.viewHash(s.DbIndex, cmd.Args[0], func(h hash) { length = len(h[cmd.Args[1]]) }); err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: length, Type: IntegerReply}
+}
+
+// hgetallCommand handles HGETALL, which returns a map of the fields to their value, HKEYS and HVALS.
+// Fields are sorted.
+func (k *KeyValueDB) hgetallCommand(s *Session, cmd Command) any {
+	elems := []DBResult{}
+	err := k.viewHash(s.DbIndex, cmd.Args[0], func(h hash) {
+		for _, field := range h.fields() {
+			if cmd.Keyword != HVALS {
+				elems = append(elems, NewBulkResult(field))
+			}
+			if cmd.Keyword != HKEYS {
+				elems = append(elems, NewBulkResult(h[field]))
+			}
+		}
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	if cmd.Keyword == HGETALL {
+		return DBResult{DbIndex: s.DbIndex, Value: elems, Type: MapReply}
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: elems, Type: ArrayReply}
+}
+
+// hincrbyCommand increments the integer value of a field of a hash, a missing field counts as 0.
+func (k *KeyValueDB) hincrbyCommand(s *Session, cmd Command) any {
+	delta, err := convertToInt64(cmd.Args[2])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+
+	var result int64
+	err = k.updateHash(s.DbIndex, cmd.Args[0], func(h hash) error {
+		var current int64
+		if value, ok := h[cmd.Args[1]]; ok {
+			var err error
+			if current, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return &CommandError{msg: "hash value is not an integer"}
+			}
+		}
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return &CommandError{msg: "increment or decrement would overflow"}
+		}
+		result = current + delta
+		h[cmd.Args[1]] = strconv.FormatInt(result, 10)
+		return nil
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: int(result), Type: IntegerReply}
+}
+
+// hincrbyfloatCommand increments the value of a field of a hash by a floating point number, a missing field
+// counts as 0. The new value is computed and formatted by addFloats, as Redis does, then stored and returned.
+func (k *KeyValueDB) hincrbyfloatCommand(s *Session, cmd Command) any {
+	if _, err := convertToFloat(cmd.Args[2]); err != nil {
+		return NewErrorResult(err)
+	}
+
+	var result string
+	err := k.updateHash(s.DbIndex, cmd.Args[0], func(h hash) error {
+		current, ok := h[cmd.Args[1]]
+		if !ok {
+			current = "0"
+		} else if value, err := strconv.ParseFloat(current, 64); err != nil || math.IsNaN(value) {
+			return &CommandError{msg: "hash value is not a float"}
+		}
+		var err error
+		if result, err = addFloats(current, cmd.Args[2]); err != nil {
+			return err
+		}
+		h[cmd.Args[1]] = result
+		return nil
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: result, Type: BulkReply}
+}
+
+func checkHScanOptions(c Command) error {
+	if _, err := parseScanCursor(c.Args[1]); err != nil {
+		return err
+	}
+	_, err := parseScanOptions(c.Keyword, c.Args[2:])
+	return err
+}
+
+// hscanCommand iterates over the fields of a hash, returning the cursor of the next page along with the fields
+// of the page and their value.
+func (k *KeyValueDB) hscanCommand(s *Session, cmd Command) any {
+	cursor, err := parseScanCursor(cmd.Args[1])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	opts, err := parseScanOptions(cmd.Keyword, cmd.Args[2:])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+
+	var next uint64
+	elems := []DBResult{}
+	err = k.viewHash(s.DbIndex, cmd.Args[0], func(h hash) {
+		var page []string
+		page, next = scan(h.fields(), cursor, opts.count)
+		for _, field := range page {
+			if opts.match != "" && !matchPattern(opts.match, field) {
+				continue
+			}
+			elems = append(elems, NewBulkResult(field))
+			if !opts.noValues {
+				elems = append(elems, NewBulkResult(h[field]))
+			}
+		}
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return NewArrayResult(NewBulkResult(strconv.FormatUint(next, 10)), NewArrayResult(elems...))
+}
@@ -0,0 +1,259 @@
+package domain
+
+import (
+	"fmt"
+	"kvdb/persistence"
+	"kvdb/storage"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyValueDB_Execute_HashCommands(t *testing.T) {
+	testCases := []struct {
+		name string
+		cmds []Command
+		want []any // SimpleMsg of the results
+	}{
+		{
+			name: "HSET and HGET",
+			cmds: []Command{
+				NewCommand("HSET", "user", "name", "Ada", "age", "36"),
+				NewCommand("HSET", "user", "name", "Ada Lovelace", "city", "London"),
+				NewCommand("HGET", "user", "name"),
+				NewCommand("HGET", "user", "missing"),
+				NewCommand("HGET", "missing", "name"),
+				NewCommand("HSET", "user", "name"),
+			},
+			want: []any{
+				"(integer) 2", "(integer) 1", `"Ada Lovelace"`, "(nil)", "(nil)",
+				"(error) ERR wrong number of arguments for 'hset' command",
+			},
+		},
+		{
+			name: "HSETNX",
+			cmds: []Command{
+				NewCommand("HSETNX", "user", "name", "Ada"),
+				NewCommand("HSETNX", "user", "name", "Grace"),
+				NewCommand("HGET", "user", "name"),
+			},
+			want: []any{"(integer) 1", "(integer) 0", `"Ada"`},
+		},
+		{
+			name: "HMGET, HEXISTS, HLEN and HSTRLEN",
+			cmds: []Command{
+				NewCommand("HSET", "user", "name", "Ada", "age", "36"),
+				NewCommand("HMGET", "user", "age", "missing", "name"),
+				NewCommand("HEXISTS", "user", "age"),
+				NewCommand("HEXISTS", "user", "missing"),
+				NewCommand("HLEN", "user"),
+				NewCommand("HLEN", "missing"),
+				NewCommand("HSTRLEN", "user", "name"),
+				NewCommand("HSTRLEN", "user", "missing"),
+			},
+			want: []any{
+				"(integer) 2", "1) \"36\"\n2) (nil)\n3) \"Ada\"", "(integer) 1", "(integer) 0",
+				"(integer) 2", "(integer) 0", "(integer) 3", "(integer) 0",
+			},
+		},
+		{
+			name: "HGETALL, HKEYS and HVALS",
+			cmds: []Command{
+				NewCommand("HSET", "user", "name", "Ada", "age", "36"),
+				NewCommand("HGETALL", "user"),
+				NewCommand("HKEYS", "user"),
+				NewCommand("HVALS", "user"),
+				NewCommand("HGETALL", "missing"),
+			},
+			want: []any{
+				"(integer) 2", "1# \"age\" => \"36\"\n2# \"name\" => \"Ada\"", "1) \"age\"\n2) \"name\"",
+				"1) \"36\"\n2) \"Ada\"", "(empty hash)",
+			},
+		},
+		{
+			name: "HDEL",
+			cmds: []Command{
+				NewCommand("HSET", "user", "name", "Ada", "age", "36"),
+				NewCommand("HDEL", "user", "name", "missing"),
+				NewCommand("HDEL", "user", "name"),
+				NewCommand("HDEL", "user", "age"),
+				NewCommand("EXISTS", "user"),
+			},
+			want: []any{"(integer) 2", "(integer) 1", "(integer) 0", "(integer) 1", "(integer) 0"},
+		},
+		{
+			name: "HINCRBY",
+			cmds: []Command{
+				NewCommand("HINCRBY", "user", "age", "36"),
+				NewCommand("HINCRBY", "user", "age", "-1"),
+				NewCommand("HSET", "user", "name", "Ada", "max", "9223372036854775807"),
+				NewCommand("HINCRBY", "user", "name", "1"),
+				NewCommand("HINCRBY", "user", "max", "1"),
+				NewCommand("HINCRBY", "user", "age", "one"),
+			},
+			want: []any{
+				"(integer) 36", "(integer) 35", "(integer) 2",
+				"(error) ERR hash value is not an integer",
+				"(error) ERR increment or decrement would overflow",
+				"(error) ERR value is not an integer or out of range",
+			},
+		},
+		{
+			name: "HINCRBYFLOAT",
+			cmds: []Command{
+				NewCommand("HINCRBYFLOAT", "user", "height", "1.5"),
+				NewCommand("HINCRBYFLOAT", "user", "height", "0.25"),
+				NewCommand("HSET", "user", "name", "Ada", "max", "1e308"),
+				NewCommand("HINCRBYFLOAT", "user", "name", "1"),
+				NewCommand("HINCRBYFLOAT", "user", "max", "1e308"),
+				NewCommand("HGET", "user", "height"),
+				NewCommand("HINCRBYFLOAT", "user", "sum", "0.1"),
+				NewCommand("HINCRBYFLOAT", "user", "sum", "0.2"),
+			},
+			want: []any{
+				`"1.5"`, `"1.75"`, "(integer) 2",
+				"(error) ERR hash value is not a float",
+				"(error) ERR increment would produce NaN or Infinity",
+				`"1.75"`, `"0.1"`, `"0.3"`,
+			},
+		},
+		{
+			name: "HSCAN",
+			cmds: []Command{
+				NewCommand("HSET", "user", "name", "Ada", "age", "36"),
+				NewCommand("HSCAN", "user", "0", "MATCH", "n*"),
+				NewCommand("HSCAN", "user", "0", "MATCH", "a*", "NOVALUES"),
+				NewCommand("HSCAN", "missing", "0"),
+				NewCommand("HSCAN", "user", "-1"),
+				NewCommand("HSCAN", "user", "0", "COUNT", "0"),
+			},
+			want: []any{
+				"(integer) 2", "1) \"0\"\n2) 1) \"name\"\n   2) \"Ada\"", "1) \"0\"\n2) 1) \"age\"",
+				"1) \"0\"\n2) (empty array)", "(error) ERR invalid cursor", "(error) ERR syntax error",
+			},
+		},
+		{
+			name: "Wrong type",
+			cmds: []Command{
+				NewCommand("SET", "string", "value"),
+				NewCommand("HSET", "user", "name", "Ada"),
+				NewCommand("HSET", "string", "name", "Ada"),
+				NewCommand("HGET", "string", "name"),
+				NewCommand("HGETALL", "string"),
+				NewCommand("GET", "user"),
+				NewCommand("LPUSH", "user", "a"),
+				NewCommand("APPEND", "user", "a"),
+			},
+			want: []any{
+				"OK", "(integer) 1",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+			session := db.NewSession()
+			for i, cmd := range tc.cmds {
+				got := db.Execute(session, cmd).(DBResult).SimpleMsg()
+				if got != tc.want[i] {
+					t.Errorf("KeyValueDB.Execute(%v) = %v, want %v", cmd, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestKeyValueDB_Execute_HScanCommand(t *testing.T) {
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	session := db.NewSession()
+	for i := 0; i < 100; i++ {
+		db.Execute(session, NewCommand("HSET", "hash", fmt.Sprintf("field%d", i), i))
+	}
+
+	// Fields added and removed during the iteration do not prevent the others from being returned
+	seen := map[string]bool{}
+	cursor, pages := "0", 0
+	for {
+		reply := db.Execute(session, NewCommand("HSCAN", "hash", cursor, "COUNT", "7")).(DBResult).Elements()
+		fields := reply[1].Elements()
+		for i := 0; i < len(fields); i += 2 {
+			seen[fields[i].Text()] = true
+		}
+		db.Execute(session, NewCommand("HSET", "hash", fmt.Sprintf("new%d", pages), "value"))
+		db.Execute(session, NewCommand("HDEL", "hash", fmt.Sprintf("field%d", 99-pages)))
+		pages++
+		if cursor = reply[0].Text(); cursor == "0" {
+			break
+		}
+	}
+	if pages < 100/7 {
+		t.Errorf("HSCAN COUNT 7 returned 100 fields in %d pages", pages)
+	}
+	var missing []string
+	for i := 0; i < 100-pages; i++ {
+		if field := fmt.Sprintf("field%d", i); !seen[field] {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) > 0 {
+		t.Errorf("HSCAN iteration missed the fields %v", missing)
+	}
+}
+
+func TestKeyValueDB_HashPersistence(t *testing.T) {
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "appendonly.aof"), filepath.Join(dir, "dump.kvdb")
+	aof, err := persistence.OpenAOF(aofPath, persistence.FsyncAlways)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	db.EnableAOF(aof)
+	db.EnableSnapshots(snapshotPath, nil)
+	session := db.NewSession()
+	for _, cmd := range []Command{
+		NewCommand("HSET", "user", "name", "Ada", "age", "36", "city", "London"),
+		NewCommand("HINCRBY", "user", "age", "1"),
+		NewCommand("HDEL", "user", "city"),
+		NewCommand("SAVE"),
+		NewCommand("BGREWRITEAOF"),
+	} {
+		if got := db.Execute(session, cmd).(DBResult); got.Err != nil {
+			t.Fatalf("KeyValueDB.Execute(%v) error = %v", cmd, got.Err)
+		}
+	}
+	for aof.RewriteInProgress() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Unexpected error closing AOF: %v", err)
+	}
+
+	want := "1# \"age\" => \"37\"\n2# \"name\" => \"Ada\""
+	for _, load := range []struct {
+		name string
+		fn   func(db *KeyValueDB) error
+	}{
+		{name: "AOF", fn: func(db *KeyValueDB) error { return db.LoadAOF(aofPath, false) }},
+		{name: "Snapshot", fn: func(db *KeyValueDB) error { return db.LoadSnapshot(snapshotPath) }},
+	} {
+		t.Run(load.name, func(t *testing.T) {
+			loaded := NewKeyValueDB(storage.NewInMemoryStorage(1))
+			if err := load.fn(loaded); err != nil {
+				t.Fatalf("Loading the %s error = %v", load.name, err)
+			}
+			got := loaded.Execute(loaded.NewSession(), NewCommand("HGETALL", "user")).(DBResult)
+			if got.SimpleMsg() != want {
+				t.Errorf("HGETALL user = %v, want %v", got.SimpleMsg(), want)
+			}
+		})
+	}
+}
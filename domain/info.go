@@ -0,0 +1,73 @@
+package domain
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// infoSection is a section of the INFO reply, made of "field:value" lines.
+type infoSection struct {
+	name  string
+	lines func(k *KeyValueDB) []string
+}
+
+var infoSections = []infoSection{
+	{name: "Server", lines: (*KeyValueDB).serverInfo},
+	{name: "Clients", lines: (*KeyValueDB).clientsInfo},
+	{name: "Replication", lines: func(k *KeyValueDB) []string { return k.repl.info() }},
+	{name: "Keyspace", lines: (*KeyValueDB).keyspaceInfo},
+}
+
+// infoCommand handles INFO, which returns the given sections of information about the server, each one starting
+// with a "# Name" header. Every section is returned when none is given, or when given all, everything or default.
+// Unknown sections are left out.
+func (k *KeyValueDB) infoCommand(_ *Session, cmd Command) any {
+	all := len(cmd.Args) == 0
+	requested := make(map[string]bool)
+	for _, arg := range cmd.Args {
+		switch name := strings.ToLower(arg); name {
+		case "all", "everything", "default":
+			all = true
+		default:
+			requested[name] = true
+		}
+	}
+
+	var sections []string
+	for _, section := range infoSections {
+		if !all && !requested[strings.ToLower(section.name)] {
+			continue
+		}
+		lines := append([]string{"# " + section.name}, section.lines(k)...)
+		sections = append(sections, strings.Join(lines, "\r\n"))
+	}
+	return NewVerbatimResult("txt", strings.Join(sections, "\r\n\r\n"))
+}
+
+func (k *KeyValueDB) serverInfo() []string {
+	k.repl.mu.Lock()
+	port := k.repl.listeningPort
+	k.repl.mu.Unlock()
+	return []string{
+		"kvdb_version:" + Version,
+		fmt.Sprintf("process_id:%d", os.Getpid()),
+		fmt.Sprintf("tcp_port:%d", port),
+	}
+}
+
+// clientsInfo returns the number of clients waiting for a blocking command.
+func (k *KeyValueDB) clientsInfo() []string {
+	return []string{fmt.Sprintf("blocked_clients:%d", k.blockers.count())}
+}
+
+// keyspaceInfo returns the number of keys of every database holding some.
+func (k *KeyValueDB) keyspaceInfo() []string {
+	var lines []string
+	for dbIndex := 0; dbIndex < k.storage.DbCount(); dbIndex++ {
+		if size := k.storage.Size(dbIndex); size > 0 {
+			lines = append(lines, fmt.Sprintf("db%d:keys=%d", dbIndex, size))
+		}
+	}
+	return lines
+}
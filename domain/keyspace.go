@@ -0,0 +1,324 @@
+package domain
+
+import (
+	"fmt"
+	"kvdb/storage"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Names of the types of values returned by TYPE and accepted by the TYPE option of SCAN
+var typeNames = []string{"string", "list", "hash", "set", "zset"}
+
+// typeName returns the name of the type of a value, "none" for a missing key.
+func typeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "none"
+	case *list:
+		return "list"
+	case hash:
+		return "hash"
+	case set:
+		return "set"
+	case *zset:
+		return "zset"
+	default:
+		return "string"
+	}
+}
+
+// allEntries returns the entries of a database by iterating over it from start to end.
+func (k *KeyValueDB) allEntries(dbIndex int) ([]storage.Entry, error) {
+	var entries []storage.Entry
+	err := k.storage.Iterate(dbIndex, func(e storage.Entry) bool {
+		entries = append(entries, e)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// keysCommand returns the keys of the database matching a glob-style pattern, sorted.
+func (k *KeyValueDB) keysCommand(s *Session, cmd Command) any {
+	var keys []string
+	err := k.storage.Keys(s.DbIndex, func(key string) bool {
+		if matchPattern(cmd.Args[0], key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return NewErrorResult(&CommandError{msg: err.Error()})
+	}
+	sort.Strings(keys)
+	elems := make([]DBResult, 0, len(keys))
+	for _, key := range keys {
+		elems = append(elems, NewBulkResult(key))
+	}
+	return NewArrayResult(elems...)
+}
+
+func checkScanOptions(c Command) error {
+	if _, err := parseScanCursor(c.Args[0]); err != nil {
+		return err
+	}
+	_, err := parseScanOptions(c.Keyword, c.Args[1:])
+	return err
+}
+
+// scanCommand iterates over the keys of the database, returning the cursor of the next page along with the keys
+// of the page. The MATCH and TYPE options filter the keys of the page, which may thus be empty.
+func (k *KeyValueDB) scanCommand(s *Session, cmd Command) any {
+	cursor, err := parseScanCursor(cmd.Args[0])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	opts, err := parseScanOptions(cmd.Keyword, cmd.Args[1:])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+
+	page, next, err := k.storage.Scan(s.DbIndex, cursor, opts.count)
+	if err != nil {
+		return NewErrorResult(&CommandError{msg: err.Error()})
+	}
+	elems := []DBResult{}
+	for _, e := range page {
+		if opts.match != "" && !matchPattern(opts.match, e.Key) {
+			continue
+		}
+		if opts.typeName != "" && typeName(e.Value) != opts.typeName {
+			continue
+		}
+		elems = append(elems, NewBulkResult(e.Key))
+	}
+	return NewArrayResult(NewBulkResult(strconv.FormatUint(next, 10)), NewArrayResult(elems...))
+}
+
+// typeCommand returns the name of the type of the value of a key.
+func (k *KeyValueDB) typeCommand(s *Session, cmd Command) any {
+	var name string
+	_ = k.storage.View(s.DbIndex, cmd.Args[0], func(value any, _ bool) error {
+		name = typeName(value)
+		return nil
+	})
+	return NewStatusResult(name)
+}
+
+func (k *KeyValueDB) dbsizeCommand(s *Session, _ Command) any {
+	return NewIntegerResult(k.storage.Size(s.DbIndex))
+}
+
+func (k *KeyValueDB) randomkeyCommand(s *Session, _ Command) any {
+	key, ok := k.storage.RandomKey(s.DbIndex)
+	if !ok {
+		return NewNilResult()
+	}
+	return NewBulkResult(key)
+}
+
+// renameCommand handles RENAME and RENAMENX, which only renames the key when the new one does not exist.
+// The new key gets the expiration time of the renamed one.
+func (k *KeyValueDB) renameCommand(s *Session, cmd Command) any {
+	key, newKey := cmd.Args[0], cmd.Args[1]
+	renamed := false
+	err := k.storage.UpdateEntries(s.DbIndex, []string{key, newKey}, func(entries []storage.Entry) ([]storage.Entry, error) {
+		if entries[0].Value == nil {
+			return nil, &CommandError{msg: "no such key"}
+		}
+		if key == newKey || (cmd.Keyword == RENAMENX && entries[1].Value != nil) {
+			return entries, nil
+		}
+		renamed = true
+		return []storage.Entry{{}, entries[0]}, nil
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	if cmd.Keyword == RENAME {
+		return DBResult{DbIndex: s.DbIndex, Value: "", Type: StatusReply, Response: "OK"}
+	}
+	if !renamed {
+		return notFoundResult(s.DbIndex, newKey, NewIntegerResult(0))
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: 1, Type: IntegerReply}
+}
+
+// copyOptions are the options of COPY.
+type copyOptions struct {
+	db      string // Index of the destination database, empty for the selected one
+	replace bool   // Set by REPLACE, the destination key is overwritten
+}
+
+func parseCopyOptions(options []string) (copyOptions, error) {
+	var opts copyOptions
+	for i := 0; i < len(options); i++ {
+		switch option := strings.ToUpper(options[i]); {
+		case option == "REPLACE":
+			opts.replace = true
+		case option == "DB" && i+1 < len(options):
+			i++
+			if _, err := strconv.Atoi(options[i]); err != nil {
+				return opts, &CommandError{msg: "value is not an integer or out of range"}
+			}
+			opts.db = options[i]
+		default:
+			return opts, &CommandError{msg: "syntax error"}
+		}
+	}
+	return opts, nil
+}
+
+func checkCopyOptions(c Command) error {
+	_, err := parseCopyOptions(c.Args[2:])
+	return err
+}
+
+// copyCommand copies the value of a key and its expiration time to another key, possibly of another database.
+func (k *KeyValueDB) copyCommand(s *Session, cmd Command) any {
+	source, destination := cmd.Args[0], cmd.Args[1]
+	opts, err := parseCopyOptions(cmd.Args[2:])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	dstIndex := s.DbIndex
+	if opts.db != "" {
+		if dstIndex, err = k.storage.Select(opts.db); err != nil {
+			return NewErrorResult(err)
+		}
+	}
+	if dstIndex == s.DbIndex && source == destination {
+		return NewErrorResult(&CommandError{msg: "source and destination objects are the same"})
+	}
+
+	copied, err := k.storage.Copy(s.DbIndex, source, dstIndex, destination, opts.replace)
+	if _, notFound := err.(*storage.KeyNotFoundError); notFound || (err == nil && !copied) {
+		return notFoundResult(s.DbIndex, source, NewIntegerResult(0))
+	}
+	if err != nil {
+		return NewErrorResult(&CommandError{msg: err.Error()})
+	}
+	if dstIndex != s.DbIndex {
+		k.touchKeys(dstIndex, destination)
+		k.blockers.signal(dstIndex, destination)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: 1, Type: IntegerReply}
+}
+
+// moveCommand moves a key to another database, unless the key exists there.
+func (k *KeyValueDB) moveCommand(s *Session, cmd Command) any {
+	key := cmd.Args[0]
+	dstIndex, err := k.storage.Select(cmd.Args[1])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	if dstIndex == s.DbIndex {
+		return NewErrorResult(&CommandError{msg: "source and destination objects are the same"})
+	}
+
+	moved, err := k.storage.Move(s.DbIndex, key, dstIndex)
+	if _, notFound := err.(*storage.KeyNotFoundError); notFound || (err == nil && !moved) {
+		return notFoundResult(s.DbIndex, key, NewIntegerResult(0))
+	}
+	if err != nil {
+		return NewErrorResult(&CommandError{msg: err.Error()})
+	}
+	k.touchKeys(dstIndex, key)
+	k.blockers.signal(dstIndex, key)
+	return DBResult{DbIndex: s.DbIndex, Value: 1, Type: IntegerReply}
+}
+
+// swapdbCommand exchanges the keys of two databases. The sessions watching keys of either database are flagged
+// unless the key exists in neither of them, and the sessions blocked on keys of either database check them again.
+func (k *KeyValueDB) swapdbCommand(_ *Session, cmd Command) any {
+	var indexes [2]int
+	for i, arg := range cmd.Args {
+		if _, err := strconv.Atoi(arg); err != nil {
+			return NewErrorResult(&CommandError{msg: fmt.Sprintf("invalid %s DB index", [2]string{"first", "second"}[i])})
+		}
+		index, err := k.storage.Select(arg)
+		if err != nil {
+			return NewErrorResult(err)
+		}
+		indexes[i] = index
+	}
+
+	k.touchDB(indexes[0], indexes[0], indexes[1])
+	k.touchDB(indexes[1], indexes[0], indexes[1])
+	if err := k.storage.Swap(indexes[0], indexes[1]); err != nil {
+		return NewErrorResult(&CommandError{msg: err.Error()})
+	}
+	k.blockers.signalDB(indexes[0])
+	k.blockers.signalDB(indexes[1])
+	return NewStatusResult("OK")
+}
+
+// parseFlushMode parses the option of FLUSHDB and FLUSHALL, and reports whether the memory is freed asynchronously.
+func parseFlushMode(options []string) (bool, error) {
+	switch {
+	case len(options) == 0:
+		return false, nil
+	case len(options) > 1:
+		return false, &CommandError{msg: "syntax error"}
+	}
+	switch strings.ToUpper(options[0]) {
+	case "ASYNC":
+		return true, nil
+	case "SYNC":
+		return false, nil
+	}
+	return false, &CommandError{msg: "syntax error"}
+}
+
+func checkFlushMode(c Command) error {
+	_, err := parseFlushMode(c.Args)
+	return err
+}
+
+// flushCommand handles FLUSHDB and FLUSHALL, which remove the keys of the selected database or of all of them.
+//
+// The storage may hold on to the space of the removed keys until it reclaims it. SYNC reclaims it before replying,
+// once the lock of the database is released so that the other clients are not kept waiting, while ASYNC replies
+// right away and lets the storage reclaim it in the background.
+func (k *KeyValueDB) flushCommand(s *Session, cmd Command) any {
+	async, err := parseFlushMode(cmd.Args)
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	dbIndexes := []int{s.DbIndex}
+	if cmd.Keyword == FLUSHALL {
+		dbIndexes = dbIndexes[:0]
+		for dbIndex := 0; dbIndex < k.storage.DbCount(); dbIndex++ {
+			dbIndexes = append(dbIndexes, dbIndex)
+		}
+	}
+
+	for _, dbIndex := range dbIndexes {
+		k.touchDB(dbIndex, dbIndex)
+		if err := k.storage.Flush(dbIndex); err != nil {
+			return NewErrorResult(&CommandError{msg: err.Error()})
+		}
+	}
+	if async {
+		k.reclaim(true)
+	} else {
+		s.reclaim = true
+	}
+	return NewStatusResult("OK")
+}
+
+// reclaim has the storage release the space still held by the removed keys, if it holds on to it.
+func (k *KeyValueDB) reclaim(async bool) {
+	reclaimer, ok := k.storage.(storage.Reclaimer)
+	if !ok {
+		return
+	}
+	if err := reclaimer.Reclaim(async); err != nil {
+		log.Printf("Error reclaiming the space of the removed keys: %v\n", err)
+	}
+}
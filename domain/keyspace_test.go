@@ -0,0 +1,343 @@
+package domain
+
+import (
+	"fmt"
+	"kvdb/persistence"
+	"kvdb/storage"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestKeyValueDB_Execute_KeyspaceCommands(t *testing.T) {
+	testCases := []struct {
+		name string
+		cmds []Command
+		want []any // SimpleMsg of the results
+	}{
+		{
+			name: "KEYS and DBSIZE",
+			cmds: []Command{
+				NewCommand("KEYS", "*"),
+				NewCommand("DBSIZE"),
+				NewCommand("MSET", "user:2", "b", "user:1", "a", "order:1", "c"),
+				NewCommand("RPUSH", "user:list", "a"),
+				NewCommand("KEYS", "user:?"),
+				NewCommand("KEYS", "*"),
+				NewCommand("KEYS", "[^u]*"),
+				NewCommand("DBSIZE"),
+			},
+			want: []any{
+				"(empty array)", "(integer) 0", "OK", "(integer) 1",
+				"1) \"user:1\"\n2) \"user:2\"",
+				"1) \"order:1\"\n2) \"user:1\"\n3) \"user:2\"\n4) \"user:list\"",
+				"1) \"order:1\"",
+				"(integer) 4",
+			},
+		},
+		{
+			name: "TYPE",
+			cmds: []Command{
+				NewCommand("SET", "string", "value"),
+				NewCommand("INCR", "counter"),
+				NewCommand("RPUSH", "list", "a"),
+				NewCommand("HSET", "hash", "field", "value"),
+				NewCommand("SADD", "set", "a"),
+				NewCommand("ZADD", "zset", "1", "a"),
+				NewCommand("TYPE", "string"),
+				NewCommand("TYPE", "counter"),
+				NewCommand("TYPE", "list"),
+				NewCommand("TYPE", "hash"),
+				NewCommand("TYPE", "set"),
+				NewCommand("TYPE", "zset"),
+				NewCommand("TYPE", "missing"),
+			},
+			want: []any{
+				"OK", "(integer) 1", "(integer) 1", "(integer) 1", "(integer) 1", "(integer) 1",
+				"string", "string", "list", "hash", "set", "zset", "none",
+			},
+		},
+		{
+			name: "SCAN",
+			cmds: []Command{
+				NewCommand("SCAN", "0"),
+				NewCommand("SET", "string", "value"),
+				NewCommand("RPUSH", "list", "a"),
+				NewCommand("SCAN", "0", "MATCH", "s*"),
+				NewCommand("SCAN", "0", "TYPE", "LIST"),
+				NewCommand("SCAN", "0", "TYPE", "zset", "COUNT", "100"),
+				NewCommand("SCAN", "0", "TYPE", "unknown"),
+				NewCommand("SCAN", "cursor"),
+				NewCommand("SCAN", "0", "NOVALUES"),
+			},
+			want: []any{
+				"1) \"0\"\n2) (empty array)", "OK", "(integer) 1",
+				"1) \"0\"\n2) 1) \"string\"",
+				"1) \"0\"\n2) 1) \"list\"",
+				"1) \"0\"\n2) (empty array)",
+				"(error) ERR unknown type name", "(error) ERR invalid cursor", "(error) ERR syntax error",
+			},
+		},
+		{
+			name: "RENAME and RENAMENX",
+			cmds: []Command{
+				NewCommand("RENAME", "missing", "key"),
+				NewCommand("SET", "key", "value", "EX", "100"),
+				NewCommand("RENAME", "key", "renamed"),
+				NewCommand("EXISTS", "key"),
+				NewCommand("GET", "renamed"),
+				NewCommand("TTL", "renamed"),
+				NewCommand("RENAME", "renamed", "renamed"),
+				NewCommand("SET", "other", "value"),
+				NewCommand("RENAMENX", "renamed", "other"),
+				NewCommand("RENAMENX", "renamed", "key"),
+				NewCommand("RENAMENX", "missing", "key"),
+			},
+			want: []any{
+				"(error) ERR no such key", "OK", "OK", "(integer) 0", `"value"`, "(integer) 100", "OK", "OK",
+				"(integer) 0", "(integer) 1", "(error) ERR no such key",
+			},
+		},
+		{
+			name: "COPY",
+			cmds: []Command{
+				NewCommand("RPUSH", "list", "a", "b"),
+				NewCommand("COPY", "list", "copy"),
+				NewCommand("RPUSH", "copy", "c"),
+				NewCommand("LRANGE", "list", "0", "-1"),
+				NewCommand("COPY", "list", "copy"),
+				NewCommand("COPY", "list", "copy", "REPLACE"),
+				NewCommand("LRANGE", "copy", "0", "-1"),
+				NewCommand("COPY", "missing", "copy"),
+				NewCommand("COPY", "list", "list"),
+				NewCommand("COPY", "list", "list", "DB", "1"),
+				NewCommand("SELECT", "1"),
+				NewCommand("LRANGE", "list", "0", "-1"),
+				NewCommand("COPY", "list", "list", "DB", "2"),
+				NewCommand("COPY", "list", "list", "DB"),
+			},
+			want: []any{
+				"(integer) 2", "(integer) 1", "(integer) 3", "1) \"a\"\n2) \"b\"", "(integer) 0", "(integer) 1",
+				"1) \"a\"\n2) \"b\"", "(integer) 0", "(error) ERR source and destination objects are the same",
+				"(integer) 1", "OK", "1) \"a\"\n2) \"b\"", "(error) ERR DB index is out of range",
+				"(error) ERR syntax error",
+			},
+		},
+		{
+			name: "MOVE",
+			cmds: []Command{
+				NewCommand("SET", "key", "value"),
+				NewCommand("MOVE", "key", "1"),
+				NewCommand("EXISTS", "key"),
+				NewCommand("MOVE", "key", "1"),
+				NewCommand("SET", "key", "other"),
+				NewCommand("MOVE", "key", "1"),
+				NewCommand("MOVE", "key", "0"),
+				NewCommand("MOVE", "key", "db"),
+				NewCommand("SELECT", "1"),
+				NewCommand("GET", "key"),
+			},
+			want: []any{
+				"OK", "(integer) 1", "(integer) 0", "(integer) 0", "OK", "(integer) 0",
+				"(error) ERR source and destination objects are the same",
+				"(error) ERR value is not an integer or out of range", "OK", `"value"`,
+			},
+		},
+		{
+			name: "SWAPDB",
+			cmds: []Command{
+				NewCommand("SET", "key", "db0"),
+				NewCommand("SWAPDB", "0", "1"),
+				NewCommand("EXISTS", "key"),
+				NewCommand("SELECT", "1"),
+				NewCommand("GET", "key"),
+				NewCommand("SWAPDB", "1", "1"),
+				NewCommand("SWAPDB", "a", "1"),
+				NewCommand("SWAPDB", "0", "b"),
+				NewCommand("SWAPDB", "0", "2"),
+			},
+			want: []any{
+				"OK", "OK", "(integer) 0", "OK", `"db0"`, "OK", "(error) ERR invalid first DB index",
+				"(error) ERR invalid second DB index", "(error) ERR DB index is out of range",
+			},
+		},
+		{
+			name: "FLUSHDB and FLUSHALL",
+			cmds: []Command{
+				NewCommand("MSET", "a", "1", "b", "2"),
+				NewCommand("COPY", "a", "a", "DB", "1"),
+				NewCommand("FLUSHDB"),
+				NewCommand("DBSIZE"),
+				NewCommand("SELECT", "1"),
+				NewCommand("DBSIZE"),
+				NewCommand("MSET", "a", "1", "b", "2"),
+				NewCommand("SELECT", "0"),
+				NewCommand("SET", "c", "3"),
+				NewCommand("FLUSHALL", "async"),
+				NewCommand("DBSIZE"),
+				NewCommand("SELECT", "1"),
+				NewCommand("DBSIZE"),
+				NewCommand("FLUSHDB", "LAZY"),
+				NewCommand("FLUSHALL", "SYNC", "ASYNC"),
+			},
+			want: []any{
+				"OK", "(integer) 1", "OK", "(integer) 0", "OK", "(integer) 1", "OK", "OK", "OK", "OK",
+				"(integer) 0", "OK", "(integer) 0", "(error) ERR syntax error", "(error) ERR syntax error",
+			},
+		},
+		{
+			name: "RANDOMKEY",
+			cmds: []Command{
+				NewCommand("RANDOMKEY"),
+				NewCommand("SET", "key", "value"),
+				NewCommand("RANDOMKEY"),
+			},
+			want: []any{"(nil)", "OK", `"key"`},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := NewKeyValueDB(storage.NewInMemoryStorage(2))
+			session := db.NewSession()
+			for i, cmd := range tc.cmds {
+				got := db.Execute(session, cmd).(DBResult).SimpleMsg()
+				if got != tc.want[i] {
+					t.Errorf("KeyValueDB.Execute(%v) = %v, want %v", cmd, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestKeyValueDB_Execute_ScanCommand(t *testing.T) {
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	session := db.NewSession()
+	for i := 0; i < 100; i++ {
+		db.Execute(session, NewCommand("SET", fmt.Sprintf("key%d", i), i))
+	}
+
+	// Keys added and removed during the iteration do not prevent the others from being returned
+	seen := map[string]bool{}
+	cursor, pages := "0", 0
+	for {
+		reply := db.Execute(session, NewCommand("SCAN", cursor, "COUNT", "7")).(DBResult).Elements()
+		for _, key := range reply[1].Elements() {
+			seen[key.Text()] = true
+		}
+		db.Execute(session, NewCommand("SET", fmt.Sprintf("new%d", pages), "value"))
+		db.Execute(session, NewCommand("DEL", fmt.Sprintf("key%d", 99-pages)))
+		pages++
+		if cursor = reply[0].Text(); cursor == "0" {
+			break
+		}
+	}
+	if pages < 100/7 {
+		t.Errorf("SCAN COUNT 7 returned 100 keys in %d pages", pages)
+	}
+	var missing []string
+	for i := 0; i < 100-pages; i++ {
+		if key := fmt.Sprintf("key%d", i); !seen[key] {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		t.Errorf("SCAN iteration missed the keys %v", missing)
+	}
+}
+
+func TestKeyValueDB_KeyspacePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	aof, err := persistence.OpenAOF(path, persistence.FsyncAlways)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+
+	db := NewKeyValueDB(storage.NewInMemoryStorage(3))
+	db.EnableAOF(aof)
+	session := db.NewSession()
+	for _, cmd := range []Command{
+		NewCommand("MSET", "a", "1", "b", "2", "c", "3"),
+		NewCommand("RENAME", "a", "renamed"),
+		NewCommand("MOVE", "b", "1"),
+		NewCommand("COPY", "c", "copy", "DB", "2"),
+		NewCommand("SWAPDB", "0", "2"),
+		NewCommand("SELECT", "1"),
+		NewCommand("SET", "flushed", "value"),
+		NewCommand("FLUSHDB"),
+	} {
+		if got := db.Execute(session, cmd).(DBResult); got.Err != nil {
+			t.Fatalf("KeyValueDB.Execute(%v) error = %v", cmd, got.Err)
+		}
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Unexpected error closing AOF: %v", err)
+	}
+
+	loaded := NewKeyValueDB(storage.NewInMemoryStorage(3))
+	if err := loaded.LoadAOF(path, false); err != nil {
+		t.Fatalf("KeyValueDB.LoadAOF() error = %v", err)
+	}
+	loadedSession := loaded.NewSession()
+	for _, want := range []struct {
+		dbIndex string
+		keys    string
+	}{
+		{dbIndex: "0", keys: "1) \"copy\""},
+		{dbIndex: "1", keys: "(empty array)"},
+		{dbIndex: "2", keys: "1) \"c\"\n2) \"renamed\""},
+	} {
+		loaded.Execute(loadedSession, NewCommand("SELECT", want.dbIndex))
+		if got := loaded.Execute(loadedSession, NewCommand("KEYS", "*")).(DBResult).SimpleMsg(); got != want.keys {
+			t.Errorf("KEYS * of database %s = %v, want %v", want.dbIndex, got, want.keys)
+		}
+	}
+}
+
+// reclaimStorage records the calls to Reclaim, and whether the lock of the database was held by a synchronous one.
+type reclaimStorage struct {
+	storage.Storage
+	db     *KeyValueDB
+	calls  []string
+	locked bool
+}
+
+func (r *reclaimStorage) Reclaim(async bool) error {
+	r.calls = append(r.calls, map[bool]string{false: "sync", true: "async"}[async])
+	if async {
+		return nil
+	}
+	if r.db.lock.TryLock() {
+		r.db.lock.Unlock()
+	} else {
+		r.locked = true
+	}
+	return nil
+}
+
+func TestKeyValueDB_FlushReclaim(t *testing.T) {
+	reclaimer := &reclaimStorage{Storage: storage.NewInMemoryStorage(2)}
+	db := NewKeyValueDB(reclaimer)
+	reclaimer.db = db
+	session := db.NewSession()
+	for _, cmd := range []Command{
+		NewCommand("SET", "key", "value"),
+		NewCommand("FLUSHDB"),
+		NewCommand("FLUSHALL", "ASYNC"),
+		NewCommand("FLUSHDB", "SYNC"),
+		NewCommand("MULTI"),
+		NewCommand("FLUSHALL"),
+		NewCommand("EXEC"),
+		NewCommand("FLUSHDB", "LAZY"),
+	} {
+		db.Execute(session, cmd)
+	}
+
+	// SYNC reclaims the space once the lock is released, ASYNC leaves it to the storage
+	if want := []string{"sync", "async", "sync", "sync"}; !reflect.DeepEqual(reclaimer.calls, want) {
+		t.Errorf("Calls to Reclaim = %v, want %v", reclaimer.calls, want)
+	}
+	if reclaimer.locked {
+		t.Errorf("The lock of the database was held while reclaiming the space synchronously")
+	}
+}
@@ -0,0 +1,577 @@
+package domain
+
+import (
+	"kvdb/storage"
+	"strconv"
+	"strings"
+)
+
+// Capacity of a new list, lists never shrink below it
+const minListCapacity = 8
+
+// list is the value of the keys set by the list commands: a deque of strings stored in a ring buffer,
+// so that elements are pushed and popped at both ends in constant time. It is modified in place.
+type list struct {
+	elems []string
+	head  int // Position of the first element in elems
+	size  int
+}
+
+// newList returns a list holding the given elements.
+func newList(elems ...string) *list {
+	l := &list{elems: make([]string, max(len(elems), minListCapacity)), size: len(elems)}
+	copy(l.elems, elems)
+	return l
+}
+
+// Len returns the number of elements of the list.
+func (l *list) Len() int {
+	return l.size
+}
+
+// at returns the element at the given index, counted from the head of the list.
+func (l *list) at(i int) string {
+	return l.elems[(l.head+i)%len(l.elems)]
+}
+
+// set replaces the element at the given index, counted from the head of the list.
+func (l *list) set(i int, elem string) {
+	l.elems[(l.head+i)%len(l.elems)] = elem
+}
+
+// push adds an element at the head of the list, or at its tail.
+func (l *list) push(head bool, elem string) {
+	if l.size == len(l.elems) {
+		l.resize(2 * len(l.elems))
+	}
+	if head {
+		l.head = (l.head - 1 + len(l.elems)) % len(l.elems)
+	}
+	l.size++
+	if head {
+		l.set(0, elem)
+	} else {
+		l.set(l.size-1, elem)
+	}
+}
+
+// pop removes and returns the element at the head of the list, or at its tail. The list must not be empty.
+func (l *list) pop(head bool) string {
+	var elem string
+	if head {
+		elem = l.at(0)
+		l.set(0, "")
+		l.head = (l.head + 1) % len(l.elems)
+	} else {
+		elem = l.at(l.size - 1)
+		l.set(l.size-1, "")
+	}
+	l.size--
+	if len(l.elems) > minListCapacity && l.size < len(l.elems)/4 {
+		l.resize(len(l.elems) / 2)
+	}
+	return elem
+}
+
+// resize moves the elements to a buffer of the given capacity, starting at its beginning.
+func (l *list) resize(capacity int) {
+	elems := make([]string, capacity)
+	for i := 0; i < l.size; i++ {
+		elems[i] = l.at(i)
+	}
+	l.elems, l.head = elems, 0
+}
+
+// slice returns a copy of the elements between two indexes, both included.
+func (l *list) slice(start, end int) []string {
+	elems := make([]string, 0, end-start+1)
+	for i := start; i <= end; i++ {
+		elems = append(elems, l.at(i))
+	}
+	return elems
+}
+
+// elements returns a copy of all the elements of the list, from its head to its tail.
+func (l *list) elements() []string {
+	return l.slice(0, l.size-1)
+}
+
+// replace replaces all the elements of the list.
+func (l *list) replace(elems []string) {
+	*l = *newList(elems...)
+}
+
+// Clone returns a copy of the list, its ring buffer sized to the elements.
+func (l *list) Clone() any {
+	return newList(l.elements()...)
+}
+
+// listValue returns the list held by a value, nil for the value of a missing key.
+func listValue(value any) (*list, error) {
+	if value == nil {
+		return nil, nil
+	}
+	l, ok := value.(*list)
+	if !ok {
+		return nil, &WrongTypeError{}
+	}
+	return l, nil
+}
+
+// listRange resolves the start and end indexes of LRANGE and LTRIM into a range of a list of the given length.
+// Negative indexes count from the end of the list. It reports false when the range holds no element.
+func listRange(start, end, length int) (int, int, bool) {
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if end < 0 {
+		end = length + end
+	}
+	end = min(end, length-1)
+	if start > end || start >= length {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// parseListEnd parses the LEFT or RIGHT argument of LMOVE and BLMOVE, returning whether it designates the head.
+func parseListEnd(arg string) (bool, error) {
+	switch strings.ToUpper(arg) {
+	case "LEFT":
+		return true, nil
+	case "RIGHT":
+		return false, nil
+	}
+	return false, &CommandError{msg: "syntax error"}
+}
+
+// notFoundResult is the reply of a write command leaving a missing key untouched. Its error keeps the command
+// out of the persistence, and it replies with the given result.
+func notFoundResult(dbIndex int, key string, result DBResult) DBResult {
+	result.DbIndex, result.Err = dbIndex, storage.NewKeyNotFoundError(key)
+	return result
+}
+
+// pushCommand handles LPUSH and RPUSH, which creates the list if the key does not exist.
+func (k *KeyValueDB) pushCommand(s *Session, cmd Command) any {
+	length := 0
+	_, err := k.storage.Update(s.DbIndex, cmd.Args[0], func(value any, _ bool) (any, error) {
+		l, err := listValue(value)
+		if err != nil {
+			return nil, err
+		}
+		if l == nil {
+			l = newList()
+		}
+		for _, elem := range cmd.Args[1:] {
+			l.push(cmd.Keyword == LPUSH, elem)
+		}
+		length = l.Len()
+		return l, nil
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: length, Type: IntegerReply}
+}
+
+// popCommand handles LPOP and RPOP. Without count, it returns the popped element alone.
+func (k *KeyValueDB) popCommand(s *Session, cmd Command) any {
+	count := 1
+	if len(cmd.Args) > 1 {
+		var err error
+		if count, err = strconv.Atoi(cmd.Args[1]); err != nil || count < 0 {
+			err := &CommandError{msg: "value is out of range, must be positive"}
+			return NewErrorResult(err)
+		}
+	}
+
+	popped, err := k.pop(s.DbIndex, cmd.Args[0], cmd.Keyword == LPOP, count)
+	if err != nil {
+		if _, notFound := err.(*storage.KeyNotFoundError); notFound {
+			return notFoundResult(s.DbIndex, cmd.Args[0], NewNilResult())
+		}
+		return NewErrorResult(err)
+	}
+	if len(cmd.Args) == 1 {
+		return DBResult{DbIndex: s.DbIndex, Value: popped[0], Type: BulkReply}
+	}
+	elems := []DBResult{}
+	for _, elem := range popped {
+		elems = append(elems, NewBulkResult(elem))
+	}
+	return NewArrayResult(elems...)
+}
+
+// pop removes up to count elements from the head or the tail of the list of a key, deleting the key once empty.
+func (k *KeyValueDB) pop(dbIndex int, key string, head bool, count int) ([]string, error) {
+	var popped []string
+	_, err := k.storage.Update(dbIndex, key, func(value any, _ bool) (any, error) {
+		l, err := listValue(value)
+		if err != nil {
+			return nil, err
+		}
+		if l == nil {
+			return nil, storage.NewKeyNotFoundError(key)
+		}
+		for len(popped) < count && l.Len() > 0 {
+			popped = append(popped, l.pop(head))
+		}
+		if l.Len() == 0 {
+			return nil, nil
+		}
+		return l, nil
+	})
+	return popped, err
+}
+
+// viewList calls fn with the list of a key while holding its lock, a missing key being an empty list.
+func (k *KeyValueDB) viewList(dbIndex int, key string, fn func(l *list)) error {
+	return k.storage.View(dbIndex, key, func(value any, _ bool) error {
+		l, err := listValue(value)
+		if err != nil {
+			return err
+		}
+		if l == nil {
+			l = newList()
+		}
+		fn(l)
+		return nil
+	})
+}
+
+func (k *KeyValueDB) lrangeCommand(s *Session, cmd Command) any {
+	start, err1 := strconv.Atoi(cmd.Args[1])
+	end, err2 := strconv.Atoi(cmd.Args[2])
+	if err1 != nil || err2 != nil {
+		return NewErrorResult(&CommandError{msg: "value is not an integer or out of range"})
+	}
+
+	elems := []DBResult{}
+	err := k.viewList(s.DbIndex, cmd.Args[0], func(l *list) {
+		if start, end, ok := listRange(start, end, l.Len()); ok {
+			for i := start; i <= end; i++ {
+				elems = append(elems, NewBulkResult(l.at(i)))
+			}
+		}
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: elems, Type: ArrayReply}
+}
+
+func (k *KeyValueDB) llenCommand(s *Session, cmd Command) any {
+	length := 0
+	if err := k.viewList(s.DbIndex, cmd.Args[0], func(l *list) { length = l.Len() }); err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: length, Type: IntegerReply}
+}
+
+// lindexCommand returns the element at an index of a list, negative indexes counting from its tail.
+func (k *KeyValueDB) lindexCommand(s *Session, cmd Command) any {
+	index, err := strconv.Atoi(cmd.Args[1])
+	if err != nil {
+		return NewErrorResult(&CommandError{msg: "value is not an integer or out of range"})
+	}
+
+	var elem string
+	found := false
+	err = k.viewList(s.DbIndex, cmd.Args[0], func(l *list) {
+		if index < 0 {
+			index += l.Len()
+		}
+		if index >= 0 && index < l.Len() {
+			elem, found = l.at(index), true
+		}
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	if !found {
+		return DBResult{DbIndex: s.DbIndex, Type: NilReply, Response: "(nil)"}
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: elem, Type: BulkReply}
+}
+
+// lsetCommand replaces the element at an index of a list, negative indexes counting from its tail.
+func (k *KeyValueDB) lsetCommand(s *Session, cmd Command) any {
+	index, err := strconv.Atoi(cmd.Args[1])
+	if err != nil {
+		return NewErrorResult(&CommandError{msg: "value is not an integer or out of range"})
+	}
+
+	_, err = k.storage.Update(s.DbIndex, cmd.Args[0], func(value any, _ bool) (any, error) {
+		l, err := listValue(value)
+		if err != nil {
+			return nil, err
+		}
+		if l == nil {
+			return nil, &CommandError{msg: "no such key"}
+		}
+		if index < 0 {
+			index += l.Len()
+		}
+		if index < 0 || index >= l.Len() {
+			return nil, &CommandError{msg: "index out of range"}
+		}
+		l.set(index, cmd.Args[2])
+		return l, nil
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: "", Type: StatusReply, Response: "OK"}
+}
+
+// lremCommand removes the first count occurrences of an element from a list, the last ones when count is
+// negative and all of them when it is 0.
+func (k *KeyValueDB) lremCommand(s *Session, cmd Command) any {
+	count, err := strconv.Atoi(cmd.Args[1])
+	if err != nil {
+		return NewErrorResult(&CommandError{msg: "value is not an integer or out of range"})
+	}
+
+	removed := 0
+	_, err = k.storage.Update(s.DbIndex, cmd.Args[0], func(value any, _ bool) (any, error) {
+		l, err := listValue(value)
+		if err != nil || l == nil {
+			return nil, err
+		}
+		elems := l.elements()
+		kept := make([]string, 0, len(elems))
+		if count >= 0 {
+			for _, elem := range elems {
+				if elem == cmd.Args[2] && (count == 0 || removed < count) {
+					removed++
+					continue
+				}
+				kept = append(kept, elem)
+			}
+		} else {
+			for i := len(elems) - 1; i >= 0; i-- {
+				if elems[i] == cmd.Args[2] && removed < -count {
+					removed++
+					continue
+				}
+				kept = append(kept, elems[i])
+			}
+			for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+				kept[i], kept[j] = kept[j], kept[i]
+			}
+		}
+		if len(kept) == 0 {
+			return nil, nil
+		}
+		if removed > 0 {
+			l.replace(kept)
+		}
+		return l, nil
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: removed, Type: IntegerReply}
+}
+
+// ltrimCommand trims a list to the elements between two indexes, deleting the key when none is left.
+func (k *KeyValueDB) ltrimCommand(s *Session, cmd Command) any {
+	start, err1 := strconv.Atoi(cmd.Args[1])
+	end, err2 := strconv.Atoi(cmd.Args[2])
+	if err1 != nil || err2 != nil {
+		return NewErrorResult(&CommandError{msg: "value is not an integer or out of range"})
+	}
+
+	_, err := k.storage.Update(s.DbIndex, cmd.Args[0], func(value any, _ bool) (any, error) {
+		l, err := listValue(value)
+		if err != nil || l == nil {
+			return nil, err
+		}
+		start, end, ok := listRange(start, end, l.Len())
+		if !ok {
+			return nil, nil
+		}
+		if start > 0 || end < l.Len()-1 {
+			l.replace(l.slice(start, end))
+		}
+		return l, nil
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: "", Type: StatusReply, Response: "OK"}
+}
+
+// linsertCommand inserts an element before or after the first occurrence of a pivot in a list.
+// It returns the new length of the list, -1 when the pivot is not found and 0 when the key does not exist.
+func (k *KeyValueDB) linsertCommand(s *Session, cmd Command) any {
+	where := strings.ToUpper(cmd.Args[1])
+	if where != "BEFORE" && where != "AFTER" {
+		return NewErrorResult(&CommandError{msg: "syntax error"})
+	}
+	pivot, elem := cmd.Args[2], cmd.Args[3]
+
+	length := -1
+	_, err := k.storage.Update(s.DbIndex, cmd.Args[0], func(value any, _ bool) (any, error) {
+		l, err := listValue(value)
+		if err != nil {
+			return nil, err
+		}
+		if l == nil {
+			return nil, storage.NewKeyNotFoundError(cmd.Args[0])
+		}
+		elems := l.elements()
+		for i, e := range elems {
+			if e != pivot {
+				continue
+			}
+			if where == "AFTER" {
+				i++
+			}
+			elems = append(elems[:i], append([]string{elem}, elems[i:]...)...)
+			l.replace(elems)
+			length = l.Len()
+			break
+		}
+		return l, nil
+	})
+	if err != nil {
+		if _, notFound := err.(*storage.KeyNotFoundError); notFound {
+			return notFoundResult(s.DbIndex, cmd.Args[0], NewIntegerResult(0))
+		}
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: length, Type: IntegerReply}
+}
+
+func (k *KeyValueDB) lmoveCommand(s *Session, cmd Command) any {
+	return k.lmove(s, cmd.Args[0], cmd.Args[1], cmd.Args[2], cmd.Args[3])
+}
+
+// lmove pops an element from one end of the source list and pushes it to one end of the destination list,
+// both keys being updated atomically. The source and the destination may be the same list.
+func (k *KeyValueDB) lmove(s *Session, source, destination, from, to string) DBResult {
+	fromHead, err := parseListEnd(from)
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	toHead, err := parseListEnd(to)
+	if err != nil {
+		return NewErrorResult(err)
+	}
+
+	var elem string
+	err = k.storage.UpdateValues(s.DbIndex, []string{source, destination}, func(values []any) ([]any, error) {
+		src, err := listValue(values[0])
+		if err != nil {
+			return nil, err
+		}
+		dst, err := listValue(values[1])
+		if err != nil {
+			return nil, err
+		}
+		if src == nil {
+			return nil, storage.NewKeyNotFoundError(source)
+		}
+		if dst == nil {
+			dst = newList()
+		}
+		elem = src.pop(fromHead)
+		dst.push(toHead, elem)
+		if src.Len() == 0 {
+			return []any{nil, dst}, nil
+		}
+		return []any{src, dst}, nil
+	})
+	if err != nil {
+		if _, notFound := err.(*storage.KeyNotFoundError); notFound {
+			return notFoundResult(s.DbIndex, source, NewNilResult())
+		}
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: elem, Type: BulkReply}
+}
+
+// lposOptions are the options of LPOS: the rank of the first match returned, negative to search from the tail,
+// the number of matches returned, 0 meaning all, and the maximum number of elements compared, 0 meaning all.
+type lposOptions struct {
+	rank     int
+	count    int
+	maxLen   int
+	hasCount bool
+}
+
+func parseLPosOptions(options []string) (lposOptions, error) {
+	opts := lposOptions{rank: 1}
+	for i := 0; i < len(options); i += 2 {
+		option := strings.ToUpper(options[i])
+		if i+1 >= len(options) || (option != "RANK" && option != "COUNT" && option != "MAXLEN") {
+			return opts, &CommandError{msg: "syntax error"}
+		}
+		n, err := strconv.Atoi(options[i+1])
+		if err != nil {
+			return opts, &CommandError{msg: "value is not an integer or out of range"}
+		}
+		switch {
+		case option == "RANK" && n == 0:
+			return opts, &CommandError{msg: "RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list"}
+		case option == "RANK":
+			opts.rank = n
+		case n < 0:
+			return opts, &CommandError{msg: option + " can't be negative"}
+		case option == "COUNT":
+			opts.count, opts.hasCount = n, true
+		default:
+			opts.maxLen = n
+		}
+	}
+	return opts, nil
+}
+
+func checkLPosOptions(c Command) error {
+	_, err := parseLPosOptions(c.Args[2:])
+	return err
+}
+
+// lposCommand returns the index of the matches of an element in a list. Without the COUNT option, it returns
+// the index of the first match alone or a nil reply when there is none.
+func (k *KeyValueDB) lposCommand(s *Session, cmd Command) any {
+	opts, err := parseLPosOptions(cmd.Args[2:])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+
+	var matches []DBResult
+	err = k.viewList(s.DbIndex, cmd.Args[0], func(l *list) {
+		skipped := 0
+		for n := 0; n < l.Len() && (opts.maxLen == 0 || n < opts.maxLen); n++ {
+			i := n
+			if opts.rank < 0 {
+				i = l.Len() - 1 - n
+			}
+			if l.at(i) != cmd.Args[1] {
+				continue
+			}
+			if skipped < max(opts.rank, -opts.rank)-1 {
+				skipped++
+				continue
+			}
+			matches = append(matches, NewIntegerResult(i))
+			if !opts.hasCount || len(matches) == opts.count {
+				break
+			}
+		}
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+
+	if opts.hasCount {
+		return DBResult{DbIndex: s.DbIndex, Value: append([]DBResult{}, matches...), Type: ArrayReply}
+	}
+	if len(matches) == 0 {
+		return DBResult{DbIndex: s.DbIndex, Type: NilReply, Response: "(nil)"}
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: matches[0].Value, Type: IntegerReply}
+}
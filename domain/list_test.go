@@ -0,0 +1,391 @@
+package domain
+
+import (
+	"kvdb/persistence"
+	"kvdb/storage"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestList(t *testing.T) {
+	l := newList()
+	var want []string
+	// Pushing and popping at both ends wraps around the ring buffer and resizes it both ways
+	for i := 0; i < 100; i++ {
+		elem := string(rune('a' + i%26))
+		if i%3 == 0 {
+			l.push(true, elem)
+			want = append([]string{elem}, want...)
+		} else {
+			l.push(false, elem)
+			want = append(want, elem)
+		}
+	}
+	for i := 0; i < 90; i++ {
+		head := i%2 == 0
+		wantElem := want[len(want)-1]
+		if head {
+			wantElem, want = want[0], want[1:]
+		} else {
+			want = want[:len(want)-1]
+		}
+		if got := l.pop(head); got != wantElem || l.Len() != len(want) {
+			t.Fatalf("pop(%v) = %q with %d elements left, want %q with %d", head, got, l.Len(), wantElem, len(want))
+		}
+	}
+	if got := l.elements(); !reflect.DeepEqual(got, want) {
+		t.Errorf("elements() = %q, want %q", got, want)
+	}
+	if len(l.elems) > 32 {
+		t.Errorf("Capacity after popping = %d, want the buffer to shrink", len(l.elems))
+	}
+
+	clone := l.Clone().(*list)
+	clone.set(0, "changed")
+	if l.at(0) == "changed" {
+		t.Errorf("Modifying a clone modified the list")
+	}
+}
+
+func TestKeyValueDB_Execute_ListCommands(t *testing.T) {
+	testCases := []struct {
+		name string
+		cmds []Command
+		want []any // SimpleMsg of the results
+	}{
+		{
+			name: "LPUSH and RPUSH",
+			cmds: []Command{
+				NewCommand("RPUSH", "list", "b", "c"),
+				NewCommand("LPUSH", "list", "a", "z"),
+				NewCommand("LRANGE", "list", "0", "-1"),
+				NewCommand("LLEN", "list"),
+				NewCommand("LLEN", "missing"),
+			},
+			want: []any{"(integer) 2", "(integer) 4", "1) \"z\"\n2) \"a\"\n3) \"b\"\n4) \"c\"", "(integer) 4", "(integer) 0"},
+		},
+		{
+			name: "LPOP and RPOP",
+			cmds: []Command{
+				NewCommand("RPUSH", "list", "a", "b", "c", "d"),
+				NewCommand("LPOP", "list"),
+				NewCommand("RPOP", "list", "2"),
+				NewCommand("LPOP", "list", "5"),
+				NewCommand("EXISTS", "list"),
+				NewCommand("LPOP", "list"),
+				NewCommand("RPOP", "list", "-1"),
+			},
+			want: []any{
+				"(integer) 4", `"a"`, "1) \"d\"\n2) \"c\"", `1) "b"`, "(integer) 0", "(nil)",
+				"(error) ERR value is out of range, must be positive",
+			},
+		},
+		{
+			name: "LRANGE",
+			cmds: []Command{
+				NewCommand("RPUSH", "list", "a", "b", "c"),
+				NewCommand("LRANGE", "list", "-2", "10"),
+				NewCommand("LRANGE", "list", "2", "1"),
+				NewCommand("LRANGE", "list", "5", "10"),
+				NewCommand("LRANGE", "missing", "0", "-1"),
+				NewCommand("LRANGE", "list", "a", "1"),
+			},
+			want: []any{
+				"(integer) 3", "1) \"b\"\n2) \"c\"", "(empty array)", "(empty array)", "(empty array)",
+				"(error) ERR value is not an integer or out of range",
+			},
+		},
+		{
+			name: "LINDEX and LSET",
+			cmds: []Command{
+				NewCommand("RPUSH", "list", "a", "b", "c"),
+				NewCommand("LSET", "list", "-1", "z"),
+				NewCommand("LINDEX", "list", "-1"),
+				NewCommand("LINDEX", "list", "3"),
+				NewCommand("LSET", "list", "3", "z"),
+				NewCommand("LSET", "missing", "0", "z"),
+			},
+			want: []any{
+				"(integer) 3", "OK", `"z"`, "(nil)",
+				"(error) ERR index out of range", "(error) ERR no such key",
+			},
+		},
+		{
+			name: "LREM",
+			cmds: []Command{
+				NewCommand("RPUSH", "list", "a", "b", "a", "c", "a"),
+				NewCommand("LREM", "list", "-2", "a"),
+				NewCommand("LRANGE", "list", "0", "-1"),
+				NewCommand("LREM", "list", "1", "a"),
+				NewCommand("LREM", "list", "0", "b"),
+				NewCommand("LREM", "list", "0", "c"),
+				NewCommand("EXISTS", "list"),
+			},
+			want: []any{
+				"(integer) 5", "(integer) 2", "1) \"a\"\n2) \"b\"\n3) \"c\"",
+				"(integer) 1", "(integer) 1", "(integer) 1", "(integer) 0",
+			},
+		},
+		{
+			name: "LTRIM",
+			cmds: []Command{
+				NewCommand("RPUSH", "list", "a", "b", "c", "d"),
+				NewCommand("LTRIM", "list", "1", "-2"),
+				NewCommand("LRANGE", "list", "0", "-1"),
+				NewCommand("LTRIM", "list", "5", "10"),
+				NewCommand("EXISTS", "list"),
+			},
+			want: []any{"(integer) 4", "OK", "1) \"b\"\n2) \"c\"", "OK", "(integer) 0"},
+		},
+		{
+			name: "LINSERT",
+			cmds: []Command{
+				NewCommand("RPUSH", "list", "a", "c"),
+				NewCommand("LINSERT", "list", "BEFORE", "c", "b"),
+				NewCommand("LINSERT", "list", "after", "c", "d"),
+				NewCommand("LINSERT", "list", "AFTER", "z", "d"),
+				NewCommand("LINSERT", "missing", "AFTER", "a", "b"),
+				NewCommand("LINSERT", "list", "AROUND", "a", "b"),
+				NewCommand("LRANGE", "list", "0", "-1"),
+			},
+			want: []any{
+				"(integer) 2", "(integer) 3", "(integer) 4", "(integer) -1", "(integer) 0",
+				"(error) ERR syntax error", "1) \"a\"\n2) \"b\"\n3) \"c\"\n4) \"d\"",
+			},
+		},
+		{
+			name: "LMOVE",
+			cmds: []Command{
+				NewCommand("RPUSH", "src", "a", "b"),
+				NewCommand("LMOVE", "src", "dst", "LEFT", "RIGHT"),
+				NewCommand("LMOVE", "src", "dst", "right", "left"),
+				NewCommand("LRANGE", "dst", "0", "-1"),
+				NewCommand("EXISTS", "src"),
+				NewCommand("LMOVE", "src", "dst", "LEFT", "LEFT"),
+				NewCommand("LMOVE", "dst", "dst", "LEFT", "RIGHT"),
+				NewCommand("LRANGE", "dst", "0", "-1"),
+				NewCommand("LMOVE", "dst", "dst", "UP", "RIGHT"),
+			},
+			want: []any{
+				"(integer) 2", `"a"`, `"b"`, "1) \"b\"\n2) \"a\"", "(integer) 0", "(nil)",
+				`"b"`, "1) \"a\"\n2) \"b\"", "(error) ERR syntax error",
+			},
+		},
+		{
+			name: "LPOS",
+			cmds: []Command{
+				NewCommand("RPUSH", "list", "a", "b", "c", "1", "2", "3", "c", "c"),
+				NewCommand("LPOS", "list", "c"),
+				NewCommand("LPOS", "list", "c", "RANK", "2"),
+				NewCommand("LPOS", "list", "c", "RANK", "-1"),
+				NewCommand("LPOS", "list", "c", "COUNT", "2"),
+				NewCommand("LPOS", "list", "c", "RANK", "-1", "COUNT", "0"),
+				NewCommand("LPOS", "list", "c", "COUNT", "0", "MAXLEN", "7"),
+				NewCommand("LPOS", "list", "z"),
+				NewCommand("LPOS", "list", "z", "COUNT", "1"),
+				NewCommand("LPOS", "list", "c", "RANK", "0"),
+				NewCommand("LPOS", "list", "c", "MAXLEN", "-1"),
+			},
+			want: []any{
+				"(integer) 8", "(integer) 2", "(integer) 6", "(integer) 7", "1) (integer) 2\n2) (integer) 6",
+				"1) (integer) 7\n2) (integer) 6\n3) (integer) 2", "1) (integer) 2\n2) (integer) 6",
+				"(nil)", "(empty array)",
+				"(error) ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list",
+				"(error) ERR MAXLEN can't be negative",
+			},
+		},
+		{
+			name: "Wrong type",
+			cmds: []Command{
+				NewCommand("SET", "string", "value"),
+				NewCommand("RPUSH", "list", "a"),
+				NewCommand("LPUSH", "string", "a"),
+				NewCommand("LRANGE", "string", "0", "-1"),
+				NewCommand("LMOVE", "list", "string", "LEFT", "LEFT"),
+				NewCommand("GET", "list"),
+				NewCommand("INCR", "list"),
+				NewCommand("MGET", "string", "list"),
+				NewCommand("LLEN", "list"),
+			},
+			want: []any{
+				"OK", "(integer) 1",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"1) \"value\"\n2) (nil)", "(integer) 1",
+			},
+		},
+		{
+			name: "Blocking commands without waiting",
+			cmds: []Command{
+				NewCommand("RPUSH", "list", "a", "b"),
+				NewCommand("BLPOP", "missing", "list", "0"),
+				NewCommand("BRPOP", "list", "0.5"),
+				NewCommand("BLPOP", "list", "-1"),
+				NewCommand("BLPOP", "list", "soon"),
+			},
+			want: []any{
+				"(integer) 2", "1) \"list\"\n2) \"a\"", "1) \"list\"\n2) \"b\"",
+				"(error) ERR timeout is negative", "(error) ERR timeout is not a float or out of range",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+			session := db.NewSession()
+			for i, cmd := range tc.cmds {
+				got := db.Execute(session, cmd).(DBResult).SimpleMsg()
+				if got != tc.want[i] {
+					t.Errorf("KeyValueDB.Execute(%v) = %v, want %v", cmd, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestKeyValueDB_Execute_BlockingCommands(t *testing.T) {
+	testCases := []struct {
+		name  string
+		cmd   Command   // Blocking command
+		other []Command // Executed by another client while the command blocks
+		want  any       // SimpleMsg of the result of the blocking command
+	}{
+		{
+			name:  "BLPOP woken by RPUSH",
+			cmd:   NewCommand("BLPOP", "list1", "list2", "0"),
+			other: []Command{NewCommand("SET", "key", "value"), NewCommand("RPUSH", "list2", "a", "b")},
+			want:  "1) \"list2\"\n2) \"a\"",
+		},
+		{
+			name:  "BRPOP woken by LMOVE",
+			cmd:   NewCommand("BRPOP", "list", "5"),
+			other: []Command{NewCommand("RPUSH", "src", "a", "b"), NewCommand("LMOVE", "src", "list", "RIGHT", "LEFT")},
+			want:  "1) \"list\"\n2) \"b\"",
+		},
+		{
+			name:  "BLMOVE woken by LPUSH",
+			cmd:   NewCommand("BLMOVE", "src", "dst", "RIGHT", "LEFT", "5"),
+			other: []Command{NewCommand("LPUSH", "src", "a", "b")},
+			want:  `"a"`,
+		},
+		{
+			name:  "BLPOP woken by RENAME",
+			cmd:   NewCommand("BLPOP", "list", "5"),
+			other: []Command{NewCommand("RPUSH", "src", "a"), NewCommand("RENAME", "src", "list")},
+			want:  "1) \"list\"\n2) \"a\"",
+		},
+		{
+			name: "BLPOP woken by MOVE",
+			cmd:  NewCommand("BLPOP", "list", "5"),
+			other: []Command{
+				NewCommand("SELECT", "1"), NewCommand("RPUSH", "list", "a"), NewCommand("MOVE", "list", "0"),
+			},
+			want: "1) \"list\"\n2) \"a\"",
+		},
+		{
+			name: "BLPOP woken by SWAPDB",
+			cmd:  NewCommand("BLPOP", "list", "5"),
+			other: []Command{
+				NewCommand("SELECT", "1"), NewCommand("RPUSH", "list", "a"), NewCommand("SWAPDB", "0", "1"),
+			},
+			want: "1) \"list\"\n2) \"a\"",
+		},
+		{
+			name:  "Timeout",
+			cmd:   NewCommand("BLPOP", "list", "0.05"),
+			other: []Command{NewCommand("RPUSH", "other", "a")},
+			want:  "(nil)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := NewKeyValueDB(storage.NewInMemoryStorage(2))
+			done := make(chan any, 1)
+			go func() {
+				done <- db.Execute(db.NewSession(), tc.cmd)
+			}()
+
+			time.Sleep(20 * time.Millisecond)
+			other := db.NewSession()
+			for _, cmd := range tc.other {
+				db.Execute(other, cmd)
+			}
+
+			select {
+			case got := <-done:
+				if msg := got.(DBResult).SimpleMsg(); msg != tc.want {
+					t.Errorf("KeyValueDB.Execute(%v) = %v, want %v", tc.cmd, msg, tc.want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("KeyValueDB.Execute(%v) still blocked", tc.cmd)
+			}
+		})
+	}
+
+	// Inside a transaction, blocking commands do not wait
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	session := db.NewSession()
+	db.Execute(session, NewCommand("MULTI"))
+	db.Execute(session, NewCommand("BLPOP", "list", "0"))
+	got := db.Execute(session, NewCommand("EXEC")).([]DBResult)
+	if len(got) != 1 || got[0].Kind() != NilReply {
+		t.Errorf("EXEC of BLPOP on an empty list = %v, want a nil reply", got)
+	}
+}
+
+func TestKeyValueDB_ListPersistence(t *testing.T) {
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "appendonly.aof"), filepath.Join(dir, "dump.kvdb")
+	aof, err := persistence.OpenAOF(aofPath, persistence.FsyncAlways)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	db.EnableAOF(aof)
+	db.EnableSnapshots(snapshotPath, nil)
+	session := db.NewSession()
+	for _, cmd := range []Command{
+		NewCommand("RPUSH", "list", "a", "b", "c", "d"),
+		NewCommand("BLPOP", "missing", "list", "0"),
+		NewCommand("BLMOVE", "list", "other", "RIGHT", "LEFT", "0"),
+		NewCommand("LSET", "list", "0", "multi word"),
+		NewCommand("SAVE"),
+	} {
+		if got := db.Execute(session, cmd).(DBResult); got.Err != nil {
+			t.Fatalf("KeyValueDB.Execute(%v) error = %v", cmd, got.Err)
+		}
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Unexpected error closing AOF: %v", err)
+	}
+
+	want := map[string]string{"list": "1) \"multi word\"\n2) \"c\"", "other": `1) "d"`}
+	for _, load := range []struct {
+		name string
+		fn   func(db *KeyValueDB) error
+	}{
+		{name: "AOF", fn: func(db *KeyValueDB) error { return db.LoadAOF(aofPath, false) }},
+		{name: "Snapshot", fn: func(db *KeyValueDB) error { return db.LoadSnapshot(snapshotPath) }},
+	} {
+		t.Run(load.name, func(t *testing.T) {
+			loaded := NewKeyValueDB(storage.NewInMemoryStorage(1))
+			if err := load.fn(loaded); err != nil {
+				t.Fatalf("Loading the %s error = %v", load.name, err)
+			}
+			for key, elems := range want {
+				got := loaded.Execute(loaded.NewSession(), NewCommand("LRANGE", key, "0", "-1")).(DBResult)
+				if got.SimpleMsg() != elems {
+					t.Errorf("LRANGE %s 0 -1 = %v, want %v", key, got.SimpleMsg(), elems)
+				}
+			}
+		})
+	}
+}
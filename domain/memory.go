@@ -0,0 +1,151 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"kvdb/storage"
+	"strings"
+	"time"
+)
+
+// Number of elements of a list, hash, set or sorted set sampled to estimate the memory it holds
+const memorySampleSize = 5
+
+// OOMError is returned by the commands that may use more memory once the keys hold more than the limit
+type OOMError struct{}
+
+func (o *OOMError) Error() string {
+	return "(error) OOM command not allowed when used memory > 'maxmemory'."
+}
+
+// estimateMemory extrapolates the memory held by n elements, each holding overhead bytes besides its length,
+// from the length of the first elements sample yields. sample stops once yield returns false.
+func estimateMemory(n, overhead int, sample func(yield func(length int) bool)) int {
+	sampled, total := 0, 0
+	sample(func(length int) bool {
+		sampled++
+		total += length
+		return sampled < memorySampleSize
+	})
+	if sampled == 0 {
+		return 0
+	}
+	return n*overhead + total*n/sampled
+}
+
+// MemoryUsage estimates the memory held by the list, for the storage to account for it.
+func (l *list) MemoryUsage() int {
+	return len(l.elems)*16 + estimateMemory(l.size, 0, func(yield func(int) bool) {
+		for i := 0; i < l.size; i++ {
+			if !yield(len(l.at(i))) {
+				return
+			}
+		}
+	})
+}
+
+// MemoryUsage estimates the memory held by the hash, for the storage to account for it.
+func (h hash) MemoryUsage() int {
+	return estimateMemory(len(h), 48, func(yield func(int) bool) {
+		for field, value := range h {
+			if !yield(len(field) + len(value)) {
+				return
+			}
+		}
+	})
+}
+
+// MemoryUsage estimates the memory held by the set, for the storage to account for it.
+func (st set) MemoryUsage() int {
+	return estimateMemory(len(st), 32, func(yield func(int) bool) {
+		for member := range st {
+			if !yield(len(member)) {
+				return
+			}
+		}
+	})
+}
+
+// MemoryUsage estimates the memory held by the sorted set, for the storage to account for it. Every member is
+// held by the map of scores and a node of the skiplist.
+func (z *zset) MemoryUsage() int {
+	return estimateMemory(z.Len(), 112, func(yield func(int) bool) {
+		for member := range z.scores {
+			if !yield(len(member)) {
+				return
+			}
+		}
+	})
+}
+
+// needsMemory reports whether a command may use more memory: a CmdDenyOOM command, or EXEC when the transaction
+// queued one.
+func (c Command) needsMemory(s *Session) bool {
+	if c.flags()&CmdDenyOOM != 0 {
+		return true
+	}
+	if c.Keyword == EXEC && s.Has(FlagMulti) {
+		for _, queued := range s.cmdQueue {
+			if queued.flags()&CmdDenyOOM != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// freeMemory evicts keys as the policy of the storage says when the keys hold more memory than the limit, before
+// a command that may use more memory runs. It returns an OOMError when the keys still hold more than the limit.
+//
+// Evicted keys are handled like deleted ones: their watchers are flagged and they are propagated as DEL to the
+// append-only file and the replicas, so that replaying it or replicating does not depend on the memory limit.
+func (k *KeyValueDB) freeMemory() error {
+	evictor, ok := k.storage.(storage.Evictor)
+	if !ok {
+		return nil
+	}
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	defer k.lockWrites()()
+
+	err := evictor.Evict(func(dbIndex int, key string) {
+		k.touchKeys(dbIndex, key)
+		k.snapshots.markDirty()
+		k.propagate(dbIndex, NewCommand(DEL, key), nil)
+	})
+	if errors.Is(err, storage.ErrOutOfMemory) {
+		return &OOMError{}
+	}
+	return err
+}
+
+// objectCommand handles OBJECT FREQ and OBJECT IDLETIME, which return the access frequency of a key and the number
+// of seconds since it was last accessed, without accessing it. Like Redis, only the frequency is reported under an
+// LFU policy and only the idle time under the other ones.
+func (k *KeyValueDB) objectCommand(s *Session, cmd Command) any {
+	subcommand := strings.ToUpper(cmd.Args[0])
+	if subcommand != "FREQ" && subcommand != "IDLETIME" {
+		return NewErrorResult(&CommandError{msg: fmt.Sprintf("unknown subcommand '%s'", cmd.Args[0])})
+	}
+	evictor, ok := k.storage.(storage.Evictor)
+	if !ok {
+		return NewErrorResult(&CommandError{msg: "the storage does not track the accesses to the keys"})
+	}
+	info, err := evictor.AccessInfo(s.DbIndex, cmd.Args[1])
+	if err != nil {
+		return NewNilResult()
+	}
+	lfu := evictor.EvictionPolicy().LFU()
+	if subcommand == "FREQ" {
+		if !lfu {
+			return NewErrorResult(&CommandError{msg: "An LFU maxmemory policy is not selected, access frequency not tracked. " +
+				"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."})
+		}
+		return NewIntegerResult(info.Frequency)
+	}
+	if lfu {
+		return NewErrorResult(&CommandError{msg: "An LFU maxmemory policy is selected, idle time not tracked. " +
+			"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."})
+	}
+	return NewIntegerResult(int(time.Since(info.LastAccess) / time.Second))
+}
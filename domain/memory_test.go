@@ -0,0 +1,145 @@
+package domain
+
+import (
+	"fmt"
+	"kvdb/persistence"
+	"kvdb/storage"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyValueDB_Execute_NoEviction(t *testing.T) {
+	s := storage.NewInMemoryStorage(1)
+	defer s.Close()
+	s.(storage.Evictor).SetMaxMemory(1, storage.NoEviction)
+	db := NewKeyValueDB(s)
+	session := db.NewSession()
+
+	oom := (&OOMError{}).Error()
+	cmds := []Command{
+		NewCommand("SET", "a", "1"),
+		NewCommand("SET", "b", "2"),
+		NewCommand("RPUSH", "list", "a"),
+		NewCommand("GET", "a"),
+		NewCommand("MULTI"),
+		NewCommand("GET", "a"),
+		NewCommand("INCR", "a"),
+		NewCommand("EXEC"),
+		NewCommand("DEL", "a"),
+		NewCommand("SET", "b", "2"),
+	}
+	want := []string{
+		"OK", oom, oom, `"1"`, "OK", "QUEUED", oom,
+		"(error) EXECABORT Transaction discarded because of previous errors.",
+		"(integer) 1", "OK",
+	}
+	for i, cmd := range cmds {
+		if got := db.Execute(session, cmd).(DBResult).SimpleMsg(); got != want[i] {
+			t.Errorf("KeyValueDB.Execute(%v) = %v, want %v", cmd, got, want[i])
+		}
+	}
+}
+
+func TestKeyValueDB_Execute_Eviction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	aof, err := persistence.OpenAOF(path, persistence.FsyncAlways)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+
+	s := storage.NewInMemoryStorage(1)
+	defer s.Close()
+	s.(storage.Evictor).SetMaxMemory(1000, storage.AllKeysLRU)
+	db := NewKeyValueDB(s)
+	db.EnableAOF(aof)
+	session, watcher := db.NewSession(), db.NewSession()
+
+	value := strings.Repeat("x", 100)
+	db.Execute(session, NewCommand("SET", "key_0", value))
+	db.Execute(watcher, NewCommand("WATCH", "key_0"))
+	for i := 1; i < 20; i++ {
+		if got := db.Execute(session, NewCommand("SET", fmt.Sprintf("key_%d", i), value)).(DBResult); got.Err != nil {
+			t.Fatalf("SET with allkeys-lru error = %v", got.Err)
+		}
+	}
+	// Keys are evicted before a write, which may then exceed the limit by the memory of the key it writes
+	if got := s.(storage.Evictor).UsedMemory(); got > 1000+2*int64(len(value)) {
+		t.Errorf("used memory after writes with allkeys-lru = %d, want about 1000", got)
+	}
+	if got := db.Execute(session, NewCommand("EXISTS", "key_0")).(DBResult).SimpleMsg(); got != "(integer) 0" {
+		t.Fatalf("EXISTS of the least recently used key = %v, want it evicted", got)
+	}
+
+	// The eviction of a watched key aborts the transaction
+	db.Execute(watcher, NewCommand("MULTI"))
+	db.Execute(watcher, NewCommand("SET", "key_0", "value"))
+	if got, ok := db.Execute(watcher, NewCommand("EXEC")).(DBResult); !ok || got.Kind() != NilReply {
+		t.Errorf("EXEC after the eviction of a watched key = %v, want a nil reply", got)
+	}
+
+	// Evicted keys are logged as deleted, replaying the file without a limit yields the same keys
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Unexpected error closing AOF: %v", err)
+	}
+	loaded := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	if err := loaded.LoadAOF(path, false); err != nil {
+		t.Fatalf("KeyValueDB.LoadAOF() error = %v", err)
+	}
+	keys := NewCommand("KEYS", "*")
+	want := db.Execute(session, keys).(DBResult).SimpleMsg()
+	if got := loaded.Execute(loaded.NewSession(), keys).(DBResult).SimpleMsg(); got != want {
+		t.Errorf("KEYS * after replaying the AOF = %v, want %v", got, want)
+	}
+}
+
+func TestKeyValueDB_Execute_ObjectCommand(t *testing.T) {
+	s := storage.NewInMemoryStorage(1)
+	db := NewKeyValueDB(s)
+	session := db.NewSession()
+	noFreq := "(error) ERR An LFU maxmemory policy is not selected, access frequency not tracked. " +
+		"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."
+	noIdleTime := "(error) ERR An LFU maxmemory policy is selected, idle time not tracked. " +
+		"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."
+
+	testCases := []struct {
+		policy storage.EvictionPolicy
+		cmds   []Command
+		want   []string
+	}{
+		{
+			policy: storage.AllKeysLFU,
+			cmds: []Command{
+				NewCommand("SET", "key", "value"),
+				NewCommand("OBJECT", "FREQ", "key"),
+				NewCommand("GET", "key"),
+				NewCommand("OBJECT", "freq", "key"),
+				NewCommand("OBJECT", "IDLETIME", "key"),
+				NewCommand("OBJECT", "FREQ", "key"),
+				NewCommand("OBJECT", "IDLETIME", "missing"),
+				NewCommand("OBJECT", "ENCODING", "key"),
+			},
+			want: []string{
+				"OK", "(integer) 5", `"value"`, "(integer) 6", noIdleTime, "(integer) 6", "(nil)",
+				"(error) ERR unknown subcommand 'ENCODING'",
+			},
+		},
+		{
+			policy: storage.NoEviction,
+			cmds: []Command{
+				NewCommand("OBJECT", "IDLETIME", "key"),
+				NewCommand("OBJECT", "FREQ", "key"),
+				NewCommand("OBJECT", "FREQ", "missing"),
+			},
+			want: []string{"(integer) 0", noFreq, "(nil)"},
+		},
+	}
+	for _, tc := range testCases {
+		s.(storage.Evictor).SetMaxMemory(0, tc.policy)
+		for i, cmd := range tc.cmds {
+			if got := db.Execute(session, cmd).(DBResult).SimpleMsg(); got != tc.want[i] {
+				t.Errorf("KeyValueDB.Execute(%v) under %v = %v, want %v", cmd, tc.policy, got, tc.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"kvdb/persistence"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// EnableAOF makes the database log every successful write command to the given append-only file.
+func (k *KeyValueDB) EnableAOF(aof *persistence.AOF) {
+	k.aof = aof
+}
+
+// LoadAOF replays the commands of the append-only file at the given path into the database.
+//
+// It has to be called before EnableAOF, otherwise the replayed commands would be logged again.
+// When repair is true a truncated or corrupted tail is cut off the file instead of failing the load. A transaction
+// missing its EXEC at the end of the file is never replayed, so the session is left out of any MULTI block.
+func (k *KeyValueDB) LoadAOF(path string, repair bool) error {
+	if k.aof != nil {
+		return errors.New("cannot load the append-only file while it is enabled")
+	}
+
+	// The logged SELECT commands switch the database of the replaying session
+	session := &Session{}
+	return persistence.LoadAOF(path, repair, func(args []string) error {
+		if len(args) == 0 {
+			return nil
+		}
+		result, ok := k.Execute(session, newCommandFromArgs(args)).(DBResult)
+		if ok && result.Kind() == ErrorReply {
+			return result.Err
+		}
+		return nil
+	})
+}
+
+// propagate logs a write command that executed successfully to the append-only file, if enabled, and streams it
+// to the replicas. It must be called right after the command executed, while still holding the writes lock or the
+// lock of the database exclusively, so that the file and the replicas get the commands in the order they were applied.
+func (k *KeyValueDB) propagate(dbIndex int, cmd Command, result any) any {
+	k.repl.feed(dbIndex, cmd.Argv())
+	if k.aof == nil {
+		return result
+	}
+
+	if err := k.aof.Append(dbIndex, cmd.Argv()); err != nil {
+		log.Printf("Error appending %v to the append-only file: %v\n", cmd, err)
+		return NewErrorResult(&CommandError{msg: fmt.Sprintf("failed to persist the command: %v", err)})
+	}
+	return result
+}
+
+// rewriteAOF starts rewriting the append-only file in the background from a snapshot of all databases.
+//
+// The snapshot is made of the COMPACT commands of every non-empty database, each group preceded by
+// a SELECT command. It must be called while holding the lock of the database exclusively, so that the
+// snapshot is consistent with the commands buffered by the AOF during the rewrite.
+func (k *KeyValueDB) rewriteAOF() DBResult {
+	if k.aof == nil {
+		return NewErrorResult(&CommandError{msg: "Append only file is disabled"})
+	}
+
+	var snapshot [][]string
+	for dbIndex := 0; dbIndex < k.storage.DbCount(); dbIndex++ {
+		cmds, err := k.compactCommands(dbIndex)
+		if err != nil {
+			return NewErrorResult(&CommandError{msg: err.Error()})
+		}
+		if len(cmds) == 0 {
+			continue
+		}
+		snapshot = append(snapshot, []string{SELECT, strconv.Itoa(dbIndex)})
+		for _, cmd := range cmds {
+			snapshot = append(snapshot, cmd.Argv())
+		}
+	}
+
+	if err := k.aof.Rewrite(snapshot); err != nil {
+		return NewErrorResult(err)
+	}
+	return NewStatusResult("Background append only file rewriting started")
+}
+
+func (k *KeyValueDB) bgrewriteaofCommand(_ *Session, _ Command) any {
+	return k.rewriteAOF()
+}
+
+// Maximum number of elements, fields or members added by a single command returned by compactCommands
+const compactBatchSize = 64
+
+// compactCommands returns the minimal list of commands recreating the given database.
+//
+// Strings are set by SET commands, with their expiration time set by the PXAT option. Lists, hashes, sets and sorted
+// sets are built by RPUSH, HSET, SADD and ZADD commands adding up to compactBatchSize elements, fields or members
+// each, followed by PEXPIREAT if they expire.
+// Expired keys are left out.
+func (k *KeyValueDB) compactCommands(dbIndex int) ([]Command, error) {
+	entries, err := k.allEntries(dbIndex)
+	if err != nil {
+		return nil, err
+	}
+	var cmds []Command
+	for _, e := range entries {
+		switch v := e.Value.(type) {
+		case *list:
+			elems := v.elements()
+			for start := 0; start < len(elems); start += compactBatchSize {
+				args := []string{e.Key}
+				args = append(args, elems[start:min(start+compactBatchSize, len(elems))]...)
+				cmds = append(cmds, Command{Keyword: RPUSH, Args: args})
+			}
+		case hash:
+			fields := v.fields()
+			for start := 0; start < len(fields); start += compactBatchSize {
+				args := []string{e.Key}
+				for _, field := range fields[start:min(start+compactBatchSize, len(fields))] {
+					args = append(args, field, v[field])
+				}
+				cmds = append(cmds, Command{Keyword: HSET, Args: args})
+			}
+		case set:
+			members := v.members()
+			for start := 0; start < len(members); start += compactBatchSize {
+				args := []string{e.Key}
+				args = append(args, members[start:min(start+compactBatchSize, len(members))]...)
+				cmds = append(cmds, Command{Keyword: SADD, Args: args})
+			}
+		case *zset:
+			nodes := v.byRank(0, v.Len()-1, false)
+			for start := 0; start < len(nodes); start += compactBatchSize {
+				args := []string{e.Key}
+				for _, x := range nodes[start:min(start+compactBatchSize, len(nodes))] {
+					args = append(args, FormatFloat(x.score), x.member)
+				}
+				cmds = append(cmds, Command{Keyword: ZADD, Args: args})
+			}
+		default:
+			if e.ExpireAt.IsZero() {
+				cmds = append(cmds, NewCommand(SET, e.Key, e.Value))
+			} else {
+				cmds = append(cmds, NewCommand(SET, e.Key, e.Value, optPXAT, e.ExpireAt.UnixMilli()))
+			}
+			continue
+		}
+		if !e.ExpireAt.IsZero() {
+			cmds = append(cmds, NewCommand(PEXPIREAT, e.Key, e.ExpireAt.UnixMilli()))
+		}
+	}
+	return cmds, nil
+}
+
+func newCommandFromArgs(args []string) Command {
+	return Command{Keyword: strings.ToUpper(args[0]), Args: args[1:]}
+}
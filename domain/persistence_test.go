@@ -0,0 +1,321 @@
+package domain
+
+import (
+	"kvdb/persistence"
+	"kvdb/storage"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyValueDB_LoadAOF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	aof, err := persistence.OpenAOF(path, persistence.FsyncAlways)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+
+	db := NewKeyValueDB(storage.NewInMemoryStorage(5))
+	db.EnableAOF(aof)
+	cmds := []struct {
+		dbIndex int
+		cmd     Command
+	}{
+		{0, NewCommand("SET", "key", "10")},
+		{0, NewCommand("INCRBY", "key", "5")},
+		{0, NewCommand("GET", "key")},
+		{0, NewCommand("DEL", "missing")},
+		{2, NewCommand("SET", "other", "value")},
+		{2, NewCommand("SET", "deleted", "value")},
+		{2, NewCommand("DEL", "deleted")},
+		{0, NewCommand("SET", "expiring", "value", "EX", "100")},
+		{0, NewCommand("SET", "expired", "value")},
+		{0, NewCommand("PEXPIREAT", "expired", "1")},
+		{1, NewCommand("MSET", "first", "1", "second", "2")},
+		{1, NewCommand("DEL", "first", "missing")},
+		{1, NewCommand("INCRBYFLOAT", "float", "0.1")},
+		{1, NewCommand("INCRBYFLOAT", "float", "0.2")},
+		{1, NewCommand("DECRBY", "second", "5")},
+	}
+	for _, c := range cmds {
+		db.Execute(newSession(c.dbIndex), c.cmd)
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Unexpected error closing AOF: %v", err)
+	}
+
+	loadedDB := NewKeyValueDB(storage.NewInMemoryStorage(5))
+	if err := loadedDB.LoadAOF(path, false); err != nil {
+		t.Fatalf("KeyValueDB.LoadAOF() error = %v", err)
+	}
+
+	want := []struct {
+		dbIndex int
+		key     string
+		value   any
+	}{
+		{0, "key", "15"},
+		{2, "other", "value"},
+		{2, "deleted", "(nil)"},
+		{0, "other", "(nil)"},
+		{0, "expiring", "value"},
+		{0, "expired", "(nil)"},
+		{1, "first", "(nil)"},
+		{1, "second", "-3"},
+		{1, "float", "0.3"},
+	}
+	for _, w := range want {
+		got := loadedDB.Execute(newSession(w.dbIndex), NewCommand("GET", w.key)).(DBResult)
+		value := got.Value
+		if got.Kind() == NilReply {
+			value = got.Response
+		}
+		if value != w.value {
+			t.Errorf("GET %s in db %d after LoadAOF() = %v, want %v", w.key, w.dbIndex, value, w.value)
+		}
+	}
+	if got := loadedDB.Execute(newSession(0), NewCommand("TTL", "expiring")).(DBResult); got.Value != 100 {
+		t.Errorf("TTL expiring after LoadAOF() = %v, want 100", got.Value)
+	}
+}
+
+func TestKeyValueDB_LoadAOF_ConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	aof, err := persistence.OpenAOF(path, persistence.FsyncNo)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+
+	// The clients have to run in parallel for their writes to interleave
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	db.EnableAOF(aof)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			session := db.NewSession()
+			for j := 0; j < 200; j++ {
+				db.Execute(session, NewCommand("RPUSH", "list", strconv.Itoa(client*1000+j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Unexpected error closing AOF: %v", err)
+	}
+
+	// Replaying the file rebuilds the list in the order the elements were pushed
+	loadedDB := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	if err := loadedDB.LoadAOF(path, false); err != nil {
+		t.Fatalf("KeyValueDB.LoadAOF() error = %v", err)
+	}
+	lrange := NewCommand("LRANGE", "list", "0", "-1")
+	want := db.Execute(newSession(0), lrange).(DBResult).SimpleMsg()
+	if got := loadedDB.Execute(newSession(0), lrange).(DBResult).SimpleMsg(); got != want {
+		t.Errorf("LRANGE list after LoadAOF() differs from the list written concurrently")
+	}
+}
+
+func TestKeyValueDB_LoadAOF_ConcurrentTransactions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	aof, err := persistence.OpenAOF(path, persistence.FsyncNo)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+
+	// The clients have to run in parallel for their writes to interleave
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	db.EnableAOF(aof)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			session := db.NewSession()
+			for j := 0; j < 100; j++ {
+				elem := strconv.Itoa(client*1000 + j)
+				if client%2 == 0 {
+					db.Execute(session, NewCommand("RPUSH", "first", elem))
+					db.Execute(session, NewCommand("LPUSH", "second", elem))
+					continue
+				}
+				db.Execute(session, NewCommand("MULTI"))
+				db.Execute(session, NewCommand("RPUSH", "first", elem))
+				db.Execute(session, NewCommand("LPUSH", "second", elem))
+				db.Execute(session, NewCommand("EXEC"))
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Unexpected error closing AOF: %v", err)
+	}
+
+	loadedDB := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	if err := loadedDB.LoadAOF(path, false); err != nil {
+		t.Fatalf("KeyValueDB.LoadAOF() error = %v", err)
+	}
+	for _, key := range []string{"first", "second"} {
+		lrange := NewCommand("LRANGE", key, "0", "-1")
+		want := db.Execute(newSession(0), lrange).(DBResult).SimpleMsg()
+		if got := loadedDB.Execute(newSession(0), lrange).(DBResult).SimpleMsg(); got != want {
+			t.Errorf("LRANGE %s after LoadAOF() differs from the list written concurrently", key)
+		}
+	}
+}
+
+func TestKeyValueDB_Execute_BgRewriteAOFCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	aof, err := persistence.OpenAOF(path, persistence.FsyncNo)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+
+	db := NewKeyValueDB(storage.NewInMemoryStorage(5))
+	got := db.Execute(newSession(0), NewCommand("BGREWRITEAOF")).(DBResult)
+	if got.Kind() != ErrorReply {
+		t.Errorf("BGREWRITEAOF without AOF = %v, want an error", got)
+	}
+
+	db.EnableAOF(aof)
+	for i := 0; i < 10; i++ {
+		db.Execute(newSession(0), NewCommand("INCRBY", "counter", "1"))
+	}
+	db.Execute(newSession(0), NewCommand("SET", "counter", "0"))
+	db.Execute(newSession(4), NewCommand("SET", "key", "value"))
+
+	got = db.Execute(newSession(0), NewCommand("BGREWRITEAOF")).(DBResult)
+	if got.Err != nil {
+		t.Fatalf("BGREWRITEAOF error = %v", got.Err)
+	}
+	db.Execute(newSession(4), NewCommand("INCR", "counter"))
+	for aof.RewriteInProgress() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Unexpected error closing AOF: %v", err)
+	}
+
+	var logged int
+	err = persistence.LoadAOF(path, false, func(args []string) error {
+		logged++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error loading AOF: %v", err)
+	}
+	// SELECT 0, SET counter, SELECT 4, SET key and the INCR with its SELECT if it was buffered
+	if logged > 6 {
+		t.Errorf("Rewritten AOF holds %d commands, want at most 6", logged)
+	}
+
+	loadedDB := NewKeyValueDB(storage.NewInMemoryStorage(5))
+	if err := loadedDB.LoadAOF(path, false); err != nil {
+		t.Fatalf("KeyValueDB.LoadAOF() error = %v", err)
+	}
+	for _, c := range []struct {
+		dbIndex int
+		key     string
+		want    any
+	}{
+		{0, "counter", "0"},
+		{4, "key", "value"},
+	} {
+		res := loadedDB.Execute(newSession(c.dbIndex), NewCommand("GET", c.key)).(DBResult)
+		if res.Value != c.want {
+			t.Errorf("GET %s in db %d after rewrite = %v, want %v", c.key, c.dbIndex, res.Value, c.want)
+		}
+	}
+}
+
+func TestKeyValueDB_LoadAOF_Transaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	aof, err := persistence.OpenAOF(path, persistence.FsyncAlways)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+
+	db := NewKeyValueDB(storage.NewInMemoryStorage(5))
+	db.EnableAOF(aof)
+	session := db.NewSession()
+	for _, cmd := range []Command{
+		NewCommand("SET", "first", "1"),
+		NewCommand("MULTI"),
+		NewCommand("SET", "second", "2"),
+		NewCommand("SET", "third", "3"),
+		NewCommand("EXEC"),
+	} {
+		db.Execute(session, cmd)
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Unexpected error closing AOF: %v", err)
+	}
+
+	var logged [][]string
+	err = persistence.LoadAOF(path, false, func(args []string) error {
+		logged = append(logged, args)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error loading AOF: %v", err)
+	}
+	want := [][]string{
+		{"SELECT", "0"},
+		{"SET", "first", "1"},
+		{"MULTI"},
+		{"SET", "second", "2"},
+		{"SET", "third", "3"},
+		{"EXEC"},
+	}
+	if !reflect.DeepEqual(logged, want) {
+		t.Fatalf("Logged commands = %q, want %q", logged, want)
+	}
+
+	// A transaction missing its EXEC, e.g. after a crash, is not replayed
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error reading AOF: %v", err)
+	}
+	truncated := content[:len(content)-len(persistence.AppendCommand(nil, []string{"EXEC"}))]
+	if err := os.WriteFile(path, truncated, 0644); err != nil {
+		t.Fatalf("Unexpected error writing AOF: %v", err)
+	}
+
+	loadedDB := NewKeyValueDB(storage.NewInMemoryStorage(5))
+	if err := loadedDB.LoadAOF(path, false); err != nil {
+		t.Fatalf("KeyValueDB.LoadAOF() error = %v", err)
+	}
+
+	// The open MULTI block is cut off the file, so the commands appended next are not queued in it when replayed
+	aof, err = persistence.OpenAOF(path, persistence.FsyncAlways)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+	loadedDB.EnableAOF(aof)
+	loadedDB.Execute(newSession(0), NewCommand("SET", "fourth", "4"))
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Unexpected error closing AOF: %v", err)
+	}
+
+	reloadedDB := NewKeyValueDB(storage.NewInMemoryStorage(5))
+	if err := reloadedDB.LoadAOF(path, false); err != nil {
+		t.Fatalf("KeyValueDB.LoadAOF() error = %v", err)
+	}
+	for key, want := range map[string]any{"first": "1", "second": nil, "third": nil, "fourth": "4"} {
+		res := reloadedDB.Execute(newSession(0), NewCommand("GET", key)).(DBResult)
+		if res.Kind() == NilReply {
+			res.Value = nil
+		}
+		if res.Value != want {
+			t.Errorf("GET %s after LoadAOF() = %v, want %v", key, res.Value, want)
+		}
+	}
+}
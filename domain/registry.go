@@ -0,0 +1,648 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CommandFlag describes how a command behaves.
+type CommandFlag uint
+
+const (
+	// CmdReadOnly commands only read the data
+	CmdReadOnly CommandFlag = 1 << iota
+	// CmdWrite commands may modify the data, they are persisted when they succeed
+	CmdWrite
+	// CmdAdmin commands manage the server rather than the data
+	CmdAdmin
+	// CmdExclusive commands run with exclusive access to the database, no other command runs concurrently
+	CmdExclusive
+	// CmdNoQueue commands are executed right away instead of being queued in a MULTI block
+	CmdNoQueue
+	// CmdBlocking commands block the client until one of their keys holds data, unless run in a MULTI block
+	CmdBlocking
+	// CmdMovableKeys commands have keys at positions depending on their arguments, found by their Keys function
+	CmdMovableKeys
+	// CmdDenyOOM commands may use more memory, they fail once the keys hold more memory than the limit and no key
+	// can be evicted
+	CmdDenyOOM
+)
+
+// flagNames are the names COMMAND INFO reports for every flag, in the order of the flags
+var flagNames = []string{"readonly", "write", "admin", "exclusive", "noqueue", "blocking", "movablekeys", "denyoom"}
+
+// names returns the names of the flags that are set.
+func (f CommandFlag) names() []string {
+	var names []string
+	for i, name := range flagNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// CommandHandler executes a validated command on behalf of the client owning the session.
+//
+// It runs while holding the lock of the database, exclusively for CmdExclusive commands, and returns
+// either a DBResult or a []DBResult. Write commands are persisted when the DBResult returned has no error.
+type CommandHandler func(k *KeyValueDB, s *Session, cmd Command) any
+
+// CommandSpec describes a command and how to execute it, the way Redis does in its command table.
+//
+// The arity counts the keyword: a positive arity is the exact number of arguments of the command,
+// a negative one is the minimum number of arguments. Key positions also count the keyword, e.g. the key of
+// GET key is at position 1, and a negative last key position counts from the end of the arguments.
+// A first key position of 0 means the command has no key, unless it is flagged CmdMovableKeys: the keys of
+// commands such as SINTERCARD numkeys key [key ...] depend on their arguments and are found by their Keys function.
+type CommandSpec struct {
+	Name     string // Keyword of the command
+	Arity    int
+	Flags    CommandFlag
+	FirstKey int
+	LastKey  int
+	KeyStep  int
+	Group    string                     // Family of the command reported by COMMAND DOCS, e.g. "string" or "transactions"
+	Summary  string                     // One line description of the command reported by COMMAND DOCS
+	Syntax   string                     // Arguments following the keyword reported by COMMAND DOCS, e.g. "key value"
+	Check    func(cmd Command) error    // Checks the arguments of the command beyond their number, if set
+	Keys     func(cmd Command) []string // Returns the keys of CmdMovableKeys commands, instead of the key positions
+	Handler  CommandHandler
+}
+
+// registry holds the specification of every command the databases execute, by upper-cased name.
+var registry = map[string]*CommandSpec{}
+
+// RegisterCommand adds a command to the ones every KeyValueDB executes, so that applications embedding the
+// database can extend it with their own commands.
+//
+// Commands must be registered at startup, before any command is executed or loaded from the persistence files:
+// the registry is not safe for concurrent use. An error is returned when the specification has no name, arity
+// or handler, or when a command with the same name is already registered.
+func RegisterCommand(spec CommandSpec) error {
+	spec.Name = strings.ToUpper(spec.Name)
+	switch {
+	case spec.Name == "" || strings.ContainsAny(spec.Name, " \t\r\n"):
+		return errors.New("command name must be a single word")
+	case spec.Arity == 0:
+		return fmt.Errorf("command %s has no arity", spec.Name)
+	case spec.Handler == nil:
+		return fmt.Errorf("command %s has no handler", spec.Name)
+	case spec.FirstKey > 0 && spec.KeyStep <= 0:
+		return fmt.Errorf("command %s has keys but no key step", spec.Name)
+	case (spec.Flags&CmdMovableKeys != 0) != (spec.Keys != nil):
+		return fmt.Errorf("command %s must have both movable keys and a keys function, or neither", spec.Name)
+	}
+	if _, ok := registry[spec.Name]; ok {
+		return fmt.Errorf("command %s is already registered", spec.Name)
+	}
+	registry[spec.Name] = &spec
+	return nil
+}
+
+func mustRegisterCommands(specs ...CommandSpec) {
+	for _, spec := range specs {
+		if err := RegisterCommand(spec); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func lookupCommand(name string) (*CommandSpec, bool) {
+	spec, ok := registry[name]
+	return spec, ok
+}
+
+func init() {
+	mustRegisterCommands(
+		CommandSpec{Name: SET, Arity: -3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkSetOptions,
+			Group: "string", Summary: "Sets the string value of a key, ignoring its type.", Handler: (*KeyValueDB).setCommand,
+			Syntax: "key value [NX | XX] [GET] [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]"},
+		CommandSpec{Name: GET, Arity: 2, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Returns the string value of a key.", Syntax: "key",
+			Handler: (*KeyValueDB).getCommand},
+		CommandSpec{Name: SETNX, Arity: 3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Sets the string value of a key only when the key doesn't exist.", Syntax: "key value",
+			Handler: (*KeyValueDB).setnxCommand},
+		CommandSpec{Name: SETEX, Arity: 4, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkSetExTime,
+			Group: "string", Summary: "Sets the string value and expiration time of a key.", Syntax: "key seconds value",
+			Handler: (*KeyValueDB).setexCommand},
+		CommandSpec{Name: GETSET, Arity: 3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Returns the previous string value of a key after setting it to a new value.",
+			Syntax: "key value", Handler: (*KeyValueDB).getsetCommand},
+		CommandSpec{Name: GETDEL, Arity: 2, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Returns the string value of a key after deleting the key.", Syntax: "key",
+			Handler: (*KeyValueDB).getexCommand},
+		CommandSpec{Name: GETEX, Arity: -2, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkGetExOptions,
+			Group: "string", Summary: "Returns the string value of a key after setting its expiration time.", Handler: (*KeyValueDB).getexCommand,
+			Syntax: "key [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST]"},
+		CommandSpec{Name: APPEND, Arity: 3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Appends a string to the value of a key. Creates the key if it doesn't exist.",
+			Syntax: "key value", Handler: (*KeyValueDB).appendCommand},
+		CommandSpec{Name: STRLEN, Arity: 2, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Returns the length of a string value.", Syntax: "key",
+			Handler: (*KeyValueDB).strlenCommand},
+		CommandSpec{Name: GETRANGE, Arity: 4, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Returns a substring of the string stored at a key.", Syntax: "key start end",
+			Handler: (*KeyValueDB).getrangeCommand},
+		CommandSpec{Name: SETRANGE, Arity: 4, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Overwrites a part of a string value with another by an offset. Creates the key if it doesn't exist.",
+			Syntax: "key offset value", Handler: (*KeyValueDB).setrangeCommand},
+		CommandSpec{Name: MSET, Arity: -3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: -1, KeyStep: 2, Check: checkKeyValuePairs,
+			Group: "string", Summary: "Atomically sets the string values of one or more keys.", Syntax: "key value [key value ...]",
+			Handler: (*KeyValueDB).msetCommand},
+		CommandSpec{Name: MSETNX, Arity: -3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: -1, KeyStep: 2, Check: checkKeyValuePairs,
+			Group: "string", Summary: "Atomically sets the string values of one or more keys only when none of them exist.",
+			Syntax: "key value [key value ...]", Handler: (*KeyValueDB).msetCommand},
+		CommandSpec{Name: MGET, Arity: -2, Flags: CmdReadOnly, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "string", Summary: "Atomically returns the string values of one or more keys.", Syntax: "key [key ...]",
+			Handler: (*KeyValueDB).mgetCommand},
+		CommandSpec{Name: DEL, Arity: -2, Flags: CmdWrite, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "generic", Summary: "Deletes one or more keys.", Syntax: "key [key ...]",
+			Handler: (*KeyValueDB).delCommand},
+		CommandSpec{Name: UNLINK, Arity: -2, Flags: CmdWrite, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "generic", Summary: "Deletes one or more keys.", Syntax: "key [key ...]",
+			Handler: (*KeyValueDB).delCommand},
+		CommandSpec{Name: EXISTS, Arity: -2, Flags: CmdReadOnly, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "generic", Summary: "Determines whether one or more keys exist.", Syntax: "key [key ...]",
+			Handler: (*KeyValueDB).existsCommand},
+		CommandSpec{Name: TOUCH, Arity: -2, Flags: CmdReadOnly, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "generic", Summary: "Returns the number of existing keys out of those specified after updating the time they were last accessed.",
+			Syntax: "key [key ...]", Handler: (*KeyValueDB).existsCommand},
+		CommandSpec{Name: INCR, Arity: 2, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Increments the integer value of a key by one.", Syntax: "key",
+			Handler: (*KeyValueDB).incrCommand},
+		CommandSpec{Name: INCRBY, Arity: 3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Increments the integer value of a key by a number.", Syntax: "key increment",
+			Handler: (*KeyValueDB).incrCommand},
+		CommandSpec{Name: DECR, Arity: 2, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Decrements the integer value of a key by one.", Syntax: "key",
+			Handler: (*KeyValueDB).incrCommand},
+		CommandSpec{Name: DECRBY, Arity: 3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Decrements a number from the integer value of a key.", Syntax: "key decrement",
+			Handler: (*KeyValueDB).incrCommand},
+		CommandSpec{Name: INCRBYFLOAT, Arity: 3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "string", Summary: "Increments the floating point value of a key by a number.", Syntax: "key increment",
+			Handler: (*KeyValueDB).incrbyfloatCommand},
+		CommandSpec{Name: LPUSH, Arity: -3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Prepends one or more elements to a list. Creates the key if it doesn't exist.",
+			Syntax: "key element [element ...]", Handler: (*KeyValueDB).pushCommand},
+		CommandSpec{Name: RPUSH, Arity: -3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Appends one or more elements to a list. Creates the key if it doesn't exist.",
+			Syntax: "key element [element ...]", Handler: (*KeyValueDB).pushCommand},
+		CommandSpec{Name: LPOP, Arity: -2, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkMaxArgs(2),
+			Group: "list", Summary: "Returns the first elements in a list after removing it. Deletes the list if the last element was popped.",
+			Syntax: "key [count]", Handler: (*KeyValueDB).popCommand},
+		CommandSpec{Name: RPOP, Arity: -2, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkMaxArgs(2),
+			Group: "list", Summary: "Returns and removes the last elements of a list. Deletes the list if the last element was popped.",
+			Syntax: "key [count]", Handler: (*KeyValueDB).popCommand},
+		CommandSpec{Name: LRANGE, Arity: 4, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Returns a range of elements from a list.", Syntax: "key start stop",
+			Handler: (*KeyValueDB).lrangeCommand},
+		CommandSpec{Name: LLEN, Arity: 2, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Returns the length of a list.", Syntax: "key",
+			Handler: (*KeyValueDB).llenCommand},
+		CommandSpec{Name: LINDEX, Arity: 3, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Returns an element from a list by its index.", Syntax: "key index",
+			Handler: (*KeyValueDB).lindexCommand},
+		CommandSpec{Name: LSET, Arity: 4, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Sets the value of an element in a list by its index.", Syntax: "key index element",
+			Handler: (*KeyValueDB).lsetCommand},
+		CommandSpec{Name: LREM, Arity: 4, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Removes elements from a list. Deletes the list if the last element was removed.",
+			Syntax: "key count element", Handler: (*KeyValueDB).lremCommand},
+		CommandSpec{Name: LTRIM, Arity: 4, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Removes elements from both ends a list. Deletes the list if all elements were trimmed.",
+			Syntax: "key start stop", Handler: (*KeyValueDB).ltrimCommand},
+		CommandSpec{Name: LINSERT, Arity: 5, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "list", Summary: "Inserts an element before or after another element in a list.",
+			Syntax: "key <BEFORE | AFTER> pivot element", Handler: (*KeyValueDB).linsertCommand},
+		CommandSpec{Name: LMOVE, Arity: 5, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "list", Summary: "Returns an element after popping it from one list and pushing it to another. Deletes the list if the last element was moved.",
+			Syntax: "source destination <LEFT | RIGHT> <LEFT | RIGHT>", Handler: (*KeyValueDB).lmoveCommand},
+		CommandSpec{Name: LPOS, Arity: -3, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkLPosOptions,
+			Group: "list", Summary: "Returns the index of matching elements in a list.",
+			Syntax: "key element [RANK rank] [COUNT num-matches] [MAXLEN len]", Handler: (*KeyValueDB).lposCommand},
+		CommandSpec{Name: BLPOP, Arity: -3, Flags: CmdWrite | CmdBlocking, FirstKey: 1, LastKey: -2, KeyStep: 1, Check: checkTimeout,
+			Group: "list", Summary: "Removes and returns the first element in a list. Blocks until an element is available otherwise.",
+			Syntax: "key [key ...] timeout", Handler: (*KeyValueDB).bpopCommand},
+		CommandSpec{Name: BRPOP, Arity: -3, Flags: CmdWrite | CmdBlocking, FirstKey: 1, LastKey: -2, KeyStep: 1, Check: checkTimeout,
+			Group: "list", Summary: "Removes and returns the last element in a list. Blocks until an element is available otherwise.",
+			Syntax: "key [key ...] timeout", Handler: (*KeyValueDB).bpopCommand},
+		CommandSpec{Name: BLMOVE, Arity: 6, Flags: CmdWrite | CmdBlocking | CmdDenyOOM, FirstKey: 1, LastKey: 2, KeyStep: 1, Check: checkTimeout,
+			Group: "list", Summary: "Pops an element from a list, pushes it to another list and returns it. Blocks until an element is available otherwise.",
+			Syntax: "source destination <LEFT | RIGHT> <LEFT | RIGHT> timeout", Handler: (*KeyValueDB).blmoveCommand},
+		CommandSpec{Name: HSET, Arity: -4, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkFieldValuePairs,
+			Group: "hash", Summary: "Creates or modifies the value of a field in a hash.", Syntax: "key field value [field value ...]",
+			Handler: (*KeyValueDB).hsetCommand},
+		CommandSpec{Name: HSETNX, Arity: 4, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Sets the value of a field in a hash only when the field doesn't exist.", Syntax: "key field value",
+			Handler: (*KeyValueDB).hsetnxCommand},
+		CommandSpec{Name: HGET, Arity: 3, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns the value of a field in a hash.", Syntax: "key field",
+			Handler: (*KeyValueDB).hgetCommand},
+		CommandSpec{Name: HMGET, Arity: -3, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns the values of all fields in a hash.", Syntax: "key field [field ...]",
+			Handler: (*KeyValueDB).hmgetCommand},
+		CommandSpec{Name: HDEL, Arity: -3, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Deletes one or more fields and their values from a hash. Deletes the hash if no fields remain.",
+			Syntax: "key field [field ...]", Handler: (*KeyValueDB).hdelCommand},
+		CommandSpec{Name: HEXISTS, Arity: 3, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Determines whether a field exists in a hash.", Syntax: "key field",
+			Handler: (*KeyValueDB).hexistsCommand},
+		CommandSpec{Name: HGETALL, Arity: 2, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns all fields and values in a hash.", Syntax: "key",
+			Handler: (*KeyValueDB).hgetallCommand},
+		CommandSpec{Name: HKEYS, Arity: 2, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns all fields in a hash.", Syntax: "key",
+			Handler: (*KeyValueDB).hgetallCommand},
+		CommandSpec{Name: HVALS, Arity: 2, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns all values in a hash.", Syntax: "key",
+			Handler: (*KeyValueDB).hgetallCommand},
+		CommandSpec{Name: HLEN, Arity: 2, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns the number of fields in a hash.", Syntax: "key",
+			Handler: (*KeyValueDB).hlenCommand},
+		CommandSpec{Name: HSTRLEN, Arity: 3, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Returns the length of the value of a field.", Syntax: "key field",
+			Handler: (*KeyValueDB).hstrlenCommand},
+		CommandSpec{Name: HINCRBY, Arity: 4, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Increments the integer value of a field in a hash by a number. Uses 0 as initial value if the field doesn't exist.",
+			Syntax: "key field increment", Handler: (*KeyValueDB).hincrbyCommand},
+		CommandSpec{Name: HINCRBYFLOAT, Arity: 4, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "hash", Summary: "Increments the floating point value of a field by a number. Uses 0 as initial value if the field doesn't exist.",
+			Syntax: "key field increment", Handler: (*KeyValueDB).hincrbyfloatCommand},
+		CommandSpec{Name: HSCAN, Arity: -3, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkHScanOptions,
+			Group: "hash", Summary: "Iterates over fields and values of a hash.",
+			Syntax: "key cursor [MATCH pattern] [COUNT count] [NOVALUES]", Handler: (*KeyValueDB).hscanCommand},
+
+		CommandSpec{Name: SADD, Arity: -3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Adds one or more members to a set. Creates the key if it doesn't exist.",
+			Syntax: "key member [member ...]", Handler: (*KeyValueDB).saddCommand},
+		CommandSpec{Name: SREM, Arity: -3, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Removes one or more members from a set. Deletes the set if the last member was removed.",
+			Syntax: "key member [member ...]", Handler: (*KeyValueDB).sremCommand},
+		CommandSpec{Name: SMEMBERS, Arity: 2, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Returns all members of a set.", Syntax: "key",
+			Handler: (*KeyValueDB).smembersCommand},
+		CommandSpec{Name: SISMEMBER, Arity: 3, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Determines whether a member belongs to a set.", Syntax: "key member",
+			Handler: (*KeyValueDB).sismemberCommand},
+		CommandSpec{Name: SMISMEMBER, Arity: -3, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Determines whether multiple members belong to a set.", Syntax: "key member [member ...]",
+			Handler: (*KeyValueDB).sismemberCommand},
+		CommandSpec{Name: SCARD, Arity: 2, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "set", Summary: "Returns the number of members in a set.", Syntax: "key",
+			Handler: (*KeyValueDB).scardCommand},
+		CommandSpec{Name: SPOP, Arity: -2, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkMaxArgs(2),
+			Group: "set", Summary: "Returns one or more random members from a set after removing them. Deletes the set if the last member was popped.",
+			Syntax: "key [count]", Handler: (*KeyValueDB).spopCommand},
+		CommandSpec{Name: SRANDMEMBER, Arity: -2, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkMaxArgs(2),
+			Group: "set", Summary: "Get one or multiple random members from a set.", Syntax: "key [count]",
+			Handler: (*KeyValueDB).srandmemberCommand},
+		CommandSpec{Name: SMOVE, Arity: 4, Flags: CmdWrite, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "set", Summary: "Moves a member from one set to another.", Syntax: "source destination member",
+			Handler: (*KeyValueDB).smoveCommand},
+		CommandSpec{Name: SSCAN, Arity: -3, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkSScanOptions,
+			Group: "set", Summary: "Iterates over members of a set.", Syntax: "key cursor [MATCH pattern] [COUNT count]",
+			Handler: (*KeyValueDB).sscanCommand},
+		CommandSpec{Name: SINTER, Arity: -2, Flags: CmdReadOnly, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "set", Summary: "Returns the intersect of multiple sets.", Syntax: "key [key ...]",
+			Handler: (*KeyValueDB).setAlgebraCommand},
+		CommandSpec{Name: SUNION, Arity: -2, Flags: CmdReadOnly, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "set", Summary: "Returns the union of multiple sets.", Syntax: "key [key ...]",
+			Handler: (*KeyValueDB).setAlgebraCommand},
+		CommandSpec{Name: SDIFF, Arity: -2, Flags: CmdReadOnly, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "set", Summary: "Returns the difference of multiple sets.", Syntax: "key [key ...]",
+			Handler: (*KeyValueDB).setAlgebraCommand},
+		CommandSpec{Name: SINTERSTORE, Arity: -3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "set", Summary: "Stores the intersect of multiple sets in a key.", Syntax: "destination key [key ...]",
+			Handler: (*KeyValueDB).setAlgebraStoreCommand},
+		CommandSpec{Name: SUNIONSTORE, Arity: -3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "set", Summary: "Stores the union of multiple sets in a key.", Syntax: "destination key [key ...]",
+			Handler: (*KeyValueDB).setAlgebraStoreCommand},
+		CommandSpec{Name: SDIFFSTORE, Arity: -3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "set", Summary: "Stores the difference of multiple sets in a key.", Syntax: "destination key [key ...]",
+			Handler: (*KeyValueDB).setAlgebraStoreCommand},
+		CommandSpec{Name: SINTERCARD, Arity: -3, Flags: CmdReadOnly | CmdMovableKeys, Check: checkSInterCard, Keys: numKeys,
+			Group: "set", Summary: "Returns the number of members of the intersect of multiple sets.",
+			Syntax: "numkeys key [key ...] [LIMIT limit]", Handler: (*KeyValueDB).sintercardCommand},
+
+		CommandSpec{Name: ZADD, Arity: -4, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkZAddOptions,
+			Group: "sorted-set", Summary: "Adds one or more members to a sorted set, or updates their scores. Creates the key if it doesn't exist.",
+			Syntax: "key [NX | XX] [GT | LT] [CH] [INCR] score member [score member ...]", Handler: (*KeyValueDB).zaddCommand},
+		CommandSpec{Name: ZINCRBY, Arity: 4, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted-set", Summary: "Increments the score of a member in a sorted set.", Syntax: "key increment member",
+			Handler: (*KeyValueDB).zincrbyCommand},
+		CommandSpec{Name: ZSCORE, Arity: 3, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted-set", Summary: "Returns the score of a member in a sorted set.", Syntax: "key member",
+			Handler: (*KeyValueDB).zscoreCommand},
+		CommandSpec{Name: ZCARD, Arity: 2, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted-set", Summary: "Returns the number of members in a sorted set.", Syntax: "key",
+			Handler: (*KeyValueDB).zcardCommand},
+		CommandSpec{Name: ZRANK, Arity: -3, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkZRankOptions,
+			Group: "sorted-set", Summary: "Returns the index of a member in a sorted set ordered by ascending scores.",
+			Syntax: "key member [WITHSCORE]", Handler: (*KeyValueDB).zrankCommand},
+		CommandSpec{Name: ZREVRANK, Arity: -3, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkZRankOptions,
+			Group: "sorted-set", Summary: "Returns the index of a member in a sorted set ordered by descending scores.",
+			Syntax: "key member [WITHSCORE]", Handler: (*KeyValueDB).zrankCommand},
+		CommandSpec{Name: ZRANGE, Arity: -4, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkZRangeOptions,
+			Group: "sorted-set", Summary: "Returns members in a sorted set within a range of indexes, scores or members.",
+			Syntax: "key start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count] [WITHSCORES]", Handler: (*KeyValueDB).zrangeCommand},
+		CommandSpec{Name: ZREM, Arity: -3, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "sorted-set", Summary: "Removes one or more members from a sorted set. Deletes the sorted set if all members were removed.",
+			Syntax: "key member [member ...]", Handler: (*KeyValueDB).zremCommand},
+		CommandSpec{Name: ZCOUNT, Arity: 4, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkScoreRange,
+			Group: "sorted-set", Summary: "Returns the count of members in a sorted set that have scores within a range.", Syntax: "key min max",
+			Handler: (*KeyValueDB).zcountCommand},
+		CommandSpec{Name: ZPOPMIN, Arity: -2, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkZPopCount,
+			Group: "sorted-set", Summary: "Returns the lowest-scoring members from a sorted set after removing them. Deletes the sorted set if the last member was popped.",
+			Syntax: "key [count]", Handler: (*KeyValueDB).zpopCommand},
+		CommandSpec{Name: ZPOPMAX, Arity: -2, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkZPopCount,
+			Group: "sorted-set", Summary: "Returns the highest-scoring members from a sorted set after removing them. Deletes the sorted set if the last member was popped.",
+			Syntax: "key [count]", Handler: (*KeyValueDB).zpopCommand},
+		CommandSpec{Name: BZPOPMIN, Arity: -3, Flags: CmdWrite | CmdBlocking, FirstKey: 1, LastKey: -2, KeyStep: 1, Check: checkTimeout,
+			Group: "sorted-set", Summary: "Removes and returns the member with the lowest score from one or more sorted sets. Blocks until a member is available otherwise.",
+			Syntax: "key [key ...] timeout", Handler: (*KeyValueDB).bzpopCommand},
+		CommandSpec{Name: BZPOPMAX, Arity: -3, Flags: CmdWrite | CmdBlocking, FirstKey: 1, LastKey: -2, KeyStep: 1, Check: checkTimeout,
+			Group: "sorted-set", Summary: "Removes and returns the member with the highest score from one or more sorted sets. Blocks until a member is available otherwise.",
+			Syntax: "key [key ...] timeout", Handler: (*KeyValueDB).bzpopCommand},
+		CommandSpec{Name: ZUNIONSTORE, Arity: -4, Flags: CmdWrite | CmdMovableKeys | CmdDenyOOM, Check: checkZStore, Keys: zstoreKeys,
+			Group: "sorted-set", Summary: "Stores the union of multiple sorted sets in a key.",
+			Syntax: "destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE <SUM | MIN | MAX>]", Handler: (*KeyValueDB).zstoreCommand},
+		CommandSpec{Name: ZINTERSTORE, Arity: -4, Flags: CmdWrite | CmdMovableKeys | CmdDenyOOM, Check: checkZStore, Keys: zstoreKeys,
+			Group: "sorted-set", Summary: "Stores the intersect of multiple sorted sets in a key.",
+			Syntax: "destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE <SUM | MIN | MAX>]", Handler: (*KeyValueDB).zstoreCommand},
+
+		CommandSpec{Name: EXPIRE, Arity: 3, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkExpireTime,
+			Group: "generic", Summary: "Sets the expiration time of a key in seconds.", Syntax: "key seconds",
+			Handler: (*KeyValueDB).expireCommand},
+		CommandSpec{Name: PEXPIRE, Arity: 3, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkExpireTime,
+			Group: "generic", Summary: "Sets the expiration time of a key in milliseconds.", Syntax: "key milliseconds",
+			Handler: (*KeyValueDB).expireCommand},
+		CommandSpec{Name: EXPIREAT, Arity: 3, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkExpireTime,
+			Group: "generic", Summary: "Sets the expiration time of a key to a Unix timestamp.", Syntax: "key unix-time-seconds",
+			Handler: (*KeyValueDB).expireCommand},
+		CommandSpec{Name: PEXPIREAT, Arity: 3, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1, Check: checkExpireTime,
+			Group: "generic", Summary: "Sets the expiration time of a key to a Unix milliseconds timestamp.",
+			Syntax: "key unix-time-milliseconds", Handler: (*KeyValueDB).expireCommand},
+		CommandSpec{Name: TTL, Arity: 2, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Returns the expiration time in seconds of a key.", Syntax: "key",
+			Handler: (*KeyValueDB).ttlCommand},
+		CommandSpec{Name: PTTL, Arity: 2, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Returns the expiration time in milliseconds of a key.", Syntax: "key",
+			Handler: (*KeyValueDB).ttlCommand},
+		CommandSpec{Name: PERSIST, Arity: 2, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Removes the expiration time of a key.", Syntax: "key",
+			Handler: (*KeyValueDB).persistCommand},
+
+		CommandSpec{Name: KEYS, Arity: 2, Flags: CmdReadOnly,
+			Group: "generic", Summary: "Returns all key names that match a pattern.", Syntax: "pattern",
+			Handler: (*KeyValueDB).keysCommand},
+		CommandSpec{Name: SCAN, Arity: -2, Flags: CmdReadOnly, Check: checkScanOptions,
+			Group: "generic", Summary: "Iterates over the key names in the database.",
+			Syntax: "cursor [MATCH pattern] [COUNT count] [TYPE type]", Handler: (*KeyValueDB).scanCommand},
+		CommandSpec{Name: TYPE, Arity: 2, Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Determines the type of value stored at a key.", Syntax: "key",
+			Handler: (*KeyValueDB).typeCommand},
+		CommandSpec{Name: DBSIZE, Arity: 1, Flags: CmdReadOnly,
+			Group: "server", Summary: "Returns the number of keys in the database.",
+			Handler: (*KeyValueDB).dbsizeCommand},
+		CommandSpec{Name: RANDOMKEY, Arity: 1, Flags: CmdReadOnly,
+			Group: "generic", Summary: "Returns a random key name from the database.",
+			Handler: (*KeyValueDB).randomkeyCommand},
+		CommandSpec{Name: OBJECT, Arity: 3, Flags: CmdReadOnly, FirstKey: 2, LastKey: 2, KeyStep: 1,
+			Group: "generic", Summary: "Returns the access data of a key.", Syntax: "FREQ | IDLETIME key",
+			Handler: (*KeyValueDB).objectCommand},
+		CommandSpec{Name: RENAME, Arity: 3, Flags: CmdWrite, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "generic", Summary: "Renames a key and overwrites the destination.", Syntax: "key newkey",
+			Handler: (*KeyValueDB).renameCommand},
+		CommandSpec{Name: RENAMENX, Arity: 3, Flags: CmdWrite, FirstKey: 1, LastKey: 2, KeyStep: 1,
+			Group: "generic", Summary: "Renames a key only when the target key name doesn't exist.", Syntax: "key newkey",
+			Handler: (*KeyValueDB).renameCommand},
+		CommandSpec{Name: COPY, Arity: -3, Flags: CmdWrite | CmdDenyOOM, FirstKey: 1, LastKey: 2, KeyStep: 1, Check: checkCopyOptions,
+			Group: "generic", Summary: "Copies the value of a key to a new key.",
+			Syntax: "source destination [DB destination-db] [REPLACE]", Handler: (*KeyValueDB).copyCommand},
+		CommandSpec{Name: MOVE, Arity: 3, Flags: CmdWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+			Group: "generic", Summary: "Moves a key to another database.", Syntax: "key db",
+			Handler: (*KeyValueDB).moveCommand},
+		CommandSpec{Name: SWAPDB, Arity: 3, Flags: CmdWrite,
+			Group: "server", Summary: "Swaps two databases.", Syntax: "index1 index2",
+			Handler: (*KeyValueDB).swapdbCommand},
+		CommandSpec{Name: FLUSHDB, Arity: -1, Flags: CmdWrite, Check: checkFlushMode,
+			Group: "server", Summary: "Removes all keys from the current database.", Syntax: "[ASYNC | SYNC]",
+			Handler: (*KeyValueDB).flushCommand},
+		CommandSpec{Name: FLUSHALL, Arity: -1, Flags: CmdWrite, Check: checkFlushMode,
+			Group: "server", Summary: "Removes all keys from all databases.", Syntax: "[ASYNC | SYNC]",
+			Handler: (*KeyValueDB).flushCommand},
+
+		CommandSpec{Name: MULTI, Arity: 1, Flags: CmdNoQueue,
+			Group: "transactions", Summary: "Starts a transaction.",
+			Handler: (*KeyValueDB).multiCommand},
+		CommandSpec{Name: EXEC, Arity: 1, Flags: CmdNoQueue | CmdExclusive,
+			Group: "transactions", Summary: "Executes all commands in a transaction.",
+			Handler: (*KeyValueDB).execCommand},
+		CommandSpec{Name: DISCARD, Arity: 1, Flags: CmdNoQueue,
+			Group: "transactions", Summary: "Discards a transaction.",
+			Handler: (*KeyValueDB).discardCommand},
+		CommandSpec{Name: WATCH, Arity: -2, Flags: CmdNoQueue, FirstKey: 1, LastKey: -1, KeyStep: 1,
+			Group: "transactions", Summary: "Monitors changes to keys to determine the execution of a transaction.",
+			Syntax: "key [key ...]", Handler: (*KeyValueDB).watchCommand},
+		CommandSpec{Name: UNWATCH, Arity: 1,
+			Group: "transactions", Summary: "Forgets about watched keys of a transaction.",
+			Handler: (*KeyValueDB).unwatchCommand},
+
+		CommandSpec{Name: SELECT, Arity: 2,
+			Group: "connection", Summary: "Changes the selected database.", Syntax: "index",
+			Handler: (*KeyValueDB).selectCommand},
+		CommandSpec{Name: HELLO, Arity: -1, Check: checkMaxArgs(1),
+			Group: "connection", Summary: "Handshakes with the server.", Syntax: "[protover]",
+			Handler: (*KeyValueDB).helloCommand},
+		CommandSpec{Name: CLIENT, Arity: -2, Check: checkMaxArgs(2),
+			Group: "connection", Summary: "Manages the connection of the client.", Syntax: "ID | GETNAME | SETNAME connection-name",
+			Handler: (*KeyValueDB).clientCommand},
+		CommandSpec{Name: DISCONNECT, Arity: 1,
+			Group: "connection", Summary: "Closes the connection.",
+			Handler: (*KeyValueDB).disconnectCommand},
+		CommandSpec{Name: PING, Arity: -1, Check: checkMaxArgs(1),
+			Group: "connection", Summary: "Returns the server's liveliness response.", Syntax: "[message]",
+			Handler: (*KeyValueDB).pingCommand},
+
+		CommandSpec{Name: COMPACT, Arity: 1, Flags: CmdReadOnly,
+			Group: "server", Summary: "Returns the commands recreating the selected database.",
+			Handler: (*KeyValueDB).compactCommand},
+		CommandSpec{Name: BGREWRITEAOF, Arity: 1, Flags: CmdAdmin | CmdExclusive,
+			Group: "server", Summary: "Rewrites the append-only file.",
+			Handler: (*KeyValueDB).bgrewriteaofCommand},
+		CommandSpec{Name: SAVE, Arity: 1, Flags: CmdAdmin | CmdExclusive,
+			Group: "server", Summary: "Synchronously saves the databases to disk.",
+			Handler: (*KeyValueDB).saveCommand},
+		CommandSpec{Name: BGSAVE, Arity: 1, Flags: CmdAdmin | CmdExclusive,
+			Group: "server", Summary: "Asynchronously saves the databases to disk.",
+			Handler: (*KeyValueDB).saveCommand},
+		CommandSpec{Name: LASTSAVE, Arity: 1,
+			Group: "server", Summary: "Returns the Unix timestamp of the last successful save to disk.",
+			Handler: (*KeyValueDB).lastsaveCommand},
+		CommandSpec{Name: COMMAND, Arity: -1,
+			Group: "server", Summary: "Returns detailed information about commands.",
+			Syntax:  "[COUNT | LIST | INFO [command-name ...] | DOCS [command-name ...]]",
+			Handler: (*KeyValueDB).commandCommand},
+		CommandSpec{Name: INFO, Arity: -1,
+			Group: "server", Summary: "Returns information and statistics about the server.", Syntax: "[section [section ...]]",
+			Handler: (*KeyValueDB).infoCommand},
+
+		CommandSpec{Name: REPLICAOF, Arity: 3, Flags: CmdAdmin | CmdExclusive, Check: checkReplicaOf,
+			Group: "server", Summary: "Configures a server as replica of another, or promotes it to a master.",
+			Syntax: "host port | NO ONE", Handler: (*KeyValueDB).replicaofCommand},
+		CommandSpec{Name: SLAVEOF, Arity: 3, Flags: CmdAdmin | CmdExclusive, Check: checkReplicaOf,
+			Group: "server", Summary: "Sets a server as a replica of another, or promotes it to being a master.",
+			Syntax: "host port | NO ONE", Handler: (*KeyValueDB).replicaofCommand},
+		CommandSpec{Name: ROLE, Arity: 1,
+			Group: "server", Summary: "Returns the replication role.",
+			Handler: (*KeyValueDB).roleCommand},
+		CommandSpec{Name: SYNC, Arity: 1, Flags: CmdAdmin | CmdNoQueue,
+			Group: "server", Summary: "An internal command used in replication.",
+			Handler: (*KeyValueDB).syncCommand},
+		CommandSpec{Name: REPLCONF, Arity: -3, Flags: CmdAdmin | CmdNoQueue, Check: checkKeyValuePairs,
+			Group: "server", Summary: "An internal command for configuring the replication stream.",
+			Syntax: "option value [option value ...]", Handler: (*KeyValueDB).replconfCommand},
+	)
+}
+
+// commandCommand handles COMMAND and its subcommands describing the registered commands.
+//
+// Without subcommand, it returns the information of every command like COMMAND INFO does.
+func (k *KeyValueDB) commandCommand(s *Session, cmd Command) any {
+	if len(cmd.Args) == 0 {
+		return commandInfos(nil)
+	}
+
+	subcommand := strings.ToUpper(cmd.Args[0])
+	names := cmd.Args[1:]
+	switch subcommand {
+	case "COUNT", "LIST":
+		if len(names) > 0 {
+			err := &CommandError{msg: fmt.Sprintf("%s %s command expected no argument but was given", COMMAND, subcommand)}
+			return NewErrorResult(err)
+		}
+		if subcommand == "COUNT" {
+			return NewIntegerResult(len(registry))
+		}
+		var list []DBResult
+		for _, name := range commandNames() {
+			list = append(list, NewBulkResult(strings.ToLower(name)))
+		}
+		return NewArrayResult(list...)
+	case "INFO":
+		return commandInfos(names)
+	case "DOCS":
+		return commandDocs(names)
+	}
+	err := &CommandError{msg: fmt.Sprintf("unknown subcommand '%s'", cmd.Args[0])}
+	return NewErrorResult(err)
+}
+
+// commandNames returns the names of the registered commands, sorted.
+func commandNames() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandInfos returns the information of the given commands, or of every command when none is given.
+//
+// The information of a command is an array made of its name, arity, flags and key positions,
+// unknown commands have a nil reply instead.
+func commandInfos(names []string) DBResult {
+	if len(names) == 0 {
+		names = commandNames()
+	}
+	infos := []DBResult{}
+	for _, name := range names {
+		spec, ok := lookupCommand(strings.ToUpper(name))
+		if !ok {
+			infos = append(infos, NewNilResult())
+			continue
+		}
+		var flags []DBResult
+		for _, flag := range spec.Flags.names() {
+			flags = append(flags, NewStatusResult(flag))
+		}
+		infos = append(infos, NewArrayResult(
+			NewBulkResult(strings.ToLower(spec.Name)),
+			NewIntegerResult(spec.Arity),
+			NewSetResult(flags...),
+			NewIntegerResult(spec.FirstKey),
+			NewIntegerResult(spec.LastKey),
+			NewIntegerResult(spec.KeyStep),
+		))
+	}
+	return NewArrayResult(infos...)
+}
+
+// commandDocs returns a map from the name of the given commands, or of every command when none is given,
+// to their documentation. Unknown commands are left out.
+func commandDocs(names []string) DBResult {
+	if len(names) == 0 {
+		names = commandNames()
+	}
+	docs := []DBResult{}
+	for _, name := range names {
+		spec, ok := lookupCommand(strings.ToUpper(name))
+		if !ok {
+			continue
+		}
+		doc := []DBResult{
+			NewBulkResult("summary"), NewBulkResult(spec.Summary),
+			NewBulkResult("group"), NewBulkResult(spec.Group),
+		}
+		if spec.Syntax != "" {
+			doc = append(doc, NewBulkResult("syntax"), NewBulkResult(spec.Syntax))
+		}
+		docs = append(docs, NewBulkResult(strings.ToLower(spec.Name)), NewMapResult(doc...))
+	}
+	return NewMapResult(docs...)
+}
+
+// checkMaxArgs returns a check rejecting commands having more than max arguments.
+func checkMaxArgs(max int) func(c Command) error {
+	return func(c Command) error {
+		if len(c.Args) > max {
+			return newArityError(c.Keyword)
+		}
+		return nil
+	}
+}
+
+// checkKeyValuePairs rejects commands whose arguments are not key value pairs.
+func checkKeyValuePairs(c Command) error {
+	if len(c.Args)%2 != 0 {
+		return newArityError(c.Keyword)
+	}
+	return nil
+}
+
+func checkSetOptions(c Command) error {
+	_, err := parseSetOptions(c.Args[2:])
+	return err
+}
+
+func checkSetExTime(c Command) error {
+	_, err := parseExpiry(SETEX, optEX, c.Args[1])
+	return err
+}
+
+func checkGetExOptions(c Command) error {
+	_, err := parseGetExOptions(c.Args[1:])
+	return err
+}
+
+func checkExpireTime(c Command) error {
+	_, err := c.expireTime(time.Now())
+	return err
+}
@@ -0,0 +1,172 @@
+package domain
+
+import (
+	"kvdb/storage"
+	"strings"
+	"testing"
+)
+
+func TestRegisterCommand(t *testing.T) {
+	// APPENDX key suffix appends the suffix to the value of the key
+	appendx := CommandSpec{
+		Name:     "appendx",
+		Arity:    3,
+		Flags:    CmdWrite,
+		FirstKey: 1,
+		LastKey:  1,
+		KeyStep:  1,
+		Group:    "string",
+		Summary:  "Appends a suffix to the value of a key.",
+		Syntax:   "key suffix",
+		Handler: func(k *KeyValueDB, s *Session, cmd Command) any {
+			value, _ := k.Storage().Get(s.DbIndex, cmd.Args[0])
+			newValue := ""
+			if value != nil {
+				newValue = value.(string)
+			}
+			newValue += cmd.Args[1]
+			if err := k.Storage().Set(s.DbIndex, cmd.Args[0], newValue); err != nil {
+				return NewErrorResult(err)
+			}
+			return NewIntegerResult(len(newValue))
+		},
+	}
+	if err := RegisterCommand(appendx); err != nil {
+		t.Fatalf("RegisterCommand(%s) = %v, want no error", appendx.Name, err)
+	}
+	t.Cleanup(func() { delete(registry, "APPENDX") })
+
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	session, other := db.NewSession(), db.NewSession()
+	db.Execute(session, NewCommand("SET", "key", "abc"))
+	db.Execute(other, NewCommand("WATCH", "key"))
+
+	if got := db.Execute(session, NewCommand("APPENDX", "key", "de")).(DBResult); got.Text() != "5" {
+		t.Errorf("APPENDX key de = %v, want 5", got)
+	}
+	if got := db.Execute(session, NewCommand("GET", "key")).(DBResult); got.Text() != "abcde" {
+		t.Errorf("GET key = %v, want abcde", got)
+	}
+	got := db.Execute(session, NewCommand("APPENDX", "key")).(DBResult)
+	if want := "(error) ERR wrong number of arguments for 'appendx' command"; got.Err == nil || got.Err.Error() != want {
+		t.Errorf("APPENDX key = %v, want Error %v", got.Err, want)
+	}
+
+	// Registered write commands are tracked like the builtin ones
+	db.Execute(other, NewCommand("MULTI"))
+	if got := db.Execute(other, NewCommand("EXEC")); got.(DBResult).Kind() != NilReply {
+		t.Errorf("EXEC after APPENDX on a watched key = %v, want a nil reply", got)
+	}
+
+	docs := db.Execute(session, NewCommand("COMMAND", "DOCS", "appendx")).(DBResult).Elements()
+	if len(docs) != 2 || docs[0].Text() != "appendx" || docs[1].Elements()[1].Text() != appendx.Summary {
+		t.Errorf("COMMAND DOCS appendx = %v, want the summary %q", docs, appendx.Summary)
+	}
+
+	handler := appendx.Handler
+	errorCases := []struct {
+		name    string
+		spec    CommandSpec
+		wantErr string
+	}{
+		{name: "Already registered", spec: appendx, wantErr: "command APPENDX is already registered"},
+		{name: "Builtin command", spec: CommandSpec{Name: "get", Arity: 2, Handler: handler}, wantErr: "command GET is already registered"},
+		{name: "No name", spec: CommandSpec{Arity: 1, Handler: handler}, wantErr: "command name must be a single word"},
+		{name: "No arity", spec: CommandSpec{Name: "noarity", Handler: handler}, wantErr: "command NOARITY has no arity"},
+		{name: "No handler", spec: CommandSpec{Name: "nohandler", Arity: 1}, wantErr: "command NOHANDLER has no handler"},
+		{
+			name:    "No key step",
+			spec:    CommandSpec{Name: "nostep", Arity: 2, FirstKey: 1, LastKey: 1, Handler: handler},
+			wantErr: "command NOSTEP has keys but no key step",
+		},
+	}
+	for _, tc := range errorCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := RegisterCommand(tc.spec); err == nil || err.Error() != tc.wantErr {
+				t.Errorf("RegisterCommand(%s) = %v, want Error %v", tc.spec.Name, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyValueDB_Execute_CommandCommand(t *testing.T) {
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	session := db.NewSession()
+
+	got := db.Execute(session, NewCommand("COMMAND", "COUNT")).(DBResult)
+	if got.Value != len(registry) {
+		t.Errorf("COMMAND COUNT = %v, want %d", got.Value, len(registry))
+	}
+
+	all := db.Execute(session, NewCommand("COMMAND")).(DBResult).Elements()
+	list := db.Execute(session, NewCommand("COMMAND", "LIST")).(DBResult).Elements()
+	if len(all) != len(registry) || len(list) != len(registry) {
+		t.Errorf("COMMAND returned %d commands and COMMAND LIST %d, want %d", len(all), len(list), len(registry))
+	}
+
+	infos := db.Execute(session, NewCommand("COMMAND", "INFO", "get", "watch", "set", "missing")).(DBResult).Elements()
+	wantInfos := []string{
+		"get 2 [readonly] 1 1 1",
+		"watch -2 [noqueue] 1 -1 1",
+		"set -3 [write denyoom] 1 1 1",
+		"(nil)",
+	}
+	if len(infos) != len(wantInfos) {
+		t.Fatalf("COMMAND INFO get watch set missing = %v, want %d replies", infos, len(wantInfos))
+	}
+	for i, info := range infos {
+		if got := commandInfoString(info); got != wantInfos[i] {
+			t.Errorf("COMMAND INFO reply %d = %q, want %q", i, got, wantInfos[i])
+		}
+	}
+
+	docs := db.Execute(session, NewCommand("COMMAND", "DOCS", "INCRBY", "missing")).(DBResult)
+	if docs.Kind() != MapReply {
+		t.Fatalf("COMMAND DOCS reply type = %q, want %q", docs.Kind(), MapReply)
+	}
+	elems := docs.Elements()
+	if len(elems) != 2 || elems[0].Text() != "incrby" {
+		t.Fatalf("COMMAND DOCS INCRBY missing = %v, want the docs of incrby only", elems)
+	}
+	doc := elems[1].Elements()
+	wantDoc := []string{"summary", "Increments the integer value of a key by a number.", "group", "string", "syntax", "key increment"}
+	for i, want := range wantDoc {
+		if i >= len(doc) || doc[i].Text() != want {
+			t.Fatalf("COMMAND DOCS INCRBY = %v, want %q", doc, wantDoc)
+		}
+	}
+
+	errorCases := []struct {
+		cmd        Command
+		wantErrMsg string
+	}{
+		{cmd: NewCommand("COMMAND", "HELP"), wantErrMsg: "(error) ERR unknown subcommand 'HELP'"},
+		{cmd: NewCommand("COMMAND", "COUNT", "get"), wantErrMsg: "(error) ERR COMMAND COUNT command expected no argument but was given"},
+	}
+	for _, tc := range errorCases {
+		got := db.Execute(session, tc.cmd).(DBResult)
+		if got.Err == nil || got.Err.Error() != tc.wantErrMsg {
+			t.Errorf("KeyValueDB.Execute(%v) = %v, want Error %v", tc.cmd, got.Err, tc.wantErrMsg)
+		}
+	}
+}
+
+// commandInfoString formats a COMMAND INFO reply as its name, arity, flags and key positions separated by spaces
+func commandInfoString(info DBResult) string {
+	if info.Kind() == NilReply {
+		return "(nil)"
+	}
+	var fields []string
+	for _, elem := range info.Elements() {
+		if elem.Kind() == SetReply {
+			var flags []string
+			for _, flag := range elem.Elements() {
+				flags = append(flags, flag.Text())
+			}
+			fields = append(fields, "["+strings.Join(flags, " ")+"]")
+			continue
+		}
+		fields = append(fields, elem.Text())
+	}
+	return strings.Join(fields, " ")
+}
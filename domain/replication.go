@@ -0,0 +1,773 @@
+package domain
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"kvdb/persistence"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Maximum size of the stream buffered for a replica that does not keep up, beyond which the replica is disconnected
+// and has to synchronize again
+const replicaBufferLimit = 64 * 1024 * 1024
+
+// How often a master pings its replicas and a replica acknowledges the offset it processed, so that both notice
+// a broken link and the master knows how late its replicas are
+var (
+	replPingPeriod = 10 * time.Second
+	replAckPeriod  = time.Second
+)
+
+// Time without data from the other end of the link between a master and a replica after which the link is dropped
+var replTimeout = 60 * time.Second
+
+// Delay before a replica connects to its master again once the link broke
+var replRetryDelay = time.Second
+
+// States of the link of a replica to its master, reported by ROLE
+const (
+	linkConnect    = "connect"    // Waiting to connect to the master
+	linkConnecting = "connecting" // Connecting to the master
+	linkSync       = "sync"       // Receiving the snapshot of the master
+	linkConnected  = "connected"  // Applying the commands streamed by the master
+)
+
+// ReadOnlyError is returned by the write commands of the clients of a read-only replica.
+type ReadOnlyError struct{}
+
+func (r *ReadOnlyError) Error() string {
+	return "(error) READONLY You can't write against a read only replica."
+}
+
+// NoMasterLinkError is returned when a replica is asked to synchronize another one while it is not synchronized
+// with its master.
+type NoMasterLinkError struct{}
+
+func (n *NoMasterLinkError) Error() string {
+	return "(error) NOMASTERLINK Can't SYNC while not connected with my master"
+}
+
+// replication is the state of the database as a master streaming the commands it propagates to its replicas, and
+// as the replica of another database once REPLICAOF is called. A replica streams the commands of its master to its
+// own replicas.
+//
+// All the replicas get the same stream, so that the offset of the master, the number of bytes streamed since it got
+// its first replica, can be compared to the offsets the replicas acknowledge.
+type replication struct {
+	mu            sync.Mutex
+	id            string // Identifies the stream, generated once needed
+	offset        int64  // Number of bytes streamed
+	dbIndex       int    // Database of the last command streamed
+	selectDB      bool   // Whether the next command streamed is preceded by a SELECT, set when a replica joins
+	replicas      map[*replica]struct{}
+	streaming     atomic.Bool // Whether replicas are connected, read without holding the mutex
+	pinging       bool        // Whether the goroutine pinging the replicas runs
+	listeningPort int         // Port of the server, announced to the master
+	link          *masterLink // Link to the master, nil unless the database is a replica
+	writable      bool        // Whether the clients of a replica may run write commands
+	closed        bool        // Set by CloseReplication, once replicas can no longer connect
+}
+
+// replica is a replica connected to the master, which streams it the commands propagated since its snapshot.
+//
+// Its fields are guarded by the mutex of the replication.
+type replica struct {
+	id        int64 // Id of the session of the replica, which orders the replicas
+	conn      net.Conn
+	ip        string
+	port      int    // Port the replica listens on, 0 when it did not announce it
+	pending   []byte // Stream not sent yet
+	wake      chan struct{}
+	closed    bool
+	ackOffset int64     // Offset acknowledged by the replica
+	ackTime   time.Time // Time of the last acknowledgment, or of the synchronization
+}
+
+// masterLink is the link of a replica to its master, connected again whenever it breaks until it is stopped.
+//
+// Its fields are guarded by the mutex of the replication.
+type masterLink struct {
+	host   string
+	port   string
+	state  string
+	offset int64     // Offset of the stream of the master processed, -1 until synchronized
+	lastIO time.Time // Time data was last received from the master
+	conn   net.Conn  // Current connection to the master, nil until connected
+	stop   chan struct{}
+	done   chan struct{} // Closed once the link stopped applying the stream
+}
+
+func (l *masterLink) addr() string {
+	return net.JoinHostPort(l.host, l.port)
+}
+
+// close stops the link and closes its connection, it must be called while holding the mutex of the replication.
+func (l *masterLink) close() {
+	close(l.stop)
+	if l.conn != nil {
+		_ = l.conn.Close()
+	}
+}
+
+// SetReplicaReadOnly sets whether the clients of the database are denied write commands while it is a replica, which
+// is the default. The writes made to a writable replica are lost once it synchronizes with its master again.
+func (k *KeyValueDB) SetReplicaReadOnly(readOnly bool) {
+	k.repl.mu.Lock()
+	defer k.repl.mu.Unlock()
+	k.repl.writable = !readOnly
+}
+
+// SetListeningPort sets the port the server listens on, which the database announces to its master once a replica.
+func (k *KeyValueDB) SetListeningPort(port int) {
+	k.repl.mu.Lock()
+	defer k.repl.mu.Unlock()
+	k.repl.listeningPort = port
+}
+
+// ReplicaOf makes the database a replica of the master listening at the given host and port, like REPLICAOF.
+func (k *KeyValueDB) ReplicaOf(host, port string) error {
+	cmd := NewCommand(REPLICAOF, host, port)
+	if _, err := cmd.Validate(); err != nil {
+		return err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.replicaofCommand(nil, cmd)
+	return nil
+}
+
+// CloseReplication disconnects the replicas and stops replicating the master, waiting for the command being applied.
+// Replicas can no longer connect afterwards.
+func (k *KeyValueDB) CloseReplication() {
+	r := &k.repl
+	r.mu.Lock()
+	r.closed = true
+	for rep := range r.replicas {
+		r.drop(rep)
+	}
+	link := r.link
+	if link != nil {
+		link.close()
+		r.link = nil
+	}
+	r.mu.Unlock()
+
+	if link != nil {
+		<-link.done
+	}
+}
+
+// replicaofCommand handles REPLICAOF and SLAVEOF, which make the database a replica of the master listening at the
+// given host and port, or a master again when given NO ONE.
+//
+// The replica connects to its master in the background, replacing the content of the databases by the snapshot of
+// the master once connected. A master keeps its data when it becomes a replica until then, a replica keeps it when
+// it becomes a master.
+func (k *KeyValueDB) replicaofCommand(_ *Session, cmd Command) any {
+	r := &k.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	host, port := cmd.Args[0], cmd.Args[1]
+	if strings.EqualFold(host, "NO") && strings.EqualFold(port, "ONE") {
+		if r.link != nil {
+			log.Printf("Stopped replicating %s, the database is a master", r.link.addr())
+			r.link.close()
+			r.link = nil
+		}
+		return NewStatusResult("OK")
+	}
+
+	if r.link != nil {
+		if strings.EqualFold(r.link.host, host) && r.link.port == port {
+			return NewStatusResult("OK Already connected to specified master")
+		}
+		r.link.close()
+	}
+	r.link = &masterLink{
+		host:   host,
+		port:   port,
+		state:  linkConnect,
+		offset: -1,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	log.Printf("Replicating %s", r.link.addr())
+	go k.replicate(r.link)
+	return NewStatusResult("OK")
+}
+
+func checkReplicaOf(c Command) error {
+	if strings.EqualFold(c.Args[0], "NO") && strings.EqualFold(c.Args[1], "ONE") {
+		return nil
+	}
+	if port, err := strconv.Atoi(c.Args[1]); err != nil || port <= 0 || port > 65535 {
+		return &CommandError{msg: "Invalid master port"}
+	}
+	return nil
+}
+
+// replicate keeps the database synchronized with the master of the link, connecting again whenever the link breaks,
+// until the link is stopped.
+func (k *KeyValueDB) replicate(link *masterLink) {
+	defer close(link.done)
+
+	for {
+		err := k.syncWithMaster(link)
+		select {
+		case <-link.stop:
+			return
+		default:
+		}
+		log.Printf("Lost the link to master %s: %v", link.addr(), err)
+		k.repl.setLinkState(link, linkConnect)
+
+		select {
+		case <-link.stop:
+			return
+		case <-time.After(replRetryDelay):
+		}
+	}
+}
+
+// syncWithMaster connects to the master of the link, loads its snapshot, then applies the commands it streams until
+// the connection breaks.
+//
+// The replica announces the port it listens on with REPLCONF listening-port before sending SYNC, and acknowledges
+// the offset of the stream it processed every replAckPeriod with REPLCONF ACK.
+func (k *KeyValueDB) syncWithMaster(link *masterLink) error {
+	k.repl.setLinkState(link, linkConnecting)
+	conn, err := net.DialTimeout("tcp", link.addr(), replTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	port, ok := k.repl.attach(link, conn)
+	if !ok {
+		return errors.New("the link was stopped")
+	}
+
+	reader := bufio.NewReader(conn)
+	_ = conn.SetDeadline(time.Now().Add(replTimeout))
+	if port > 0 {
+		if _, err := masterRequest(conn, reader, REPLCONF, "listening-port", strconv.Itoa(port)); err != nil {
+			return err
+		}
+	}
+	k.repl.setLinkState(link, linkSync)
+	reply, err := masterRequest(conn, reader, SYNC)
+	if err != nil {
+		return err
+	}
+	var id string
+	var offset int64
+	if _, err := fmt.Sscanf(reply, "FULLRESYNC %s %d", &id, &offset); err != nil {
+		return fmt.Errorf("unexpected reply to SYNC %q", reply)
+	}
+	snapshot, err := readSnapshotPayload(reader)
+	if err != nil {
+		return err
+	}
+	if err := k.loadMasterSnapshot(link, snapshot, offset); err != nil {
+		return err
+	}
+	log.Printf("Synchronized with master %s", link.addr())
+
+	done := make(chan struct{})
+	defer close(done)
+	go k.repl.sendAcks(link, conn, done)
+
+	session := k.NewSession()
+	session.master = link
+	defer k.CloseSession(session)
+	commands := persistence.NewCommandReader(reader)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(replTimeout))
+		args, err := commands.ReadCommand()
+		if err != nil {
+			return err
+		}
+		if len(args) > 0 {
+			result := k.Execute(session, newCommandFromArgs(args))
+			if res, ok := result.(DBResult); ok && res.Kind() == ErrorReply {
+				log.Printf("Error applying %q streamed by master %s: %v", args, link.addr(), res.SimpleMsg())
+			}
+		}
+		k.repl.processed(link, offset+commands.Offset())
+	}
+}
+
+// masterRequest sends a command to the master and returns its status reply, or an error for an error reply.
+func masterRequest(conn net.Conn, reader *bufio.Reader, args ...string) (string, error) {
+	if _, err := conn.Write(persistence.AppendCommand(nil, args)); err != nil {
+		return "", err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if !strings.HasPrefix(line, "+") {
+		return "", fmt.Errorf("master replied %q to %s", line, args[0])
+	}
+	return line[1:], nil
+}
+
+// readSnapshotPayload reads the snapshot the master sends after FULLRESYNC, a bulk string without trailing CRLF.
+func readSnapshotPayload(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSuffix(line, "\r\n"), "$"))
+	if !strings.HasPrefix(line, "$") || err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid snapshot header %q", line)
+	}
+	snapshot := make([]byte, size)
+	if _, err := io.ReadFull(reader, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// loadMasterSnapshot replaces the content of the databases by the snapshot of the master, unless the link was stopped
+// meanwhile. The replicas of the database are disconnected, so that they synchronize with the new content.
+//
+// The append-only file is rewritten from the new content, since replaying it would not recreate it.
+func (k *KeyValueDB) loadMasterSnapshot(link *masterLink, snapshot []byte, offset int64) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if !k.repl.isCurrent(link) {
+		return errors.New("the link was stopped")
+	}
+
+	for dbIndex := 0; dbIndex < k.storage.DbCount(); dbIndex++ {
+		k.touchDB(dbIndex, dbIndex)
+		if err := k.storage.Flush(dbIndex); err != nil {
+			return err
+		}
+	}
+	err := persistence.DecodeSnapshot(snapshot, func(dbIndex int, entry persistence.SnapshotEntry) error {
+		if err := k.loadEntry(dbIndex, entry); err != nil {
+			return err
+		}
+		k.touchKeys(dbIndex, entry.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for dbIndex := 0; dbIndex < k.storage.DbCount(); dbIndex++ {
+		k.blockers.signalDB(dbIndex)
+	}
+	k.snapshots.markDirty()
+	if k.aof != nil {
+		if res := k.rewriteAOF(); res.Err != nil {
+			log.Printf("Error rewriting the append-only file after synchronizing with the master: %v", res.Err)
+		}
+	}
+	k.repl.synchronized(link, offset)
+	return nil
+}
+
+// ServeReplica synchronizes the replica connected as the client owning the session, which sent SYNC, then streams it
+// the commands propagated by the database until it disconnects.
+//
+// The replica first gets "+FULLRESYNC <id> <offset>" and the snapshot of the databases as a bulk string without
+// trailing CRLF, then the commands in the RESP multibulk format along with a PING every replPingPeriod. The offsets
+// of the stream it acknowledges with REPLCONF ACK <offset> are read from reader, the connection of the client.
+//
+// An error is returned before anything is written when the database cannot synchronize the replica, the client can
+// then be told why. Otherwise ServeReplica returns nil once the replica disconnected.
+func (k *KeyValueDB) ServeReplica(s *Session, cmd Command, conn net.Conn, reader io.Reader) error {
+	if _, err := cmd.Validate(); err != nil {
+		return err
+	}
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	rep := &replica{id: s.ID, conn: conn, ip: ip, port: s.replicaPort, wake: make(chan struct{}, 1)}
+
+	// The replica gets the commands propagated once the snapshot is taken
+	k.lock.Lock()
+	dbs, err := k.snapshotDBs()
+	if err != nil {
+		k.lock.Unlock()
+		return &CommandError{msg: err.Error()}
+	}
+	id, offset, err := k.repl.addReplica(rep)
+	k.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	defer k.repl.removeReplica(rep)
+
+	snapshot, err := persistence.EncodeSnapshot(dbs)
+	if err != nil {
+		return &CommandError{msg: err.Error()}
+	}
+	payload := fmt.Appendf(nil, "+FULLRESYNC %s %d\r\n$%d\r\n", id, offset, len(snapshot))
+	if err := writeWithTimeout(conn, append(payload, snapshot...)); err != nil {
+		log.Printf("Error sending the snapshot to replica %s: %v", conn.RemoteAddr(), err)
+		return nil
+	}
+	log.Printf("Replica %s synchronized", conn.RemoteAddr())
+
+	acks := make(chan struct{})
+	go func() {
+		defer close(acks)
+		k.repl.readAcks(rep, reader)
+	}()
+	k.repl.stream(rep)
+	_ = conn.Close()
+	<-acks
+	return nil
+}
+
+// syncCommand handles SYNC sent through Execute, replicas are served by ServeReplica which takes over their connection.
+func (k *KeyValueDB) syncCommand(_ *Session, _ Command) any {
+	return NewErrorResult(&CommandError{msg: "SYNC is only supported over a RESP connection"})
+}
+
+// replconfCommand handles REPLCONF, which a replica sends to its master before SYNC: listening-port announces the
+// port the replica listens on. The acknowledgments sent with ACK once it is synchronized are read by ServeReplica.
+func (k *KeyValueDB) replconfCommand(s *Session, cmd Command) any {
+	for i := 0; i < len(cmd.Args); i += 2 {
+		switch option := strings.ToLower(cmd.Args[i]); option {
+		case "listening-port":
+			port, err := strconv.Atoi(cmd.Args[i+1])
+			if err != nil || port < 0 || port > 65535 {
+				return NewErrorResult(&CommandError{msg: "value is not an integer or out of range"})
+			}
+			s.replicaPort = port
+		case "ack":
+		default:
+			return NewErrorResult(&CommandError{msg: fmt.Sprintf("Unrecognized REPLCONF option: %s", cmd.Args[i])})
+		}
+	}
+	return NewStatusResult("OK")
+}
+
+// roleCommand handles ROLE. A master replies "master", its offset and the ip, port and acknowledged offset of every
+// replica. A replica replies "slave", the host and port of its master, the state of the link and its offset.
+func (k *KeyValueDB) roleCommand(_ *Session, _ Command) any {
+	r := &k.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if link := r.link; link != nil {
+		port, _ := strconv.Atoi(link.port)
+		return NewArrayResult(NewBulkResult("slave"), NewBulkResult(link.host), NewIntegerResult(port),
+			NewBulkResult(link.state), NewIntegerResult(int(link.offset)))
+	}
+	replicas := []DBResult{}
+	for _, rep := range r.sortedReplicas() {
+		replicas = append(replicas, NewArrayResult(NewBulkResult(rep.ip), NewBulkResult(strconv.Itoa(rep.port)),
+			NewBulkResult(strconv.FormatInt(rep.ackOffset, 10))))
+	}
+	return NewArrayResult(NewBulkResult("master"), NewIntegerResult(int(r.offset)), NewArrayResult(replicas...))
+}
+
+// info returns the lines of the replication section of INFO.
+//
+// A replica reports the state of its link and the seconds since it last received data from its master, a master the
+// offset every replica acknowledged and the seconds since it did. The replication offset of a replica is the offset of
+// the stream of its master it processed.
+func (r *replication) info() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var lines []string
+	offset := r.offset
+	if link := r.link; link != nil {
+		offset = link.offset
+		status, syncing, lastIO, readOnly := "down", 0, -1, 1
+		if link.state == linkConnected {
+			status = "up"
+		}
+		if link.state == linkSync {
+			syncing = 1
+		}
+		if !link.lastIO.IsZero() {
+			lastIO = int(time.Since(link.lastIO) / time.Second)
+		}
+		if r.writable {
+			readOnly = 0
+		}
+		lines = append(lines, "role:slave",
+			"master_host:"+link.host,
+			"master_port:"+link.port,
+			"master_link_status:"+status,
+			fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+			fmt.Sprintf("master_sync_in_progress:%d", syncing),
+			fmt.Sprintf("slave_repl_offset:%d", link.offset),
+			fmt.Sprintf("slave_read_only:%d", readOnly),
+		)
+	} else {
+		lines = append(lines, "role:master")
+	}
+
+	replicas := r.sortedReplicas()
+	lines = append(lines, fmt.Sprintf("connected_slaves:%d", len(replicas)))
+	for i, rep := range replicas {
+		lag := int(time.Since(rep.ackTime) / time.Second)
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%d,state=online,offset=%d,lag=%d", i, rep.ip, rep.port, rep.ackOffset, lag))
+	}
+	return append(lines, "master_replid:"+r.streamID(), fmt.Sprintf("master_repl_offset:%d", offset))
+}
+
+// isReplica reports whether the database replicates a master.
+func (r *replication) isReplica() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.link != nil
+}
+
+// acceptsWrites reports whether the client owning the session may run write commands: always on a master, on a
+// replica only when it is writable or for the session applying the stream of its current master.
+func (r *replication) acceptsWrites(s *Session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s.master != nil {
+		return s.master == r.link
+	}
+	return r.link == nil || r.writable
+}
+
+// streamID returns the id of the stream, generating it the first time. It must be called while holding the mutex.
+func (r *replication) streamID() string {
+	if r.id == "" {
+		id := make([]byte, 20)
+		_, _ = rand.Read(id)
+		r.id = hex.EncodeToString(id)
+	}
+	return r.id
+}
+
+// sortedReplicas returns the connected replicas in the order they connected. It must be called while holding the
+// mutex.
+func (r *replication) sortedReplicas() []*replica {
+	replicas := make([]*replica, 0, len(r.replicas))
+	for rep := range r.replicas {
+		replicas = append(replicas, rep)
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].id < replicas[j].id })
+	return replicas
+}
+
+// feed streams a command propagated by the database to the replicas, preceded by a SELECT when it runs against
+// another database than the previous one.
+func (r *replication) feed(dbIndex int, args []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.replicas) == 0 {
+		return
+	}
+
+	var data []byte
+	if r.selectDB || dbIndex != r.dbIndex {
+		data = persistence.AppendCommand(data, []string{SELECT, strconv.Itoa(dbIndex)})
+		r.dbIndex, r.selectDB = dbIndex, false
+	}
+	r.write(persistence.AppendCommand(data, args))
+}
+
+// write appends data to the stream of every replica, disconnecting the ones that have too much of it pending. It
+// must be called while holding the mutex.
+func (r *replication) write(data []byte) {
+	r.offset += int64(len(data))
+	for rep := range r.replicas {
+		if len(rep.pending)+len(data) > replicaBufferLimit {
+			log.Printf("Disconnecting replica %s, which does not keep up with the stream", rep.conn.RemoteAddr())
+			r.drop(rep)
+			continue
+		}
+		rep.pending = append(rep.pending, data...)
+		select {
+		case rep.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// addReplica starts streaming to a replica and returns the id and offset of the stream it gets. It must be called
+// while holding the lock of the database exclusively, along with taking the snapshot sent to the replica.
+func (r *replication) addReplica(rep *replica) (string, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return "", 0, &CommandError{msg: "the server is shutting down"}
+	}
+	if r.link != nil && r.link.state != linkConnected {
+		return "", 0, &NoMasterLinkError{}
+	}
+
+	if r.replicas == nil {
+		r.replicas = make(map[*replica]struct{})
+	}
+	r.replicas[rep] = struct{}{}
+	r.streaming.Store(true)
+	rep.ackOffset, rep.ackTime = r.offset, time.Now()
+	// The replica does not know which database the previous commands selected
+	r.selectDB = true
+	if !r.pinging {
+		r.pinging = true
+		go r.pingReplicas()
+	}
+	return r.streamID(), r.offset, nil
+}
+
+// removeReplica disconnects a replica unless it was already.
+func (r *replication) removeReplica(rep *replica) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.replicas[rep]; ok {
+		r.drop(rep)
+	}
+}
+
+// drop disconnects a replica, it must be called while holding the mutex.
+func (r *replication) drop(rep *replica) {
+	delete(r.replicas, rep)
+	r.streaming.Store(len(r.replicas) > 0)
+	rep.closed = true
+	select {
+	case rep.wake <- struct{}{}:
+	default:
+	}
+	_ = rep.conn.Close()
+}
+
+// stream sends its pending stream to a replica until it is disconnected.
+func (r *replication) stream(rep *replica) {
+	for range rep.wake {
+		r.mu.Lock()
+		pending, closed := rep.pending, rep.closed
+		rep.pending = nil
+		r.mu.Unlock()
+		if closed {
+			return
+		}
+		if err := writeWithTimeout(rep.conn, pending); err != nil {
+			log.Printf("Error streaming to replica %s: %v", rep.conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// readAcks records the offsets a replica acknowledges, until its connection breaks or it stops acknowledging them.
+func (r *replication) readAcks(rep *replica, reader io.Reader) {
+	commands := persistence.NewCommandReader(reader)
+	for {
+		_ = rep.conn.SetReadDeadline(time.Now().Add(replTimeout))
+		args, err := commands.ReadCommand()
+		if err != nil {
+			r.removeReplica(rep)
+			return
+		}
+		if len(args) != 3 || !strings.EqualFold(args[0], REPLCONF) || !strings.EqualFold(args[1], "ACK") {
+			continue
+		}
+		if offset, err := strconv.ParseInt(args[2], 10, 64); err == nil {
+			r.mu.Lock()
+			rep.ackOffset, rep.ackTime = offset, time.Now()
+			r.mu.Unlock()
+		}
+	}
+}
+
+// pingReplicas streams a PING to the replicas every replPingPeriod, until none is connected.
+func (r *replication) pingReplicas() {
+	ticker := time.NewTicker(replPingPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.mu.Lock()
+		if len(r.replicas) == 0 {
+			r.pinging = false
+			r.mu.Unlock()
+			return
+		}
+		r.write(persistence.AppendCommand(nil, []string{PING}))
+		r.mu.Unlock()
+	}
+}
+
+// sendAcks acknowledges the offset of the stream of the master processed every replAckPeriod, until done is closed.
+func (r *replication) sendAcks(link *masterLink, conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(replAckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		offset := link.offset
+		r.mu.Unlock()
+		ack := persistence.AppendCommand(nil, []string{REPLCONF, "ACK", strconv.FormatInt(offset, 10)})
+		if err := writeWithTimeout(conn, ack); err != nil {
+			return
+		}
+	}
+}
+
+// attach sets the connection of a link and returns the port to announce to the master, false when the link was
+// stopped meanwhile.
+func (r *replication) attach(link *masterLink, conn net.Conn) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.link != link {
+		return 0, false
+	}
+	link.conn = conn
+	return r.listeningPort, true
+}
+
+func (r *replication) isCurrent(link *masterLink) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.link == link
+}
+
+func (r *replication) setLinkState(link *masterLink, state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	link.state = state
+}
+
+// synchronized records that a replica loaded the snapshot of its master and disconnects its own replicas.
+func (r *replication) synchronized(link *masterLink, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	link.state, link.offset, link.lastIO = linkConnected, offset, time.Now()
+	for rep := range r.replicas {
+		r.drop(rep)
+	}
+}
+
+// processed records the offset of the stream of its master a replica processed.
+func (r *replication) processed(link *masterLink, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	link.offset, link.lastIO = offset, time.Now()
+}
+
+// writeWithTimeout writes data to the other end of a replication link, failing when it does not read it for
+// replTimeout.
+func writeWithTimeout(conn net.Conn, data []byte) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(replTimeout))
+	_, err := conn.Write(data)
+	return err
+}
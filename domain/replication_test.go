@@ -0,0 +1,147 @@
+package domain
+
+import (
+	"kvdb/storage"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestKeyValueDB_Execute_ReplicationCommands(t *testing.T) {
+	testCases := []struct {
+		name string
+		cmds []Command
+		want []any // SimpleMsg of the results
+	}{
+		{
+			name: "PING",
+			cmds: []Command{
+				NewCommand("PING"),
+				NewCommand("PING", "hello"),
+				NewCommand("PING", "a", "b"),
+			},
+			want: []any{"PONG", `"hello"`, "(error) ERR wrong number of arguments for 'ping' command"},
+		},
+		{
+			name: "ROLE and INFO of a master",
+			cmds: []Command{
+				NewCommand("ROLE"),
+				NewCommand("INFO", "keyspace"),
+				NewCommand("SET", "key", "value"),
+				NewCommand("SELECT", "1"),
+				NewCommand("RPUSH", "list", "a"),
+				NewCommand("INFO", "KEYSPACE", "missing"),
+				NewCommand("INFO", "missing"),
+			},
+			want: []any{
+				"1) \"master\"\n2) (integer) 0\n3) (empty array)", "# Keyspace", "OK", "OK", "(integer) 1",
+				"# Keyspace\r\ndb0:keys=1\r\ndb1:keys=1", "",
+			},
+		},
+		{
+			name: "REPLICAOF arguments",
+			cmds: []Command{
+				NewCommand("REPLICAOF", "localhost", "port"),
+				NewCommand("REPLICAOF", "localhost", "0"),
+				NewCommand("SLAVEOF", "localhost", "65536"),
+				NewCommand("REPLICAOF", "no", "one"),
+				NewCommand("REPLICAOF", "NO"),
+			},
+			want: []any{
+				"(error) ERR Invalid master port", "(error) ERR Invalid master port", "(error) ERR Invalid master port",
+				"OK", "(error) ERR wrong number of arguments for 'replicaof' command",
+			},
+		},
+		{
+			name: "REPLCONF and SYNC",
+			cmds: []Command{
+				NewCommand("REPLCONF", "listening-port", "6380"),
+				NewCommand("REPLCONF", "listening-port", "port"),
+				NewCommand("REPLCONF", "ACK", "10", "capa"),
+				NewCommand("REPLCONF", "unknown", "value"),
+				NewCommand("SYNC"),
+			},
+			want: []any{
+				"OK", "(error) ERR value is not an integer or out of range",
+				"(error) ERR wrong number of arguments for 'replconf' command",
+				"(error) ERR Unrecognized REPLCONF option: unknown",
+				"(error) ERR SYNC is only supported over a RESP connection",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := NewKeyValueDB(storage.NewInMemoryStorage(2))
+			session := db.NewSession()
+			for i, cmd := range tc.cmds {
+				got := db.Execute(session, cmd).(DBResult).SimpleMsg()
+				if got != tc.want[i] {
+					t.Errorf("KeyValueDB.Execute(%v) = %q, want %q", cmd, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestKeyValueDB_ReadOnlyReplica(t *testing.T) {
+	// Nothing listens on the port of the master, the replica keeps trying to connect
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	session := db.NewSession()
+	db.Execute(session, NewCommand("SET", "key", "value"))
+	if err := db.ReplicaOf("127.0.0.1", port); err != nil {
+		t.Fatalf("KeyValueDB.ReplicaOf() error = %v", err)
+	}
+	defer db.CloseReplication()
+
+	readOnly := "(error) READONLY You can't write against a read only replica."
+	cmds := []Command{
+		NewCommand("SET", "key", "other"),
+		NewCommand("GET", "key"),
+		NewCommand("MULTI"),
+		NewCommand("DEL", "key"),
+		NewCommand("EXEC"),
+		NewCommand("REPLICAOF", "127.0.0.1", port),
+	}
+	want := []any{
+		readOnly, `"value"`, "OK", readOnly,
+		"(error) EXECABORT Transaction discarded because of previous errors.", "OK Already connected to specified master",
+	}
+	for i, cmd := range cmds {
+		if got := db.Execute(session, cmd).(DBResult).SimpleMsg(); got != want[i] {
+			t.Errorf("KeyValueDB.Execute(%v) = %q, want %q", cmd, got, want[i])
+		}
+	}
+
+	role := db.Execute(session, NewCommand("ROLE")).(DBResult).Elements()
+	if len(role) != 5 || role[0].Text() != "slave" || role[1].Text() != "127.0.0.1" || role[2].Text() != port ||
+		role[4].Text() != "-1" {
+		t.Errorf("ROLE = %v, want slave 127.0.0.1 %s <state> -1", role, port)
+	}
+	info := db.Execute(session, NewCommand("INFO", "replication")).(DBResult).Text()
+	for _, line := range []string{"role:slave", "master_port:" + port, "master_link_status:down", "slave_read_only:1"} {
+		if !strings.Contains(info, line+"\r\n") {
+			t.Errorf("INFO replication = %q, want a %q line", info, line)
+		}
+	}
+
+	db.SetReplicaReadOnly(false)
+	if got := db.Execute(session, NewCommand("SET", "key", "writable")).(DBResult).SimpleMsg(); got != "OK" {
+		t.Errorf("SET on a writable replica = %q, want OK", got)
+	}
+	db.SetReplicaReadOnly(true)
+	if got := db.Execute(session, NewCommand("REPLICAOF", "NO", "ONE")).(DBResult).SimpleMsg(); got != "OK" {
+		t.Errorf("REPLICAOF NO ONE = %q, want OK", got)
+	}
+	if got := db.Execute(session, NewCommand("INCR", "counter")).(DBResult).SimpleMsg(); got != "(integer) 1" {
+		t.Errorf("INCR on a former replica = %q, want (integer) 1", got)
+	}
+}
@@ -0,0 +1,152 @@
+package domain
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// ReplyType describes how a DBResult has to be rendered by a protocol encoder.
+//
+// The values double as the labels redis-cli prints in front of some replies, e.g. "(integer) 1".
+type ReplyType string
+
+const (
+	StatusReply    ReplyType = "status"
+	ErrorReply     ReplyType = "error"
+	IntegerReply   ReplyType = "integer"
+	BulkReply      ReplyType = "string"
+	NilReply       ReplyType = "nil"
+	ArrayReply     ReplyType = "array"
+	MapReply       ReplyType = "map"
+	SetReply       ReplyType = "set"
+	DoubleReply    ReplyType = "double"
+	BooleanReply   ReplyType = "boolean"
+	VerbatimReply  ReplyType = "verbatim"
+	BigNumberReply ReplyType = "big number"
+	PushReply      ReplyType = "push"
+)
+
+// IsAggregate reports whether replies of this type hold a list of nested DBResults in their Value.
+func (r ReplyType) IsAggregate() bool {
+	switch r {
+	case ArrayReply, MapReply, SetReply, PushReply:
+		return true
+	}
+	return false
+}
+
+// Kind returns the ReplyType of the result.
+//
+// Results created without an explicit Type are inferred the way they used to be rendered:
+// a "(nil)" response is a nil reply, an error is an error reply, any other response is a status
+// reply and a plain value is a bulk string.
+func (d DBResult) Kind() ReplyType {
+	switch {
+	case d.Type != "":
+		return d.Type
+	case d.Response == "(nil)":
+		return NilReply
+	case d.Err != nil:
+		return ErrorReply
+	case d.Response != "":
+		return StatusReply
+	}
+	return BulkReply
+}
+
+// Elements returns the nested results of an aggregate reply.
+//
+// For map replies the elements alternate between keys and values.
+func (d DBResult) Elements() []DBResult {
+	if elems, ok := d.Value.([]DBResult); ok {
+		return elems
+	}
+	return nil
+}
+
+// Text returns the textual payload of a scalar reply, i.e. what a bulk string, status, integer,
+// double or big number reply carries on the wire.
+func (d DBResult) Text() string {
+	if d.Response != "" && d.Type != VerbatimReply {
+		return d.Response
+	}
+	switch v := d.Value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return FormatFloat(v)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	}
+	return fmt.Sprintf("%v", d.Value)
+}
+
+// FormatFloat formats a float the way replies and the scores of sorted sets represent it:
+// the shortest representation that round-trips, with "inf", "-inf" and "nan" for special values.
+func FormatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func NewStatusResult(status string) DBResult {
+	return DBResult{Value: "", Type: StatusReply, Response: status}
+}
+
+func NewErrorResult(err error) DBResult {
+	return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+}
+
+func NewIntegerResult(i int) DBResult {
+	return DBResult{Value: i, Type: IntegerReply}
+}
+
+func NewBulkResult(value any) DBResult {
+	return DBResult{Value: value, Type: BulkReply}
+}
+
+func NewNilResult() DBResult {
+	return DBResult{Type: NilReply, Response: "(nil)"}
+}
+
+func NewDoubleResult(f float64) DBResult {
+	return DBResult{Value: f, Type: DoubleReply}
+}
+
+func NewBooleanResult(b bool) DBResult {
+	return DBResult{Value: b, Type: BooleanReply}
+}
+
+// NewVerbatimResult creates a verbatim string reply, format is a three letters hint such as "txt" or "mkd".
+func NewVerbatimResult(format string, text string) DBResult {
+	return DBResult{Value: text, Type: VerbatimReply, Response: format}
+}
+
+func NewArrayResult(elems ...DBResult) DBResult {
+	return DBResult{Value: elems, Type: ArrayReply}
+}
+
+func NewSetResult(elems ...DBResult) DBResult {
+	return DBResult{Value: elems, Type: SetReply}
+}
+
+// NewMapResult creates a map reply from a list of alternating keys and values.
+func NewMapResult(pairs ...DBResult) DBResult {
+	return DBResult{Value: pairs, Type: MapReply}
+}
+
+func NewPushResult(elems ...DBResult) DBResult {
+	return DBResult{Value: elems, Type: PushReply}
+}
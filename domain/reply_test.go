@@ -0,0 +1,121 @@
+package domain
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestDBResult_Kind(t *testing.T) {
+	testCases := []struct {
+		name   string
+		result DBResult
+		want   ReplyType
+	}{
+		{
+			name:   "Explicit type",
+			result: DBResult{Value: 1, Type: IntegerReply},
+			want:   IntegerReply,
+		},
+		{
+			name:   "Inferred nil",
+			result: DBResult{Response: "(nil)", Err: errors.New("not found")},
+			want:   NilReply,
+		},
+		{
+			name:   "Inferred error",
+			result: DBResult{Err: errors.New("(error) ERR failure")},
+			want:   ErrorReply,
+		},
+		{
+			name:   "Inferred status",
+			result: DBResult{Response: "OK"},
+			want:   StatusReply,
+		},
+		{
+			name:   "Inferred bulk string",
+			result: DBResult{Value: "value"},
+			want:   BulkReply,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.result.Kind(); got != tc.want {
+				t.Errorf("DBResult.Kind() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDBResult_SimpleMsg(t *testing.T) {
+	testCases := []struct {
+		name   string
+		result DBResult
+		want   any
+	}{
+		{
+			name:   "Status",
+			result: NewStatusResult("OK"),
+			want:   "OK",
+		},
+		{
+			name:   "Error",
+			result: NewErrorResult(errors.New("(error) ERR failure")),
+			want:   "(error) ERR failure",
+		},
+		{
+			name:   "Integer",
+			result: NewIntegerResult(10),
+			want:   "(integer) 10",
+		},
+		{
+			name:   "Bulk string",
+			result: NewBulkResult("value"),
+			want:   "\"value\"",
+		},
+		{
+			name:   "Nil",
+			result: NewNilResult(),
+			want:   "(nil)",
+		},
+		{
+			name:   "Double",
+			result: NewDoubleResult(math.Inf(1)),
+			want:   "(double) inf",
+		},
+		{
+			name:   "Boolean",
+			result: NewBooleanResult(false),
+			want:   "(false)",
+		},
+		{
+			name:   "Empty array",
+			result: NewArrayResult(),
+			want:   "(empty array)",
+		},
+		{
+			name:   "Nested array",
+			result: NewArrayResult(NewBulkResult("a"), NewArrayResult(NewIntegerResult(1), NewNilResult())),
+			want:   "1) \"a\"\n2) 1) (integer) 1\n   2) (nil)",
+		},
+		{
+			name:   "Map",
+			result: NewMapResult(NewBulkResult("proto"), NewIntegerResult(3)),
+			want:   "1# \"proto\" => (integer) 3",
+		},
+		{
+			name:   "Set",
+			result: NewSetResult(NewBulkResult("a")),
+			want:   "1~ \"a\"",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.result.SimpleMsg(); got != tc.want {
+				t.Errorf("DBResult.SimpleMsg() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
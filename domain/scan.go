@@ -0,0 +1,178 @@
+package domain
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Number of items the SCAN family of commands returns by default in a page
+const defaultScanCount = 10
+
+// scanOptions are the options of the SCAN family of commands.
+type scanOptions struct {
+	match    string // Glob-style pattern the returned items match, empty to return them all
+	count    int    // Number of items returned in a page, a hint rather than a limit
+	noValues bool   // Set by the NOVALUES option of HSCAN, only the fields are returned
+	typeName string // Set by the TYPE option of SCAN, only the keys holding a value of this type are returned
+}
+
+// parseScanCursor parses the cursor of the SCAN family of commands, 0 starting a new iteration.
+func parseScanCursor(arg string) (uint64, error) {
+	cursor, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return 0, &CommandError{msg: "invalid cursor"}
+	}
+	return cursor, nil
+}
+
+// parseScanOptions parses the options following the cursor of a command of the SCAN family.
+func parseScanOptions(keyword string, options []string) (scanOptions, error) {
+	opts := scanOptions{count: defaultScanCount}
+	for i := 0; i < len(options); i++ {
+		option := strings.ToUpper(options[i])
+		switch {
+		case option == "NOVALUES" && keyword == HSCAN:
+			opts.noValues = true
+		case option == "TYPE" && keyword == SCAN && i+1 < len(options):
+			i++
+			opts.typeName = strings.ToLower(options[i])
+			if !slices.Contains(typeNames, opts.typeName) {
+				return opts, &CommandError{msg: "unknown type name"}
+			}
+		case option == "MATCH" && i+1 < len(options):
+			i++
+			opts.match = options[i]
+		case option == "COUNT" && i+1 < len(options):
+			i++
+			count, err := strconv.Atoi(options[i])
+			if err != nil {
+				return opts, &CommandError{msg: "value is not an integer or out of range"}
+			}
+			if count < 1 {
+				return opts, &CommandError{msg: "syntax error"}
+			}
+			opts.count = count
+		default:
+			return opts, &CommandError{msg: "syntax error"}
+		}
+	}
+	return opts, nil
+}
+
+// scanPosition returns the position of an item in the order the SCAN family of commands iterates over
+// a collection, the FNV-1a hash of the item.
+func scanPosition(item string) uint64 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(item))
+	return uint64(h.Sum32())
+}
+
+// scan returns a page of at least count items starting at the given cursor, along with the cursor of the next
+// page, 0 once the iteration is complete.
+//
+// Items are ordered by their position, which does not depend on the other items of the collection, and the cursor
+// is the position of the first item of the page. An iteration thus returns every item present in the collection
+// from its start to its end, whatever is added or removed in the meantime. Items sharing a position are returned
+// in the same page.
+func scan(items []string, cursor uint64, count int) ([]string, uint64) {
+	type positioned struct {
+		pos  uint64
+		item string
+	}
+	var candidates []positioned
+	for _, item := range items {
+		if pos := scanPosition(item); pos >= cursor {
+			candidates = append(candidates, positioned{pos: pos, item: item})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].pos != candidates[j].pos {
+			return candidates[i].pos < candidates[j].pos
+		}
+		return candidates[i].item < candidates[j].item
+	})
+
+	var page []string
+	for i, c := range candidates {
+		if len(page) >= count && c.pos != candidates[i-1].pos {
+			return page, c.pos
+		}
+		page = append(page, c.item)
+	}
+	return page, 0
+}
+
+// matchPattern reports whether a string matches a glob-style pattern, the way Redis matches keys and fields:
+// '*' matches any sequence of bytes, '?' a single byte, "[abc]", "[^abc]" and "[a-z]" a byte of a class,
+// and '\' escapes the next character.
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			negated := len(pattern) > 0 && pattern[0] == '^'
+			if negated {
+				pattern = pattern[1:]
+			}
+			matched := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) > 1:
+					pattern = pattern[1:]
+					matched = matched || pattern[0] == s[0]
+				case len(pattern) > 2 && pattern[1] == '-':
+					low, high := min(pattern[0], pattern[2]), max(pattern[0], pattern[2])
+					matched = matched || (s[0] >= low && s[0] <= high)
+					pattern = pattern[2:]
+				default:
+					matched = matched || pattern[0] == s[0]
+				}
+				pattern = pattern[1:]
+			}
+			if matched == negated {
+				return false
+			}
+			s = s[1:]
+			if len(pattern) == 0 {
+				// Unterminated class
+				return len(s) == 0
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
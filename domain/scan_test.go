@@ -0,0 +1,71 @@
+package domain
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{pattern: "*", s: "", want: true},
+		{pattern: "user:*", s: "user:42", want: true},
+		{pattern: "user:*", s: "session:42", want: false},
+		{pattern: "*:*:name", s: "user:42:name", want: true},
+		{pattern: "h?llo", s: "hello", want: true},
+		{pattern: "h?llo", s: "hllo", want: false},
+		{pattern: "h[ae]llo", s: "hallo", want: true},
+		{pattern: "h[ae]llo", s: "hillo", want: false},
+		{pattern: "h[^e]llo", s: "hallo", want: true},
+		{pattern: "h[^e]llo", s: "hello", want: false},
+		{pattern: "h[a-c]llo", s: "hbllo", want: true},
+		{pattern: "h[c-a]llo", s: "hbllo", want: true},
+		{pattern: "h[a-c]llo", s: "hdllo", want: false},
+		{pattern: `h\*llo`, s: "h*llo", want: true},
+		{pattern: `h\*llo`, s: "hello", want: false},
+		{pattern: `[\]]`, s: "]", want: true},
+		{pattern: "key", s: "key2", want: false},
+		{pattern: "[ab", s: "a", want: true},
+	}
+	for _, tc := range testCases {
+		if got := matchPattern(tc.pattern, tc.s); got != tc.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tc.pattern, tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	var items []string
+	for i := 0; i < 50; i++ {
+		items = append(items, fmt.Sprintf("item%d", i))
+	}
+
+	seen := map[string]int{}
+	cursor, pages := uint64(0), 0
+	for {
+		var page []string
+		page, cursor = scan(items, cursor, 10)
+		for _, item := range page {
+			seen[item]++
+		}
+		pages++
+		if cursor == 0 {
+			break
+		}
+	}
+	if pages != 5 {
+		t.Errorf("scan() of 50 items by 10 took %d pages, want 5", pages)
+	}
+	for _, item := range items {
+		if seen[item] != 1 {
+			t.Errorf("scan() returned %q %d times, want once", item, seen[item])
+		}
+	}
+
+	if page, next := scan(nil, 0, 10); len(page) != 0 || next != 0 {
+		t.Errorf("scan() of no item = %v, %d, want an empty page and cursor 0", page, next)
+	}
+}
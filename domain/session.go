@@ -0,0 +1,159 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SessionFlag is a state a client connection can be in.
+type SessionFlag uint
+
+const (
+	// FlagMulti is set while the client is in a MULTI block, its commands are queued until EXEC or DISCARD
+	FlagMulti SessionFlag = 1 << iota
+	// FlagDirtyExec is set when a command is rejected while in a MULTI block, EXEC then discards the transaction
+	FlagDirtyExec
+)
+
+// Session is the state of a single client connection to the database.
+//
+// It holds the database selected by the client, its protocol version, its transaction queue, its name and flags.
+// A session is used by one client at a time, unlike the KeyValueDB which is shared by all of them.
+type Session struct {
+	ID       int64
+	DbIndex  int    // Database the commands of the client run against, changed by SELECT
+	Name     string // Set by CLIENT SETNAME
+	Protocol int    // RESP version negotiated with HELLO, either 2 or 3
+	flags    SessionFlag
+	cmdQueue []Command // Commands queued in a MULTI block
+	reclaim  bool      // Set by FLUSHDB and FLUSHALL SYNC, for Execute to reclaim the space of the removed keys
+
+	// Closed once the client disconnected, which cancels the blocking command it waits for
+	Done <-chan struct{}
+
+	// Link to the master whose stream the session applies, nil for the sessions of clients
+	master *masterLink
+	// Port a replica listens on, announced by REPLCONF listening-port before SYNC
+	replicaPort int
+
+	// Keys watched by WATCH along with their expiration time at that moment
+	watched map[dbKey]time.Time
+	// Set when one of the watched keys is modified, guarded by the lock of the watchers of the database
+	dirtyCAS bool
+}
+
+// NewSession returns a new session of a client connected to the database, identified by a unique id.
+func (k *KeyValueDB) NewSession() *Session {
+	return &Session{ID: k.clientID.Add(1), Protocol: 2}
+}
+
+// CloseSession releases the resources held by the session once its client disconnected.
+func (k *KeyValueDB) CloseSession(s *Session) {
+	k.unwatch(s)
+}
+
+// Has reports whether the given flag is set on the session.
+func (s *Session) Has(flag SessionFlag) bool {
+	return s.flags&flag != 0
+}
+
+func (s *Session) set(flag SessionFlag) {
+	s.flags |= flag
+}
+
+func (s *Session) clear(flag SessionFlag) {
+	s.flags &^= flag
+}
+
+func (k *KeyValueDB) selectCommand(s *Session, cmd Command) any {
+	dbIndex, err := k.storage.Select(cmd.Args[0])
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	s.DbIndex = dbIndex
+	return DBResult{DbIndex: dbIndex, Value: "", Type: StatusReply, Response: "OK"}
+}
+
+// helloCommand handles the HELLO command which negotiates the RESP version of a connection.
+//
+// It returns the server information map. The protocol version of the session stays the current one when
+// no version is requested or the requested one is not supported.
+func (k *KeyValueDB) helloCommand(s *Session, cmd Command) any {
+	version := max(s.Protocol, 2)
+	if len(cmd.Args) > 0 {
+		requested, err := strconv.Atoi(cmd.Args[0])
+		if err != nil {
+			return NewErrorResult(&CommandError{msg: "Protocol version is not an integer or out of range"})
+		}
+		if requested != 2 && requested != 3 {
+			return NewErrorResult(errors.New("(error) NOPROTO unsupported protocol version"))
+		}
+		version = requested
+	}
+	s.Protocol = version
+
+	role := "master"
+	if k.repl.isReplica() {
+		role = "replica"
+	}
+	return NewMapResult(
+		NewBulkResult("server"), NewBulkResult("kvdb"),
+		NewBulkResult("version"), NewBulkResult(Version),
+		NewBulkResult("proto"), NewIntegerResult(version),
+		NewBulkResult("id"), NewIntegerResult(int(s.ID)),
+		NewBulkResult("mode"), NewBulkResult("standalone"),
+		NewBulkResult("role"), NewBulkResult(role),
+		NewBulkResult("modules"), NewArrayResult(),
+	)
+}
+
+// disconnectCommand acknowledges DISCONNECT, the connection is closed by the server once the reply is sent.
+func (k *KeyValueDB) disconnectCommand(s *Session, _ Command) any {
+	return DBResult{DbIndex: s.DbIndex, Value: "", Type: StatusReply, Response: "OK"}
+}
+
+// pingCommand replies PONG, or the given message. Masters ping their replicas to keep the link alive.
+func (k *KeyValueDB) pingCommand(_ *Session, cmd Command) any {
+	if len(cmd.Args) > 0 {
+		return NewBulkResult(cmd.Args[0])
+	}
+	return NewStatusResult("PONG")
+}
+
+// clientCommand handles the CLIENT subcommands managing the connection of the client owning the session.
+func (k *KeyValueDB) clientCommand(s *Session, cmd Command) any {
+	subcommand := strings.ToUpper(cmd.Args[0])
+	if subcommand != "SETNAME" && len(cmd.Args) > 1 {
+		err := &CommandError{msg: fmt.Sprintf("%s %s command expected no argument but was given", CLIENT, subcommand)}
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+
+	switch subcommand {
+	case "ID":
+		return DBResult{DbIndex: s.DbIndex, Value: int(s.ID), Type: IntegerReply}
+	case "GETNAME":
+		if s.Name == "" {
+			return DBResult{DbIndex: s.DbIndex, Type: NilReply, Response: "(nil)"}
+		}
+		return DBResult{DbIndex: s.DbIndex, Value: s.Name, Type: BulkReply}
+	case "SETNAME":
+		if len(cmd.Args) < 2 {
+			err := &CommandError{msg: fmt.Sprintf("%s %s command expected 1 argument but none was given", CLIENT, subcommand)}
+			return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+		}
+		name := cmd.Args[1]
+		for _, c := range name {
+			if c <= ' ' || c > '~' {
+				err := &CommandError{msg: "Client names cannot contain spaces, newlines or special characters."}
+				return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+			}
+		}
+		s.Name = name
+		return DBResult{DbIndex: s.DbIndex, Value: "", Type: StatusReply, Response: "OK"}
+	}
+	err := &CommandError{msg: fmt.Sprintf("unknown subcommand '%s'", cmd.Args[0])}
+	return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+}
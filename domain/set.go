@@ -0,0 +1,505 @@
+package domain
+
+import (
+	"kvdb/storage"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// set is the value of the keys set by the set commands: an unordered collection of unique strings, modified in
+// place.
+type set map[string]struct{}
+
+// Clone returns a copy of the set.
+func (st set) Clone() any {
+	clone := make(set, len(st))
+	for member := range st {
+		clone[member] = struct{}{}
+	}
+	return clone
+}
+
+// has reports whether the member belongs to the set.
+func (st set) has(member string) bool {
+	_, ok := st[member]
+	return ok
+}
+
+// members returns the members of the set, sorted so that replies are stable.
+func (st set) members() []string {
+	members := make([]string, 0, len(st))
+	for member := range st {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// sample returns count distinct members of the set picked at random, all of them when the set holds fewer.
+// The members are picked by reservoir sampling while iterating over the set once, without sorting them.
+func (st set) sample(count int) []string {
+	picked := make([]string, 0, min(count, len(st)))
+	seen := 0
+	for member := range st {
+		if len(picked) < count {
+			picked = append(picked, member)
+		} else if i := rand.Intn(seen + 1); i < count {
+			picked[i] = member
+		}
+		seen++
+	}
+	return picked
+}
+
+// setValue returns the set held by a value, nil for the value of a missing key.
+func setValue(value any) (set, error) {
+	if value == nil {
+		return nil, nil
+	}
+	st, ok := value.(set)
+	if !ok {
+		return nil, &WrongTypeError{}
+	}
+	return st, nil
+}
+
+// viewSet calls fn with the set of a key while holding its lock, a missing key being an empty set.
+func (k *KeyValueDB) viewSet(dbIndex int, key string, fn func(st set)) error {
+	return k.storage.View(dbIndex, key, func(value any, _ bool) error {
+		st, err := setValue(value)
+		if err != nil {
+			return err
+		}
+		fn(st)
+		return nil
+	})
+}
+
+// updateSet calls fn with the set of a key while holding its lock, creating the set if the key does not exist.
+// The key is deleted when the set is left empty.
+func (k *KeyValueDB) updateSet(dbIndex int, key string, fn func(st set)) error {
+	_, err := k.storage.Update(dbIndex, key, func(value any, _ bool) (any, error) {
+		st, err := setValue(value)
+		if err != nil {
+			return nil, err
+		}
+		if st == nil {
+			st = set{}
+		}
+		fn(st)
+		if len(st) == 0 {
+			return nil, nil
+		}
+		return st, nil
+	})
+	return err
+}
+
+// membersResult returns the set reply holding the given members.
+func membersResult(dbIndex int, members []string) DBResult {
+	elems := []DBResult{}
+	for _, member := range members {
+		elems = append(elems, NewBulkResult(member))
+	}
+	return DBResult{DbIndex: dbIndex, Value: elems, Type: SetReply}
+}
+
+// saddCommand adds members to a set, creating it if the key does not exist, and returns the number of members added.
+func (k *KeyValueDB) saddCommand(s *Session, cmd Command) any {
+	added := 0
+	err := k.updateSet(s.DbIndex, cmd.Args[0], func(st set) {
+		for _, member := range cmd.Args[1:] {
+			if !st.has(member) {
+				st[member] = struct{}{}
+				added++
+			}
+		}
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: added, Type: IntegerReply}
+}
+
+// sremCommand removes members from a set and returns the number of members removed, the key is deleted
+// along with the last member.
+func (k *KeyValueDB) sremCommand(s *Session, cmd Command) any {
+	removed := 0
+	err := k.updateSet(s.DbIndex, cmd.Args[0], func(st set) {
+		for _, member := range cmd.Args[1:] {
+			if st.has(member) {
+				delete(st, member)
+				removed++
+			}
+		}
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	if removed == 0 {
+		return notFoundResult(s.DbIndex, cmd.Args[0], NewIntegerResult(0))
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: removed, Type: IntegerReply}
+}
+
+// smembersCommand returns the members of a set, sorted.
+func (k *KeyValueDB) smembersCommand(s *Session, cmd Command) any {
+	var members []string
+	if err := k.viewSet(s.DbIndex, cmd.Args[0], func(st set) { members = st.members() }); err != nil {
+		return NewErrorResult(err)
+	}
+	return membersResult(s.DbIndex, members)
+}
+
+// sismemberCommand handles SISMEMBER, and SMISMEMBER which returns whether every member belongs to the set.
+func (k *KeyValueDB) sismemberCommand(s *Session, cmd Command) any {
+	var elems []DBResult
+	err := k.viewSet(s.DbIndex, cmd.Args[0], func(st set) {
+		for _, member := range cmd.Args[1:] {
+			if st.has(member) {
+				elems = append(elems, NewIntegerResult(1))
+			} else {
+				elems = append(elems, NewIntegerResult(0))
+			}
+		}
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	if cmd.Keyword == SISMEMBER {
+		return DBResult{DbIndex: s.DbIndex, Value: elems[0].Value, Type: IntegerReply}
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: elems, Type: ArrayReply}
+}
+
+func (k *KeyValueDB) scardCommand(s *Session, cmd Command) any {
+	length := 0
+	if err := k.viewSet(s.DbIndex, cmd.Args[0], func(st set) { length = len(st) }); err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: length, Type: IntegerReply}
+}
+
+// spopCommand removes random members from a set. Without count, it returns the removed member alone.
+func (k *KeyValueDB) spopCommand(s *Session, cmd Command) any {
+	count := 1
+	if len(cmd.Args) > 1 {
+		var err error
+		if count, err = strconv.Atoi(cmd.Args[1]); err != nil || count < 0 {
+			return NewErrorResult(&CommandError{msg: "value is out of range, must be positive"})
+		}
+	}
+
+	var popped []string
+	err := k.updateSet(s.DbIndex, cmd.Args[0], func(st set) {
+		popped = st.sample(count)
+		for _, member := range popped {
+			delete(st, member)
+		}
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+
+	if len(cmd.Args) == 1 {
+		if len(popped) == 0 {
+			return notFoundResult(s.DbIndex, cmd.Args[0], NewNilResult())
+		}
+		return DBResult{DbIndex: s.DbIndex, Value: popped[0], Type: BulkReply}
+	}
+	sort.Strings(popped)
+	if len(popped) == 0 {
+		return notFoundResult(s.DbIndex, cmd.Args[0], membersResult(s.DbIndex, nil))
+	}
+	return membersResult(s.DbIndex, popped)
+}
+
+// srandmemberCommand returns random members of a set. Without count, it returns a single member. A positive count
+// returns distinct members, as many as the set holds at most, a negative one returns as many members as asked,
+// the same member possibly several times.
+func (k *KeyValueDB) srandmemberCommand(s *Session, cmd Command) any {
+	count := 1
+	if len(cmd.Args) > 1 {
+		var err error
+		if count, err = strconv.Atoi(cmd.Args[1]); err != nil {
+			return NewErrorResult(&CommandError{msg: "value is not an integer or out of range"})
+		}
+	}
+
+	var picked []string
+	err := k.viewSet(s.DbIndex, cmd.Args[0], func(st set) {
+		if count >= 0 || len(st) == 0 {
+			picked = st.sample(count)
+			return
+		}
+		members := make([]string, 0, len(st))
+		for member := range st {
+			members = append(members, member)
+		}
+		for i := 0; i < -count; i++ {
+			picked = append(picked, members[rand.Intn(len(members))])
+		}
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+
+	if len(cmd.Args) == 1 {
+		if len(picked) == 0 {
+			return DBResult{DbIndex: s.DbIndex, Type: NilReply, Response: "(nil)"}
+		}
+		return DBResult{DbIndex: s.DbIndex, Value: picked[0], Type: BulkReply}
+	}
+	elems := []DBResult{}
+	for _, member := range picked {
+		elems = append(elems, NewBulkResult(member))
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: elems, Type: ArrayReply}
+}
+
+// smoveCommand atomically moves a member from a set to another, it returns 0 when the member is not in the source.
+func (k *KeyValueDB) smoveCommand(s *Session, cmd Command) any {
+	source, destination, member := cmd.Args[0], cmd.Args[1], cmd.Args[2]
+	err := k.storage.UpdateValues(s.DbIndex, []string{source, destination}, func(values []any) ([]any, error) {
+		src, err := setValue(values[0])
+		if err != nil {
+			return nil, err
+		}
+		dst, err := setValue(values[1])
+		if err != nil {
+			return nil, err
+		}
+		if !src.has(member) {
+			return nil, storage.NewKeyNotFoundError(source)
+		}
+		if source == destination {
+			return values, nil
+		}
+		if dst == nil {
+			dst = set{}
+		}
+		delete(src, member)
+		dst[member] = struct{}{}
+		if len(src) == 0 {
+			return []any{nil, dst}, nil
+		}
+		return []any{src, dst}, nil
+	})
+	if err != nil {
+		if _, notFound := err.(*storage.KeyNotFoundError); notFound {
+			return notFoundResult(s.DbIndex, source, NewIntegerResult(0))
+		}
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: 1, Type: IntegerReply}
+}
+
+func checkSScanOptions(c Command) error {
+	if _, err := parseScanCursor(c.Args[1]); err != nil {
+		return err
+	}
+	_, err := parseScanOptions(c.Keyword, c.Args[2:])
+	return err
+}
+
+// sscanCommand iterates over the members of a set, returning the cursor of the next page along with the members
+// of the page.
+func (k *KeyValueDB) sscanCommand(s *Session, cmd Command) any {
+	cursor, err := parseScanCursor(cmd.Args[1])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	opts, err := parseScanOptions(cmd.Keyword, cmd.Args[2:])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+
+	var next uint64
+	elems := []DBResult{}
+	err = k.viewSet(s.DbIndex, cmd.Args[0], func(st set) {
+		var page []string
+		page, next = scan(st.members(), cursor, opts.count)
+		for _, member := range page {
+			if opts.match == "" || matchPattern(opts.match, member) {
+				elems = append(elems, NewBulkResult(member))
+			}
+		}
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return NewArrayResult(NewBulkResult(strconv.FormatUint(next, 10)), NewArrayResult(elems...))
+}
+
+// combineSets computes the intersection, union or difference of the sets held by values, a missing key being
+// an empty set. The difference holds the members of the first set found in none of the others.
+func combineSets(op string, values []any) (set, error) {
+	sets := make([]set, len(values))
+	for i, value := range values {
+		var err error
+		if sets[i], err = setValue(value); err != nil {
+			return nil, err
+		}
+	}
+
+	result := set{}
+	switch op {
+	case SINTER:
+		for member := range sets[0] {
+			inAll := true
+			for _, other := range sets[1:] {
+				if !other.has(member) {
+					inAll = false
+					break
+				}
+			}
+			if inAll {
+				result[member] = struct{}{}
+			}
+		}
+	case SUNION:
+		for _, st := range sets {
+			for member := range st {
+				result[member] = struct{}{}
+			}
+		}
+	case SDIFF:
+		for member := range sets[0] {
+			inOther := false
+			for _, other := range sets[1:] {
+				if other.has(member) {
+					inOther = true
+					break
+				}
+			}
+			if !inOther {
+				result[member] = struct{}{}
+			}
+		}
+	}
+	return result, nil
+}
+
+// setAlgebraCommand handles SINTER, SUNION and SDIFF, which return the members of the combined sets, sorted.
+func (k *KeyValueDB) setAlgebraCommand(s *Session, cmd Command) any {
+	var result set
+	err := k.storage.ViewValues(s.DbIndex, cmd.Args, func(values []any) error {
+		var err error
+		result, err = combineSets(cmd.Keyword, values)
+		return err
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return membersResult(s.DbIndex, result.members())
+}
+
+// setAlgebraStoreCommand handles SINTERSTORE, SUNIONSTORE and SDIFFSTORE, which store the combined sets in
+// the destination key, overwriting it, and return the number of members stored. The destination is deleted
+// when the result is empty.
+func (k *KeyValueDB) setAlgebraStoreCommand(s *Session, cmd Command) any {
+	op := strings.TrimSuffix(cmd.Keyword, "STORE")
+	stored := 0
+	err := k.storage.UpdateEntries(s.DbIndex, cmd.Args, func(entries []storage.Entry) ([]storage.Entry, error) {
+		values := make([]any, len(entries)-1)
+		for i, e := range entries[1:] {
+			values[i] = e.Value
+		}
+		result, err := combineSets(op, values)
+		if err != nil {
+			return nil, err
+		}
+		stored = len(result)
+		for i, key := range cmd.Args {
+			// The destination may also be a source, the last entry of a key given several times wins
+			if key == cmd.Args[0] {
+				entries[i] = storage.Entry{}
+				if stored > 0 {
+					entries[i].Value = result
+				}
+			}
+		}
+		return entries, nil
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: stored, Type: IntegerReply}
+}
+
+// parseNumKeys parses the number of keys following it in the arguments of commands such as SINTERCARD.
+func parseNumKeys(args []string) (int, error) {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, &CommandError{msg: "value is not an integer or out of range"}
+	}
+	if numKeys <= 0 {
+		return 0, &CommandError{msg: "numkeys should be greater than 0"}
+	}
+	if numKeys > len(args)-1 {
+		return 0, &CommandError{msg: "Number of keys can't be greater than number of args"}
+	}
+	return numKeys, nil
+}
+
+// numKeys returns the keys of commands giving their number before them, such as SINTERCARD.
+func numKeys(c Command) []string {
+	n, err := parseNumKeys(c.Args)
+	if err != nil {
+		return nil
+	}
+	return c.Args[1 : n+1]
+}
+
+// parseSInterCardLimit parses the options of SINTERCARD following its keys, 0 meaning no limit.
+func parseSInterCardLimit(options []string) (int, error) {
+	if len(options) == 0 {
+		return 0, nil
+	}
+	if len(options) != 2 || strings.ToUpper(options[0]) != "LIMIT" {
+		return 0, &CommandError{msg: "syntax error"}
+	}
+	limit, err := strconv.Atoi(options[1])
+	if err != nil {
+		return 0, &CommandError{msg: "value is not an integer or out of range"}
+	}
+	if limit < 0 {
+		return 0, &CommandError{msg: "LIMIT can't be negative"}
+	}
+	return limit, nil
+}
+
+func checkSInterCard(c Command) error {
+	n, err := parseNumKeys(c.Args)
+	if err != nil {
+		return err
+	}
+	_, err = parseSInterCardLimit(c.Args[n+1:])
+	return err
+}
+
+// sintercardCommand returns the number of members of the intersection of sets, counting up to the limit if any.
+func (k *KeyValueDB) sintercardCommand(s *Session, cmd Command) any {
+	keys := numKeys(cmd)
+	limit, err := parseSInterCardLimit(cmd.Args[len(keys)+1:])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+
+	var result set
+	err = k.storage.ViewValues(s.DbIndex, keys, func(values []any) error {
+		var err error
+		result, err = combineSets(SINTER, values)
+		return err
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	count := len(result)
+	if limit > 0 {
+		count = min(count, limit)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: count, Type: IntegerReply}
+}
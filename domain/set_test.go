@@ -0,0 +1,324 @@
+package domain
+
+import (
+	"fmt"
+	"kvdb/persistence"
+	"kvdb/storage"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyValueDB_Execute_SetCommands(t *testing.T) {
+	testCases := []struct {
+		name string
+		cmds []Command
+		want []any // SimpleMsg of the results
+	}{
+		{
+			name: "SADD, SMEMBERS and SCARD",
+			cmds: []Command{
+				NewCommand("SADD", "tags", "b", "a", "b"),
+				NewCommand("SADD", "tags", "c", "a"),
+				NewCommand("SMEMBERS", "tags"),
+				NewCommand("SCARD", "tags"),
+				NewCommand("SMEMBERS", "missing"),
+				NewCommand("SCARD", "missing"),
+			},
+			want: []any{
+				"(integer) 2", "(integer) 1", "1~ \"a\"\n2~ \"b\"\n3~ \"c\"", "(integer) 3",
+				"(empty array)", "(integer) 0",
+			},
+		},
+		{
+			name: "SREM",
+			cmds: []Command{
+				NewCommand("SADD", "tags", "a", "b"),
+				NewCommand("SREM", "tags", "a", "missing"),
+				NewCommand("SREM", "tags", "a"),
+				NewCommand("SREM", "tags", "b"),
+				NewCommand("EXISTS", "tags"),
+			},
+			want: []any{"(integer) 2", "(integer) 1", "(integer) 0", "(integer) 1", "(integer) 0"},
+		},
+		{
+			name: "SISMEMBER and SMISMEMBER",
+			cmds: []Command{
+				NewCommand("SADD", "tags", "a", "b"),
+				NewCommand("SISMEMBER", "tags", "a"),
+				NewCommand("SISMEMBER", "tags", "c"),
+				NewCommand("SISMEMBER", "missing", "a"),
+				NewCommand("SMISMEMBER", "tags", "b", "c", "a"),
+			},
+			want: []any{
+				"(integer) 2", "(integer) 1", "(integer) 0", "(integer) 0",
+				"1) (integer) 1\n2) (integer) 0\n3) (integer) 1",
+			},
+		},
+		{
+			name: "SPOP",
+			cmds: []Command{
+				NewCommand("SADD", "tags", "a"),
+				NewCommand("SPOP", "tags"),
+				NewCommand("SPOP", "tags"),
+				NewCommand("SADD", "tags", "a", "b", "c"),
+				NewCommand("SPOP", "tags", "5"),
+				NewCommand("EXISTS", "tags"),
+				NewCommand("SPOP", "tags", "1"),
+				NewCommand("SPOP", "tags", "-1"),
+			},
+			want: []any{
+				"(integer) 1", `"a"`, "(nil)", "(integer) 3", "1~ \"a\"\n2~ \"b\"\n3~ \"c\"", "(integer) 0",
+				"(empty array)", "(error) ERR value is out of range, must be positive",
+			},
+		},
+		{
+			name: "SRANDMEMBER",
+			cmds: []Command{
+				NewCommand("SADD", "tags", "a"),
+				NewCommand("SRANDMEMBER", "tags"),
+				NewCommand("SRANDMEMBER", "tags", "2"),
+				NewCommand("SRANDMEMBER", "tags", "-3"),
+				NewCommand("SRANDMEMBER", "tags", "0"),
+				NewCommand("SRANDMEMBER", "missing"),
+				NewCommand("SCARD", "tags"),
+			},
+			want: []any{
+				"(integer) 1", `"a"`, "1) \"a\"", "1) \"a\"\n2) \"a\"\n3) \"a\"", "(empty array)", "(nil)",
+				"(integer) 1",
+			},
+		},
+		{
+			name: "SMOVE",
+			cmds: []Command{
+				NewCommand("SADD", "src", "a", "b"),
+				NewCommand("SMOVE", "src", "dst", "a"),
+				NewCommand("SMOVE", "src", "dst", "a"),
+				NewCommand("SMOVE", "src", "src", "b"),
+				NewCommand("SMOVE", "src", "dst", "b"),
+				NewCommand("EXISTS", "src"),
+				NewCommand("SMEMBERS", "dst"),
+			},
+			want: []any{
+				"(integer) 2", "(integer) 1", "(integer) 0", "(integer) 1", "(integer) 1", "(integer) 0",
+				"1~ \"a\"\n2~ \"b\"",
+			},
+		},
+		{
+			name: "SSCAN",
+			cmds: []Command{
+				NewCommand("SADD", "tags", "go", "rust", "gleam"),
+				NewCommand("SSCAN", "tags", "0", "MATCH", "g*"),
+				NewCommand("SSCAN", "missing", "0"),
+				NewCommand("SSCAN", "tags", "0", "NOVALUES"),
+			},
+			want: []any{
+				"(integer) 3", "1) \"0\"\n2) 1) \"gleam\"\n   2) \"go\"", "1) \"0\"\n2) (empty array)",
+				"(error) ERR syntax error",
+			},
+		},
+		{
+			name: "SINTER, SUNION and SDIFF",
+			cmds: []Command{
+				NewCommand("SADD", "s1", "a", "b", "c"),
+				NewCommand("SADD", "s2", "b", "c", "d"),
+				NewCommand("SINTER", "s1", "s2"),
+				NewCommand("SUNION", "s1", "s2", "missing"),
+				NewCommand("SDIFF", "s1", "s2"),
+				NewCommand("SINTER", "s1", "missing"),
+				NewCommand("SDIFF", "missing", "s1"),
+			},
+			want: []any{
+				"(integer) 3", "(integer) 3", "1~ \"b\"\n2~ \"c\"", "1~ \"a\"\n2~ \"b\"\n3~ \"c\"\n4~ \"d\"",
+				"1~ \"a\"", "(empty array)", "(empty array)",
+			},
+		},
+		{
+			name: "SINTERSTORE, SUNIONSTORE and SDIFFSTORE",
+			cmds: []Command{
+				NewCommand("SADD", "s1", "a", "b", "c"),
+				NewCommand("SADD", "s2", "b", "c", "d"),
+				NewCommand("SET", "dst", "value", "EX", "100"),
+				NewCommand("SINTERSTORE", "dst", "s1", "s2"),
+				NewCommand("SMEMBERS", "dst"),
+				NewCommand("TTL", "dst"),
+				NewCommand("SUNIONSTORE", "s1", "s1", "s2"),
+				NewCommand("SCARD", "s1"),
+				NewCommand("SDIFFSTORE", "dst", "s2", "s1"),
+				NewCommand("EXISTS", "dst"),
+			},
+			want: []any{
+				"(integer) 3", "(integer) 3", "OK", "(integer) 2", "1~ \"b\"\n2~ \"c\"", "(integer) -1",
+				"(integer) 4", "(integer) 4", "(integer) 0", "(integer) 0",
+			},
+		},
+		{
+			name: "SINTERCARD",
+			cmds: []Command{
+				NewCommand("SADD", "s1", "a", "b", "c"),
+				NewCommand("SADD", "s2", "b", "c", "d"),
+				NewCommand("SINTERCARD", "2", "s1", "s2"),
+				NewCommand("SINTERCARD", "2", "s1", "s2", "LIMIT", "1"),
+				NewCommand("SINTERCARD", "1", "s1", "LIMIT", "0"),
+				NewCommand("SINTERCARD", "0", "s1"),
+				NewCommand("SINTERCARD", "3", "s1", "s2"),
+				NewCommand("SINTERCARD", "1", "s1", "LIMIT", "-1"),
+				NewCommand("SINTERCARD", "1", "s1", "s2"),
+			},
+			want: []any{
+				"(integer) 3", "(integer) 3", "(integer) 2", "(integer) 1", "(integer) 3",
+				"(error) ERR numkeys should be greater than 0",
+				"(error) ERR Number of keys can't be greater than number of args",
+				"(error) ERR LIMIT can't be negative",
+				"(error) ERR syntax error",
+			},
+		},
+		{
+			name: "Wrong type",
+			cmds: []Command{
+				NewCommand("SET", "string", "value"),
+				NewCommand("SADD", "tags", "a"),
+				NewCommand("SADD", "string", "a"),
+				NewCommand("SMEMBERS", "string"),
+				NewCommand("SINTER", "tags", "string"),
+				NewCommand("SMOVE", "tags", "string", "a"),
+				NewCommand("GET", "tags"),
+				NewCommand("HSET", "tags", "a", "b"),
+			},
+			want: []any{
+				"OK", "(integer) 1",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+			session := db.NewSession()
+			for i, cmd := range tc.cmds {
+				got := db.Execute(session, cmd).(DBResult).SimpleMsg()
+				if got != tc.want[i] {
+					t.Errorf("KeyValueDB.Execute(%v) = %v, want %v", cmd, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestKeyValueDB_SetPersistence(t *testing.T) {
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "appendonly.aof"), filepath.Join(dir, "dump.kvdb")
+	aof, err := persistence.OpenAOF(aofPath, persistence.FsyncAlways)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	db.EnableAOF(aof)
+	db.EnableSnapshots(snapshotPath, nil)
+	session := db.NewSession()
+	for _, cmd := range []Command{
+		NewCommand("SADD", "s1", "a", "b", "c", "d"),
+		NewCommand("SADD", "s2", "c", "d", "e"),
+		NewCommand("SPOP", "s1", "2"),
+		NewCommand("SUNIONSTORE", "tags", "s1", "s2"),
+		NewCommand("SMOVE", "s2", "tags", "e"),
+		NewCommand("SAVE"),
+	} {
+		if got := db.Execute(session, cmd).(DBResult); got.Err != nil {
+			t.Fatalf("KeyValueDB.Execute(%v) error = %v", cmd, got.Err)
+		}
+	}
+	want := db.Execute(session, NewCommand("SMEMBERS", "tags")).(DBResult).SimpleMsg()
+	if got := db.Execute(session, NewCommand("BGREWRITEAOF")).(DBResult); got.Err != nil {
+		t.Fatalf("BGREWRITEAOF error = %v", got.Err)
+	}
+	for aof.RewriteInProgress() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Unexpected error closing AOF: %v", err)
+	}
+
+	for _, load := range []struct {
+		name string
+		fn   func(db *KeyValueDB) error
+	}{
+		{name: "AOF", fn: func(db *KeyValueDB) error { return db.LoadAOF(aofPath, false) }},
+		{name: "Snapshot", fn: func(db *KeyValueDB) error { return db.LoadSnapshot(snapshotPath) }},
+	} {
+		t.Run(load.name, func(t *testing.T) {
+			loaded := NewKeyValueDB(storage.NewInMemoryStorage(1))
+			if err := load.fn(loaded); err != nil {
+				t.Fatalf("Loading the %s error = %v", load.name, err)
+			}
+			got := loaded.Execute(loaded.NewSession(), NewCommand("SMEMBERS", "tags")).(DBResult)
+			if got.SimpleMsg() != want {
+				t.Errorf("SMEMBERS tags = %v, want %v", got.SimpleMsg(), want)
+			}
+		})
+	}
+}
+
+func TestKeyValueDB_SpopPropagation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	aof, err := persistence.OpenAOF(path, persistence.FsyncAlways)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	db.EnableAOF(aof)
+	session := db.NewSession()
+	for i := 0; i < 20; i++ {
+		db.Execute(session, NewCommand("SADD", "tags", fmt.Sprintf("member%d", i)))
+	}
+	db.Execute(session, NewCommand("SPOP", "tags"))
+	db.Execute(session, NewCommand("SPOP", "tags", "5"))
+	db.Execute(session, NewCommand("SPOP", "missing", "5"))
+	want := db.Execute(session, NewCommand("SMEMBERS", "tags")).(DBResult).SimpleMsg()
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Unexpected error closing AOF: %v", err)
+	}
+
+	// Replaying the log removes the same random members
+	loaded := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	if err := loaded.LoadAOF(path, false); err != nil {
+		t.Fatalf("LoadAOF() error = %v", err)
+	}
+	if got := loaded.Execute(loaded.NewSession(), NewCommand("SMEMBERS", "tags")).(DBResult).SimpleMsg(); got != want {
+		t.Errorf("SMEMBERS tags after replay = %v, want %v", got, want)
+	}
+}
+
+func TestSet_Sample(t *testing.T) {
+	st := set{"a": {}, "b": {}, "c": {}, "d": {}}
+	if got := st.sample(0); len(got) != 0 {
+		t.Errorf("sample(0) = %v, want no members", got)
+	}
+	if got := st.sample(10); len(got) != len(st) {
+		t.Errorf("sample(10) = %v, want all the members", got)
+	}
+
+	// Every member is picked about as often as the others
+	picked := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		members := st.sample(2)
+		if len(members) != 2 || members[0] == members[1] {
+			t.Fatalf("sample(2) = %v, want 2 distinct members", members)
+		}
+		for _, member := range members {
+			picked[member]++
+		}
+	}
+	for member := range st {
+		if picked[member] < 1600 || picked[member] > 2400 {
+			t.Errorf("sample(2) picked %q %d times out of 4000, want about 2000", member, picked[member])
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package domain
+
+import "math/rand"
+
+const (
+	skiplistMaxLevel = 32   // Enough for 4^32 elements
+	skiplistP        = 0.25 // Probability for a node to rise to the next level
+)
+
+// skiplistNode is a member of a sorted set along with its score. Every level links the node to the next node
+// of that level and records the number of nodes the link spans, from which ranks are computed.
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	levels   []skiplistLevel
+}
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int
+}
+
+// skiplist orders the members of a sorted set by score, then by member, the way the skiplists of Redis do:
+// finding a member, its rank or the member at a given rank takes O(log n) on average.
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{header: &skiplistNode{levels: make([]skiplistLevel, skiplistMaxLevel)}, level: 1}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// before reports whether the node is ordered before the given score and member.
+func (n *skiplistNode) before(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+// notAfter reports whether the node is ordered before, or is, the given score and member.
+func (n *skiplistNode) notAfter(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member <= member)
+}
+
+// insert adds a member that the skiplist does not hold yet.
+func (sl *skiplist) insert(score float64, member string) *skiplistNode {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.levels[i].forward != nil && x.levels[i].forward.before(score, member) {
+			rank[i] += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			update[i] = sl.header
+			update[i].levels[i].span = sl.length
+		}
+		sl.level = level
+	}
+	x = &skiplistNode{member: member, score: score, levels: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.levels[i].forward = update[i].levels[i].forward
+		update[i].levels[i].forward = x
+		x.levels[i].span = update[i].levels[i].span - (rank[0] - rank[i])
+		update[i].levels[i].span = rank[0] - rank[i] + 1
+	}
+	// The levels above the new node span it too
+	for i := level; i < sl.level; i++ {
+		update[i].levels[i].span++
+	}
+
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.levels[0].forward != nil {
+		x.levels[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+	return x
+}
+
+// delete removes a member with the given score, it reports whether the member was found.
+func (sl *skiplist) delete(score float64, member string) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && x.levels[i].forward.before(score, member) {
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+	x = x.levels[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := 0; i < sl.level; i++ {
+		if update[i].levels[i].forward == x {
+			update[i].levels[i].span += x.levels[i].span - 1
+			update[i].levels[i].forward = x.levels[i].forward
+		} else {
+			update[i].levels[i].span--
+		}
+	}
+	if x.levels[0].forward != nil {
+		x.levels[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+	for sl.level > 1 && sl.header.levels[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+	return true
+}
+
+// rank returns the 0-based rank of a member with the given score, -1 if it is not found.
+func (sl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && x.levels[i].forward.notAfter(score, member) {
+			rank += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		if x != sl.header && x.score == score && x.member == member {
+			return rank - 1
+		}
+	}
+	return -1
+}
+
+// byRank returns the node at the given 0-based rank, nil if the rank is out of range.
+func (sl *skiplist) byRank(rank int) *skiplistNode {
+	if rank < 0 || rank >= sl.length {
+		return nil
+	}
+	traversed := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && traversed+x.levels[i].span <= rank+1 {
+			traversed += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		if traversed == rank+1 {
+			return x
+		}
+	}
+	return nil
+}
+
+// first returns the first node for which the predicate holds, or nil if it holds for none. The predicate must be
+// false for the first nodes and true for the following ones, e.g. whether a node is above the minimum of a range.
+func (sl *skiplist) first(fn func(n *skiplistNode) bool) *skiplistNode {
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && !fn(x.levels[i].forward) {
+			x = x.levels[i].forward
+		}
+	}
+	return x.levels[0].forward
+}
+
+// last returns the last node for which the predicate holds, or nil if it holds for none. The predicate must be
+// true for the first nodes and false for the following ones, e.g. whether a node is below the maximum of a range.
+func (sl *skiplist) last(fn func(n *skiplistNode) bool) *skiplistNode {
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && fn(x.levels[i].forward) {
+			x = x.levels[i].forward
+		}
+	}
+	if x == sl.header {
+		return nil
+	}
+	return x
+}
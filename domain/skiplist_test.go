@@ -0,0 +1,88 @@
+package domain
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestSkiplist(t *testing.T) {
+	type entry struct {
+		score  float64
+		member string
+	}
+	sl := newSkiplist()
+	var want []entry
+	sortEntries := func() {
+		sort.Slice(want, func(i, j int) bool {
+			if want[i].score != want[j].score {
+				return want[i].score < want[j].score
+			}
+			return want[i].member < want[j].member
+		})
+	}
+
+	check := func(step string) {
+		t.Helper()
+		if sl.length != len(want) {
+			t.Fatalf("%s: skiplist length = %d, want %d", step, sl.length, len(want))
+		}
+		var prev *skiplistNode
+		for i, e := range want {
+			x := sl.byRank(i)
+			if x == nil || x.score != e.score || x.member != e.member {
+				t.Fatalf("%s: skiplist.byRank(%d) = %v, want %v", step, i, x, e)
+			}
+			if x.backward != prev {
+				t.Fatalf("%s: backward link of rank %d is wrong", step, i)
+			}
+			if got := sl.rank(e.score, e.member); got != i {
+				t.Fatalf("%s: skiplist.rank(%v, %q) = %d, want %d", step, e.score, e.member, got, i)
+			}
+			prev = x
+		}
+		if sl.tail != prev {
+			t.Fatalf("%s: skiplist tail is wrong", step)
+		}
+		if got := sl.byRank(len(want)); got != nil {
+			t.Fatalf("%s: skiplist.byRank(%d) = %v, want nil", step, len(want), got)
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		e := entry{score: float64(rnd.Intn(50)), member: fmt.Sprintf("member%d", i)}
+		sl.insert(e.score, e.member)
+		want = append(want, e)
+	}
+	sortEntries()
+	check("insert")
+
+	if sl.delete(want[0].score, "missing") {
+		t.Errorf("skiplist.delete() of a missing member = true, want false")
+	}
+	for i := 0; i < 400; i++ {
+		j := rnd.Intn(len(want))
+		if !sl.delete(want[j].score, want[j].member) {
+			t.Fatalf("skiplist.delete(%v) = false, want true", want[j])
+		}
+		want = append(want[:j], want[j+1:]...)
+	}
+	check("delete")
+	if got := sl.rank(1000, "missing"); got != -1 {
+		t.Errorf("skiplist.rank() of a missing member = %d, want -1", got)
+	}
+
+	// Searching the first and last nodes of a range of scores
+	r := scoreRange{min: 10, max: 20, maxEx: true}
+	first, last := sl.first(r.aboveMin), sl.last(r.belowMax)
+	i := sort.Search(len(want), func(i int) bool { return want[i].score >= 10 })
+	j := sort.Search(len(want), func(i int) bool { return want[i].score >= 20 }) - 1
+	if first != sl.byRank(i) || last != sl.byRank(j) {
+		t.Errorf("skiplist.first() and skiplist.last() of [10, 20) = %v and %v, want ranks %d and %d", first, last, i, j)
+	}
+	if got := sl.first(scoreRange{min: 1000, max: 2000}.aboveMin); got != nil {
+		t.Errorf("skiplist.first() of a range above all scores = %v, want nil", got)
+	}
+}
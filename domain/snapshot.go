@@ -0,0 +1,279 @@
+package domain
+
+import (
+	"fmt"
+	"kvdb/persistence"
+	"log"
+	"sync"
+	"time"
+)
+
+// Delay before a failed automatic background save is attempted again
+const saveRetryDelay = 5 * time.Second
+
+// How often the save rules are checked
+var saveRulesInterval = time.Second
+
+// snapshotter keeps track of the binary snapshots of the databases and of the writes made since the last one.
+type snapshotter struct {
+	mu          sync.Mutex
+	path        string
+	rules       []persistence.SaveRule
+	saving      bool      // Whether a save is running
+	lastSave    time.Time // Time of the last successful save, or of the startup
+	lastAttempt time.Time // Time of the last save attempt
+	lastErr     error     // Error of the last save attempt
+	dirty       int       // Number of writes since the last successful save
+	dirtyAtSave int       // Value of dirty when the running save started
+	stop        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// SaveInProgressError is returned when a save is requested while another one is still running.
+type SaveInProgressError struct{}
+
+func (s *SaveInProgressError) Error() string {
+	return "(error) ERR Background save already in progress"
+}
+
+// EnableSnapshots makes SAVE and BGSAVE write snapshots to the given path and starts
+// saving automatically in the background whenever one of the save rules is met.
+func (k *KeyValueDB) EnableSnapshots(path string, rules []persistence.SaveRule) {
+	k.snapshots = &snapshotter{
+		path:     path,
+		rules:    rules,
+		lastSave: time.Now(),
+		stop:     make(chan struct{}),
+	}
+	if len(rules) > 0 {
+		k.snapshots.wg.Add(1)
+		go k.saveOnRules()
+	}
+}
+
+// CloseSnapshots stops the automatic saves, waits for a running background save and, when save rules
+// are configured and the data changed since the last save, saves a final snapshot.
+func (k *KeyValueDB) CloseSnapshots() error {
+	s := k.snapshots
+	if s == nil {
+		return nil
+	}
+	close(s.stop)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	needsSave := len(s.rules) > 0 && s.dirty > 0
+	s.mu.Unlock()
+	if needsSave {
+		k.lock.Lock()
+		defer k.lock.Unlock()
+		if res := k.save(false); res.Err != nil {
+			return res.Err
+		}
+	}
+	return nil
+}
+
+// LoadSnapshot loads the snapshot at the given path into the storage.
+func (k *KeyValueDB) LoadSnapshot(path string) error {
+	return persistence.LoadSnapshot(path, k.loadEntry)
+}
+
+// loadEntry stores a key of a snapshot into the storage.
+func (k *KeyValueDB) loadEntry(dbIndex int, entry persistence.SnapshotEntry) error {
+	if dbIndex >= k.storage.DbCount() {
+		return fmt.Errorf("snapshot holds database %d but only %d databases are available", dbIndex, k.storage.DbCount())
+	}
+	return k.storage.SetWithExpiry(dbIndex, entry.Key, importValue(entry.Value), entry.ExpireAt)
+}
+
+// exportValue returns a value the way persistence stores it: lists as the slice of their elements, hashes, sets
+// and sorted sets as a map.
+func exportValue(value any) any {
+	switch v := value.(type) {
+	case *list:
+		return v.elements()
+	case hash:
+		return map[string]string(v)
+	case set:
+		return map[string]struct{}(v)
+	case *zset:
+		return v.scores
+	}
+	return value
+}
+
+// importValue returns the value stored by persistence as exportValue returned it.
+func importValue(value any) any {
+	switch v := value.(type) {
+	case []string:
+		return newList(v...)
+	case map[string]string:
+		return hash(v)
+	case map[string]struct{}:
+		return set(v)
+	case map[string]float64:
+		z := newZSet()
+		for member, score := range v {
+			z.add(member, score)
+		}
+		return z
+	}
+	return value
+}
+
+// ValueCodec encodes the values of the keys, including lists, hashes, sets and sorted sets, for the storages
+// keeping them on disk.
+type ValueCodec struct{}
+
+func (ValueCodec) Encode(value any) ([]byte, error) {
+	return persistence.EncodeValue(exportValue(value))
+}
+
+func (ValueCodec) Decode(data []byte) (any, error) {
+	value, err := persistence.DecodeValue(data)
+	if err != nil {
+		return nil, err
+	}
+	return importValue(value), nil
+}
+
+// save writes a snapshot of all databases, either blocking other commands until it is written or in the background.
+//
+// It must be called while holding the lock of the database exclusively, so that the point-in-time copy of the
+// databases is consistent. A background save only needs the copy, the lock can be released once it returns.
+func (k *KeyValueDB) save(background bool) DBResult {
+	s := k.snapshots
+	if s == nil {
+		return NewErrorResult(&CommandError{msg: "Snapshots are disabled"})
+	}
+
+	s.mu.Lock()
+	if s.saving {
+		s.mu.Unlock()
+		return NewErrorResult(&SaveInProgressError{})
+	}
+	s.saving = true
+	s.mu.Unlock()
+
+	dbs, err := k.snapshotDBs()
+	if err != nil {
+		_ = s.finishSave(err)
+		return NewErrorResult(&CommandError{msg: err.Error()})
+	}
+	s.mu.Lock()
+	s.dirtyAtSave = s.dirty
+	s.mu.Unlock()
+
+	if background {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.finishSave(persistence.WriteSnapshot(s.path, dbs)); err == nil {
+				log.Println("Background saving terminated with success")
+			}
+		}()
+		return NewStatusResult("Background saving started")
+	}
+
+	if err := s.finishSave(persistence.WriteSnapshot(s.path, dbs)); err != nil {
+		return NewErrorResult(&CommandError{msg: err.Error()})
+	}
+	return NewStatusResult("OK")
+}
+
+// snapshotDBs copies the content of all databases, it must be called while holding the lock exclusively.
+func (k *KeyValueDB) snapshotDBs() ([]persistence.SnapshotDB, error) {
+	var dbs []persistence.SnapshotDB
+	for dbIndex := 0; dbIndex < k.storage.DbCount(); dbIndex++ {
+		db := persistence.SnapshotDB{Index: dbIndex}
+		entries, err := k.allEntries(dbIndex)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			db.Entries = append(db.Entries, persistence.SnapshotEntry{Key: e.Key, Value: exportValue(e.Value), ExpireAt: e.ExpireAt})
+		}
+		dbs = append(dbs, db)
+	}
+	return dbs, nil
+}
+
+// saveCommand handles SAVE and BGSAVE.
+func (k *KeyValueDB) saveCommand(_ *Session, cmd Command) any {
+	return k.save(cmd.Keyword == BGSAVE)
+}
+
+// lastsaveCommand returns the LASTSAVE reply, the unix time of the last successful save.
+func (k *KeyValueDB) lastsaveCommand(_ *Session, _ Command) any {
+	s := k.snapshots
+	if s == nil {
+		return NewErrorResult(&CommandError{msg: "Snapshots are disabled"})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewIntegerResult(int(s.lastSave.Unix()))
+}
+
+// saveOnRules checks the save rules periodically and starts a background save when one of them is met.
+func (k *KeyValueDB) saveOnRules() {
+	s := k.snapshots
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(saveRulesInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			if s.shouldSave(now) {
+				k.lock.Lock()
+				k.save(true)
+				k.lock.Unlock()
+			}
+		}
+	}
+}
+
+func (s *snapshotter) shouldSave(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.saving || (s.lastErr != nil && now.Sub(s.lastAttempt) < saveRetryDelay) {
+		return false
+	}
+	for _, rule := range s.rules {
+		elapsed := now.Sub(s.lastSave)
+		if s.dirty >= rule.Changes && s.dirty > 0 && elapsed >= time.Duration(rule.Seconds)*time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *snapshotter) finishSave(err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.saving = false
+	s.lastAttempt = time.Now()
+	s.lastErr = err
+	if err != nil {
+		log.Printf("Error saving snapshot: %v\n", err)
+		return err
+	}
+	s.lastSave = s.lastAttempt
+	s.dirty -= s.dirtyAtSave
+	return nil
+}
+
+// markDirty records a successful write, it does nothing when snapshots are disabled.
+func (s *snapshotter) markDirty() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.dirty++
+	s.mu.Unlock()
+}
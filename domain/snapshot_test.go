@@ -0,0 +1,199 @@
+package domain
+
+import (
+	"kvdb/persistence"
+	"kvdb/storage"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyValueDB_Execute_SaveCommands(t *testing.T) {
+	for _, keyword := range []string{"SAVE", "BGSAVE"} {
+		t.Run(keyword, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dump.kvdb")
+			db := NewKeyValueDB(storage.NewInMemoryStorage(5))
+
+			got := db.Execute(newSession(0), NewCommand(keyword)).(DBResult)
+			if got.Kind() != ErrorReply {
+				t.Errorf("%s without snapshots = %v, want an error", keyword, got)
+			}
+
+			db.EnableSnapshots(path, nil)
+			db.Execute(newSession(0), NewCommand("SET", "key", "10"))
+			db.Execute(newSession(0), NewCommand("INCR", "key"))
+			db.Execute(newSession(3), NewCommand("SET", "other", "value"))
+			db.Execute(newSession(3), NewCommand("SET", "expiring", "value", "EX", "100"))
+
+			got = db.Execute(newSession(0), NewCommand(keyword)).(DBResult)
+			if got.Err != nil {
+				t.Fatalf("%s error = %v", keyword, got.Err)
+			}
+			waitSave(t, db)
+			if db.snapshots.dirty != 0 {
+				t.Errorf("Changes since last save after %s = %d, want 0", keyword, db.snapshots.dirty)
+			}
+
+			loadedDB := NewKeyValueDB(storage.NewInMemoryStorage(5))
+			if err := loadedDB.LoadSnapshot(path); err != nil {
+				t.Fatalf("KeyValueDB.LoadSnapshot() error = %v", err)
+			}
+			for _, c := range []struct {
+				dbIndex int
+				key     string
+				want    any
+			}{
+				{0, "key", "11"},
+				{3, "other", "value"},
+				{3, "expiring", "value"},
+			} {
+				res := loadedDB.Execute(newSession(c.dbIndex), NewCommand("GET", c.key)).(DBResult)
+				if res.Value != c.want {
+					t.Errorf("GET %s in db %d after %s = %v, want %v", c.key, c.dbIndex, keyword, res.Value, c.want)
+				}
+			}
+			if res := loadedDB.Execute(newSession(3), NewCommand("TTL", "expiring")).(DBResult); res.Value != 100 {
+				t.Errorf("TTL expiring after %s = %v, want 100", keyword, res.Value)
+			}
+			if err := db.CloseSnapshots(); err != nil {
+				t.Errorf("KeyValueDB.CloseSnapshots() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestKeyValueDB_Execute_LastSaveCommand(t *testing.T) {
+	db := NewKeyValueDB(storage.NewInMemoryStorage(5))
+	db.EnableSnapshots(filepath.Join(t.TempDir(), "dump.kvdb"), nil)
+	db.snapshots.lastSave = time.Unix(1000, 0)
+
+	got := db.Execute(newSession(0), NewCommand("LASTSAVE")).(DBResult)
+	if got.Value != 1000 {
+		t.Errorf("LASTSAVE = %v, want %v", got.Value, 1000)
+	}
+
+	db.Execute(newSession(0), NewCommand("SAVE"))
+	got = db.Execute(newSession(0), NewCommand("LASTSAVE")).(DBResult)
+	if got.Value.(int) < int(time.Now().Unix())-1 {
+		t.Errorf("LASTSAVE after SAVE = %v, want the current time", got.Value)
+	}
+}
+
+func TestKeyValueDB_SaveRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.kvdb")
+	db := NewKeyValueDB(storage.NewInMemoryStorage(5))
+	defaultInterval := saveRulesInterval
+	saveRulesInterval = 10 * time.Millisecond
+	defer func() { saveRulesInterval = defaultInterval }()
+	db.EnableSnapshots(path, []persistence.SaveRule{{Seconds: 0, Changes: 3}})
+	defer db.CloseSnapshots()
+
+	db.Execute(newSession(0), NewCommand("SET", "key1", "value"))
+	db.Execute(newSession(0), NewCommand("SET", "key2", "value"))
+	time.Sleep(50 * time.Millisecond)
+	db.snapshots.mu.Lock()
+	dirty := db.snapshots.dirty
+	db.snapshots.mu.Unlock()
+	if dirty != 2 {
+		t.Fatalf("Changes since last save = %d, want 2 as the rule is not met yet", dirty)
+	}
+
+	db.Execute(newSession(0), NewCommand("SET", "key3", "value"))
+	for i := 0; ; i++ {
+		db.snapshots.mu.Lock()
+		dirty = db.snapshots.dirty
+		db.snapshots.mu.Unlock()
+		if dirty == 0 {
+			break
+		}
+		if i == 200 {
+			t.Fatalf("Save rule did not trigger a background save")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitSave(t *testing.T, db *KeyValueDB) {
+	t.Helper()
+	for i := 0; ; i++ {
+		db.snapshots.mu.Lock()
+		saving := db.snapshots.saving
+		db.snapshots.mu.Unlock()
+		if !saving {
+			return
+		}
+		if i == 500 {
+			t.Fatalf("Background save did not complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeyValueDB_DiskStorages(t *testing.T) {
+	storages := map[string]func(dir string) (storage.Storage, error){
+		"bitcask": func(dir string) (storage.Storage, error) {
+			return storage.OpenBitcaskStorage(dir, 2, storage.BitcaskOptions{Codec: ValueCodec{}})
+		},
+		"lsm": func(dir string) (storage.Storage, error) {
+			return storage.OpenLSMStorage(dir, 2, storage.LSMOptions{Codec: ValueCodec{}})
+		},
+	}
+	for name, openStorage := range storages {
+		t.Run(name, func(t *testing.T) {
+			testDiskStorage(t, openStorage)
+		})
+	}
+}
+
+// testDiskStorage writes values of every type to a storage keeping them on disk, then checks them once reopened.
+func testDiskStorage(t *testing.T, openStorage func(dir string) (storage.Storage, error)) {
+	dir := t.TempDir()
+	open := func() (*KeyValueDB, storage.Storage) {
+		s, err := openStorage(dir)
+		if err != nil {
+			t.Fatalf("Opening the storage error = %v", err)
+		}
+		return NewKeyValueDB(s), s
+	}
+	db, s := open()
+	session := db.NewSession()
+	for _, cmd := range []Command{
+		NewCommand("SET", "string", "value"),
+		NewCommand("INCRBY", "counter", "41"),
+		NewCommand("RPUSH", "list", "a", "b", "c"),
+		NewCommand("LPOP", "list"),
+		NewCommand("HSET", "hash", "field", "value"),
+		NewCommand("SADD", "set", "a", "b"),
+		NewCommand("ZADD", "zset", "1.5", "a", "-2", "b"),
+		NewCommand("SET", "expiring", "value", "EX", "100"),
+	} {
+		if got := db.Execute(session, cmd).(DBResult); got.Err != nil {
+			t.Fatalf("KeyValueDB.Execute(%v) error = %v", cmd, got.Err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Storage.Close() error = %v", err)
+	}
+
+	db, s = open()
+	defer s.Close()
+	session = db.NewSession()
+	testCases := []struct {
+		cmd  Command
+		want string
+	}{
+		{cmd: NewCommand("GET", "string"), want: `"value"`},
+		{cmd: NewCommand("INCR", "counter"), want: "(integer) 42"},
+		{cmd: NewCommand("LRANGE", "list", "0", "-1"), want: "1) \"b\"\n2) \"c\""},
+		{cmd: NewCommand("HGET", "hash", "field"), want: `"value"`},
+		{cmd: NewCommand("SMEMBERS", "set"), want: "1~ \"a\"\n2~ \"b\""},
+		{cmd: NewCommand("ZRANGE", "zset", "0", "-1", "WITHSCORES"), want: "1) \"b\"\n2) (double) -2\n3) \"a\"\n4) (double) 1.5"},
+		{cmd: NewCommand("TTL", "expiring"), want: "(integer) 100"},
+		{cmd: NewCommand("DBSIZE"), want: "(integer) 7"},
+	}
+	for _, tc := range testCases {
+		if got := db.Execute(session, tc.cmd).(DBResult).SimpleMsg(); got != tc.want {
+			t.Errorf("KeyValueDB.Execute(%v) after reopening = %v, want %v", tc.cmd, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package domain
+
+import (
+	"fmt"
+	"kvdb/storage"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Maximum length of a string value, the one of a bulk string
+const maxStringLength = 512 * 1024 * 1024
+
+// WrongTypeError is returned by the commands run against a key holding a value of another type
+type WrongTypeError struct{}
+
+func (w *WrongTypeError) Error() string {
+	return "(error) WRONGTYPE Operation against a key holding the wrong kind of value"
+}
+
+// stringValue returns the string representation of a value set by the string commands,
+// i.e. a string or an integer stored by INCR.
+func stringValue(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int:
+		return strconv.Itoa(v), nil
+	}
+	return "", &WrongTypeError{}
+}
+
+// setString sets the string value of a key along the given SET options and returns the previous value of the key,
+// whether it existed and whether the value was set, which it is not when the NX or XX condition is not met.
+func (k *KeyValueDB) setString(dbIndex int, key string, value string, opts setOptions) (any, bool, bool, error) {
+	var expireAt time.Time
+	if opts.expiry != "" {
+		expireAt, _ = absoluteTime(opts.expiry, opts.ttl, time.Now())
+	}
+
+	var old any
+	var oldExists, set bool
+	_, err := k.storage.UpdateEntry(dbIndex, key, func(e storage.Entry, exists bool) (storage.Entry, error) {
+		if opts.get && exists {
+			if _, err := stringValue(e.Value); err != nil {
+				return e, err
+			}
+		}
+		old, oldExists = e.Value, exists
+		if (opts.condition == optNX && exists) || (opts.condition == optXX && !exists) {
+			return e, nil
+		}
+		set = true
+		if opts.keepTTL {
+			expireAt = e.ExpireAt
+		}
+		return storage.Entry{Value: value, ExpireAt: expireAt}, nil
+	})
+	return old, oldExists, set, err
+}
+
+func (k *KeyValueDB) setCommand(s *Session, cmd Command) any {
+	dbIndex := s.DbIndex
+	opts, _ := parseSetOptions(cmd.Args[2:])
+	old, oldExists, set, err := k.setString(dbIndex, cmd.Args[0], cmd.Args[1], opts)
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	if opts.get {
+		if !oldExists {
+			return DBResult{DbIndex: dbIndex, Type: NilReply, Response: "(nil)"}
+		}
+		return DBResult{DbIndex: dbIndex, Value: old, Type: BulkReply}
+	}
+	if !set {
+		return DBResult{DbIndex: dbIndex, Type: NilReply, Response: "(nil)"}
+	}
+	return DBResult{DbIndex: dbIndex, Value: "", Type: StatusReply, Response: "OK"}
+}
+
+func (k *KeyValueDB) setnxCommand(s *Session, cmd Command) any {
+	_, _, set, err := k.setString(s.DbIndex, cmd.Args[0], cmd.Args[1], setOptions{condition: optNX})
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	if !set {
+		return DBResult{DbIndex: s.DbIndex, Value: 0, Type: IntegerReply}
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: 1, Type: IntegerReply}
+}
+
+func (k *KeyValueDB) setexCommand(s *Session, cmd Command) any {
+	ttl, err := parseExpiry(SETEX, optEX, cmd.Args[1])
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	_, _, _, err = k.setString(s.DbIndex, cmd.Args[0], cmd.Args[2], setOptions{expiry: optEX, ttl: ttl})
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: "", Type: StatusReply, Response: "OK"}
+}
+
+func (k *KeyValueDB) getsetCommand(s *Session, cmd Command) any {
+	old, oldExists, _, err := k.setString(s.DbIndex, cmd.Args[0], cmd.Args[1], setOptions{get: true})
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	if !oldExists {
+		return DBResult{DbIndex: s.DbIndex, Type: NilReply, Response: "(nil)"}
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: old, Type: BulkReply}
+}
+
+func (k *KeyValueDB) getCommand(s *Session, cmd Command) any {
+	dbIndex := s.DbIndex
+	result, err := k.storage.Get(dbIndex, cmd.Args[0])
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: NilReply, Response: "(nil)", Err: err}
+	}
+	if _, err := stringValue(result); err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	return DBResult{DbIndex: dbIndex, Value: result, Type: BulkReply}
+}
+
+// getexCommand handles GETEX, which returns the value of a key after setting or removing its expiration time
+// if given an option, and GETDEL, which deletes the key once read.
+func (k *KeyValueDB) getexCommand(s *Session, cmd Command) any {
+	dbIndex := s.DbIndex
+	var opts setOptions
+	if cmd.Keyword == GETEX {
+		var err error
+		if opts, err = parseGetExOptions(cmd.Args[1:]); err != nil {
+			return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+		}
+	}
+	var expireAt time.Time
+	if opts.expiry != "" {
+		expireAt, _ = absoluteTime(opts.expiry, opts.ttl, time.Now())
+	}
+
+	var value any
+	_, err := k.storage.UpdateEntry(dbIndex, cmd.Args[0], func(e storage.Entry, exists bool) (storage.Entry, error) {
+		if !exists {
+			return e, storage.NewKeyNotFoundError(cmd.Args[0])
+		}
+		if _, err := stringValue(e.Value); err != nil {
+			return e, err
+		}
+		value = e.Value
+		switch {
+		case cmd.Keyword == GETDEL:
+			return storage.Entry{}, nil
+		case opts.expiry != "":
+			e.ExpireAt = expireAt
+		case opts.persist:
+			e.ExpireAt = time.Time{}
+		}
+		return e, nil
+	})
+	if _, notFound := err.(*storage.KeyNotFoundError); notFound {
+		return DBResult{Value: err.Error(), Type: NilReply, Response: "(nil)", Err: err}
+	}
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	return DBResult{DbIndex: dbIndex, Value: value, Type: BulkReply}
+}
+
+func (k *KeyValueDB) appendCommand(s *Session, cmd Command) any {
+	newValue, err := k.storage.Update(s.DbIndex, cmd.Args[0], func(value any, exists bool) (any, error) {
+		if !exists {
+			return cmd.Args[1], nil
+		}
+		str, err := stringValue(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(str)+len(cmd.Args[1]) > maxStringLength {
+			return nil, &CommandError{msg: "string exceeds maximum allowed size (proto-max-bulk-len)"}
+		}
+		return str + cmd.Args[1], nil
+	})
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: len(newValue.(string)), Type: IntegerReply}
+}
+
+func (k *KeyValueDB) strlenCommand(s *Session, cmd Command) any {
+	value, err := k.storage.Get(s.DbIndex, cmd.Args[0])
+	if err != nil {
+		return DBResult{DbIndex: s.DbIndex, Value: 0, Type: IntegerReply}
+	}
+	str, err := stringValue(value)
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: len(str), Type: IntegerReply}
+}
+
+// getrangeCommand returns the substring of the value of a key between two offsets, both included.
+// Negative offsets count from the end of the value.
+func (k *KeyValueDB) getrangeCommand(s *Session, cmd Command) any {
+	start, err1 := strconv.Atoi(cmd.Args[1])
+	end, err2 := strconv.Atoi(cmd.Args[2])
+	if err1 != nil || err2 != nil {
+		err := &CommandError{msg: "value is not an integer or out of range"}
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+
+	value, err := k.storage.Get(s.DbIndex, cmd.Args[0])
+	if err != nil {
+		return DBResult{DbIndex: s.DbIndex, Value: "", Type: BulkReply}
+	}
+	str, err := stringValue(value)
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+
+	if start < 0 {
+		start = max(len(str)+start, 0)
+	}
+	if end < 0 {
+		end = max(len(str)+end, 0)
+	}
+	end = min(end, len(str)-1)
+	if start > end || len(str) == 0 {
+		return DBResult{DbIndex: s.DbIndex, Value: "", Type: BulkReply}
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: str[start : end+1], Type: BulkReply}
+}
+
+// setrangeCommand overwrites the value of a key from an offset, padding it with zero bytes if it is shorter.
+func (k *KeyValueDB) setrangeCommand(s *Session, cmd Command) any {
+	offset, err := strconv.Atoi(cmd.Args[1])
+	if err != nil || offset < 0 {
+		err := &CommandError{msg: "offset is out of range"}
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	patch := cmd.Args[2]
+	if offset+len(patch) > maxStringLength {
+		err := &CommandError{msg: "string exceeds maximum allowed size (proto-max-bulk-len)"}
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+
+	newValue, err := k.storage.Update(s.DbIndex, cmd.Args[0], func(value any, exists bool) (any, error) {
+		str := ""
+		if exists {
+			var err error
+			if str, err = stringValue(value); err != nil {
+				return nil, err
+			}
+		}
+		if patch == "" {
+			// The value is left untouched, a missing key is not created
+			return value, nil
+		}
+		buf := []byte(str)
+		if len(buf) < offset+len(patch) {
+			buf = append(buf, make([]byte, offset+len(patch)-len(buf))...)
+		}
+		copy(buf[offset:], patch)
+		return string(buf), nil
+	})
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	length := 0
+	if newValue != nil {
+		str, _ := stringValue(newValue)
+		length = len(str)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: length, Type: IntegerReply}
+}
+
+// msetCommand handles MSET and MSETNX, which sets none of the keys when one of them exists.
+func (k *KeyValueDB) msetCommand(s *Session, cmd Command) any {
+	dbIndex := s.DbIndex
+	var entries []storage.Entry
+	for i := 0; i+1 < len(cmd.Args); i += 2 {
+		entries = append(entries, storage.Entry{Key: cmd.Args[i], Value: cmd.Args[i+1]})
+	}
+
+	if cmd.Keyword == MSET {
+		if err := k.storage.MSet(dbIndex, entries); err != nil {
+			return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+		}
+		return DBResult{DbIndex: dbIndex, Value: "", Type: StatusReply, Response: "OK"}
+	}
+
+	set, err := k.storage.MSetNX(dbIndex, entries)
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	if !set {
+		return DBResult{DbIndex: dbIndex, Value: 0, Type: IntegerReply}
+	}
+	return DBResult{DbIndex: dbIndex, Value: 1, Type: IntegerReply}
+}
+
+// mgetCommand returns the values of the given keys, keys holding a value of another type than a string
+// have a nil reply like missing keys.
+func (k *KeyValueDB) mgetCommand(s *Session, cmd Command) any {
+	var values []DBResult
+	for _, value := range k.storage.MGet(s.DbIndex, cmd.Args...) {
+		if _, err := stringValue(value); err != nil {
+			values = append(values, NewNilResult())
+		} else {
+			values = append(values, NewBulkResult(value))
+		}
+	}
+	return NewArrayResult(values...)
+}
+
+// incrCommand handles INCR, INCRBY, DECR and DECRBY, a missing key counts as 0.
+//
+// The new value is stored as a decimal string, the canonical form of integers, and increments overflowing
+// a 64-bit integer are rejected.
+func (k *KeyValueDB) incrCommand(s *Session, cmd Command) any {
+	dbIndex := s.DbIndex
+	delta := int64(1)
+	if cmd.Keyword == INCRBY || cmd.Keyword == DECRBY {
+		var err error
+		if delta, err = convertToInt64(cmd.Args[1]); err != nil {
+			return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+		}
+	}
+	if cmd.Keyword == DECR || cmd.Keyword == DECRBY {
+		if delta == math.MinInt64 {
+			err := &CommandError{msg: "decrement would overflow"}
+			return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+		}
+		delta = -delta
+	}
+
+	var result int64
+	_, err := k.storage.Update(dbIndex, cmd.Args[0], func(value any, exists bool) (any, error) {
+		var current int64
+		if exists {
+			var err error
+			if current, err = convertToInt64(value); err != nil {
+				return nil, err
+			}
+		}
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return nil, &CommandError{msg: "increment or decrement would overflow"}
+		}
+		result = current + delta
+		return strconv.FormatInt(result, 10), nil
+	})
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	return DBResult{DbIndex: dbIndex, Value: int(result), Type: IntegerReply}
+}
+
+// incrbyfloatCommand increments the value of a key by a floating point number, a missing key counts as 0.
+//
+// The new value is computed and formatted by addFloats, as Redis does, then stored and returned.
+func (k *KeyValueDB) incrbyfloatCommand(s *Session, cmd Command) any {
+	dbIndex := s.DbIndex
+	if _, err := convertToFloat(cmd.Args[1]); err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+
+	newValue, err := k.storage.Update(dbIndex, cmd.Args[0], func(value any, exists bool) (any, error) {
+		current := "0"
+		if exists {
+			if _, err := convertToFloat(value); err != nil {
+				return nil, err
+			}
+			current = fmt.Sprint(value)
+		}
+		return addFloats(current, cmd.Args[1])
+	})
+	if err != nil {
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+	return DBResult{DbIndex: dbIndex, Value: newValue, Type: BulkReply}
+}
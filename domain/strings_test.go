@@ -0,0 +1,232 @@
+package domain
+
+import (
+	"kvdb/storage"
+	"testing"
+)
+
+func TestKeyValueDB_Execute_StringCommands(t *testing.T) {
+	testCases := []struct {
+		name string
+		cmds []Command
+		want []any // SimpleMsg of the results
+	}{
+		{
+			name: "SET NX and XX",
+			cmds: []Command{
+				NewCommand("SET", "key", "1", "XX"),
+				NewCommand("SET", "key", "1", "NX"),
+				NewCommand("SET", "key", "2", "NX"),
+				NewCommand("SET", "key", "3", "xx"),
+				NewCommand("GET", "key"),
+			},
+			want: []any{"(nil)", "OK", "(nil)", "OK", `"3"`},
+		},
+		{
+			name: "SET GET",
+			cmds: []Command{
+				NewCommand("SET", "key", "1", "GET"),
+				NewCommand("SET", "key", "2", "GET"),
+				NewCommand("SET", "key", "3", "NX", "GET"),
+				NewCommand("GET", "key"),
+			},
+			want: []any{"(nil)", `"1"`, `"2"`, `"2"`},
+		},
+		{
+			name: "SET conflicting options",
+			cmds: []Command{NewCommand("SET", "key", "1", "NX", "XX")},
+			want: []any{"(error) ERR syntax error"},
+		},
+		{
+			name: "SETNX",
+			cmds: []Command{
+				NewCommand("SETNX", "key", "1"),
+				NewCommand("SETNX", "key", "2"),
+				NewCommand("GET", "key"),
+			},
+			want: []any{"(integer) 1", "(integer) 0", `"1"`},
+		},
+		{
+			name: "SETEX",
+			cmds: []Command{
+				NewCommand("SETEX", "key", "100", "value"),
+				NewCommand("TTL", "key"),
+				NewCommand("SETEX", "key", "0", "value"),
+			},
+			want: []any{"OK", "(integer) 100", "(error) ERR invalid expire time in 'setex' command"},
+		},
+		{
+			name: "GETSET removes the expiration time",
+			cmds: []Command{
+				NewCommand("GETSET", "key", "1"),
+				NewCommand("EXPIRE", "key", "100"),
+				NewCommand("GETSET", "key", "2"),
+				NewCommand("TTL", "key"),
+			},
+			want: []any{"(nil)", "(integer) 1", `"1"`, "(integer) -1"},
+		},
+		{
+			name: "GETDEL",
+			cmds: []Command{
+				NewCommand("SET", "key", "value"),
+				NewCommand("GETDEL", "key"),
+				NewCommand("GETDEL", "key"),
+				NewCommand("EXISTS", "key"),
+			},
+			want: []any{"OK", `"value"`, "(nil)", "(integer) 0"},
+		},
+		{
+			name: "GETEX",
+			cmds: []Command{
+				NewCommand("SET", "key", "value"),
+				NewCommand("GETEX", "key", "EX", "100"),
+				NewCommand("TTL", "key"),
+				NewCommand("GETEX", "key"),
+				NewCommand("TTL", "key"),
+				NewCommand("GETEX", "key", "PERSIST"),
+				NewCommand("TTL", "key"),
+				NewCommand("GETEX", "missing", "PERSIST"),
+				NewCommand("GETEX", "key", "PERSIST", "EX", "10"),
+			},
+			want: []any{
+				"OK", `"value"`, "(integer) 100", `"value"`, "(integer) 100", `"value"`, "(integer) -1", "(nil)",
+				"(error) ERR syntax error",
+			},
+		},
+		{
+			name: "APPEND and STRLEN",
+			cmds: []Command{
+				NewCommand("APPEND", "key", "Hello"),
+				NewCommand("APPEND", "key", " World"),
+				NewCommand("STRLEN", "key"),
+				NewCommand("STRLEN", "missing"),
+				NewCommand("GET", "key"),
+			},
+			want: []any{"(integer) 5", "(integer) 11", "(integer) 11", "(integer) 0", `"Hello World"`},
+		},
+		{
+			name: "APPEND to an integer",
+			cmds: []Command{
+				NewCommand("SET", "key", "10"),
+				NewCommand("INCR", "key"),
+				NewCommand("APPEND", "key", "0"),
+				NewCommand("INCR", "key"),
+			},
+			want: []any{"OK", "(integer) 11", "(integer) 3", "(integer) 111"},
+		},
+		{
+			name: "GETRANGE",
+			cmds: []Command{
+				NewCommand("SET", "key", "This is a string"),
+				NewCommand("GETRANGE", "key", "0", "3"),
+				NewCommand("GETRANGE", "key", "-3", "-1"),
+				NewCommand("GETRANGE", "key", "0", "-1"),
+				NewCommand("GETRANGE", "key", "10", "100"),
+				NewCommand("GETRANGE", "key", "5", "3"),
+				NewCommand("GETRANGE", "missing", "0", "-1"),
+				NewCommand("GETRANGE", "key", "a", "1"),
+			},
+			want: []any{
+				"OK", `"This"`, `"ing"`, `"This is a string"`, `"string"`, `""`, `""`,
+				"(error) ERR value is not an integer or out of range",
+			},
+		},
+		{
+			name: "SETRANGE",
+			cmds: []Command{
+				NewCommand("SET", "key", "Hello World"),
+				NewCommand("SETRANGE", "key", "6", "Redis"),
+				NewCommand("GET", "key"),
+				NewCommand("SETRANGE", "padded", "3", "abc"),
+				NewCommand("GET", "padded"),
+				NewCommand("SETRANGE", "missing", "3", ""),
+				NewCommand("EXISTS", "missing"),
+				NewCommand("SETRANGE", "key", "-1", "abc"),
+			},
+			want: []any{
+				"OK", "(integer) 11", `"Hello Redis"`, "(integer) 6", `"\x00\x00\x00abc"`, "(integer) 0", "(integer) 0",
+				"(error) ERR offset is out of range",
+			},
+		},
+		{
+			name: "Missing keys count as 0",
+			cmds: []Command{
+				NewCommand("INCR", "incr"),
+				NewCommand("DECR", "decr"),
+				NewCommand("DECRBY", "decrby", "5"),
+				NewCommand("INCRBYFLOAT", "float", "2.5"),
+			},
+			want: []any{"(integer) 1", "(integer) -1", "(integer) -5", `"2.5"`},
+		},
+		{
+			name: "Integers are stored in canonical form",
+			cmds: []Command{
+				NewCommand("SET", "key", "010"),
+				NewCommand("DECRBY", "key", "-5"),
+				NewCommand("GET", "key"),
+				NewCommand("DECRBY", "key", "a"),
+				NewCommand("SET", "key", "1.5"),
+				NewCommand("INCR", "key"),
+			},
+			want: []any{
+				"OK", "(integer) 15", `"15"`, "(error) ERR value is not an integer or out of range", "OK",
+				"(error) ERR value is not an integer or out of range",
+			},
+		},
+		{
+			name: "64-bit overflow",
+			cmds: []Command{
+				NewCommand("SET", "key", "9223372036854775806"),
+				NewCommand("INCR", "key"),
+				NewCommand("INCR", "key"),
+				NewCommand("SET", "key", "-9223372036854775807"),
+				NewCommand("DECRBY", "key", "2"),
+				NewCommand("DECRBY", "key", "-9223372036854775808"),
+				NewCommand("INCRBY", "key", "9223372036854775808"),
+				NewCommand("GET", "key"),
+			},
+			want: []any{
+				"OK", "(integer) 9223372036854775807", "(error) ERR increment or decrement would overflow", "OK",
+				"(error) ERR increment or decrement would overflow", "(error) ERR decrement would overflow",
+				"(error) ERR value is not an integer or out of range", `"-9223372036854775807"`,
+			},
+		},
+		{
+			name: "INCRBYFLOAT",
+			cmds: []Command{
+				NewCommand("SET", "key", "10.50"),
+				NewCommand("INCRBYFLOAT", "key", "0.1"),
+				NewCommand("INCRBYFLOAT", "key", "-5"),
+				NewCommand("SET", "key", "5.0e3"),
+				NewCommand("INCRBYFLOAT", "key", "2.0e2"),
+				NewCommand("INCR", "key"),
+				NewCommand("INCRBYFLOAT", "key", "abc"),
+				NewCommand("SET", "key", "1e308"),
+				NewCommand("INCRBYFLOAT", "key", "1e308"),
+				NewCommand("INCRBYFLOAT", "sum", "0.1"),
+				NewCommand("INCRBYFLOAT", "sum", "0.2"),
+				NewCommand("SET", "key", "9007199254740993"),
+				NewCommand("INCRBYFLOAT", "key", "1"),
+			},
+			want: []any{
+				"OK", `"10.6"`, `"5.6"`, "OK", `"5200"`, "(integer) 5201", "(error) ERR value is not a valid float",
+				"OK",
+				"(error) ERR increment would produce NaN or Infinity",
+				`"0.1"`, `"0.3"`, "OK", `"9007199254740994"`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+			session := db.NewSession()
+			for i, cmd := range tc.cmds {
+				got := db.Execute(session, cmd).(DBResult).SimpleMsg()
+				if got != tc.want[i] {
+					t.Errorf("KeyValueDB.Execute(%v) = %v, want %v", cmd, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
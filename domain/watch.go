@@ -0,0 +1,125 @@
+package domain
+
+import (
+	"sync"
+	"time"
+)
+
+// dbKey identifies a key of a given database
+type dbKey struct {
+	dbIndex int
+	key     string
+}
+
+// watchers tracks the sessions watching every key, to flag them when the key is modified.
+type watchers struct {
+	mu       sync.Mutex
+	sessions map[dbKey]map[*Session]struct{}
+}
+
+// watch adds the keys of the given database to the keys watched by the session.
+//
+// The expiration time the keys have when watched is recorded, so that EXEC can tell whether they expired since.
+func (k *KeyValueDB) watch(s *Session, keys []string) DBResult {
+	if s.Has(FlagMulti) {
+		err := &CommandError{msg: "WATCH inside MULTI is not allowed"}
+		return DBResult{Value: err.Error(), Type: ErrorReply, Err: err}
+	}
+
+	k.watchers.mu.Lock()
+	defer k.watchers.mu.Unlock()
+
+	if k.watchers.sessions == nil {
+		k.watchers.sessions = make(map[dbKey]map[*Session]struct{})
+	}
+	if s.watched == nil {
+		s.watched = make(map[dbKey]time.Time)
+	}
+	for _, key := range keys {
+		dk := dbKey{dbIndex: s.DbIndex, key: key}
+		if _, ok := s.watched[dk]; ok {
+			continue
+		}
+		expireAt, _ := k.storage.ExpireTime(s.DbIndex, key)
+		s.watched[dk] = expireAt
+		if k.watchers.sessions[dk] == nil {
+			k.watchers.sessions[dk] = make(map[*Session]struct{})
+		}
+		k.watchers.sessions[dk][s] = struct{}{}
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: "", Type: StatusReply, Response: "OK"}
+}
+
+func (k *KeyValueDB) watchCommand(s *Session, cmd Command) any {
+	return k.watch(s, cmd.keys())
+}
+
+func (k *KeyValueDB) unwatchCommand(s *Session, _ Command) any {
+	k.unwatch(s)
+	return DBResult{DbIndex: s.DbIndex, Value: "", Type: StatusReply, Response: "OK"}
+}
+
+// unwatch forgets all the keys watched by the session.
+func (k *KeyValueDB) unwatch(s *Session) {
+	k.watchers.mu.Lock()
+	defer k.watchers.mu.Unlock()
+
+	for dk := range s.watched {
+		delete(k.watchers.sessions[dk], s)
+		if len(k.watchers.sessions[dk]) == 0 {
+			delete(k.watchers.sessions, dk)
+		}
+	}
+	s.watched = nil
+	s.dirtyCAS = false
+}
+
+// touchKeys flags the sessions watching the given keys of a database, it is called once they were modified.
+func (k *KeyValueDB) touchKeys(dbIndex int, keys ...string) {
+	k.watchers.mu.Lock()
+	defer k.watchers.mu.Unlock()
+
+	for _, key := range keys {
+		for s := range k.watchers.sessions[dbKey{dbIndex: dbIndex, key: key}] {
+			s.dirtyCAS = true
+		}
+	}
+}
+
+// touchDB flags the sessions watching keys of a database that exist in one of the given databases, it is called
+// before the database is flushed or replaced by one of them.
+func (k *KeyValueDB) touchDB(dbIndex int, dbIndexes ...int) {
+	k.watchers.mu.Lock()
+	defer k.watchers.mu.Unlock()
+
+	for dk, sessions := range k.watchers.sessions {
+		if dk.dbIndex != dbIndex {
+			continue
+		}
+		for _, other := range dbIndexes {
+			if k.storage.Exists(other, dk.key) > 0 {
+				for s := range sessions {
+					s.dirtyCAS = true
+				}
+				break
+			}
+		}
+	}
+}
+
+// watchedKeysChanged reports whether one of the keys watched by the session was modified or expired since WATCH.
+func (k *KeyValueDB) watchedKeysChanged(s *Session) bool {
+	k.watchers.mu.Lock()
+	defer k.watchers.mu.Unlock()
+
+	if s.dirtyCAS {
+		return true
+	}
+	now := time.Now()
+	for _, expireAt := range s.watched {
+		if !expireAt.IsZero() && !now.Before(expireAt) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package domain
+
+import (
+	"kvdb/storage"
+	"testing"
+	"time"
+)
+
+func TestKeyValueDB_Execute_WatchCommand(t *testing.T) {
+	testCases := []struct {
+		name      string
+		setup     []Command // Executed by the session before WATCH
+		other     []Command // Executed by another client between WATCH and MULTI
+		wait      time.Duration
+		wantAbort bool
+	}{
+		{
+			name: "Unmodified key",
+		},
+		{
+			name:  "Other key modified",
+			other: []Command{NewCommand("SET", "other", "value")},
+		},
+		{
+			name:      "Key modified",
+			other:     []Command{NewCommand("INCR", "counter")},
+			wantAbort: true,
+		},
+		{
+			name:      "Key deleted",
+			other:     []Command{NewCommand("DEL", "counter")},
+			wantAbort: true,
+		},
+		{
+			name:      "Key expiration time changed",
+			other:     []Command{NewCommand("EXPIRE", "counter", "100")},
+			wantAbort: true,
+		},
+		{
+			name:  "Missing key not created",
+			other: []Command{NewCommand("DEL", "missing")},
+		},
+		{
+			name:      "Key renamed",
+			other:     []Command{NewCommand("RENAME", "counter", "other")},
+			wantAbort: true,
+		},
+		{
+			name:      "Key moved to another database",
+			other:     []Command{NewCommand("MOVE", "counter", "1")},
+			wantAbort: true,
+		},
+		{
+			name:      "Database flushed",
+			other:     []Command{NewCommand("FLUSHDB", "ASYNC")},
+			wantAbort: true,
+		},
+		{
+			name:  "Other database flushed",
+			other: []Command{NewCommand("SELECT", "1"), NewCommand("FLUSHDB")},
+		},
+		{
+			name:      "Databases swapped",
+			other:     []Command{NewCommand("SWAPDB", "1", "0")},
+			wantAbort: true,
+		},
+		{
+			name:      "Key expired",
+			setup:     []Command{NewCommand("PEXPIRE", "counter", "20")},
+			wait:      50 * time.Millisecond,
+			wantAbort: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := NewKeyValueDB(storage.NewInMemoryStorage(2))
+			session, other := db.NewSession(), db.NewSession()
+			db.Execute(session, NewCommand("SET", "counter", "10"))
+			for _, cmd := range tc.setup {
+				db.Execute(session, cmd)
+			}
+
+			if got := db.Execute(session, NewCommand("WATCH", "counter", "missing")).(DBResult); got.Response != "OK" {
+				t.Fatalf("WATCH = %v, want OK", got)
+			}
+			for _, cmd := range tc.other {
+				db.Execute(other, cmd)
+			}
+			time.Sleep(tc.wait)
+
+			db.Execute(session, NewCommand("MULTI"))
+			db.Execute(session, NewCommand("SET", "counter", "0"))
+			got := db.Execute(session, NewCommand("EXEC"))
+
+			if res, aborted := got.(DBResult); aborted != tc.wantAbort {
+				t.Fatalf("EXEC = %v, want aborted %v", got, tc.wantAbort)
+			} else if aborted && res.Kind() != NilReply {
+				t.Errorf("EXEC of an aborted transaction = %v, want a nil reply", res)
+			}
+
+			// EXEC unwatches all keys, the next transaction is not aborted
+			db.Execute(other, NewCommand("INCR", "counter"))
+			db.Execute(session, NewCommand("MULTI"))
+			if got, ok := db.Execute(session, NewCommand("EXEC")).([]DBResult); !ok {
+				t.Errorf("EXEC after an EXEC = %v, want no aborted transaction", got)
+			}
+		})
+	}
+}
+
+func TestKeyValueDB_Execute_UnwatchCommand(t *testing.T) {
+	db := NewKeyValueDB(storage.NewInMemoryStorage(2))
+	session, other := db.NewSession(), db.NewSession()
+
+	db.Execute(session, NewCommand("WATCH", "key"))
+	db.Execute(session, NewCommand("UNWATCH"))
+	db.Execute(other, NewCommand("SET", "key", "value"))
+	db.Execute(session, NewCommand("MULTI"))
+	if got, ok := db.Execute(session, NewCommand("EXEC")).([]DBResult); !ok {
+		t.Errorf("EXEC after UNWATCH = %v, want no aborted transaction", got)
+	}
+
+	db.Execute(session, NewCommand("MULTI"))
+	got := db.Execute(session, NewCommand("WATCH", "key")).(DBResult)
+	if want := "(error) ERR WATCH inside MULTI is not allowed"; got.Err == nil || got.Err.Error() != want {
+		t.Errorf("WATCH inside MULTI = %v, want Error %v", got.Err, want)
+	}
+	db.Execute(session, NewCommand("DISCARD"))
+
+	// Watched keys of closed sessions are forgotten
+	db.Execute(session, NewCommand("WATCH", "key", "other"))
+	db.CloseSession(session)
+	if len(db.watchers.sessions) != 0 {
+		t.Errorf("Keys still watched after CloseSession() = %v", db.watchers.sessions)
+	}
+}
@@ -0,0 +1,869 @@
+package domain
+
+import (
+	"fmt"
+	"kvdb/storage"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// zset is the value of the keys set by the sorted set commands: unique members ordered by their score, then
+// lexicographically. The scores of the members are looked up in a map and their order is kept by a skiplist, both
+// modified in place.
+type zset struct {
+	scores map[string]float64
+	index  *skiplist
+}
+
+func newZSet() *zset {
+	return &zset{scores: map[string]float64{}, index: newSkiplist()}
+}
+
+// Len returns the number of members of the sorted set.
+func (z *zset) Len() int {
+	return len(z.scores)
+}
+
+// Clone returns a copy of the sorted set, rebuilding its skiplist.
+func (z *zset) Clone() any {
+	clone := newZSet()
+	for x := z.index.header.levels[0].forward; x != nil; x = x.levels[0].forward {
+		clone.add(x.member, x.score)
+	}
+	return clone
+}
+
+// add sets the score of a member, it reports whether the member was added rather than updated.
+func (z *zset) add(member string, score float64) bool {
+	current, exists := z.scores[member]
+	if exists {
+		if current == score {
+			return false
+		}
+		z.index.delete(current, member)
+	}
+	z.scores[member] = score
+	z.index.insert(score, member)
+	return !exists
+}
+
+// remove removes a member, it reports whether the member was found.
+func (z *zset) remove(member string) bool {
+	score, exists := z.scores[member]
+	if !exists {
+		return false
+	}
+	delete(z.scores, member)
+	z.index.delete(score, member)
+	return true
+}
+
+// rank returns the 0-based rank of a member, by ascending score or by descending score when reversed.
+func (z *zset) rank(member string, reversed bool) (int, bool) {
+	score, exists := z.scores[member]
+	if !exists {
+		return 0, false
+	}
+	rank := z.index.rank(score, member)
+	if reversed {
+		rank = z.Len() - 1 - rank
+	}
+	return rank, true
+}
+
+// byRank returns the members from the start rank to the end rank, both included, ascending or descending.
+func (z *zset) byRank(start, end int, reversed bool) []*skiplistNode {
+	var nodes []*skiplistNode
+	if reversed {
+		for x := z.index.byRank(z.Len() - 1 - start); x != nil && len(nodes) <= end-start; x = x.backward {
+			nodes = append(nodes, x)
+		}
+		return nodes
+	}
+	for x := z.index.byRank(start); x != nil && len(nodes) <= end-start; x = x.levels[0].forward {
+		nodes = append(nodes, x)
+	}
+	return nodes
+}
+
+// inRange returns the members of a score or lexicographical range, ascending or descending, skipping the first
+// offset members and returning at most count members, all of them if count is negative.
+func (z *zset) inRange(r zrange, reversed bool, offset, count int) []*skiplistNode {
+	var x *skiplistNode
+	if reversed {
+		x = z.index.last(r.belowMax)
+	} else {
+		x = z.index.first(r.aboveMin)
+	}
+	next := func(x *skiplistNode) *skiplistNode {
+		if reversed {
+			return x.backward
+		}
+		return x.levels[0].forward
+	}
+
+	for ; x != nil && offset > 0; offset-- {
+		x = next(x)
+	}
+	var nodes []*skiplistNode
+	for ; x != nil && count != 0 && r.aboveMin(x) && r.belowMax(x); x = next(x) {
+		nodes = append(nodes, x)
+		count--
+	}
+	return nodes
+}
+
+// count returns the number of members of a range.
+func (z *zset) count(r zrange) int {
+	first, last := z.index.first(r.aboveMin), z.index.last(r.belowMax)
+	if first == nil || last == nil {
+		return 0
+	}
+	return max(z.index.rank(last.score, last.member)-z.index.rank(first.score, first.member)+1, 0)
+}
+
+// zsetValue returns the sorted set held by a value, nil for the value of a missing key.
+func zsetValue(value any) (*zset, error) {
+	if value == nil {
+		return nil, nil
+	}
+	z, ok := value.(*zset)
+	if !ok {
+		return nil, &WrongTypeError{}
+	}
+	return z, nil
+}
+
+// viewZSet calls fn with the sorted set of a key while holding its lock, a missing key being an empty sorted set.
+func (k *KeyValueDB) viewZSet(dbIndex int, key string, fn func(z *zset)) error {
+	return k.storage.View(dbIndex, key, func(value any, _ bool) error {
+		z, err := zsetValue(value)
+		if err != nil {
+			return err
+		}
+		if z == nil {
+			z = newZSet()
+		}
+		fn(z)
+		return nil
+	})
+}
+
+// updateZSet calls fn with the sorted set of a key while holding its lock, creating the sorted set if the key does
+// not exist. The key is deleted when the sorted set is left empty.
+func (k *KeyValueDB) updateZSet(dbIndex int, key string, fn func(z *zset) error) error {
+	_, err := k.storage.Update(dbIndex, key, func(value any, _ bool) (any, error) {
+		z, err := zsetValue(value)
+		if err != nil {
+			return nil, err
+		}
+		if z == nil {
+			z = newZSet()
+		}
+		if err := fn(z); err != nil {
+			return nil, err
+		}
+		if z.Len() == 0 {
+			return nil, nil
+		}
+		return z, nil
+	})
+	return err
+}
+
+// zrange is a range of members of a sorted set, either by score or lexicographical.
+type zrange interface {
+	aboveMin(n *skiplistNode) bool
+	belowMax(n *skiplistNode) bool
+}
+
+// scoreRange is a range of scores, whose bounds are excluded when given as "(score".
+type scoreRange struct {
+	min, max     float64
+	minEx, maxEx bool
+}
+
+func parseScoreBound(arg string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(arg, "(")
+	if exclusive {
+		arg = arg[1:]
+	}
+	score, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false, &CommandError{msg: "min or max is not a float"}
+	}
+	return score, exclusive, nil
+}
+
+func parseScoreRange(min, max string) (scoreRange, error) {
+	var r scoreRange
+	var err error
+	if r.min, r.minEx, err = parseScoreBound(min); err != nil {
+		return r, err
+	}
+	if r.max, r.maxEx, err = parseScoreBound(max); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+func (r scoreRange) aboveMin(n *skiplistNode) bool {
+	if r.minEx {
+		return n.score > r.min
+	}
+	return n.score >= r.min
+}
+
+func (r scoreRange) belowMax(n *skiplistNode) bool {
+	if r.maxEx {
+		return n.score < r.max
+	}
+	return n.score <= r.max
+}
+
+// lexBound is a bound of a lexicographical range: "[member" includes the member, "(member" excludes it,
+// and "-" and "+" are lower and greater than any member.
+type lexBound struct {
+	member    string
+	exclusive bool
+	inf       int // -1 for "-", 1 for "+"
+}
+
+func parseLexBound(arg string) (lexBound, error) {
+	switch {
+	case arg == "-":
+		return lexBound{inf: -1}, nil
+	case arg == "+":
+		return lexBound{inf: 1}, nil
+	case strings.HasPrefix(arg, "["):
+		return lexBound{member: arg[1:]}, nil
+	case strings.HasPrefix(arg, "("):
+		return lexBound{member: arg[1:], exclusive: true}, nil
+	}
+	return lexBound{}, &CommandError{msg: "min or max not valid string range item"}
+}
+
+// lexRange is a lexicographical range, which is only meaningful when all the members share the same score.
+type lexRange struct {
+	min, max lexBound
+}
+
+func parseLexRange(min, max string) (lexRange, error) {
+	var r lexRange
+	var err error
+	if r.min, err = parseLexBound(min); err != nil {
+		return r, err
+	}
+	if r.max, err = parseLexBound(max); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+func (r lexRange) aboveMin(n *skiplistNode) bool {
+	switch {
+	case r.min.inf != 0:
+		return r.min.inf < 0
+	case r.min.exclusive:
+		return n.member > r.min.member
+	}
+	return n.member >= r.min.member
+}
+
+func (r lexRange) belowMax(n *skiplistNode) bool {
+	switch {
+	case r.max.inf != 0:
+		return r.max.inf > 0
+	case r.max.exclusive:
+		return n.member < r.max.member
+	}
+	return n.member <= r.max.member
+}
+
+// nodesResult returns the array reply holding the given members, each followed by its score if asked.
+func nodesResult(dbIndex int, nodes []*skiplistNode, withScores bool) DBResult {
+	elems := []DBResult{}
+	for _, x := range nodes {
+		elems = append(elems, NewBulkResult(x.member))
+		if withScores {
+			elems = append(elems, NewDoubleResult(x.score))
+		}
+	}
+	return DBResult{DbIndex: dbIndex, Value: elems, Type: ArrayReply}
+}
+
+// zaddOptions are the options of ZADD: NX adds new members only and XX updates existing ones only, GT and LT
+// update the score of existing members only when the new score is greater or lower, CH counts the updated members
+// along with the added ones and INCR increments the score of a single member, the way ZINCRBY does.
+type zaddOptions struct {
+	nx, xx, gt, lt, ch, incr bool
+}
+
+// parseZAddOptions parses the options of ZADD and returns them along with the score member pairs following them.
+func parseZAddOptions(args []string) (zaddOptions, []string, error) {
+	var opts zaddOptions
+	i := 0
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			opts.nx = true
+		case "XX":
+			opts.xx = true
+		case "GT":
+			opts.gt = true
+		case "LT":
+			opts.lt = true
+		case "CH":
+			opts.ch = true
+		case "INCR":
+			opts.incr = true
+		default:
+			break options
+		}
+	}
+	pairs := args[i:]
+	switch {
+	case len(pairs) == 0 || len(pairs)%2 != 0:
+		return opts, nil, &CommandError{msg: "syntax error"}
+	case opts.nx && opts.xx:
+		return opts, nil, &CommandError{msg: "XX and NX options at the same time are not compatible"}
+	case (opts.gt && opts.nx) || (opts.lt && opts.nx) || (opts.gt && opts.lt):
+		return opts, nil, &CommandError{msg: "GT, LT, and/or NX options at the same time are not compatible"}
+	case opts.incr && len(pairs) > 2:
+		return opts, nil, &CommandError{msg: "INCR option supports a single increment-element pair"}
+	}
+	return opts, pairs, nil
+}
+
+func checkZAddOptions(c Command) error {
+	_, _, err := parseZAddOptions(c.Args[1:])
+	return err
+}
+
+// zaddCommand adds members to a sorted set, or updates their score, and returns the number of members added.
+func (k *KeyValueDB) zaddCommand(s *Session, cmd Command) any {
+	opts, pairs, err := parseZAddOptions(cmd.Args[1:])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return k.zadd(s.DbIndex, cmd.Args[0], opts, pairs)
+}
+
+// zincrbyCommand increments the score of a member of a sorted set, a missing member counting as 0.
+func (k *KeyValueDB) zincrbyCommand(s *Session, cmd Command) any {
+	return k.zadd(s.DbIndex, cmd.Args[0], zaddOptions{incr: true}, cmd.Args[1:])
+}
+
+func (k *KeyValueDB) zadd(dbIndex int, key string, opts zaddOptions, pairs []string) DBResult {
+	scores := make([]float64, len(pairs)/2)
+	for i := range scores {
+		score, err := strconv.ParseFloat(pairs[2*i], 64)
+		if err != nil || math.IsNaN(score) {
+			return NewErrorResult(&CommandError{msg: "value is not a valid float"})
+		}
+		scores[i] = score
+	}
+
+	added, updated := 0, 0
+	var incremented float64
+	performed := false
+	err := k.updateZSet(dbIndex, key, func(z *zset) error {
+		for i, score := range scores {
+			member := pairs[2*i+1]
+			current, exists := z.scores[member]
+			if (opts.nx && exists) || (opts.xx && !exists) {
+				continue
+			}
+			if opts.incr {
+				score += current
+				if math.IsNaN(score) {
+					return &CommandError{msg: "resulting score is not a number (NaN)"}
+				}
+			}
+			if exists && ((opts.gt && score <= current) || (opts.lt && score >= current)) {
+				continue
+			}
+			switch {
+			case !exists:
+				added++
+			case score != current:
+				updated++
+			}
+			z.add(member, score)
+			incremented, performed = score, true
+		}
+		return nil
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+
+	var result DBResult
+	switch {
+	case opts.incr && !performed:
+		result = NewNilResult()
+	case opts.incr:
+		result = DBResult{DbIndex: dbIndex, Value: incremented, Type: DoubleReply}
+	case opts.ch:
+		result = DBResult{DbIndex: dbIndex, Value: added + updated, Type: IntegerReply}
+	default:
+		result = DBResult{DbIndex: dbIndex, Value: added, Type: IntegerReply}
+	}
+	if added+updated == 0 {
+		return notFoundResult(dbIndex, key, result)
+	}
+	return result
+}
+
+func (k *KeyValueDB) zscoreCommand(s *Session, cmd Command) any {
+	var score float64
+	found := false
+	if err := k.viewZSet(s.DbIndex, cmd.Args[0], func(z *zset) { score, found = z.scores[cmd.Args[1]] }); err != nil {
+		return NewErrorResult(err)
+	}
+	if !found {
+		return DBResult{DbIndex: s.DbIndex, Type: NilReply, Response: "(nil)"}
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: score, Type: DoubleReply}
+}
+
+func (k *KeyValueDB) zcardCommand(s *Session, cmd Command) any {
+	length := 0
+	if err := k.viewZSet(s.DbIndex, cmd.Args[0], func(z *zset) { length = z.Len() }); err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: length, Type: IntegerReply}
+}
+
+func checkZRankOptions(c Command) error {
+	if len(c.Args) == 3 && strings.ToUpper(c.Args[2]) != "WITHSCORE" {
+		return &CommandError{msg: "syntax error"}
+	}
+	return nil
+}
+
+// zrankCommand handles ZRANK and ZREVRANK, which return the rank of a member by ascending or descending score,
+// along with its score when given the WITHSCORE option.
+func (k *KeyValueDB) zrankCommand(s *Session, cmd Command) any {
+	var rank int
+	var score float64
+	found := false
+	err := k.viewZSet(s.DbIndex, cmd.Args[0], func(z *zset) {
+		rank, found = z.rank(cmd.Args[1], cmd.Keyword == ZREVRANK)
+		score = z.scores[cmd.Args[1]]
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	switch {
+	case !found:
+		return DBResult{DbIndex: s.DbIndex, Type: NilReply, Response: "(nil)"}
+	case len(cmd.Args) == 3:
+		return DBResult{DbIndex: s.DbIndex, Value: []DBResult{NewIntegerResult(rank), NewDoubleResult(score)}, Type: ArrayReply}
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: rank, Type: IntegerReply}
+}
+
+// zremCommand removes members from a sorted set and returns the number of members removed, the key is deleted
+// along with the last member.
+func (k *KeyValueDB) zremCommand(s *Session, cmd Command) any {
+	removed := 0
+	err := k.updateZSet(s.DbIndex, cmd.Args[0], func(z *zset) error {
+		for _, member := range cmd.Args[1:] {
+			if z.remove(member) {
+				removed++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	if removed == 0 {
+		return notFoundResult(s.DbIndex, cmd.Args[0], NewIntegerResult(0))
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: removed, Type: IntegerReply}
+}
+
+func checkScoreRange(c Command) error {
+	_, err := parseScoreRange(c.Args[1], c.Args[2])
+	return err
+}
+
+// zcountCommand returns the number of members of a sorted set within a range of scores.
+func (k *KeyValueDB) zcountCommand(s *Session, cmd Command) any {
+	r, err := parseScoreRange(cmd.Args[1], cmd.Args[2])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	count := 0
+	if err := k.viewZSet(s.DbIndex, cmd.Args[0], func(z *zset) { count = z.count(r) }); err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: count, Type: IntegerReply}
+}
+
+// zrangeOptions are the options of ZRANGE: the start and stop arguments are ranks unless BYSCORE or BYLEX is
+// given, REV reverses the order, in which case the range is given from its maximum to its minimum, and LIMIT
+// skips offset members and returns count members at most, all of them if count is negative.
+type zrangeOptions struct {
+	by         string // BYSCORE or BYLEX, empty for a range of ranks
+	rev        bool
+	limit      bool
+	offset     int
+	count      int
+	withScores bool
+}
+
+func parseZRangeOptions(options []string) (zrangeOptions, error) {
+	opts := zrangeOptions{count: -1}
+	for i := 0; i < len(options); i++ {
+		switch option := strings.ToUpper(options[i]); {
+		case option == "BYSCORE" || option == "BYLEX":
+			opts.by = option
+		case option == "REV":
+			opts.rev = true
+		case option == "WITHSCORES":
+			opts.withScores = true
+		case option == "LIMIT" && i+2 < len(options):
+			offset, err := strconv.Atoi(options[i+1])
+			if err != nil {
+				return opts, &CommandError{msg: "value is not an integer or out of range"}
+			}
+			count, err := strconv.Atoi(options[i+2])
+			if err != nil {
+				return opts, &CommandError{msg: "value is not an integer or out of range"}
+			}
+			opts.limit, opts.offset, opts.count = true, offset, count
+			i += 2
+		default:
+			return opts, &CommandError{msg: "syntax error"}
+		}
+	}
+	switch {
+	case opts.limit && opts.by == "":
+		return opts, &CommandError{msg: "syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"}
+	case opts.withScores && opts.by == "BYLEX":
+		return opts, &CommandError{msg: "syntax error, WITHSCORES not supported in combination with BYLEX"}
+	}
+	return opts, nil
+}
+
+// parseZRange parses the range of ZRANGE: ranks, scores or members. With REV, score and lexicographical ranges
+// are given from their maximum to their minimum.
+func parseZRange(opts zrangeOptions, start, stop string) (zrange, int, int, error) {
+	if opts.rev && opts.by != "" {
+		start, stop = stop, start
+	}
+	switch opts.by {
+	case "BYSCORE":
+		r, err := parseScoreRange(start, stop)
+		return r, 0, 0, err
+	case "BYLEX":
+		r, err := parseLexRange(start, stop)
+		return r, 0, 0, err
+	}
+	startRank, err := strconv.Atoi(start)
+	if err != nil {
+		return nil, 0, 0, &CommandError{msg: "value is not an integer or out of range"}
+	}
+	stopRank, err := strconv.Atoi(stop)
+	if err != nil {
+		return nil, 0, 0, &CommandError{msg: "value is not an integer or out of range"}
+	}
+	return nil, startRank, stopRank, nil
+}
+
+func checkZRangeOptions(c Command) error {
+	opts, err := parseZRangeOptions(c.Args[3:])
+	if err != nil {
+		return err
+	}
+	_, _, _, err = parseZRange(opts, c.Args[1], c.Args[2])
+	return err
+}
+
+// zrangeCommand returns the members of a sorted set within a range of ranks, scores or members.
+func (k *KeyValueDB) zrangeCommand(s *Session, cmd Command) any {
+	opts, err := parseZRangeOptions(cmd.Args[3:])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	r, start, stop, err := parseZRange(opts, cmd.Args[1], cmd.Args[2])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+
+	var nodes []*skiplistNode
+	err = k.viewZSet(s.DbIndex, cmd.Args[0], func(z *zset) {
+		if r != nil {
+			if opts.offset >= 0 {
+				nodes = z.inRange(r, opts.rev, opts.offset, opts.count)
+			}
+			return
+		}
+		if start, stop, ok := listRange(start, stop, z.Len()); ok {
+			nodes = z.byRank(start, stop, opts.rev)
+		}
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return nodesResult(s.DbIndex, nodes, opts.withScores)
+}
+
+// zpop removes up to count members with the lowest or highest scores from a sorted set. It returns a
+// *storage.KeyNotFoundError when the key does not exist.
+func (k *KeyValueDB) zpop(dbIndex int, key string, highest bool, count int) ([]*skiplistNode, error) {
+	var popped []*skiplistNode
+	err := k.updateZSet(dbIndex, key, func(z *zset) error {
+		if z.Len() == 0 {
+			return storage.NewKeyNotFoundError(key)
+		}
+		popped = z.byRank(0, count-1, highest)
+		for _, x := range popped {
+			z.remove(x.member)
+		}
+		return nil
+	})
+	return popped, err
+}
+
+func checkZPopCount(c Command) error {
+	if len(c.Args) == 2 {
+		if count, err := strconv.Atoi(c.Args[1]); err != nil || count < 0 {
+			return &CommandError{msg: "value is out of range, must be positive"}
+		}
+	}
+	return nil
+}
+
+// zpopCommand handles ZPOPMIN and ZPOPMAX, which remove the members with the lowest or highest scores from a
+// sorted set and return them along with their score.
+func (k *KeyValueDB) zpopCommand(s *Session, cmd Command) any {
+	count := 1
+	if len(cmd.Args) == 2 {
+		var err error
+		if count, err = strconv.Atoi(cmd.Args[1]); err != nil || count < 0 {
+			return NewErrorResult(&CommandError{msg: "value is out of range, must be positive"})
+		}
+	}
+	popped, err := k.zpop(s.DbIndex, cmd.Args[0], cmd.Keyword == ZPOPMAX, count)
+	if err != nil {
+		if _, notFound := err.(*storage.KeyNotFoundError); notFound {
+			return notFoundResult(s.DbIndex, cmd.Args[0], nodesResult(s.DbIndex, nil, true))
+		}
+		return NewErrorResult(err)
+	}
+	return nodesResult(s.DbIndex, popped, true)
+}
+
+// bzpopCommand handles BZPOPMIN and BZPOPMAX, which pop the member with the lowest or highest score from the first
+// non-empty sorted set of the given keys and return it along with its key and score. It replies with a nil reply
+// when all the sorted sets are empty.
+func (k *KeyValueDB) bzpopCommand(s *Session, cmd Command) any {
+	keys := cmd.keys()
+	for _, key := range keys {
+		popped, err := k.zpop(s.DbIndex, key, cmd.Keyword == BZPOPMAX, 1)
+		if err == nil {
+			elems := []DBResult{NewBulkResult(key), NewBulkResult(popped[0].member), NewDoubleResult(popped[0].score)}
+			return DBResult{DbIndex: s.DbIndex, Value: elems, Type: ArrayReply}
+		}
+		if _, notFound := err.(*storage.KeyNotFoundError); !notFound {
+			return NewErrorResult(err)
+		}
+	}
+	return notFoundResult(s.DbIndex, keys[0], NewNilResult())
+}
+
+// zstoreOptions are the options of ZUNIONSTORE and ZINTERSTORE: the weights the scores of every source are
+// multiplied by and how the scores of a member found in several sources are aggregated, SUM, MIN or MAX.
+type zstoreOptions struct {
+	weights   []float64
+	aggregate string
+}
+
+// parseZStoreNumKeys parses the number of source keys of ZUNIONSTORE and ZINTERSTORE, following the destination.
+func parseZStoreNumKeys(c Command) (int, error) {
+	if numKeys, err := strconv.Atoi(c.Args[1]); err == nil && numKeys <= 0 {
+		return 0, &CommandError{msg: fmt.Sprintf("at least 1 input key is needed for '%s' command", strings.ToLower(c.Keyword))}
+	}
+	return parseNumKeys(c.Args[1:])
+}
+
+func parseZStoreOptions(numKeys int, options []string) (zstoreOptions, error) {
+	opts := zstoreOptions{weights: make([]float64, numKeys), aggregate: "SUM"}
+	for i := range opts.weights {
+		opts.weights[i] = 1
+	}
+	for i := 0; i < len(options); i++ {
+		switch option := strings.ToUpper(options[i]); {
+		case option == "WEIGHTS" && i+numKeys < len(options):
+			for j := range opts.weights {
+				weight, err := strconv.ParseFloat(options[i+1+j], 64)
+				if err != nil || math.IsNaN(weight) {
+					return opts, &CommandError{msg: "weight value is not a float"}
+				}
+				opts.weights[j] = weight
+			}
+			i += numKeys
+		case option == "AGGREGATE" && i+1 < len(options):
+			i++
+			switch aggregate := strings.ToUpper(options[i]); aggregate {
+			case "SUM", "MIN", "MAX":
+				opts.aggregate = aggregate
+			default:
+				return opts, &CommandError{msg: "syntax error"}
+			}
+		default:
+			return opts, &CommandError{msg: "syntax error"}
+		}
+	}
+	return opts, nil
+}
+
+func checkZStore(c Command) error {
+	numKeys, err := parseZStoreNumKeys(c)
+	if err != nil {
+		return err
+	}
+	_, err = parseZStoreOptions(numKeys, c.Args[numKeys+2:])
+	return err
+}
+
+// zstoreKeys returns the keys of ZUNIONSTORE and ZINTERSTORE: the destination followed by the source keys.
+func zstoreKeys(c Command) []string {
+	numKeys, err := parseZStoreNumKeys(c)
+	if err != nil {
+		return c.Args[:1]
+	}
+	return append([]string{c.Args[0]}, c.Args[2:numKeys+2]...)
+}
+
+// zsetScores returns the scores of the members held by a value: a sorted set, or a set whose members all score 1.
+func zsetScores(value any) (map[string]float64, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case *zset:
+		return v.scores, nil
+	case set:
+		scores := make(map[string]float64, len(v))
+		for member := range v {
+			scores[member] = 1
+		}
+		return scores, nil
+	}
+	return nil, &WrongTypeError{}
+}
+
+// aggregateScores combines the scores of a member found in several sources. A sum of infinities of opposite
+// signs is 0.
+func aggregateScores(aggregate string, a, b float64) float64 {
+	switch aggregate {
+	case "MIN":
+		return math.Min(a, b)
+	case "MAX":
+		return math.Max(a, b)
+	}
+	if sum := a + b; !math.IsNaN(sum) {
+		return sum
+	}
+	return 0
+}
+
+// combineZSets computes the union or intersection of the sorted sets, or sets, held by values.
+func combineZSets(keyword string, values []any, opts zstoreOptions) (*zset, error) {
+	sources := make([]map[string]float64, len(values))
+	for i, value := range values {
+		var err error
+		if sources[i], err = zsetScores(value); err != nil {
+			return nil, err
+		}
+	}
+	weighted := func(i int, score float64) float64 {
+		// 0 times an infinite score is 0
+		if score = score * opts.weights[i]; math.IsNaN(score) {
+			return 0
+		}
+		return score
+	}
+
+	scores := map[string]float64{}
+	switch keyword {
+	case ZUNIONSTORE:
+		for i, source := range sources {
+			for member, score := range source {
+				if current, ok := scores[member]; ok {
+					scores[member] = aggregateScores(opts.aggregate, current, weighted(i, score))
+				} else {
+					scores[member] = weighted(i, score)
+				}
+			}
+		}
+	case ZINTERSTORE:
+	members:
+		for member, score := range sources[0] {
+			total := weighted(0, score)
+			for i, source := range sources[1:] {
+				other, ok := source[member]
+				if !ok {
+					continue members
+				}
+				total = aggregateScores(opts.aggregate, total, weighted(i+1, other))
+			}
+			scores[member] = total
+		}
+	}
+
+	result := newZSet()
+	for member, score := range scores {
+		result.add(member, score)
+	}
+	return result, nil
+}
+
+// zstoreCommand handles ZUNIONSTORE and ZINTERSTORE, which store the union or intersection of sorted sets in the
+// destination key, overwriting it, and return the number of members stored. Sets count as sorted sets whose
+// members all score 1. The destination is deleted when the result is empty.
+func (k *KeyValueDB) zstoreCommand(s *Session, cmd Command) any {
+	numKeys, err := parseZStoreNumKeys(cmd)
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	opts, err := parseZStoreOptions(numKeys, cmd.Args[numKeys+2:])
+	if err != nil {
+		return NewErrorResult(err)
+	}
+
+	destination := cmd.Args[0]
+	keys := append([]string{destination}, cmd.Args[2:numKeys+2]...)
+	stored := 0
+	err = k.storage.UpdateEntries(s.DbIndex, keys, func(entries []storage.Entry) ([]storage.Entry, error) {
+		values := make([]any, len(entries)-1)
+		for i, e := range entries[1:] {
+			values[i] = e.Value
+		}
+		result, err := combineZSets(cmd.Keyword, values, opts)
+		if err != nil {
+			return nil, err
+		}
+		stored = result.Len()
+		for i, key := range keys {
+			// The destination may also be a source, the last entry of a key given several times wins
+			if key == destination {
+				entries[i] = storage.Entry{}
+				if stored > 0 {
+					entries[i].Value = result
+				}
+			}
+		}
+		return entries, nil
+	})
+	if err != nil {
+		return NewErrorResult(err)
+	}
+	return DBResult{DbIndex: s.DbIndex, Value: stored, Type: IntegerReply}
+}
@@ -0,0 +1,346 @@
+package domain
+
+import (
+	"fmt"
+	"kvdb/persistence"
+	"kvdb/storage"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyValueDB_Execute_SortedSetCommands(t *testing.T) {
+	testCases := []struct {
+		name string
+		cmds []Command
+		want []any // SimpleMsg of the results
+	}{
+		{
+			name: "ZADD, ZSCORE and ZCARD",
+			cmds: []Command{
+				NewCommand("ZADD", "board", "10", "ada", "20", "grace"),
+				NewCommand("ZADD", "board", "15", "ada", "5", "linus"),
+				NewCommand("ZSCORE", "board", "ada"),
+				NewCommand("ZSCORE", "board", "missing"),
+				NewCommand("ZCARD", "board"),
+				NewCommand("ZCARD", "missing"),
+				NewCommand("ZADD", "board", "high", "ada"),
+				NewCommand("ZADD", "board", "1", "ada", "2"),
+			},
+			want: []any{
+				"(integer) 2", "(integer) 1", "(double) 15", "(nil)", "(integer) 3", "(integer) 0",
+				"(error) ERR value is not a valid float", "(error) ERR syntax error",
+			},
+		},
+		{
+			name: "ZADD options",
+			cmds: []Command{
+				NewCommand("ZADD", "board", "10", "ada"),
+				NewCommand("ZADD", "board", "NX", "20", "ada", "5", "grace"),
+				NewCommand("ZADD", "board", "XX", "30", "linus", "12", "ada"),
+				NewCommand("ZADD", "board", "GT", "CH", "11", "ada", "6", "grace"),
+				NewCommand("ZADD", "board", "LT", "CH", "20", "ada", "1", "grace", "3", "linus"),
+				NewCommand("ZADD", "board", "INCR", "5", "ada"),
+				NewCommand("ZADD", "board", "NX", "INCR", "5", "ada"),
+				NewCommand("ZRANGE", "board", "0", "-1", "WITHSCORES"),
+				NewCommand("ZADD", "board", "NX", "XX", "1", "ada"),
+				NewCommand("ZADD", "board", "GT", "LT", "1", "ada"),
+				NewCommand("ZADD", "board", "INCR", "1", "ada", "2", "grace"),
+			},
+			want: []any{
+				"(integer) 1", "(integer) 1", "(integer) 0", "(integer) 1", "(integer) 2", "(double) 17", "(nil)",
+				"1) \"grace\"\n2) (double) 1\n3) \"linus\"\n4) (double) 3\n5) \"ada\"\n6) (double) 17",
+				"(error) ERR XX and NX options at the same time are not compatible",
+				"(error) ERR GT, LT, and/or NX options at the same time are not compatible",
+				"(error) ERR INCR option supports a single increment-element pair",
+			},
+		},
+		{
+			name: "ZINCRBY",
+			cmds: []Command{
+				NewCommand("ZINCRBY", "board", "2.5", "ada"),
+				NewCommand("ZINCRBY", "board", "-1", "ada"),
+				NewCommand("ZINCRBY", "board", "inf", "ada"),
+				NewCommand("ZINCRBY", "board", "-inf", "ada"),
+				NewCommand("ZINCRBY", "board", "one", "ada"),
+			},
+			want: []any{
+				"(double) 2.5", "(double) 1.5", "(double) inf",
+				"(error) ERR resulting score is not a number (NaN)",
+				"(error) ERR value is not a valid float",
+			},
+		},
+		{
+			name: "ZRANK and ZREVRANK",
+			cmds: []Command{
+				NewCommand("ZADD", "board", "10", "ada", "20", "grace", "5", "linus"),
+				NewCommand("ZRANK", "board", "ada"),
+				NewCommand("ZREVRANK", "board", "ada"),
+				NewCommand("ZRANK", "board", "linus", "WITHSCORE"),
+				NewCommand("ZRANK", "board", "missing"),
+				NewCommand("ZREVRANK", "missing", "ada"),
+			},
+			want: []any{
+				"(integer) 3", "(integer) 1", "(integer) 1", "1) (integer) 0\n2) (double) 5", "(nil)", "(nil)",
+			},
+		},
+		{
+			name: "ZRANGE by rank",
+			cmds: []Command{
+				NewCommand("ZADD", "board", "1", "a", "2", "b", "3", "c", "4", "d"),
+				NewCommand("ZRANGE", "board", "0", "-1"),
+				NewCommand("ZRANGE", "board", "1", "2", "WITHSCORES"),
+				NewCommand("ZRANGE", "board", "0", "1", "REV"),
+				NewCommand("ZRANGE", "board", "-2", "10"),
+				NewCommand("ZRANGE", "board", "3", "1"),
+				NewCommand("ZRANGE", "board", "0", "1", "LIMIT", "0", "1"),
+				NewCommand("ZRANGE", "board", "a", "1"),
+			},
+			want: []any{
+				"(integer) 4", "1) \"a\"\n2) \"b\"\n3) \"c\"\n4) \"d\"", "1) \"b\"\n2) (double) 2\n3) \"c\"\n4) (double) 3",
+				"1) \"d\"\n2) \"c\"", "1) \"c\"\n2) \"d\"", "(empty array)",
+				"(error) ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX",
+				"(error) ERR value is not an integer or out of range",
+			},
+		},
+		{
+			name: "ZRANGE BYSCORE",
+			cmds: []Command{
+				NewCommand("ZADD", "board", "1", "a", "2", "b", "3", "c", "4", "d"),
+				NewCommand("ZRANGE", "board", "2", "3", "BYSCORE"),
+				NewCommand("ZRANGE", "board", "(1", "+inf", "BYSCORE", "LIMIT", "1", "2"),
+				NewCommand("ZRANGE", "board", "(4", "-inf", "BYSCORE", "REV"),
+				NewCommand("ZRANGE", "board", "3", "2", "BYSCORE"),
+				NewCommand("ZRANGE", "board", "-inf", "+inf", "BYSCORE", "LIMIT", "-1", "2"),
+				NewCommand("ZRANGE", "board", "x", "2", "BYSCORE"),
+			},
+			want: []any{
+				"(integer) 4", "1) \"b\"\n2) \"c\"", "1) \"c\"\n2) \"d\"", "1) \"c\"\n2) \"b\"\n3) \"a\"", "(empty array)",
+				"(empty array)", "(error) ERR min or max is not a float",
+			},
+		},
+		{
+			name: "ZRANGE BYLEX",
+			cmds: []Command{
+				NewCommand("ZADD", "words", "0", "apple", "0", "banana", "0", "cherry", "0", "date"),
+				NewCommand("ZRANGE", "words", "[banana", "(date", "BYLEX"),
+				NewCommand("ZRANGE", "words", "-", "+", "BYLEX", "LIMIT", "1", "1"),
+				NewCommand("ZRANGE", "words", "+", "(b", "BYLEX", "REV"),
+				NewCommand("ZRANGE", "words", "banana", "+", "BYLEX"),
+				NewCommand("ZRANGE", "words", "-", "+", "BYLEX", "WITHSCORES"),
+			},
+			want: []any{
+				"(integer) 4", "1) \"banana\"\n2) \"cherry\"", "1) \"banana\"", "1) \"date\"\n2) \"cherry\"\n3) \"banana\"",
+				"(error) ERR min or max not valid string range item",
+				"(error) ERR syntax error, WITHSCORES not supported in combination with BYLEX",
+			},
+		},
+		{
+			name: "ZREM and ZCOUNT",
+			cmds: []Command{
+				NewCommand("ZADD", "board", "1", "a", "2", "b", "3", "c"),
+				NewCommand("ZCOUNT", "board", "2", "+inf"),
+				NewCommand("ZCOUNT", "board", "(1", "(3"),
+				NewCommand("ZCOUNT", "board", "5", "10"),
+				NewCommand("ZREM", "board", "a", "missing"),
+				NewCommand("ZREM", "board", "a"),
+				NewCommand("ZREM", "board", "b", "c"),
+				NewCommand("EXISTS", "board"),
+			},
+			want: []any{
+				"(integer) 3", "(integer) 2", "(integer) 1", "(integer) 0", "(integer) 1", "(integer) 0", "(integer) 2",
+				"(integer) 0",
+			},
+		},
+		{
+			name: "ZPOPMIN and ZPOPMAX",
+			cmds: []Command{
+				NewCommand("ZADD", "board", "1", "a", "2", "b", "3", "c"),
+				NewCommand("ZPOPMIN", "board"),
+				NewCommand("ZPOPMAX", "board", "0"),
+				NewCommand("ZPOPMAX", "board", "5"),
+				NewCommand("ZPOPMIN", "board"),
+				NewCommand("EXISTS", "board"),
+				NewCommand("ZPOPMIN", "board", "0"),
+				NewCommand("ZPOPMIN", "board", "-1"),
+			},
+			want: []any{
+				"(integer) 3", "1) \"a\"\n2) (double) 1", "(empty array)",
+				"1) \"c\"\n2) (double) 3\n3) \"b\"\n4) (double) 2", "(empty array)", "(integer) 0", "(empty array)",
+				"(error) ERR value is out of range, must be positive",
+			},
+		},
+		{
+			name: "ZUNIONSTORE and ZINTERSTORE",
+			cmds: []Command{
+				NewCommand("ZADD", "z1", "1", "a", "2", "b"),
+				NewCommand("ZADD", "z2", "10", "b", "20", "c"),
+				NewCommand("SADD", "s", "a", "c"),
+				NewCommand("ZUNIONSTORE", "out", "2", "z1", "z2"),
+				NewCommand("ZRANGE", "out", "0", "-1", "WITHSCORES"),
+				NewCommand("ZUNIONSTORE", "out", "3", "z1", "z2", "s", "WEIGHTS", "2", "1", "100", "AGGREGATE", "MAX"),
+				NewCommand("ZRANGE", "out", "0", "-1", "WITHSCORES"),
+				NewCommand("ZINTERSTORE", "out", "2", "z1", "z2", "AGGREGATE", "MIN"),
+				NewCommand("ZRANGE", "out", "0", "-1", "WITHSCORES"),
+				NewCommand("ZINTERSTORE", "z1", "2", "z1", "missing"),
+				NewCommand("EXISTS", "z1"),
+				NewCommand("ZUNIONSTORE", "out", "0", "z1"),
+				NewCommand("ZUNIONSTORE", "out", "2", "z2"),
+				NewCommand("ZUNIONSTORE", "out", "1", "z2", "WEIGHTS", "x"),
+				NewCommand("ZUNIONSTORE", "out", "1", "z2", "AGGREGATE", "AVG"),
+			},
+			want: []any{
+				"(integer) 2", "(integer) 2", "(integer) 2", "(integer) 3",
+				"1) \"a\"\n2) (double) 1\n3) \"b\"\n4) (double) 12\n5) \"c\"\n6) (double) 20",
+				"(integer) 3", "1) \"b\"\n2) (double) 10\n3) \"a\"\n4) (double) 100\n5) \"c\"\n6) (double) 100",
+				"(integer) 1", "1) \"b\"\n2) (double) 2", "(integer) 0", "(integer) 0",
+				"(error) ERR at least 1 input key is needed for 'zunionstore' command",
+				"(error) ERR Number of keys can't be greater than number of args",
+				"(error) ERR weight value is not a float", "(error) ERR syntax error",
+			},
+		},
+		{
+			name: "Wrong type",
+			cmds: []Command{
+				NewCommand("SET", "string", "value"),
+				NewCommand("ZADD", "board", "1", "a"),
+				NewCommand("ZADD", "string", "1", "a"),
+				NewCommand("ZRANGE", "string", "0", "-1"),
+				NewCommand("ZUNIONSTORE", "out", "2", "board", "string"),
+				NewCommand("SMEMBERS", "board"),
+				NewCommand("GET", "board"),
+			},
+			want: []any{
+				"OK", "(integer) 1",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+				"(error) WRONGTYPE Operation against a key holding the wrong kind of value",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+			session := db.NewSession()
+			for i, cmd := range tc.cmds {
+				got := db.Execute(session, cmd).(DBResult).SimpleMsg()
+				if got != tc.want[i] {
+					t.Errorf("KeyValueDB.Execute(%v) = %v, want %v", cmd, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestKeyValueDB_Execute_SortedSetRanks(t *testing.T) {
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	session := db.NewSession()
+	for i := 0; i < 1000; i++ {
+		db.Execute(session, NewCommand("ZADD", "board", (i*7919)%1000, fmt.Sprintf("player%d", i)))
+	}
+
+	// Scores are a permutation of 0 to 999, the rank of a member is its score
+	for _, i := range []int{0, 1, 500, 998, 999} {
+		member := fmt.Sprintf("player%d", i)
+		want := (i * 7919) % 1000
+		if got := db.Execute(session, NewCommand("ZRANK", "board", member)).(DBResult).SimpleMsg(); got != fmt.Sprintf("(integer) %d", want) {
+			t.Errorf("ZRANK board %s = %v, want %d", member, got, want)
+		}
+		if got := db.Execute(session, NewCommand("ZREVRANK", "board", member)).(DBResult).SimpleMsg(); got != fmt.Sprintf("(integer) %d", 999-want) {
+			t.Errorf("ZREVRANK board %s = %v, want %d", member, got, 999-want)
+		}
+	}
+	got := db.Execute(session, NewCommand("ZRANGE", "board", "500", "501", "WITHSCORES")).(DBResult).SimpleMsg()
+	if want := "1) \"player500\"\n2) (double) 500\n3) \"player179\"\n4) (double) 501"; got != want {
+		t.Errorf("ZRANGE board 500 501 WITHSCORES = %v, want %v", got, want)
+	}
+}
+
+func TestKeyValueDB_Execute_BZPopCommands(t *testing.T) {
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	session := db.NewSession()
+	db.Execute(session, NewCommand("ZADD", "board", "1", "a", "2", "b"))
+
+	got := db.Execute(session, NewCommand("BZPOPMAX", "missing", "board", "0")).(DBResult).SimpleMsg()
+	if want := "1) \"board\"\n2) \"b\"\n3) (double) 2"; got != want {
+		t.Errorf("BZPOPMAX missing board 0 = %v, want %v", got, want)
+	}
+
+	done := make(chan string)
+	go func() {
+		done <- fmt.Sprint(db.Execute(db.NewSession(), NewCommand("BZPOPMIN", "empty", "0")).(DBResult).SimpleMsg())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	db.Execute(session, NewCommand("ZADD", "empty", "5", "c"))
+	select {
+	case got := <-done:
+		if want := "1) \"empty\"\n2) \"c\"\n3) (double) 5"; got != want {
+			t.Errorf("Blocked BZPOPMIN empty 0 = %v, want %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("BZPOPMIN was not woken up by ZADD")
+	}
+
+	got = db.Execute(session, NewCommand("BZPOPMIN", "empty", "0.05")).(DBResult).SimpleMsg()
+	if got != "(nil)" {
+		t.Errorf("BZPOPMIN after its timeout = %v, want (nil)", got)
+	}
+}
+
+func TestKeyValueDB_SortedSetPersistence(t *testing.T) {
+	dir := t.TempDir()
+	aofPath, snapshotPath := filepath.Join(dir, "appendonly.aof"), filepath.Join(dir, "dump.kvdb")
+	aof, err := persistence.OpenAOF(aofPath, persistence.FsyncAlways)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+
+	db := NewKeyValueDB(storage.NewInMemoryStorage(1))
+	db.EnableAOF(aof)
+	db.EnableSnapshots(snapshotPath, nil)
+	session := db.NewSession()
+	for _, cmd := range []Command{
+		NewCommand("ZADD", "board", "10", "ada", "20.5", "grace", "-inf", "linus", "7", "ken"),
+		NewCommand("ZINCRBY", "board", "0.25", "ada"),
+		NewCommand("BZPOPMAX", "board", "0"),
+		NewCommand("ZADD", "other", "1", "a", "2", "b"),
+		NewCommand("ZUNIONSTORE", "board", "2", "board", "other", "WEIGHTS", "1", "3"),
+		NewCommand("SAVE"),
+	} {
+		if got := db.Execute(session, cmd).(DBResult); got.Err != nil {
+			t.Fatalf("KeyValueDB.Execute(%v) error = %v", cmd, got.Err)
+		}
+	}
+	want := db.Execute(session, NewCommand("ZRANGE", "board", "0", "-1", "WITHSCORES")).(DBResult).SimpleMsg()
+	if got := db.Execute(session, NewCommand("BGREWRITEAOF")).(DBResult); got.Err != nil {
+		t.Fatalf("BGREWRITEAOF error = %v", got.Err)
+	}
+	for aof.RewriteInProgress() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Unexpected error closing AOF: %v", err)
+	}
+
+	for _, load := range []struct {
+		name string
+		fn   func(db *KeyValueDB) error
+	}{
+		{name: "AOF", fn: func(db *KeyValueDB) error { return db.LoadAOF(aofPath, false) }},
+		{name: "Snapshot", fn: func(db *KeyValueDB) error { return db.LoadSnapshot(snapshotPath) }},
+	} {
+		t.Run(load.name, func(t *testing.T) {
+			loaded := NewKeyValueDB(storage.NewInMemoryStorage(1))
+			if err := load.fn(loaded); err != nil {
+				t.Fatalf("Loading the %s error = %v", load.name, err)
+			}
+			got := loaded.Execute(loaded.NewSession(), NewCommand("ZRANGE", "board", "0", "-1", "WITHSCORES")).(DBResult)
+			if got.SimpleMsg() != want {
+				t.Errorf("ZRANGE board 0 -1 WITHSCORES = %v, want %v", got.SimpleMsg(), want)
+			}
+		})
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"github.com/joho/godotenv"
 	"kvdb/domain"
+	"kvdb/persistence"
 	"kvdb/storage"
 	"kvdb/ui"
 	"log"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 )
 
@@ -23,23 +25,216 @@ func main() {
 
 	port := os.Getenv("TCP_PORT")
 	dbCount := os.Getenv("DB_COUNT")
+	protocolName := os.Getenv("TCP_PROTOCOL")
 
 	dbCountInt, err := getIntDbCount(dbCount)
 	if err != nil {
 		log.Fatalf("Error setting DB_COUNT: %v", err)
 	}
 
-	inMemoryStorage := storage.NewInMemoryStorage(dbCountInt)
-	keyValueDB := domain.NewKeyValueDB(inMemoryStorage)
+	protocol, err := ui.ParseProtocol(protocolName)
+	if err != nil {
+		log.Fatalf("Error setting TCP_PROTOCOL: %v", err)
+	}
+
+	dataStorage, onDisk, err := setupStorage(dbCountInt)
+	if err != nil {
+		log.Fatalf("Error setting STORAGE: %v", err)
+	}
+	keyValueDB := domain.NewKeyValueDB(dataStorage)
+
+	// A storage keeping the keys on disk already holds the persisted data, which must not be loaded twice
+	aof, err := setupPersistence(keyValueDB, !onDisk)
+	if err != nil {
+		log.Fatalf("Error setting up persistence: %v", err)
+	}
+
+	// The memory limit is set once the persisted data is loaded, which it must not evict
+	if err := setupMaxMemory(dataStorage); err != nil {
+		log.Fatalf("Error setting MAXMEMORY: %v", err)
+	}
 
-	tcpServer := ui.NewTcpServer(port, keyValueDB)
+	tcpServer := ui.NewTcpServer(port, keyValueDB, protocol)
+
+	// The replica announces the port it listens on to its master, so the server must be started first
+	if err := setupReplication(keyValueDB); err != nil {
+		log.Fatalf("Error setting REPLICAOF: %v", err)
+	}
 
 	// Wait for a SIGINT or SIGTERM signal to gracefully shut down the server
 	signal.Notify(shutDownSignal, syscall.SIGINT, syscall.SIGTERM)
 
 	<-shutDownSignal
 
+	// Replicas stay connected until disconnected, the server waits for its connections to close
+	keyValueDB.CloseReplication()
 	tcpServer.Stop()
+
+	if err := keyValueDB.CloseSnapshots(); err != nil {
+		log.Printf("Error saving the final snapshot: %v", err)
+	}
+	if aof != nil {
+		if err := aof.Close(); err != nil {
+			log.Printf("Error closing the append-only file: %v", err)
+		}
+	}
+	if err := dataStorage.Close(); err != nil {
+		log.Printf("Error closing the storage: %v", err)
+	}
+}
+
+// setupStorage creates the storage selected by STORAGE and reports whether it keeps the keys on disk.
+//
+// memory (the default) keeps the keys in memory. bitcask keeps them in the append-only segment files of BITCASK_DIR
+// (data by default) and only the keys in memory, so that the data can exceed the memory; BITCASK_SYNC_WRITES flushes
+// every write to disk before replying. lsm keeps them sorted in the log-structured merge-tree of LSM_DIR (data by
+// default); LSM_SYNC_WRITES flushes every write to its WAL before replying.
+func setupStorage(dbCount int) (storage.Storage, bool, error) {
+	switch name := strings.ToLower(strings.TrimSpace(os.Getenv("STORAGE"))); name {
+	case "", "memory":
+		return storage.NewInMemoryStorage(dbCount), false, nil
+	case "bitcask":
+		dir := os.Getenv("BITCASK_DIR")
+		if dir == "" {
+			dir = "data"
+		}
+		s, err := storage.OpenBitcaskStorage(dir, dbCount, storage.BitcaskOptions{
+			Codec:      domain.ValueCodec{},
+			SyncWrites: isEnabled(os.Getenv("BITCASK_SYNC_WRITES")),
+		})
+		return s, true, err
+	case "lsm":
+		dir := os.Getenv("LSM_DIR")
+		if dir == "" {
+			dir = "data"
+		}
+		s, err := storage.OpenLSMStorage(dir, dbCount, storage.LSMOptions{
+			Codec:      domain.ValueCodec{},
+			SyncWrites: isEnabled(os.Getenv("LSM_SYNC_WRITES")),
+		})
+		return s, true, err
+	default:
+		return nil, false, fmt.Errorf("unknown storage %q", name)
+	}
+}
+
+// setupPersistence loads the persisted data into the database, unless load is false, and enables the configured
+// persistence mechanisms.
+//
+// The append-only file is loaded when enabled since it holds the most recent writes, the snapshot otherwise.
+// Snapshots are written to SNAPSHOT_FILENAME (dump.kvdb by default) and SNAPSHOT_SAVE holds the
+// "<seconds> <changes>" rules triggering automatic background saves; setting it empty disables them.
+// A storage keeping the keys on disk, for which load is false, already persists them: automatic saves are disabled
+// by default since every snapshot copies the whole data into memory while the database is locked.
+func setupPersistence(keyValueDB *domain.KeyValueDB, load bool) (*persistence.AOF, error) {
+	snapshotPath := os.Getenv("SNAPSHOT_FILENAME")
+	if snapshotPath == "" {
+		snapshotPath = "dump.kvdb"
+	}
+	saveRules, ok := os.LookupEnv("SNAPSHOT_SAVE")
+	if !ok && load {
+		saveRules = "3600 1 300 100 60 10000"
+	}
+	rules, err := persistence.ParseSaveRules(saveRules)
+	if err != nil {
+		return nil, err
+	}
+	if !load && len(rules) > 0 {
+		log.Printf("Automatic snapshots are enabled by SNAPSHOT_SAVE although the storage keeps the keys on disk, " +
+			"each of them copies the whole data into memory while the database is locked")
+	}
+
+	if load && !isEnabled(os.Getenv("AOF_ENABLED")) {
+		if err := keyValueDB.LoadSnapshot(snapshotPath); err != nil {
+			return nil, err
+		}
+	}
+	aof, err := setupAOF(keyValueDB, load)
+	if err != nil {
+		return nil, err
+	}
+	keyValueDB.EnableSnapshots(snapshotPath, rules)
+	return aof, nil
+}
+
+// setupAOF replays the append-only file into the database, unless load is false, and enables logging to it when
+// AOF_ENABLED is set.
+//
+// AOF_FILENAME is the path of the file (appendonly.aof by default), AOF_FSYNC its fsync policy
+// (always, everysec or no) and AOF_LOAD_TRUNCATED allows repairing a truncated or corrupted file on load.
+func setupAOF(keyValueDB *domain.KeyValueDB, load bool) (*persistence.AOF, error) {
+	if !isEnabled(os.Getenv("AOF_ENABLED")) {
+		return nil, nil
+	}
+
+	filename := os.Getenv("AOF_FILENAME")
+	if filename == "" {
+		filename = "appendonly.aof"
+	}
+	fsyncPolicy, err := persistence.ParseFsyncPolicy(os.Getenv("AOF_FSYNC"))
+	if err != nil {
+		return nil, err
+	}
+
+	if load {
+		err = keyValueDB.LoadAOF(filename, isEnabled(os.Getenv("AOF_LOAD_TRUNCATED")))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	aof, err := persistence.OpenAOF(filename, fsyncPolicy)
+	if err != nil {
+		return nil, err
+	}
+	keyValueDB.EnableAOF(aof)
+	return aof, nil
+}
+
+// setupMaxMemory bounds the memory held by the keys to MAXMEMORY, an amount such as 100mb (no limit when empty or 0),
+// beyond which keys are evicted according to MAXMEMORY_POLICY (noeviction by default).
+func setupMaxMemory(s storage.Storage) error {
+	maxMemory, err := storage.ParseMemory(os.Getenv("MAXMEMORY"))
+	if err != nil {
+		return err
+	}
+	policy, err := storage.ParseEvictionPolicy(os.Getenv("MAXMEMORY_POLICY"))
+	if err != nil {
+		return err
+	}
+	evictor, ok := s.(storage.Evictor)
+	if !ok {
+		if maxMemory > 0 {
+			return fmt.Errorf("the storage does not support a memory limit")
+		}
+		return nil
+	}
+	evictor.SetMaxMemory(maxMemory, policy)
+	return nil
+}
+
+// setupReplication makes the database a replica of the master at REPLICAOF, a "<host> <port>" address, when set.
+// Replicas deny writes to their clients unless REPLICA_READ_ONLY is set to no.
+func setupReplication(keyValueDB *domain.KeyValueDB) error {
+	readOnly := os.Getenv("REPLICA_READ_ONLY")
+	keyValueDB.SetReplicaReadOnly(strings.TrimSpace(readOnly) == "" || isEnabled(readOnly))
+
+	master := strings.Fields(os.Getenv("REPLICAOF"))
+	switch len(master) {
+	case 0:
+		return nil
+	case 2:
+		return keyValueDB.ReplicaOf(master[0], master[1])
+	}
+	return fmt.Errorf("invalid master address %q, expected <host> <port>", os.Getenv("REPLICAOF"))
+}
+
+func isEnabled(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "yes", "true", "1":
+		return true
+	}
+	return false
 }
 
 func getIntDbCount(dbCountStr string) (int, error) {
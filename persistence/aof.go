@@ -0,0 +1,373 @@
+package persistence
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Size under which the commands buffered during a rewrite are flushed while holding the lock
+const rewriteBufLockedFlushSize = 64 * 1024
+
+// FsyncPolicy tells the append-only file how often written commands are flushed to disk.
+type FsyncPolicy string
+
+const (
+	// FsyncAlways syncs the file after every command, the safest and slowest policy.
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncEverySec syncs the file once per second in the background, at most one second of writes can be lost.
+	FsyncEverySec FsyncPolicy = "everysec"
+	// FsyncNo never syncs explicitly and lets the operating system flush the file when it wants to.
+	FsyncNo FsyncPolicy = "no"
+)
+
+// ParseFsyncPolicy converts the given name into a FsyncPolicy, defaulting to FsyncEverySec when the name is empty.
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	switch FsyncPolicy(strings.ToLower(strings.TrimSpace(name))) {
+	case "", FsyncEverySec:
+		return FsyncEverySec, nil
+	case FsyncAlways:
+		return FsyncAlways, nil
+	case FsyncNo:
+		return FsyncNo, nil
+	}
+	return "", fmt.Errorf("unknown fsync policy %q, expected %q, %q or %q", name, FsyncAlways, FsyncEverySec, FsyncNo)
+}
+
+// CorruptAOFError is returned when the append-only file ends with a truncated or malformed command.
+type CorruptAOFError struct {
+	Path   string
+	Offset int64 // Offset the file is valid up to, right after the last valid command or before its open MULTI block
+	Err    error
+}
+
+func (c *CorruptAOFError) Error() string {
+	return fmt.Sprintf("append-only file %q is corrupted after offset %d: %v", c.Path, c.Offset, c.Err)
+}
+
+func (c *CorruptAOFError) Unwrap() error {
+	return c.Err
+}
+
+// AOF is an append-only file logging every command that modifies the database.
+//
+// Commands are stored using the RESP multibulk format so the file can be inspected with standard tools,
+// and a SELECT command is logged whenever a command targets a different database than the previous one.
+type AOF struct {
+	mu          sync.Mutex
+	path        string
+	file        *os.File
+	policy      FsyncPolicy
+	lastDbIndex int  // Database targeted by the last logged command, -1 when unknown
+	unsynced    bool // Whether writes were made since the last fsync
+	stop        chan struct{}
+	wg          sync.WaitGroup
+
+	rewriting      bool   // Whether a background rewrite is running
+	rewriteBuf     []byte // Commands appended since the rewrite started
+	rewriteDbIndex int    // Database targeted by the last command in rewriteBuf, -1 when unknown
+}
+
+// RewriteInProgressError is returned when a rewrite is requested while another one is still running.
+type RewriteInProgressError struct{}
+
+func (r *RewriteInProgressError) Error() string {
+	return "(error) ERR Background append only file rewriting already in progress"
+}
+
+// OpenAOF opens (or creates) the append-only file at the given path for appending.
+func OpenAOF(path string, policy FsyncPolicy) (*AOF, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening append-only file: %v", err)
+	}
+
+	a := &AOF{
+		path:        path,
+		file:        file,
+		policy:      policy,
+		lastDbIndex: -1,
+		stop:        make(chan struct{}),
+	}
+	if policy == FsyncEverySec {
+		a.wg.Add(1)
+		go a.syncEverySecond()
+	}
+	return a, nil
+}
+
+// Append logs a command executed against the given database.
+func (a *AOF) Append(dbIndex int, args []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var buf []byte
+	if dbIndex != a.lastDbIndex {
+		buf = AppendCommand(buf, []string{"SELECT", strconv.Itoa(dbIndex)})
+	}
+	buf = AppendCommand(buf, args)
+
+	if a.rewriting {
+		if dbIndex != a.rewriteDbIndex {
+			a.rewriteBuf = AppendCommand(a.rewriteBuf, []string{"SELECT", strconv.Itoa(dbIndex)})
+			a.rewriteDbIndex = dbIndex
+		}
+		a.rewriteBuf = AppendCommand(a.rewriteBuf, args)
+	}
+
+	if _, err := a.file.Write(buf); err != nil {
+		// The file may now end with a partial command, force a SELECT before the next one
+		a.lastDbIndex = -1
+		return fmt.Errorf("error writing to append-only file: %v", err)
+	}
+	a.lastDbIndex = dbIndex
+
+	if a.policy == FsyncAlways {
+		if err := a.file.Sync(); err != nil {
+			return fmt.Errorf("error syncing append-only file: %v", err)
+		}
+		return nil
+	}
+	a.unsynced = true
+	return nil
+}
+
+// Close flushes the pending writes to disk and closes the file.
+func (a *AOF) Close() error {
+	close(a.stop)
+	a.wg.Wait()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing append-only file: %v", err)
+	}
+	return a.file.Close()
+}
+
+// Rewrite replaces the file in the background with a compact one made of the given snapshot commands.
+//
+// The snapshot must describe the whole database at the time Rewrite is called, including the SELECT
+// commands switching between databases. Commands appended while the rewrite runs are logged to the
+// current file as usual and buffered in memory; once the snapshot is written they are appended to the
+// new file, which then atomically replaces the current one.
+func (a *AOF) Rewrite(snapshot [][]string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rewriting {
+		return &RewriteInProgressError{}
+	}
+	a.rewriting = true
+	a.rewriteBuf = nil
+	a.rewriteDbIndex = -1
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		if err := a.rewrite(snapshot); err != nil {
+			log.Printf("Error rewriting append-only file: %v\n", err)
+		} else {
+			log.Println("Background append-only file rewriting terminated with success")
+		}
+	}()
+	return nil
+}
+
+// RewriteInProgress reports whether a background rewrite is running.
+func (a *AOF) RewriteInProgress() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rewriting
+}
+
+func (a *AOF) rewrite(snapshot [][]string) error {
+	tmpPath := fmt.Sprintf("%s.rewrite.tmp", a.path)
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err == nil {
+		err = a.writeRewrite(tmpFile, snapshot)
+	}
+	if err != nil {
+		a.mu.Lock()
+		a.rewriting = false
+		a.rewriteBuf = nil
+		a.mu.Unlock()
+		if tmpFile != nil {
+			tmpFile.Close()
+		}
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// writeRewrite writes the snapshot followed by the buffered commands to the temporary file and swaps it
+// with the current file. The buffer is drained without holding the lock as long as it keeps growing
+// significantly, so writers are only blocked while its last few commands are flushed.
+func (a *AOF) writeRewrite(tmpFile *os.File, snapshot [][]string) error {
+	writer := bufio.NewWriter(tmpFile)
+	for _, args := range snapshot {
+		if _, err := writer.Write(AppendCommand(nil, args)); err != nil {
+			return err
+		}
+	}
+
+	var buf []byte
+	for {
+		a.mu.Lock()
+		buf = a.rewriteBuf
+		a.rewriteBuf = nil
+		if len(buf) < rewriteBufLockedFlushSize {
+			break // The lock is released once the file is swapped
+		}
+		a.mu.Unlock()
+		if _, err := writer.Write(buf); err != nil {
+			return err
+		}
+	}
+	defer a.mu.Unlock()
+
+	if _, err := writer.Write(buf); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), a.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(a.path))
+
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	a.file.Close()
+	a.file = file
+	a.lastDbIndex = a.rewriteDbIndex
+	a.rewriting = false
+	a.rewriteBuf = nil
+	return nil
+}
+
+func (a *AOF) syncEverySecond() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			if a.unsynced {
+				if err := a.file.Sync(); err != nil {
+					log.Printf("Error syncing append-only file: %v\n", err)
+				} else {
+					a.unsynced = false
+				}
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+// syncDir makes a rename in the given directory durable, errors are ignored as not every platform supports it.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// LoadAOF reads the append-only file at the given path and calls apply for every logged command.
+//
+// A missing file is not an error, it simply means nothing was logged yet.
+// The commands of a MULTI block are only applied once its EXEC or DISCARD is read, a block left open at the end of
+// the file, e.g. by a crash in the middle of a transaction, is discarded and cut off the file so that the commands
+// appended next are not queued in it.
+// When the file ends with a truncated or malformed command a *CorruptAOFError is returned, unless
+// repair is true in which case the file is truncated right after the last valid command, or before the MULTI
+// block the command belongs to, and loading succeeds.
+func LoadAOF(path string, repair bool, apply func(args []string) error) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening append-only file: %v", err)
+	}
+	defer file.Close()
+
+	reader := NewCommandReader(file)
+	var block [][]string  // Commands of the open MULTI block, nil outside of one
+	var blockOffset int64 // Offset of the MULTI command opening the block
+	for {
+		offset := reader.Offset()
+		args, err := reader.ReadCommand()
+		if err == io.EOF && block == nil {
+			return nil
+		}
+		if err == io.EOF {
+			log.Printf("Discarding the MULTI block left open at offset %d of append-only file %q\n", blockOffset, path)
+			return truncateAOF(path, blockOffset)
+		}
+		if err != nil {
+			validOffset := reader.Offset()
+			if block != nil {
+				validOffset = blockOffset
+			}
+			corruptErr := &CorruptAOFError{Path: path, Offset: validOffset, Err: err}
+			if !repair {
+				return corruptErr
+			}
+			log.Printf("Repairing %v\n", corruptErr)
+			return truncateAOF(path, validOffset)
+		}
+
+		name := ""
+		if len(args) > 0 {
+			name = strings.ToUpper(args[0])
+		}
+		switch {
+		case block != nil:
+			block = append(block, args)
+			if name != "EXEC" && name != "DISCARD" {
+				continue
+			}
+		case name == "MULTI":
+			block, blockOffset = [][]string{args}, offset
+			continue
+		default:
+			block = [][]string{args}
+		}
+		for _, args := range block {
+			if err := apply(args); err != nil {
+				return fmt.Errorf("error replaying command %q from append-only file: %v", args, err)
+			}
+		}
+		block = nil
+	}
+}
+
+// truncateAOF cuts the file at the given path at the given offset.
+func truncateAOF(path string, offset int64) error {
+	if err := os.Truncate(path, offset); err != nil {
+		return fmt.Errorf("error truncating append-only file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package persistence
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFsyncPolicy(t *testing.T) {
+	testCases := []struct {
+		name    string
+		input   string
+		want    FsyncPolicy
+		wantErr bool
+	}{
+		{name: "Empty defaults to everysec", input: "", want: FsyncEverySec},
+		{name: "Always", input: "always", want: FsyncAlways},
+		{name: "Case insensitive", input: " EverySec ", want: FsyncEverySec},
+		{name: "No", input: "no", want: FsyncNo},
+		{name: "Unknown policy", input: "sometimes", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseFsyncPolicy(tc.input)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseFsyncPolicy(%q) error = %v, want error %v", tc.input, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("ParseFsyncPolicy(%q) = %q, want %q", tc.input, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAOF_AppendLoad(t *testing.T) {
+	for _, policy := range []FsyncPolicy{FsyncAlways, FsyncEverySec, FsyncNo} {
+		t.Run(string(policy), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "appendonly.aof")
+			aof, err := OpenAOF(path, policy)
+			if err != nil {
+				t.Fatalf("Unexpected error opening AOF: %v", err)
+			}
+
+			appends := []struct {
+				dbIndex int
+				args    []string
+			}{
+				{0, []string{"SET", "key", "multi word\r\nvalue"}},
+				{0, []string{"INCR", "counter"}},
+				{3, []string{"DEL", "key"}},
+			}
+			for _, a := range appends {
+				if err := aof.Append(a.dbIndex, a.args); err != nil {
+					t.Fatalf("Unexpected error appending %q: %v", a.args, err)
+				}
+			}
+			if err := aof.Close(); err != nil {
+				t.Fatalf("Unexpected error closing AOF: %v", err)
+			}
+
+			want := [][]string{
+				{"SELECT", "0"},
+				{"SET", "key", "multi word\r\nvalue"},
+				{"INCR", "counter"},
+				{"SELECT", "3"},
+				{"DEL", "key"},
+			}
+			var got [][]string
+			err = LoadAOF(path, false, func(args []string) error {
+				got = append(got, args)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error loading AOF: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("LoadAOF() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadAOF_CorruptTail(t *testing.T) {
+	valid := string(AppendCommand(nil, []string{"SET", "key", "value"}))
+
+	testCases := []struct {
+		name string
+		tail string
+	}{
+		{name: "Truncated bulk string", tail: "*3\r\n$3\r\nSET\r\n$3\r\nke"},
+		{name: "Truncated array header", tail: "*3"},
+		{name: "Malformed command", tail: "GARBAGE\r\n"},
+		{name: "Truncated transaction", tail: "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$1\r\n1\r\n*1\r\n$4\r\nEX"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "appendonly.aof")
+			if err := os.WriteFile(path, []byte(valid+tc.tail), 0644); err != nil {
+				t.Fatalf("Unexpected error writing AOF: %v", err)
+			}
+
+			var loaded int
+			apply := func(args []string) error {
+				loaded++
+				return nil
+			}
+
+			err := LoadAOF(path, false, apply)
+			var corruptErr *CorruptAOFError
+			if !errors.As(err, &corruptErr) {
+				t.Fatalf("LoadAOF() error = %v, want a *CorruptAOFError", err)
+			}
+			if corruptErr.Offset != int64(len(valid)) {
+				t.Errorf("CorruptAOFError.Offset = %d, want %d", corruptErr.Offset, len(valid))
+			}
+
+			loaded = 0
+			if err := LoadAOF(path, true, apply); err != nil {
+				t.Fatalf("LoadAOF() with repair error = %v, want nil", err)
+			}
+			if loaded != 1 {
+				t.Errorf("LoadAOF() with repair loaded %d commands, want 1", loaded)
+			}
+			content, _ := os.ReadFile(path)
+			if string(content) != valid {
+				t.Errorf("Repaired AOF content = %q, want %q", content, valid)
+			}
+		})
+	}
+}
+
+func TestLoadAOF_UnterminatedTransaction(t *testing.T) {
+	valid := string(AppendCommand(nil, []string{"SET", "key", "value"}))
+	transaction := string(AppendCommand(nil, []string{"MULTI"})) + string(AppendCommand(nil, []string{"SET", "key", "other"}))
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(path, []byte(valid+transaction), 0644); err != nil {
+		t.Fatalf("Unexpected error writing AOF: %v", err)
+	}
+
+	var loaded [][]string
+	err := LoadAOF(path, false, func(args []string) error {
+		loaded = append(loaded, args)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("LoadAOF() error = %v, want nil", err)
+	}
+	if want := [][]string{{"SET", "key", "value"}}; !reflect.DeepEqual(loaded, want) {
+		t.Errorf("LoadAOF() = %q, want %q", loaded, want)
+	}
+	content, _ := os.ReadFile(path)
+	if string(content) != valid {
+		t.Errorf("AOF content after LoadAOF() = %q, want %q", content, valid)
+	}
+}
+
+func TestLoadAOF_MissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.aof")
+	err := LoadAOF(path, false, func(args []string) error {
+		t.Errorf("Unexpected command %q", args)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("LoadAOF() error = %v, want nil", err)
+	}
+}
+
+func TestAOF_Rewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	aof, err := OpenAOF(path, FsyncAlways)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+
+	for _, value := range []string{"1", "2", "3"} {
+		if err := aof.Append(0, []string{"SET", "key", value}); err != nil {
+			t.Fatalf("Unexpected error appending: %v", err)
+		}
+	}
+
+	snapshot := [][]string{{"SELECT", "0"}, {"SET", "key", "3"}}
+	if err := aof.Rewrite(snapshot); err != nil {
+		t.Fatalf("AOF.Rewrite() error = %v", err)
+	}
+	// Appended either while the rewrite is running or once it is done, the command must end up in the new file
+	if err := aof.Append(1, []string{"SET", "other", "value"}); err != nil {
+		t.Fatalf("Unexpected error appending: %v", err)
+	}
+	waitRewrite(t, aof)
+	if err := aof.Append(1, []string{"DEL", "other"}); err != nil {
+		t.Fatalf("Unexpected error appending: %v", err)
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Unexpected error closing AOF: %v", err)
+	}
+
+	want := [][]string{
+		{"SELECT", "0"},
+		{"SET", "key", "3"},
+		{"SELECT", "1"},
+		{"SET", "other", "value"},
+		{"DEL", "other"},
+	}
+	var got [][]string
+	err = LoadAOF(path, false, func(args []string) error {
+		got = append(got, args)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error loading AOF: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadAOF() after rewrite = %q, want %q", got, want)
+	}
+
+	if _, err := os.Stat(path + ".rewrite.tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Temporary rewrite file still exists: %v", err)
+	}
+}
+
+func TestAOF_Rewrite_InProgress(t *testing.T) {
+	aof, err := OpenAOF(filepath.Join(t.TempDir(), "appendonly.aof"), FsyncNo)
+	if err != nil {
+		t.Fatalf("Unexpected error opening AOF: %v", err)
+	}
+	defer aof.Close()
+
+	aof.rewriting = true
+	err = aof.Rewrite(nil)
+	var inProgressErr *RewriteInProgressError
+	if !errors.As(err, &inProgressErr) {
+		t.Errorf("AOF.Rewrite() error = %v, want a *RewriteInProgressError", err)
+	}
+	aof.rewriting = false
+}
+
+func waitRewrite(t *testing.T, aof *AOF) {
+	t.Helper()
+	for i := 0; aof.RewriteInProgress(); i++ {
+		if i == 500 {
+			t.Fatalf("AOF rewrite did not complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
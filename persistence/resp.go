@@ -0,0 +1,115 @@
+package persistence
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const maxBulkLength = 512 * 1024 * 1024
+
+// AppendCommand appends the RESP multibulk encoding of the given command arguments to buf.
+func AppendCommand(buf []byte, args []string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// CommandReader reads RESP multibulk commands, keeping track of the offset right after the last complete one.
+type CommandReader struct {
+	reader *bufio.Reader
+	offset int64 // Offset right after the last complete command
+	read   int64 // Bytes consumed so far
+}
+
+func NewCommandReader(reader io.Reader) *CommandReader {
+	return &CommandReader{reader: bufio.NewReader(reader)}
+}
+
+// Offset returns the number of bytes up to the end of the last command returned by ReadCommand.
+func (c *CommandReader) Offset() int64 {
+	return c.offset
+}
+
+// ReadCommand returns the arguments of the next command.
+//
+// io.EOF is returned only when the input ends right after a complete command,
+// io.ErrUnexpectedEOF is returned when it ends in the middle of one.
+func (c *CommandReader) ReadCommand() ([]string, error) {
+	line, err := c.readLine()
+	if err == io.EOF && c.read == c.offset {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := parseLength(line, '*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		length, err := parseLength(line, '$')
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, length+2)
+		n, err := io.ReadFull(c.reader, buf)
+		c.read += int64(n)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if buf[length] != '\r' || buf[length+1] != '\n' {
+			return nil, errors.New("bulk string is not terminated by CRLF")
+		}
+		args = append(args, string(buf[:length]))
+	}
+
+	c.offset = c.read
+	return args, nil
+}
+
+func (c *CommandReader) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	c.read += int64(len(line))
+	if err == io.EOF && len(line) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("line is not terminated by CRLF")
+	}
+	return line[:len(line)-2], nil
+}
+
+func parseLength(line string, prefix byte) (int, error) {
+	if len(line) == 0 || line[0] != prefix {
+		return 0, fmt.Errorf("expected '%c' but got %q", prefix, line)
+	}
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length < 0 || length > maxBulkLength {
+		return 0, fmt.Errorf("invalid length %q", line[1:])
+	}
+	return length, nil
+}
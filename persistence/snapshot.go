@@ -0,0 +1,539 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot format written by WriteSnapshot
+const SnapshotVersion uint16 = 2
+
+var snapshotMagic = []byte("KVDB")
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// Opcodes and value types of the snapshot format.
+//
+// A snapshot starts with the "KVDB" magic and the big-endian uint16 format version. It is followed by
+// one opSelectDB (with the uvarint database index) per non-empty database, each followed by its entries:
+// a value type, the key and the value. Entries of expiring keys are preceded by opExpireTimeMs and the
+// big-endian uint64 unix time in milliseconds at which they expire. The opEOF opcode ends the data and
+// is followed by the big-endian CRC-64 (ECMA) checksum of everything before it.
+//
+// Version 1 snapshots have no expiration times and are still readable.
+const (
+	opExpireTimeMs byte = 0xFC
+	opSelectDB     byte = 0xFE
+	opEOF          byte = 0xFF
+
+	typeString byte = 0x00
+	typeInt    byte = 0x01
+	typeList   byte = 0x02 // The uvarint number of elements followed by the elements, from head to tail
+	typeHash   byte = 0x03 // The uvarint number of fields followed by every field and its value, sorted by field
+	typeSet    byte = 0x04 // The uvarint number of members followed by the members, sorted
+	typeZSet   byte = 0x05 // The uvarint number of members followed by every member and its big-endian float64 score, sorted by member
+)
+
+// SnapshotEntry is a key-value pair stored in a snapshot, ExpireAt is zero when the key never expires.
+type SnapshotEntry struct {
+	Key      string
+	Value    any
+	ExpireAt time.Time
+}
+
+// SnapshotDB holds the entries of one database stored in a snapshot.
+type SnapshotDB struct {
+	Index   int
+	Entries []SnapshotEntry
+}
+
+// CorruptSnapshotError is returned when a snapshot cannot be decoded or its checksum does not match.
+type CorruptSnapshotError struct {
+	Path string
+	Err  error
+}
+
+func (c *CorruptSnapshotError) Error() string {
+	return fmt.Sprintf("snapshot %q is corrupted: %v", c.Path, c.Err)
+}
+
+func (c *CorruptSnapshotError) Unwrap() error {
+	return c.Err
+}
+
+// SaveRule triggers a background save once Changes writes happened and Seconds elapsed since the last save.
+type SaveRule struct {
+	Seconds int
+	Changes int
+}
+
+// ParseSaveRules parses save rules written as space separated "<seconds> <changes>" pairs, e.g. "900 1 300 10".
+func ParseSaveRules(rules string) ([]SaveRule, error) {
+	fields := strings.Fields(rules)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save rules %q, expected <seconds> <changes> pairs", rules)
+	}
+
+	var saveRules []SaveRule
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid number of seconds %q in save rules", fields[i])
+		}
+		changes, err := strconv.Atoi(fields[i+1])
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid number of changes %q in save rules", fields[i+1])
+		}
+		saveRules = append(saveRules, SaveRule{Seconds: seconds, Changes: changes})
+	}
+	return saveRules, nil
+}
+
+// WriteSnapshot atomically writes the given databases to a snapshot file at the given path.
+//
+// The snapshot is written to a temporary file which replaces the previous snapshot only once it is
+// completely written and synced to disk.
+func WriteSnapshot(path string, dbs []SnapshotDB) error {
+	tmpPath := fmt.Sprintf("%s.tmp", path)
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating snapshot: %v", err)
+	}
+
+	err = writeSnapshot(file, dbs)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing snapshot: %v", err)
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// EncodeSnapshot returns the given databases encoded the way WriteSnapshot writes them, e.g. to send them to a
+// replica.
+func EncodeSnapshot(dbs []SnapshotDB) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, dbs); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeSnapshot(w io.Writer, dbs []SnapshotDB) error {
+	checksum := crc64.New(crcTable)
+	writer := bufio.NewWriter(io.MultiWriter(w, checksum))
+	enc := &snapshotEncoder{writer: writer}
+
+	enc.write(snapshotMagic)
+	enc.write(binary.BigEndian.AppendUint16(nil, SnapshotVersion))
+	for _, db := range dbs {
+		if len(db.Entries) == 0 {
+			continue
+		}
+		enc.writeByte(opSelectDB)
+		enc.writeUvarint(uint64(db.Index))
+		for _, entry := range db.Entries {
+			enc.writeEntry(entry)
+		}
+	}
+	enc.writeByte(opEOF)
+	if enc.err != nil {
+		return enc.err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	_, err := w.Write(binary.BigEndian.AppendUint64(nil, checksum.Sum64()))
+	return err
+}
+
+// LoadSnapshot reads the snapshot at the given path and calls apply for every entry it holds.
+//
+// Keys that expired since the snapshot was written are skipped.
+// A missing file is not an error, it simply means nothing was saved yet. A *CorruptSnapshotError
+// is returned when the file cannot be decoded or its checksum does not match its content.
+func LoadSnapshot(path string, apply func(dbIndex int, entry SnapshotEntry) error) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading snapshot: %v", err)
+	}
+
+	if err := readSnapshot(content, apply); err != nil {
+		var corruptErr *CorruptSnapshotError
+		if errors.As(err, &corruptErr) {
+			corruptErr.Path = path
+		}
+		return err
+	}
+	return nil
+}
+
+// DecodeSnapshot calls apply for every entry of a snapshot encoded by EncodeSnapshot, skipping expired keys.
+// A *CorruptSnapshotError is returned when it cannot be decoded or its checksum does not match its content.
+func DecodeSnapshot(content []byte, apply func(dbIndex int, entry SnapshotEntry) error) error {
+	return readSnapshot(content, apply)
+}
+
+func readSnapshot(content []byte, apply func(dbIndex int, entry SnapshotEntry) error) error {
+	if len(content) < len(snapshotMagic)+2+1+8 || !bytes.Equal(content[:len(snapshotMagic)], snapshotMagic) {
+		return &CorruptSnapshotError{Err: errors.New("not a snapshot file")}
+	}
+	data, sum := content[:len(content)-8], content[len(content)-8:]
+	if crc64.Checksum(data, crcTable) != binary.BigEndian.Uint64(sum) {
+		return &CorruptSnapshotError{Err: errors.New("checksum mismatch")}
+	}
+	version := binary.BigEndian.Uint16(data[len(snapshotMagic):])
+	if version > SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d, expected at most %d", version, SnapshotVersion)
+	}
+
+	dec := &snapshotDecoder{reader: bytes.NewReader(data[len(snapshotMagic)+2:])}
+	dbIndex := -1
+	var expireAt time.Time
+	for {
+		op := dec.readByte()
+		if dec.err != nil {
+			return &CorruptSnapshotError{Err: dec.err}
+		}
+
+		switch op {
+		case opEOF:
+			if dec.reader.Len() != 0 {
+				return &CorruptSnapshotError{Err: errors.New("unexpected data after EOF")}
+			}
+			return nil
+		case opSelectDB:
+			dbIndex = int(dec.readUvarint())
+		case opExpireTimeMs:
+			expireAt = time.UnixMilli(int64(dec.readUint64()))
+		default:
+			if dbIndex < 0 {
+				return &CorruptSnapshotError{Err: errors.New("entry outside of any database")}
+			}
+			entry := dec.readEntry(op)
+			if dec.err != nil {
+				return &CorruptSnapshotError{Err: dec.err}
+			}
+			entry.ExpireAt, expireAt = expireAt, time.Time{}
+			if !entry.ExpireAt.IsZero() && !entry.ExpireAt.After(time.Now()) {
+				continue
+			}
+			if err := apply(dbIndex, entry); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+type snapshotEncoder struct {
+	writer *bufio.Writer
+	err    error
+}
+
+func (e *snapshotEncoder) write(p []byte) {
+	if e.err == nil {
+		_, e.err = e.writer.Write(p)
+	}
+}
+
+func (e *snapshotEncoder) writeByte(b byte) {
+	e.write([]byte{b})
+}
+
+func (e *snapshotEncoder) writeUvarint(u uint64) {
+	e.write(binary.AppendUvarint(nil, u))
+}
+
+func (e *snapshotEncoder) writeString(s string) {
+	e.writeUvarint(uint64(len(s)))
+	e.write([]byte(s))
+}
+
+func (e *snapshotEncoder) writeEntry(entry SnapshotEntry) {
+	if !entry.ExpireAt.IsZero() {
+		e.writeByte(opExpireTimeMs)
+		e.write(binary.BigEndian.AppendUint64(nil, uint64(entry.ExpireAt.UnixMilli())))
+	}
+	valueType, ok := snapshotValueType(entry.Value)
+	if !ok {
+		if e.err == nil {
+			e.err = fmt.Errorf("unsupported value type %T for key %q", entry.Value, entry.Key)
+		}
+		return
+	}
+	e.writeByte(valueType)
+	e.writeString(entry.Key)
+	e.writeValue(entry.Value)
+}
+
+// snapshotValueType returns the value type of a value, false when snapshots cannot hold it.
+func snapshotValueType(value any) (byte, bool) {
+	switch value.(type) {
+	case string:
+		return typeString, true
+	case int:
+		return typeInt, true
+	case []string:
+		return typeList, true
+	case map[string]string:
+		return typeHash, true
+	case map[string]struct{}:
+		return typeSet, true
+	case map[string]float64:
+		return typeZSet, true
+	}
+	return 0, false
+}
+
+// writeValue writes a value of one of the types snapshotValueType supports, without its value type.
+func (e *snapshotEncoder) writeValue(value any) {
+	switch v := value.(type) {
+	case string:
+		e.writeString(v)
+	case int:
+		e.write(binary.AppendVarint(nil, int64(v)))
+	case []string:
+		e.writeUvarint(uint64(len(v)))
+		for _, elem := range v {
+			e.writeString(elem)
+		}
+	case map[string]string:
+		e.writeUvarint(uint64(len(v)))
+		fields := make([]string, 0, len(v))
+		for field := range v {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			e.writeString(field)
+			e.writeString(v[field])
+		}
+	case map[string]struct{}:
+		e.writeUvarint(uint64(len(v)))
+		members := make([]string, 0, len(v))
+		for member := range v {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		for _, member := range members {
+			e.writeString(member)
+		}
+	case map[string]float64:
+		e.writeUvarint(uint64(len(v)))
+		members := make([]string, 0, len(v))
+		for member := range v {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		for _, member := range members {
+			e.writeString(member)
+			e.write(binary.BigEndian.AppendUint64(nil, math.Float64bits(v[member])))
+		}
+	}
+}
+
+type snapshotDecoder struct {
+	reader *bytes.Reader
+	err    error
+}
+
+func (d *snapshotDecoder) readByte() byte {
+	if d.err != nil {
+		return 0
+	}
+	b, err := d.reader.ReadByte()
+	if err != nil {
+		d.err = io.ErrUnexpectedEOF
+	}
+	return b
+}
+
+func (d *snapshotDecoder) readUvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	u, err := binary.ReadUvarint(d.reader)
+	if err != nil {
+		d.err = fmt.Errorf("invalid length: %v", err)
+	}
+	return u
+}
+
+func (d *snapshotDecoder) readUint64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(d.reader, buf); err != nil {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	return binary.BigEndian.Uint64(buf)
+}
+
+func (d *snapshotDecoder) readVarint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	i, err := binary.ReadVarint(d.reader)
+	if err != nil {
+		d.err = fmt.Errorf("invalid integer: %v", err)
+	}
+	return i
+}
+
+func (d *snapshotDecoder) readString() string {
+	length := d.readUvarint()
+	if d.err != nil {
+		return ""
+	}
+	if length > uint64(d.reader.Len()) {
+		d.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	buf := make([]byte, length)
+	_, _ = io.ReadFull(d.reader, buf)
+	return string(buf)
+}
+
+func (d *snapshotDecoder) readList() []string {
+	count := d.readUvarint()
+	if count > uint64(d.reader.Len()) {
+		// Every element takes at least one byte
+		d.err = io.ErrUnexpectedEOF
+	}
+	if d.err != nil {
+		return nil
+	}
+	elems := make([]string, 0, count)
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		elems = append(elems, d.readString())
+	}
+	return elems
+}
+
+func (d *snapshotDecoder) readHash() map[string]string {
+	count := d.readUvarint()
+	if count > uint64(d.reader.Len()) {
+		d.err = io.ErrUnexpectedEOF
+	}
+	if d.err != nil {
+		return nil
+	}
+	h := make(map[string]string, count)
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		field := d.readString()
+		h[field] = d.readString()
+	}
+	return h
+}
+
+func (d *snapshotDecoder) readSet() map[string]struct{} {
+	members := d.readList()
+	if d.err != nil {
+		return nil
+	}
+	st := make(map[string]struct{}, len(members))
+	for _, member := range members {
+		st[member] = struct{}{}
+	}
+	return st
+}
+
+func (d *snapshotDecoder) readZSet() map[string]float64 {
+	count := d.readUvarint()
+	if count > uint64(d.reader.Len()) {
+		d.err = io.ErrUnexpectedEOF
+	}
+	if d.err != nil {
+		return nil
+	}
+	z := make(map[string]float64, count)
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		member := d.readString()
+		z[member] = math.Float64frombits(d.readUint64())
+	}
+	return z
+}
+
+func (d *snapshotDecoder) readEntry(valueType byte) SnapshotEntry {
+	key := d.readString()
+	return SnapshotEntry{Key: key, Value: d.readValue(valueType)}
+}
+
+func (d *snapshotDecoder) readValue(valueType byte) any {
+	switch valueType {
+	case typeString:
+		return d.readString()
+	case typeInt:
+		return int(d.readVarint())
+	case typeList:
+		return d.readList()
+	case typeHash:
+		return d.readHash()
+	case typeSet:
+		return d.readSet()
+	case typeZSet:
+		return d.readZSet()
+	}
+	if d.err == nil {
+		d.err = fmt.Errorf("unknown value type 0x%02x", valueType)
+	}
+	return nil
+}
+
+// EncodeValue encodes a single value the way snapshots store them: its value type followed by the value.
+// It supports the same types as snapshots: strings, integers, and lists, hashes, sets and sorted sets stored as
+// a []string, a map[string]string, a map[string]struct{} and a map[string]float64.
+func EncodeValue(value any) ([]byte, error) {
+	valueType, ok := snapshotValueType(value)
+	if !ok {
+		return nil, fmt.Errorf("unsupported value type %T", value)
+	}
+	var buf bytes.Buffer
+	e := &snapshotEncoder{writer: bufio.NewWriter(&buf)}
+	e.writeByte(valueType)
+	e.writeValue(value)
+	if e.err == nil {
+		e.err = e.writer.Flush()
+	}
+	return buf.Bytes(), e.err
+}
+
+// DecodeValue decodes a value encoded by EncodeValue.
+func DecodeValue(data []byte) (any, error) {
+	d := &snapshotDecoder{reader: bytes.NewReader(data)}
+	value := d.readValue(d.readByte())
+	if d.err == nil && d.reader.Len() != 0 {
+		d.err = errors.New("unexpected data after the value")
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("invalid encoded value: %v", d.err)
+	}
+	return value, nil
+}
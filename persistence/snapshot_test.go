@@ -0,0 +1,204 @@
+package persistence
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSaveRules(t *testing.T) {
+	testCases := []struct {
+		name    string
+		input   string
+		want    []SaveRule
+		wantErr bool
+	}{
+		{name: "Empty rules", input: "", want: nil},
+		{name: "Single rule", input: "900 1", want: []SaveRule{{Seconds: 900, Changes: 1}}},
+		{
+			name:  "Several rules",
+			input: " 900 1  300 10 ",
+			want:  []SaveRule{{Seconds: 900, Changes: 1}, {Seconds: 300, Changes: 10}},
+		},
+		{name: "Missing changes", input: "900 1 300", wantErr: true},
+		{name: "Invalid seconds", input: "abc 1", wantErr: true},
+		{name: "Negative changes", input: "900 -1", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseSaveRules(tc.input)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseSaveRules(%q) error = %v, want error %v", tc.input, err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ParseSaveRules(%q) = %v, want %v", tc.input, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSnapshot_WriteLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.kvdb")
+	dbs := []SnapshotDB{
+		{Index: 0, Entries: []SnapshotEntry{
+			{Key: "key", Value: "value"},
+			{Key: "multi word\r\nkey", Value: ""},
+			{Key: "counter", Value: -42},
+			{Key: "expiring", Value: "value", ExpireAt: time.UnixMilli(4102444800123)},
+			{Key: "list", Value: []string{"a", "", "multi word"}, ExpireAt: time.UnixMilli(4102444800123)},
+			{Key: "hash", Value: map[string]string{"name": "Ada", "": "empty field"}},
+			{Key: "set", Value: map[string]struct{}{"b": {}, "a": {}, "": {}}},
+			{Key: "zset", Value: map[string]float64{"ada": 1.5, "grace": -2, "linus": math.Inf(1)}},
+		}},
+		{Index: 1},
+		{Index: 300, Entries: []SnapshotEntry{
+			{Key: "other", Value: 1 << 40},
+			{Key: "expired", Value: "value", ExpireAt: time.UnixMilli(1)},
+		}},
+	}
+
+	if err := WriteSnapshot(path, dbs); err != nil {
+		t.Fatalf("WriteSnapshot() error = %v", err)
+	}
+
+	got := map[int][]SnapshotEntry{}
+	err := LoadSnapshot(path, func(dbIndex int, entry SnapshotEntry) error {
+		got[dbIndex] = append(got[dbIndex], entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("LoadSnapshot() error = %v", err)
+	}
+
+	// Keys that already expired are skipped
+	want := map[int][]SnapshotEntry{0: dbs[0].Entries, 300: dbs[2].Entries[:1]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadSnapshot() = %v, want %v", got, want)
+	}
+
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Temporary snapshot file still exists: %v", err)
+	}
+}
+
+func TestEncodeSnapshot(t *testing.T) {
+	dbs := []SnapshotDB{
+		{Index: 1, Entries: []SnapshotEntry{
+			{Key: "key", Value: "value", ExpireAt: time.UnixMilli(4102444800123)},
+			{Key: "list", Value: []string{"a", "b"}},
+		}},
+	}
+	content, err := EncodeSnapshot(dbs)
+	if err != nil {
+		t.Fatalf("EncodeSnapshot() error = %v", err)
+	}
+
+	got := map[int][]SnapshotEntry{}
+	err = DecodeSnapshot(content, func(dbIndex int, entry SnapshotEntry) error {
+		got[dbIndex] = append(got[dbIndex], entry)
+		return nil
+	})
+	if want := map[int][]SnapshotEntry{1: dbs[0].Entries}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeSnapshot(EncodeSnapshot()) = %v, %v, want %v", got, err, want)
+	}
+
+	var corruptErr *CorruptSnapshotError
+	err = DecodeSnapshot(flipByte(content, len(content)/2), func(int, SnapshotEntry) error { return nil })
+	if !errors.As(err, &corruptErr) {
+		t.Errorf("DecodeSnapshot() of a corrupted snapshot error = %v, want a *CorruptSnapshotError", err)
+	}
+}
+
+func TestEncodeValue(t *testing.T) {
+	values := []any{
+		"value", "", -42, []string{"a", "", "multi word"}, map[string]string{"name": "Ada"},
+		map[string]struct{}{"a": {}, "b": {}}, map[string]float64{"ada": 1.5, "linus": math.Inf(-1)},
+	}
+	for _, value := range values {
+		data, err := EncodeValue(value)
+		if err != nil {
+			t.Fatalf("EncodeValue(%v) error = %v", value, err)
+		}
+		got, err := DecodeValue(data)
+		if err != nil || !reflect.DeepEqual(got, value) {
+			t.Errorf("DecodeValue(EncodeValue(%v)) = %v, %v", value, got, err)
+		}
+		if _, err := DecodeValue(data[:len(data)-1]); err == nil && len(data) > 2 {
+			t.Errorf("DecodeValue() of a truncated %v returned no error", value)
+		}
+	}
+
+	if _, err := EncodeValue(1.5); err == nil {
+		t.Errorf("EncodeValue() of a float returned no error")
+	}
+	if _, err := DecodeValue([]byte{0x42}); err == nil {
+		t.Errorf("DecodeValue() of an unknown value type returned no error")
+	}
+}
+
+func TestSnapshot_UnsupportedValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.kvdb")
+	dbs := []SnapshotDB{{Index: 0, Entries: []SnapshotEntry{{Key: "key", Value: 1.5}}}}
+
+	if err := WriteSnapshot(path, dbs); err == nil {
+		t.Fatalf("WriteSnapshot() error = nil, want an error")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Snapshot file exists after a failed write: %v", err)
+	}
+}
+
+func TestLoadSnapshot_Corrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.kvdb")
+	dbs := []SnapshotDB{{Index: 2, Entries: []SnapshotEntry{{Key: "key", Value: "value"}}}}
+	if err := WriteSnapshot(path, dbs); err != nil {
+		t.Fatalf("WriteSnapshot() error = %v", err)
+	}
+	valid, _ := os.ReadFile(path)
+
+	testCases := []struct {
+		name    string
+		content []byte
+	}{
+		{name: "Flipped byte", content: flipByte(valid, len(valid)/2)},
+		{name: "Truncated", content: valid[:len(valid)-3]},
+		{name: "Not a snapshot", content: []byte("*1\r\n$4\r\nPING\r\n")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := os.WriteFile(path, tc.content, 0644); err != nil {
+				t.Fatalf("Unexpected error writing snapshot: %v", err)
+			}
+			err := LoadSnapshot(path, func(dbIndex int, entry SnapshotEntry) error {
+				return nil
+			})
+			var corruptErr *CorruptSnapshotError
+			if !errors.As(err, &corruptErr) {
+				t.Errorf("LoadSnapshot() error = %v, want a *CorruptSnapshotError", err)
+			}
+		})
+	}
+}
+
+func TestLoadSnapshot_MissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.kvdb")
+	err := LoadSnapshot(path, func(dbIndex int, entry SnapshotEntry) error {
+		t.Errorf("Unexpected entry %v", entry)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("LoadSnapshot() error = %v, want nil", err)
+	}
+}
+
+func flipByte(content []byte, i int) []byte {
+	flipped := append([]byte{}, content...)
+	flipped[i] ^= 0xFF
+	return flipped
+}
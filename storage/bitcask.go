@@ -0,0 +1,939 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxSegmentSize = 64 << 20
+	defaultMergeInterval  = time.Minute
+	defaultMergeRatio     = 0.5
+)
+
+// BitcaskOptions configures a Bitcask storage, the zero value of a field selecting its default.
+type BitcaskOptions struct {
+	// Codec encodes the values other than strings and integers, which cannot be stored without it
+	Codec Codec
+	// Size beyond which the active segment is replaced by a new one, 64 MiB by default
+	MaxSegmentSize int64
+	// How often the storage checks whether the segments should be merged, every minute by default
+	MergeInterval time.Duration
+	// Share of the size of the segments taken by overwritten, deleted or expired keys beyond which they are merged,
+	// 0.5 by default
+	MergeRatio float64
+	// Whether every write is flushed to disk before returning, rather than when the active segment is replaced
+	SyncWrites bool
+}
+
+// bitcaskLocation is where the latest record of a key is stored, along with the expiration time of the key.
+type bitcaskLocation struct {
+	fileID   uint32
+	offset   int64
+	size     uint32
+	seq      uint64
+	expireAt int64 // Unix time in nanoseconds, 0 when the key never expires
+}
+
+func (l bitcaskLocation) expired(now time.Time) bool {
+	return l.expireAt != 0 && now.UnixNano() >= l.expireAt
+}
+
+func (l bitcaskLocation) expireTime() time.Time {
+	if l.expireAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, l.expireAt)
+}
+
+// bitcaskChange is a modification of a key applied by apply: its new value and expiration time, or its removal
+// when value is nil.
+type bitcaskChange struct {
+	dbIndex  int
+	key      string
+	value    []byte
+	expireAt int64
+}
+
+// bitcaskStorage keeps the values in append-only segment files and only the keys in memory, in a keydir mapping
+// every key to the location of its latest record, so that reading a value takes a single read.
+//
+// Overwritten and deleted values are left in the segments until a merge rewrites the live records of the segments
+// other than the active one. The records carry the physical identifier of their database, which Flush and Swap
+// change in the manifest rather than rewriting the records.
+type bitcaskStorage struct {
+	dir     string
+	dbCount int
+	options BitcaskOptions
+
+	mu           sync.RWMutex
+	keydirs      [][]map[string]bitcaskLocation // Keys of every database, split like the shards of inMemoryStorage
+	physical     []uint32                       // Physical identifier of every database
+	nextPhysical uint32
+	segments     map[uint32]*segment
+	active       *segment
+	nextFileID   uint32
+	nextSeq      uint64
+	merged       []uint32 // Merged segments listed in the manifest until all of them are removed
+
+	mergeMu  sync.Mutex    // Serializes merges
+	reclaims chan struct{} // Signals the background merge that Reclaim was called
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newKeydir() []map[string]bitcaskLocation {
+	keydir := make([]map[string]bitcaskLocation, shardCount)
+	for j := range keydir {
+		keydir[j] = make(map[string]bitcaskLocation)
+	}
+	return keydir
+}
+
+// OpenBitcaskStorage opens the Bitcask storage of the given directory, creating it if needed, and starts the
+// background merge of its segments.
+//
+// The keydirs are built from the hint files of the merged segments and from the records of the other ones.
+// Records cut short by a crash are ignored, and new records are always appended to a new segment.
+func OpenBitcaskStorage(dir string, dbCount int, options BitcaskOptions) (Storage, error) {
+	if dbCount == 0 {
+		dbCount = 16
+	}
+	if options.MaxSegmentSize <= 0 {
+		options.MaxSegmentSize = defaultMaxSegmentSize
+	}
+	if options.MergeInterval <= 0 {
+		options.MergeInterval = defaultMergeInterval
+	}
+	if options.MergeRatio <= 0 {
+		options.MergeRatio = defaultMergeRatio
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	b := &bitcaskStorage{
+		dir:      dir,
+		dbCount:  dbCount,
+		options:  options,
+		keydirs:  make([][]map[string]bitcaskLocation, dbCount),
+		segments: make(map[uint32]*segment),
+		reclaims: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	for dbIndex := range b.keydirs {
+		b.keydirs[dbIndex] = newKeydir()
+	}
+	err := b.loadManifest()
+	if err == nil {
+		err = b.load()
+	}
+	if err == nil {
+		err = b.rotate()
+	}
+	if err != nil {
+		for _, s := range b.segments {
+			_ = s.file.Close()
+		}
+		return nil, fmt.Errorf("error opening bitcask storage %s: %v", dir, err)
+	}
+
+	b.wg.Add(1)
+	go b.mergeSegments()
+	return b, nil
+}
+
+// loadManifest reads the physical identifiers of the databases, or assigns them when the storage is new or holds
+// fewer databases than dbCount. The segments of a merge interrupted while removing them are removed.
+func (b *bitcaskStorage) loadManifest() error {
+	m, ok, err := readManifest(b.dir)
+	if err != nil {
+		return err
+	}
+	if len(m.physical) > b.dbCount {
+		return fmt.Errorf("the storage holds %d databases, more than %d", len(m.physical), b.dbCount)
+	}
+	b.physical, b.nextPhysical = m.physical, m.nextPhysical
+	if ok && len(m.physical) == b.dbCount && len(m.merged) == 0 {
+		return nil
+	}
+	for _, id := range m.merged {
+		if err := removeSegmentFiles(b.dir, id); err != nil {
+			return err
+		}
+	}
+	for len(b.physical) < b.dbCount {
+		b.physical = append(b.physical, b.nextPhysical)
+		b.nextPhysical++
+	}
+	return writeManifest(b.dir, manifest{nextPhysical: b.nextPhysical, physical: b.physical})
+}
+
+// manifest returns the manifest of the storage listing the given merged segments, it must be called while holding
+// the lock.
+func (b *bitcaskStorage) manifest(merged []uint32) manifest {
+	return manifest{nextPhysical: b.nextPhysical, physical: b.physical, merged: merged}
+}
+
+// load opens the segments of the directory and builds the keydirs, keeping the record of every key having the
+// highest sequence number.
+func (b *bitcaskStorage) load() error {
+	dirEntries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+	var ids []uint32
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if strings.HasSuffix(name, tmpExt) {
+			// Left by a crash while writing a hint file or the manifest
+			_ = os.Remove(filepath.Join(b.dir, name))
+			continue
+		}
+		if id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 32); err == nil && strings.HasSuffix(name, segmentExt) {
+			ids = append(ids, uint32(id))
+		}
+	}
+	sort.Slice(ids, func(a, c int) bool { return ids[a] < ids[c] })
+
+	type loaded struct {
+		location  bitcaskLocation
+		tombstone bool
+	}
+	latest := make(map[uint32]map[string]loaded)
+	add := func(db uint32, key string, l loaded) {
+		keys, ok := latest[db]
+		if !ok {
+			keys = make(map[string]loaded)
+			latest[db] = keys
+		}
+		if current, ok := keys[key]; !ok || l.location.seq > current.location.seq {
+			keys[key] = l
+		}
+		b.nextSeq = max(b.nextSeq, l.location.seq+1)
+	}
+
+	for _, id := range ids {
+		file, err := os.OpenFile(segmentPath(b.dir, id, segmentExt), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		s := &segment{id: id, file: file}
+		b.segments[id] = s
+		b.nextFileID = id + 1
+
+		if hints, err := readHintFile(b.dir, id); err == nil {
+			for _, h := range hints {
+				add(h.db, h.key, loaded{location: h.location})
+			}
+			info, err := file.Stat()
+			if err != nil {
+				return err
+			}
+			s.size = info.Size()
+			continue
+		}
+		s.size, err = scanSegment(file, func(r record, offset int64) {
+			add(r.db, r.key, loaded{
+				location:  bitcaskLocation{fileID: id, offset: offset, size: uint32(r.size()), seq: r.seq, expireAt: r.expireAt},
+				tombstone: r.flags&recordTombstone != 0,
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	currentTime := now()
+	for dbIndex, db := range b.physical {
+		for key, l := range latest[db] {
+			if !l.tombstone && !l.location.expired(currentTime) {
+				b.keydir(dbIndex, key)[key] = l.location
+			}
+		}
+	}
+	return nil
+}
+
+// keydir returns the part of the keydir of a database holding the key.
+func (b *bitcaskStorage) keydir(dbIndex int, key string) map[string]bitcaskLocation {
+	return b.keydirs[dbIndex][shardIndex(key)]
+}
+
+// rotate replaces the active segment by a new one, it must be called while holding the lock.
+func (b *bitcaskStorage) rotate() error {
+	if b.active != nil {
+		if err := b.active.file.Sync(); err != nil {
+			return err
+		}
+	}
+	s, err := createSegment(b.dir, b.nextFileID)
+	if err != nil {
+		return err
+	}
+	b.nextFileID++
+	b.segments[s.id], b.active = s, s
+	return nil
+}
+
+// write appends records to the active segment at once, after assigning their sequence numbers, and returns their
+// location. It must be called while holding the lock.
+func (b *bitcaskStorage) write(records []record) ([]bitcaskLocation, error) {
+	size := 0
+	for _, r := range records {
+		size += r.size()
+	}
+	if b.active.size > 0 && b.active.size+int64(size) > b.options.MaxSegmentSize {
+		if err := b.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := make([]byte, 0, size)
+	locations := make([]bitcaskLocation, len(records))
+	for j, r := range records {
+		r.seq = b.nextSeq
+		b.nextSeq++
+		if j < len(records)-1 {
+			r.flags |= recordBatch
+		}
+		locations[j] = bitcaskLocation{
+			fileID: b.active.id, offset: b.active.size + int64(len(buf)), size: uint32(r.size()), seq: r.seq,
+			expireAt: r.expireAt,
+		}
+		buf = r.appendTo(buf)
+	}
+	if _, err := b.active.file.WriteAt(buf, b.active.size); err != nil {
+		return nil, err
+	}
+	if b.options.SyncWrites {
+		if err := b.active.file.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	b.active.size += int64(len(buf))
+	return locations, nil
+}
+
+// apply writes the changes as one batch, then applies them to the keydirs. Removing a key that does not exist
+// writes no tombstone. It must be called while holding the lock.
+func (b *bitcaskStorage) apply(changes ...bitcaskChange) error {
+	var records []record
+	var applied []bitcaskChange
+	for _, c := range changes {
+		r := record{expireAt: c.expireAt, db: b.physical[c.dbIndex], key: c.key, value: c.value}
+		if c.value == nil {
+			if !b.written(c.dbIndex, c.key, applied) {
+				continue
+			}
+			r.flags, r.expireAt = recordTombstone, 0
+		}
+		records = append(records, r)
+		applied = append(applied, c)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	locations, err := b.write(records)
+	if err != nil {
+		return err
+	}
+	for j, c := range applied {
+		if c.value == nil {
+			delete(b.keydir(c.dbIndex, c.key), c.key)
+		} else {
+			b.keydir(c.dbIndex, c.key)[c.key] = locations[j]
+		}
+	}
+	return nil
+}
+
+// written reports whether a key has a record that may need a tombstone: it is in the keydir, even expired,
+// or set by one of the pending changes.
+func (b *bitcaskStorage) written(dbIndex int, key string, pending []bitcaskChange) bool {
+	if _, ok := b.keydir(dbIndex, key)[key]; ok {
+		return true
+	}
+	for _, c := range pending {
+		if c.dbIndex == dbIndex && c.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the location of a key unless it does not exist or expired.
+// It must be called while holding the lock, possibly the read lock.
+func (b *bitcaskStorage) lookup(dbIndex int, key string) (bitcaskLocation, bool) {
+	l, ok := b.keydir(dbIndex, key)[key]
+	if !ok || l.expired(now()) {
+		return bitcaskLocation{}, false
+	}
+	return l, true
+}
+
+// readValue reads the encoded value stored at a location with a single read.
+func (b *bitcaskStorage) readValue(l bitcaskLocation) ([]byte, error) {
+	s, ok := b.segments[l.fileID]
+	if !ok {
+		return nil, fmt.Errorf("segment %d not found", l.fileID)
+	}
+	data := make([]byte, l.size)
+	if _, err := s.file.ReadAt(data, l.offset); err != nil {
+		return nil, fmt.Errorf("error reading segment %d: %v", l.fileID, err)
+	}
+	r, err := decodeRecord(data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading segment %d at %d: %v", l.fileID, l.offset, err)
+	}
+	return r.value, nil
+}
+
+// get returns the value of a key and its location, false when it does not exist or expired.
+// It must be called while holding the lock, possibly the read lock.
+func (b *bitcaskStorage) get(dbIndex int, key string) (any, bitcaskLocation, bool, error) {
+	l, ok := b.lookup(dbIndex, key)
+	if !ok {
+		return nil, l, false, nil
+	}
+	data, err := b.readValue(l)
+	if err != nil {
+		return nil, l, false, err
+	}
+	value, err := decodeValue(b.options.Codec, data)
+	if err != nil {
+		return nil, l, false, err
+	}
+	return value, l, true, nil
+}
+
+func (b *bitcaskStorage) Set(dbIndex int, key string, value any) error {
+	return b.SetWithExpiry(dbIndex, key, value, time.Time{})
+}
+
+func (b *bitcaskStorage) SetWithExpiry(dbIndex int, key string, value any, expireAt time.Time) error {
+	data, err := encodeValue(b.options.Codec, value)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.apply(bitcaskChange{dbIndex: dbIndex, key: key, value: data, expireAt: unixNano(expireAt)})
+}
+
+func (b *bitcaskStorage) Get(dbIndex int, key string) (any, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	value, _, ok, err := b.get(dbIndex, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &KeyNotFoundError{key: key}
+	}
+	return value, nil
+}
+
+func (b *bitcaskStorage) View(dbIndex int, key string, fn func(value any, exists bool) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	value, _, ok, err := b.get(dbIndex, key)
+	if err != nil {
+		return err
+	}
+	return fn(value, ok)
+}
+
+func (b *bitcaskStorage) ViewValues(dbIndex int, keys []string, fn func(values []any) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	values := make([]any, len(keys))
+	for j, key := range keys {
+		value, _, _, err := b.get(dbIndex, key)
+		if err != nil {
+			return err
+		}
+		values[j] = value
+	}
+	return fn(values)
+}
+
+func (b *bitcaskStorage) Delete(dbIndex int, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.lookup(dbIndex, key); !ok {
+		return &KeyNotFoundError{key: key}
+	}
+	return b.apply(bitcaskChange{dbIndex: dbIndex, key: key})
+}
+
+// encodeEntries returns the changes setting the given entries.
+func (b *bitcaskStorage) encodeEntries(dbIndex int, entries []Entry) ([]bitcaskChange, error) {
+	changes := make([]bitcaskChange, len(entries))
+	for j, e := range entries {
+		data, err := encodeValue(b.options.Codec, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		changes[j] = bitcaskChange{dbIndex: dbIndex, key: e.Key, value: data, expireAt: unixNano(e.ExpireAt)}
+	}
+	return changes, nil
+}
+
+func (b *bitcaskStorage) MSet(dbIndex int, entries []Entry) error {
+	changes, err := b.encodeEntries(dbIndex, entries)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.apply(changes...)
+}
+
+func (b *bitcaskStorage) MSetNX(dbIndex int, entries []Entry) (bool, error) {
+	changes, err := b.encodeEntries(dbIndex, entries)
+	if err != nil {
+		return false, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, e := range entries {
+		if _, ok := b.lookup(dbIndex, e.Key); ok {
+			return false, nil
+		}
+	}
+	if err := b.apply(changes...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// MGet returns nil for the values that cannot be read, along with the missing ones.
+func (b *bitcaskStorage) MGet(dbIndex int, keys ...string) []any {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	values := make([]any, len(keys))
+	for j, key := range keys {
+		values[j], _, _, _ = b.get(dbIndex, key)
+	}
+	return values
+}
+
+// DeleteKeys returns 0 when the tombstones cannot be written, the keys are then left untouched.
+func (b *bitcaskStorage) DeleteKeys(dbIndex int, keys ...string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	deleted := 0
+	seen := make(map[string]bool, len(keys))
+	changes := make([]bitcaskChange, len(keys))
+	for j, key := range keys {
+		if _, ok := b.lookup(dbIndex, key); ok && !seen[key] {
+			deleted++
+		}
+		seen[key] = true
+		changes[j] = bitcaskChange{dbIndex: dbIndex, key: key}
+	}
+	if err := b.apply(changes...); err != nil {
+		return 0
+	}
+	return deleted
+}
+
+func (b *bitcaskStorage) Exists(dbIndex int, keys ...string) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	count := 0
+	for _, key := range keys {
+		if _, ok := b.lookup(dbIndex, key); ok {
+			count++
+		}
+	}
+	return count
+}
+
+func (b *bitcaskStorage) Update(dbIndex int, key string, fn UpdateFunc) (any, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	value, l, exists, err := b.get(dbIndex, key)
+	if err != nil {
+		return nil, err
+	}
+	newValue, err := fn(value, exists)
+	if err != nil {
+		return nil, err
+	}
+	c := bitcaskChange{dbIndex: dbIndex, key: key, expireAt: l.expireAt}
+	if newValue != nil {
+		if c.value, err = encodeValue(b.options.Codec, newValue); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.apply(c); err != nil {
+		return nil, err
+	}
+	return newValue, nil
+}
+
+func (b *bitcaskStorage) UpdateValues(dbIndex int, keys []string, fn UpdateValuesFunc) error {
+	return b.UpdateEntries(dbIndex, keys, updateValues(fn))
+}
+
+func (b *bitcaskStorage) UpdateEntries(dbIndex int, keys []string, fn UpdateEntriesFunc) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entries := make([]Entry, len(keys))
+	for j, key := range keys {
+		value, l, _, err := b.get(dbIndex, key)
+		if err != nil {
+			return err
+		}
+		entries[j] = Entry{Key: key, Value: value, ExpireAt: l.expireTime()}
+	}
+	newEntries, err := fn(entries)
+	if err != nil {
+		return err
+	}
+	changes := make([]bitcaskChange, len(keys))
+	for j, key := range keys {
+		if changes[j], err = b.change(dbIndex, key, newEntries[j]); err != nil {
+			return err
+		}
+	}
+	return b.apply(changes...)
+}
+
+// change returns the change setting the entry of a key, or removing the key when the entry has no value or
+// expired.
+func (b *bitcaskStorage) change(dbIndex int, key string, e Entry) (bitcaskChange, error) {
+	c := bitcaskChange{dbIndex: dbIndex, key: key}
+	if e.Value == nil || (!e.ExpireAt.IsZero() && !now().Before(e.ExpireAt)) {
+		return c, nil
+	}
+	data, err := encodeValue(b.options.Codec, e.Value)
+	c.value, c.expireAt = data, unixNano(e.ExpireAt)
+	return c, err
+}
+
+func (b *bitcaskStorage) UpdateEntry(dbIndex int, key string, fn UpdateEntryFunc) (Entry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	value, l, exists, err := b.get(dbIndex, key)
+	if err != nil {
+		return Entry{}, err
+	}
+	newEntry, err := fn(Entry{Key: key, Value: value, ExpireAt: l.expireTime()}, exists)
+	if err != nil {
+		return Entry{}, err
+	}
+	newEntry.Key = key
+	c, err := b.change(dbIndex, key, newEntry)
+	if err != nil {
+		return Entry{}, err
+	}
+	if err := b.apply(c); err != nil {
+		return Entry{}, err
+	}
+	return newEntry, nil
+}
+
+// setExpiry rewrites the record of an existing key with another expiration time, removing the key when it is
+// in the past. It must be called while holding the lock.
+func (b *bitcaskStorage) setExpiry(dbIndex int, key string, l bitcaskLocation, expireAt time.Time) error {
+	if !expireAt.IsZero() && !now().Before(expireAt) {
+		return b.apply(bitcaskChange{dbIndex: dbIndex, key: key})
+	}
+	data, err := b.readValue(l)
+	if err != nil {
+		return err
+	}
+	return b.apply(bitcaskChange{dbIndex: dbIndex, key: key, value: data, expireAt: unixNano(expireAt)})
+}
+
+func (b *bitcaskStorage) Expire(dbIndex int, key string, expireAt time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	l, ok := b.lookup(dbIndex, key)
+	if !ok {
+		return &KeyNotFoundError{key: key}
+	}
+	return b.setExpiry(dbIndex, key, l, expireAt)
+}
+
+func (b *bitcaskStorage) Persist(dbIndex int, key string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	l, ok := b.lookup(dbIndex, key)
+	if !ok {
+		return false, &KeyNotFoundError{key: key}
+	}
+	if l.expireAt == 0 {
+		return false, nil
+	}
+	if err := b.setExpiry(dbIndex, key, l, time.Time{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *bitcaskStorage) ExpireTime(dbIndex int, key string) (time.Time, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	l, ok := b.lookup(dbIndex, key)
+	if !ok {
+		return time.Time{}, &KeyNotFoundError{key: key}
+	}
+	return l.expireTime(), nil
+}
+
+// Copy copies the encoded value of the key, which is never decoded.
+func (b *bitcaskStorage) Copy(srcIndex int, src string, dstIndex int, dst string, replace bool) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	l, ok := b.lookup(srcIndex, src)
+	if !ok {
+		return false, &KeyNotFoundError{key: src}
+	}
+	if srcIndex == dstIndex && src == dst {
+		return false, nil
+	}
+	if _, exists := b.lookup(dstIndex, dst); exists && !replace {
+		return false, nil
+	}
+	data, err := b.readValue(l)
+	if err != nil {
+		return false, err
+	}
+	if err := b.apply(bitcaskChange{dbIndex: dstIndex, key: dst, value: data, expireAt: l.expireAt}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Move writes the key to the other database and its tombstone as one batch.
+func (b *bitcaskStorage) Move(srcIndex int, key string, dstIndex int) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	l, ok := b.lookup(srcIndex, key)
+	if !ok {
+		return false, &KeyNotFoundError{key: key}
+	}
+	if _, exists := b.lookup(dstIndex, key); exists || srcIndex == dstIndex {
+		return false, nil
+	}
+	data, err := b.readValue(l)
+	if err != nil {
+		return false, err
+	}
+	err = b.apply(
+		bitcaskChange{dbIndex: dstIndex, key: key, value: data, expireAt: l.expireAt},
+		bitcaskChange{dbIndex: srcIndex, key: key},
+	)
+	return err == nil, err
+}
+
+// Flush gives the database a new physical identifier, the records of the previous one are left to the merge.
+func (b *bitcaskStorage) Flush(dbIndex int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	physical := append([]uint32(nil), b.physical...)
+	physical[dbIndex] = b.nextPhysical
+	if err := writeManifest(b.dir, manifest{nextPhysical: b.nextPhysical + 1, physical: physical, merged: b.merged}); err != nil {
+		return err
+	}
+	b.physical, b.nextPhysical = physical, b.nextPhysical+1
+	b.keydirs[dbIndex] = newKeydir()
+	return nil
+}
+
+// Swap exchanges the physical identifiers of the databases along with their keydirs.
+func (b *bitcaskStorage) Swap(dbIndex1, dbIndex2 int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if dbIndex1 == dbIndex2 {
+		return nil
+	}
+	physical := append([]uint32(nil), b.physical...)
+	physical[dbIndex1], physical[dbIndex2] = physical[dbIndex2], physical[dbIndex1]
+	if err := writeManifest(b.dir, manifest{nextPhysical: b.nextPhysical, physical: physical, merged: b.merged}); err != nil {
+		return err
+	}
+	b.physical = physical
+	b.keydirs[dbIndex1], b.keydirs[dbIndex2] = b.keydirs[dbIndex2], b.keydirs[dbIndex1]
+	return nil
+}
+
+// Scan iterates over the keys in the order of their scan position, like inMemoryStorage.Scan, and reads the values
+// of the page while holding the read lock.
+func (b *bitcaskStorage) Scan(dbIndex int, cursor uint64, count int) ([]Entry, uint64, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	type positioned struct {
+		pos uint64
+		key string
+		l   bitcaskLocation
+	}
+	var page []Entry
+	for j := max(int(cursor>>32)-1, 0); j < shardCount; j++ {
+		if len(page) >= count {
+			return page, uint64(j+1) << 32, nil
+		}
+
+		var candidates []positioned
+		currentTime := now()
+		for k, l := range b.keydirs[dbIndex][j] {
+			if pos := scanPosition(k); pos >= cursor && !l.expired(currentTime) {
+				candidates = append(candidates, positioned{pos: pos, key: k, l: l})
+			}
+		}
+		sort.Slice(candidates, func(a, c int) bool {
+			if candidates[a].pos != candidates[c].pos {
+				return candidates[a].pos < candidates[c].pos
+			}
+			return candidates[a].key < candidates[c].key
+		})
+		for n, c := range candidates {
+			if len(page) >= count && c.pos != candidates[n-1].pos {
+				return page, c.pos, nil
+			}
+			data, err := b.readValue(c.l)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, err := decodeValue(b.options.Codec, data)
+			if err != nil {
+				return nil, 0, err
+			}
+			page = append(page, Entry{Key: c.key, Value: value, ExpireAt: c.l.expireTime()})
+		}
+	}
+	return page, 0, nil
+}
+
+// Iterate reads the values while holding the read lock, during which writes wait.
+func (b *bitcaskStorage) Iterate(dbIndex int, fn func(e Entry) bool) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	currentTime := now()
+	for _, keys := range b.keydirs[dbIndex] {
+		for k, l := range keys {
+			if l.expired(currentTime) {
+				continue
+			}
+			data, err := b.readValue(l)
+			if err != nil {
+				return err
+			}
+			value, err := decodeValue(b.options.Codec, data)
+			if err != nil {
+				return err
+			}
+			if !fn(Entry{Key: k, Value: value, ExpireAt: l.expireTime()}) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Keys only reads the keydir, while holding the read lock.
+func (b *bitcaskStorage) Keys(dbIndex int, fn func(key string) bool) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	currentTime := now()
+	for _, keys := range b.keydirs[dbIndex] {
+		for k, l := range keys {
+			if !l.expired(currentTime) && !fn(k) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// RandomKey picks a random part of the keydir, then a random key of the first part holding a key not expired
+// from there.
+func (b *bitcaskStorage) RandomKey(dbIndex int) (string, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	start := rand.Intn(shardCount)
+	currentTime := now()
+	for j := 0; j < shardCount; j++ {
+		var keys []string
+		for k, l := range b.keydirs[dbIndex][(start+j)%shardCount] {
+			if !l.expired(currentTime) {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) > 0 {
+			return keys[rand.Intn(len(keys))], true
+		}
+	}
+	return "", false
+}
+
+func (b *bitcaskStorage) Size(dbIndex int) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	size := 0
+	for _, keys := range b.keydirs[dbIndex] {
+		size += len(keys)
+	}
+	return size
+}
+
+func (b *bitcaskStorage) Select(dbIndex string) (int, error) {
+	return selectDB(dbIndex, b.dbCount)
+}
+
+func (b *bitcaskStorage) DbCount() int {
+	return b.dbCount
+}
+
+// Close stops the background merge and flushes the active segment to disk.
+func (b *bitcaskStorage) Close() error {
+	close(b.stop)
+	b.wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := b.active.file.Sync()
+	for _, s := range b.segments {
+		if closeErr := s.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,340 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Files of a Bitcask storage directory: the segments holding the records, named after their identifier, the hint
+// files of the merged segments and the manifest.
+const (
+	segmentExt   = ".data"
+	hintExt      = ".hint"
+	manifestName = "MANIFEST"
+	tmpExt       = ".tmp"
+)
+
+// A record sets the value of a key, or removes the key when it is a tombstone:
+//
+//	crc (4) | seq (8) | expireAt (8) | db (4) | flags (1) | key length (4) | value length (4) | key | value
+//
+// Integers are big-endian and the CRC-32 (IEEE) covers everything after it. seq orders the records of a key,
+// whatever segment holds them, expireAt is the unix time in nanoseconds at which the key expires, 0 when it never
+// does, and db is the physical identifier of the database of the key.
+//
+// The records written at once by a multi-key operation have recordBatch set, except the last one: a batch cut
+// short by a crash is ignored when the segment is loaded.
+const recordHeaderSize = 33
+
+const (
+	recordTombstone byte = 1 << iota
+	recordBatch
+)
+
+var errCorruptRecord = errors.New("corrupt record")
+
+type record struct {
+	seq      uint64
+	expireAt int64
+	db       uint32
+	flags    byte
+	key      string
+	value    []byte
+}
+
+func (r record) size() int {
+	return recordHeaderSize + len(r.key) + len(r.value)
+}
+
+// appendTo appends the encoded record to buf.
+func (r record) appendTo(buf []byte) []byte {
+	start := len(buf)
+	buf = binary.BigEndian.AppendUint32(buf, 0)
+	buf = binary.BigEndian.AppendUint64(buf, r.seq)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(r.expireAt))
+	buf = binary.BigEndian.AppendUint32(buf, r.db)
+	buf = append(buf, r.flags)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(r.key)))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(r.value)))
+	buf = append(buf, r.key...)
+	buf = append(buf, r.value...)
+	binary.BigEndian.PutUint32(buf[start:], crc32.ChecksumIEEE(buf[start+4:]))
+	return buf
+}
+
+// recordSize returns the size of the record starting with the given header.
+func recordSize(header []byte) int64 {
+	return recordHeaderSize + int64(binary.BigEndian.Uint32(header[25:])) + int64(binary.BigEndian.Uint32(header[29:]))
+}
+
+// decodeRecord decodes a record, data holding exactly the record.
+func decodeRecord(data []byte) (record, error) {
+	if len(data) < recordHeaderSize || int64(len(data)) != recordSize(data) {
+		return record{}, errCorruptRecord
+	}
+	if crc32.ChecksumIEEE(data[4:]) != binary.BigEndian.Uint32(data) {
+		return record{}, errCorruptRecord
+	}
+	keyEnd := recordHeaderSize + binary.BigEndian.Uint32(data[25:])
+	return record{
+		seq:      binary.BigEndian.Uint64(data[4:]),
+		expireAt: int64(binary.BigEndian.Uint64(data[12:])),
+		db:       binary.BigEndian.Uint32(data[20:]),
+		flags:    data[24],
+		key:      string(data[recordHeaderSize:keyEnd]),
+		value:    data[keyEnd:],
+	}, nil
+}
+
+// segment is a data file of a Bitcask storage. Records are only appended to the active segment, the other ones
+// are read-only until a merge replaces them.
+type segment struct {
+	id   uint32
+	file *os.File
+	size int64
+}
+
+func segmentPath(dir string, id uint32, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%09d%s", id, ext))
+}
+
+// removeSegmentFiles removes the segment file of the given identifier and its hint file, if they exist.
+func removeSegmentFiles(dir string, id uint32) error {
+	for _, ext := range []string{segmentExt, hintExt} {
+		if err := os.Remove(segmentPath(dir, id, ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// createSegment creates the segment file of the given identifier, which must not exist.
+func createSegment(dir string, id uint32) (*segment, error) {
+	file, err := os.OpenFile(segmentPath(dir, id, segmentExt), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &segment{id: id, file: file}, nil
+}
+
+// scanSegment calls fn with every record of a segment along with its offset, in order. It stops at the first
+// record that cannot be read, which is how a segment cut short by a crash ends, and returns the size of the records
+// read. The records of a batch are only passed to fn once its last record is read.
+func scanSegment(file *os.File, fn func(r record, offset int64)) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReaderSize(io.NewSectionReader(file, 0, info.Size()), 64<<10)
+
+	type positioned struct {
+		r      record
+		offset int64
+	}
+	var batch []positioned
+	offset, end := int64(0), int64(0)
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return end, nil
+		}
+		size := recordSize(header)
+		if size > info.Size()-offset {
+			return end, nil
+		}
+		data := make([]byte, size)
+		copy(data, header)
+		if _, err := io.ReadFull(reader, data[recordHeaderSize:]); err != nil {
+			return end, nil
+		}
+		r, err := decodeRecord(data)
+		if err != nil {
+			return end, nil
+		}
+		batch = append(batch, positioned{r: r, offset: offset})
+		offset += size
+		if r.flags&recordBatch == 0 {
+			for _, p := range batch {
+				fn(p.r, p.offset)
+			}
+			batch, end = batch[:0], offset
+		}
+	}
+}
+
+// A hint file lists the records of a merged segment without their values, so that opening the storage reads it
+// rather than the whole segment:
+//
+//	seq (8) | expireAt (8) | db (4) | offset (8) | size (4) | key length (4) | key
+//
+// for every record, followed by the big-endian CRC-32 (IEEE) of all of them. Merged segments hold no tombstones.
+type hint struct {
+	db       uint32
+	key      string
+	location bitcaskLocation
+}
+
+const hintHeaderSize = 36
+
+// writeHintFile writes the hint file of a merged segment, through a temporary file renamed once complete.
+func writeHintFile(dir string, id uint32, hints []hint) error {
+	var buf []byte
+	for _, h := range hints {
+		buf = binary.BigEndian.AppendUint64(buf, h.location.seq)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(h.location.expireAt))
+		buf = binary.BigEndian.AppendUint32(buf, h.db)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(h.location.offset))
+		buf = binary.BigEndian.AppendUint32(buf, h.location.size)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(h.key)))
+		buf = append(buf, h.key...)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	return writeFileAtomically(segmentPath(dir, id, hintExt), buf)
+}
+
+// readHintFile reads the hint file of a merged segment, it returns an error when the file is missing or corrupt.
+func readHintFile(dir string, id uint32) ([]hint, error) {
+	content, err := os.ReadFile(segmentPath(dir, id, hintExt))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < 4 {
+		return nil, errCorruptRecord
+	}
+	data, sum := content[:len(content)-4], content[len(content)-4:]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(sum) {
+		return nil, errCorruptRecord
+	}
+	var hints []hint
+	for len(data) > 0 {
+		if len(data) < hintHeaderSize {
+			return nil, errCorruptRecord
+		}
+		keyEnd := hintHeaderSize + int(binary.BigEndian.Uint32(data[32:]))
+		if keyEnd > len(data) {
+			return nil, errCorruptRecord
+		}
+		hints = append(hints, hint{
+			db:  binary.BigEndian.Uint32(data[16:]),
+			key: string(data[hintHeaderSize:keyEnd]),
+			location: bitcaskLocation{
+				fileID:   id,
+				offset:   int64(binary.BigEndian.Uint64(data[20:])),
+				size:     binary.BigEndian.Uint32(data[28:]),
+				seq:      binary.BigEndian.Uint64(data),
+				expireAt: int64(binary.BigEndian.Uint64(data[8:])),
+			},
+		})
+		data = data[keyEnd:]
+	}
+	return hints, nil
+}
+
+// The manifest holds the next physical database identifier followed by the physical identifier of every database,
+// separated by spaces. Flush and Swap change the identifiers rather than the records.
+//
+// A second line lists the segments of a merge that are being removed, so that all of them are considered removed
+// at once: a tombstone dropped by the merge must not be removed without the older records of its key.
+type manifest struct {
+	nextPhysical uint32
+	physical     []uint32
+	merged       []uint32
+}
+
+// readManifest returns the manifest of the directory, false when it does not exist.
+func readManifest(dir string) (manifest, bool, error) {
+	content, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest{}, false, nil
+	}
+	if err != nil {
+		return manifest{}, false, err
+	}
+	lines := strings.SplitN(string(content), "\n", 2)
+	physical, err := parseIDs(lines[0])
+	if err != nil {
+		return manifest{}, false, err
+	}
+	if len(physical) == 0 {
+		return manifest{}, false, fmt.Errorf("invalid manifest: empty")
+	}
+	m := manifest{nextPhysical: physical[0], physical: physical[1:]}
+	if len(lines) > 1 {
+		if m.merged, err = parseIDs(lines[1]); err != nil {
+			return manifest{}, false, err
+		}
+	}
+	return m, true, nil
+}
+
+func parseIDs(line string) ([]uint32, error) {
+	fields := strings.Fields(line)
+	ids := make([]uint32, len(fields))
+	for j, field := range fields {
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest: %v", err)
+		}
+		ids[j] = uint32(id)
+	}
+	return ids, nil
+}
+
+func writeManifest(dir string, m manifest) error {
+	content := formatIDs(append([]uint32{m.nextPhysical}, m.physical...)) + "\n"
+	if len(m.merged) > 0 {
+		content += formatIDs(m.merged) + "\n"
+	}
+	return writeFileAtomically(filepath.Join(dir, manifestName), []byte(content))
+}
+
+func formatIDs(ids []uint32) string {
+	fields := make([]string, len(ids))
+	for j, id := range ids {
+		fields[j] = strconv.FormatUint(uint64(id), 10)
+	}
+	return strings.Join(fields, " ")
+}
+
+// writeFileAtomically writes a file to disk through a temporary file renamed once synced, so that the file is
+// either left untouched or entirely written.
+func writeFileAtomically(path string, content []byte) error {
+	tmpPath := path + tmpExt
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the entries of a directory to disk, so that the files created or renamed in it are persisted.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// mergeSegments periodically merges the segments other than the active one once overwritten, deleted and expired
+// keys take more than MergeRatio of their size, and all of them when Reclaim asks to, until the storage is closed.
+func (b *bitcaskStorage) mergeSegments() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.options.MergeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-b.reclaims:
+			if err := b.reclaim(); err != nil {
+				log.Printf("Error merging the segments of %s: %v", b.dir, err)
+			}
+		case <-ticker.C:
+			if !b.shouldMerge() {
+				continue
+			}
+			if err := b.merge(); err != nil {
+				log.Printf("Error merging the segments of %s: %v", b.dir, err)
+			}
+		}
+	}
+}
+
+// Reclaim merges all the segments, the active one included, so that the records of the removed keys are dropped.
+func (b *bitcaskStorage) Reclaim(async bool) error {
+	if !async {
+		return b.reclaim()
+	}
+	select {
+	case b.reclaims <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// reclaim replaces the active segment by a new one and merges the others.
+func (b *bitcaskStorage) reclaim() error {
+	b.mu.Lock()
+	err := b.rotate()
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return b.merge()
+}
+
+// shouldMerge reports whether the dead records of the segments other than the active one, the ones no key of the
+// keydirs points to, take more than MergeRatio of their size.
+func (b *bitcaskStorage) shouldMerge() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	total := int64(0)
+	for _, s := range b.segments {
+		if s != b.active {
+			total += s.size
+		}
+	}
+	live := int64(0)
+	currentTime := now()
+	for _, keydir := range b.keydirs {
+		for _, keys := range keydir {
+			for _, l := range keys {
+				if l.fileID != b.active.id && !l.expired(currentTime) {
+					live += int64(l.size)
+				}
+			}
+		}
+	}
+	return total > live && float64(total-live) >= b.options.MergeRatio*float64(total)
+}
+
+// merge rewrites the live records of the segments other than the active one to new segments, each along with
+// its hint file, then removes the merged segments.
+//
+// Writes go on during the merge: the keys they modify in the meantime keep pointing to the active segment. The
+// merged records keep their sequence number, which orders them with the records written since when the storage is
+// opened. Tombstones are left out, the older records of their key are merged at the same time and the merged
+// segments are all removed at once.
+func (b *bitcaskStorage) merge() error {
+	b.mergeMu.Lock()
+	defer b.mergeMu.Unlock()
+
+	b.mu.RLock()
+	var inputs []*segment
+	for _, s := range b.segments {
+		if s != b.active {
+			inputs = append(inputs, s)
+		}
+	}
+	b.mu.RUnlock()
+	if len(inputs) == 0 {
+		return nil
+	}
+	sort.Slice(inputs, func(a, c int) bool { return inputs[a].id < inputs[c].id })
+
+	// moved holds the records rewritten to the outputs, dropped the expired ones the keydirs still point to
+	type move struct {
+		db       uint32
+		key      string
+		from, to bitcaskLocation
+	}
+	var moved, dropped []move
+	var outputs []*segment
+	var output *segment
+	var hints []hint
+	finish := func() error {
+		if output == nil {
+			return nil
+		}
+		if err := output.file.Sync(); err != nil {
+			return err
+		}
+		return writeHintFile(b.dir, output.id, hints)
+	}
+
+	var mergeErr error
+	for _, input := range inputs {
+		_, err := scanSegment(input.file, func(r record, offset int64) {
+			if mergeErr != nil || r.flags&recordTombstone != 0 {
+				return
+			}
+			from := bitcaskLocation{fileID: input.id, offset: offset, size: uint32(r.size()), seq: r.seq, expireAt: r.expireAt}
+			live, expired := b.isLive(r.db, r.key, from)
+			if expired {
+				dropped = append(dropped, move{db: r.db, key: r.key, from: from})
+			}
+			if !live {
+				return
+			}
+
+			if output == nil || output.size+int64(r.size()) > b.options.MaxSegmentSize {
+				if mergeErr = finish(); mergeErr != nil {
+					return
+				}
+				b.mu.Lock()
+				output, mergeErr = createSegment(b.dir, b.nextFileID)
+				b.nextFileID++
+				b.mu.Unlock()
+				if mergeErr != nil {
+					return
+				}
+				outputs, hints = append(outputs, output), nil
+			}
+			r.flags = 0
+			to := bitcaskLocation{fileID: output.id, offset: output.size, size: uint32(r.size()), seq: r.seq, expireAt: r.expireAt}
+			if _, mergeErr = output.file.WriteAt(r.appendTo(nil), output.size); mergeErr != nil {
+				return
+			}
+			output.size += int64(r.size())
+			moved = append(moved, move{db: r.db, key: r.key, from: from, to: to})
+			hints = append(hints, hint{db: r.db, key: r.key, location: to})
+		})
+		if mergeErr == nil {
+			mergeErr = err
+		}
+		if mergeErr != nil {
+			break
+		}
+	}
+	if mergeErr == nil {
+		mergeErr = finish()
+	}
+	if mergeErr == nil {
+		mergeErr = syncDir(b.dir)
+	}
+
+	// The merged segments are listed in the manifest before being removed, so that a crash in between does not
+	// leave the segment of an older record of a key once the one of its tombstone is gone
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if mergeErr == nil {
+		merged := b.merged
+		for _, s := range inputs {
+			merged = append(merged, s.id)
+		}
+		if mergeErr = writeManifest(b.dir, b.manifest(merged)); mergeErr == nil {
+			b.merged = merged
+		}
+	}
+	if mergeErr != nil {
+		for _, s := range outputs {
+			_ = s.file.Close()
+			_ = removeSegmentFiles(b.dir, s.id)
+		}
+		return mergeErr
+	}
+
+	logical := make(map[uint32]int, len(b.physical))
+	for dbIndex, db := range b.physical {
+		logical[db] = dbIndex
+	}
+	for _, s := range outputs {
+		b.segments[s.id] = s
+	}
+	for _, m := range moved {
+		if dbIndex, ok := logical[m.db]; ok {
+			if keys := b.keydir(dbIndex, m.key); keys[m.key] == m.from {
+				keys[m.key] = m.to
+			}
+		}
+	}
+	for _, m := range dropped {
+		if dbIndex, ok := logical[m.db]; ok {
+			if keys := b.keydir(dbIndex, m.key); keys[m.key] == m.from {
+				delete(keys, m.key)
+			}
+		}
+	}
+	var removeErr error
+	for _, s := range inputs {
+		delete(b.segments, s.id)
+		_ = s.file.Close()
+		if err := removeSegmentFiles(b.dir, s.id); err != nil && removeErr == nil {
+			removeErr = err
+		}
+	}
+	if removeErr != nil {
+		// The segments left are removed when the storage is opened again
+		return removeErr
+	}
+	if err := writeManifest(b.dir, b.manifest(nil)); err != nil {
+		return err
+	}
+	b.merged = nil
+	return nil
+}
+
+// isLive reports whether the keydir of a physical database points to the record of a key at the given location,
+// and whether the key expired.
+func (b *bitcaskStorage) isLive(db uint32, key string, l bitcaskLocation) (bool, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for dbIndex, physical := range b.physical {
+		if physical == db {
+			if current, ok := b.keydir(dbIndex, key)[key]; ok && current == l {
+				expired := l.expired(now())
+				return !expired, expired
+			}
+			return false, false
+		}
+	}
+	return false, false
+}
@@ -0,0 +1,484 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testList is a value encoded by testCodec, standing for the values the storage cannot encode itself
+type testList []string
+
+type testCodec struct{}
+
+func (testCodec) Encode(value any) ([]byte, error) {
+	list, ok := value.(testList)
+	if !ok {
+		return nil, fmt.Errorf("unsupported value type %T", value)
+	}
+	return json.Marshal(list)
+}
+
+func (testCodec) Decode(data []byte) (any, error) {
+	var list testList
+	err := json.Unmarshal(data, &list)
+	return list, err
+}
+
+func openBitcask(t *testing.T, dir string, dbCount int, options BitcaskOptions) *bitcaskStorage {
+	t.Helper()
+	options.Codec = testCodec{}
+	s, err := OpenBitcaskStorage(dir, dbCount, options)
+	if err != nil {
+		t.Fatalf("OpenBitcaskStorage() error = %v", err)
+	}
+	return s.(*bitcaskStorage)
+}
+
+// dumpStorage returns the entries of every database of a storage, keyed by their database and key.
+func dumpStorage(t *testing.T, s Storage) map[string]Entry {
+	t.Helper()
+	entries := make(map[string]Entry)
+	for dbIndex := 0; dbIndex < s.DbCount(); dbIndex++ {
+		page, cursor, err := s.Scan(dbIndex, 0, 1<<30)
+		if err != nil || cursor != 0 {
+			t.Fatalf("Scan() of database %d = %d, %v, want a single page", dbIndex, cursor, err)
+		}
+		iterated := 0
+		err = s.Iterate(dbIndex, func(e Entry) bool {
+			iterated++
+			return true
+		})
+		if err != nil || iterated != len(page) {
+			t.Fatalf("Iterate() over database %d = %d entries, %v, want the %d entries of Scan()", dbIndex, iterated, err, len(page))
+		}
+		keys := 0
+		err = s.Keys(dbIndex, func(string) bool {
+			keys++
+			return true
+		})
+		if err != nil || keys != len(page) {
+			t.Fatalf("Keys() of database %d = %d keys, %v, want the %d keys of Scan()", dbIndex, keys, err, len(page))
+		}
+		for _, e := range page {
+			if !e.ExpireAt.IsZero() {
+				e.ExpireAt = time.Unix(0, e.ExpireAt.UnixNano())
+			}
+			entries[fmt.Sprintf("%d/%s", dbIndex, e.Key)] = e
+		}
+	}
+	return entries
+}
+
+// segmentIDs returns the identifiers of the segment files of a directory, sorted.
+func segmentIDs(t *testing.T, dir string, ext string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+	if err != nil {
+		t.Fatalf("Unexpected error listing %s: %v", dir, err)
+	}
+	sort.Strings(paths)
+	for j, path := range paths {
+		paths[j] = filepath.Base(path)
+	}
+	return paths
+}
+
+// testMatchesInMemory applies the same random operations to a storage and an in-memory one, while calling maintain
+// every 300 operations and reopening the storage with open every 500, and checks that both always hold the same
+// entries.
+func testMatchesInMemory(t *testing.T, open func() Storage, maintain func(s Storage) error) {
+	// The clock is read by the active expiry of the in-memory storage while the test advances it
+	var clock atomic.Int64
+	clock.Store(time.Unix(1700000000, 0).UnixNano())
+	now = func() time.Time { return time.Unix(0, clock.Load()) }
+	t.Cleanup(func() { now = time.Now })
+	storage := open()
+	defer func() { _ = storage.Close() }()
+	inMemory := NewInMemoryStorage(3)
+	defer inMemory.Close()
+
+	r := rand.New(rand.NewSource(1))
+	randomKey := func() string { return fmt.Sprintf("key_%d", r.Intn(20)) }
+	randomValue := func() any {
+		switch r.Intn(3) {
+		case 0:
+			return r.Intn(1000) - 500
+		case 1:
+			return fmt.Sprintf("value_%d", r.Intn(1000))
+		}
+		return testList{randomKey(), fmt.Sprint(r.Intn(10))}
+	}
+	randomExpiry := func() time.Time {
+		return now().Add(time.Duration(r.Intn(20)-2) * time.Second)
+	}
+
+	for i := 0; i < 3000; i++ {
+		// Both storages get the same operation, all its random numbers are drawn beforehand
+		clock.Add(int64(time.Duration(r.Intn(1000)) * time.Millisecond))
+		dbIndex, otherIndex, key, other := r.Intn(3), r.Intn(3), randomKey(), randomKey()
+		value, expireAt := randomValue(), randomExpiry()
+		entries := []Entry{{Key: key, Value: value}, {Key: other, Value: randomValue(), ExpireAt: expireAt}}
+		replace, remove, rare := r.Intn(2) == 0, r.Intn(4) == 0, r.Intn(8) == 0
+		increment := func(value any, exists bool) (any, error) {
+			if n, ok := value.(int); ok && n%3 != 0 {
+				return n + 1, nil
+			}
+			if exists && remove {
+				return nil, nil
+			}
+			return 1, nil
+		}
+
+		var op string
+		for _, s := range []Storage{inMemory, storage} {
+			switch n := i % 17; {
+			case n < 4:
+				op = "Set"
+				_ = s.Set(dbIndex, key, value)
+			case n < 6:
+				op = "SetWithExpiry"
+				_ = s.SetWithExpiry(dbIndex, key, value, expireAt)
+			case n == 6:
+				op = "Delete"
+				_ = s.Delete(dbIndex, key)
+			case n == 7:
+				op = "MSet"
+				_ = s.MSet(dbIndex, entries)
+			case n == 8:
+				op = "DeleteKeys"
+				_ = s.DeleteKeys(dbIndex, key, other, key)
+			case n == 9:
+				op = "Update"
+				_, _ = s.Update(dbIndex, key, increment)
+			case n == 10:
+				op = "Expire"
+				_ = s.Expire(dbIndex, key, expireAt)
+			case n == 11:
+				op = "Persist"
+				_, _ = s.Persist(dbIndex, key)
+			case n == 12:
+				op = "Copy"
+				_, _ = s.Copy(dbIndex, key, otherIndex, other, replace)
+			case n == 13:
+				op = "Move"
+				_, _ = s.Move(dbIndex, key, otherIndex)
+			case n == 14:
+				op = "UpdateEntries"
+				_ = s.UpdateEntries(dbIndex, []string{key, other, key}, func(current []Entry) ([]Entry, error) {
+					first := current[1]
+					if remove {
+						first.Value = nil
+					}
+					return []Entry{first, entries[1], entries[0]}, nil
+				})
+			case n == 15 && rare:
+				op = "Flush"
+				_ = s.Flush(dbIndex)
+			case n == 16 && rare:
+				op = "Swap"
+				_ = s.Swap(dbIndex, otherIndex)
+			}
+		}
+
+		if i%300 == 299 {
+			if err := maintain(storage); err != nil {
+				t.Fatalf("Maintenance of the storage error = %v", err)
+			}
+		}
+		if i%500 == 499 {
+			if err := storage.Close(); err != nil {
+				t.Fatalf("Storage.Close() error = %v", err)
+			}
+			storage = open()
+		}
+		if got, want := dumpStorage(t, storage), dumpStorage(t, inMemory); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Storage after %s (operation %d) = %v, want %v", op, i, got, want)
+		}
+	}
+}
+
+// TestBitcaskStorage_MatchesInMemory checks the Bitcask storage against the in-memory one while merging its
+// segments.
+func TestBitcaskStorage_MatchesInMemory(t *testing.T) {
+	dir := t.TempDir()
+	options := BitcaskOptions{MaxSegmentSize: 512, MergeInterval: time.Hour}
+	testMatchesInMemory(t, func() Storage {
+		return openBitcask(t, dir, 3, options)
+	}, func(s Storage) error {
+		return s.(*bitcaskStorage).merge()
+	})
+}
+
+func TestBitcaskStorage_Merge(t *testing.T) {
+	dir := t.TempDir()
+	options := BitcaskOptions{MaxSegmentSize: 256, MergeInterval: time.Hour}
+	s := openBitcask(t, dir, 2, options)
+
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 10; i++ {
+			_ = s.Set(i%2, fmt.Sprintf("key_%d", i), fmt.Sprintf("value_%d_%d", i, round))
+		}
+	}
+	_ = s.Delete(0, "key_0")
+	_ = s.Set(1, "list", testList{"a", "b"})
+	want := dumpStorage(t, s)
+	before := segmentIDs(t, dir, segmentExt)
+	if !s.shouldMerge() {
+		t.Errorf("bitcask.shouldMerge() = false with 9 out of 10 values overwritten")
+	}
+
+	if err := s.merge(); err != nil {
+		t.Fatalf("bitcask.merge() error = %v", err)
+	}
+	after := segmentIDs(t, dir, segmentExt)
+	if len(after) >= len(before) {
+		t.Errorf("Segments after merge = %v, want fewer than %v", after, before)
+	}
+	// Every merged segment has a hint file, the active segment has none
+	hints := segmentIDs(t, dir, hintExt)
+	if len(hints) != len(after)-1 {
+		t.Errorf("Hint files after merge = %v, want one for every segment of %v but the active one", hints, after)
+	}
+	if s.shouldMerge() {
+		t.Errorf("bitcask.shouldMerge() = true right after a merge")
+	}
+	if got := dumpStorage(t, s); !reflect.DeepEqual(got, want) {
+		t.Errorf("Bitcask storage after merge = %v, want %v", got, want)
+	}
+
+	// The merged segments are loaded from their hint files, and the tombstone of the deleted key is not needed
+	if err := s.Close(); err != nil {
+		t.Fatalf("bitcask.Close() error = %v", err)
+	}
+	s = openBitcask(t, dir, 2, options)
+	defer s.Close()
+	if got := dumpStorage(t, s); !reflect.DeepEqual(got, want) {
+		t.Errorf("Bitcask storage reopened after merge = %v, want %v", got, want)
+	}
+	if _, err := s.Get(0, "key_0"); err == nil {
+		t.Errorf("bitcask.Get() of a deleted key after merge returned no error")
+	}
+}
+
+func TestBitcaskStorage_MergeCrash(t *testing.T) {
+	dir := t.TempDir()
+	options := BitcaskOptions{MergeInterval: time.Hour}
+	s := openBitcask(t, dir, 1, options)
+	_ = s.Set(0, "deleted", "value")
+	_ = s.Set(0, "kept", "value")
+	_ = s.Close()
+
+	// The first merge moves the record of the key to a segment above the active one, which then gets its tombstone
+	s = openBitcask(t, dir, 1, options)
+	if err := s.merge(); err != nil {
+		t.Fatalf("bitcask.merge() error = %v", err)
+	}
+	_ = s.Delete(0, "deleted")
+	_ = s.Close()
+	s = openBitcask(t, dir, 1, options)
+	segments := segmentIDs(t, dir, segmentExt)
+	older := segments[1]
+	saved := make(map[string][]byte)
+	for _, name := range []string{older, strings.TrimSuffix(older, segmentExt) + hintExt} {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Unexpected error reading %s: %v", name, err)
+		}
+		saved[name] = content
+	}
+	if err := s.merge(); err != nil {
+		t.Fatalf("bitcask.merge() error = %v", err)
+	}
+	_ = s.Close()
+
+	// A crash left the segment of the older record once the one of the tombstone was removed
+	for name, content := range saved {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatalf("Unexpected error writing %s: %v", name, err)
+		}
+	}
+	m, _, err := readManifest(dir)
+	if err != nil {
+		t.Fatalf("readManifest() error = %v", err)
+	}
+	for _, name := range segments[:2] {
+		id, _ := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 32)
+		m.merged = append(m.merged, uint32(id))
+	}
+	if err := writeManifest(dir, m); err != nil {
+		t.Fatalf("writeManifest() error = %v", err)
+	}
+
+	s = openBitcask(t, dir, 1, options)
+	defer s.Close()
+	if got := s.Exists(0, "deleted", "kept"); got != 1 {
+		t.Errorf("bitcask.Exists() after a merge interrupted by a crash = %d, want only the key not deleted", got)
+	}
+	if got := segmentIDs(t, dir, segmentExt); slices.Contains(got, older) {
+		t.Errorf("Segments after a merge interrupted by a crash = %v, want %s removed", got, older)
+	}
+}
+
+func TestBitcaskStorage_TornWrite(t *testing.T) {
+	dir := t.TempDir()
+	s := openBitcask(t, dir, 1, BitcaskOptions{})
+	_ = s.Set(0, "kept", "value")
+	_ = s.MSet(0, []Entry{{Key: "batch_1", Value: "a"}, {Key: "batch_2", Value: "b"}, {Key: "batch_3", Value: "c"}})
+	if err := s.Close(); err != nil {
+		t.Fatalf("bitcask.Close() error = %v", err)
+	}
+
+	// A crash cut the last record of the batch short
+	segments := segmentIDs(t, dir, segmentExt)
+	path := filepath.Join(dir, segments[len(segments)-1])
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openBitcask(t, dir, 1, BitcaskOptions{})
+	defer s.Close()
+	if got := s.Exists(0, "kept", "batch_1", "batch_2", "batch_3"); got != 1 {
+		t.Errorf("bitcask.Exists() after a torn batch = %d, want only the key written before it", got)
+	}
+	if err := s.Set(0, "batch_1", "new"); err != nil {
+		t.Fatalf("bitcask.Set() after a torn batch error = %v", err)
+	}
+	if value, _ := s.Get(0, "batch_1"); value != "new" {
+		t.Errorf("bitcask.Get() after a torn batch = %v, want %q", value, "new")
+	}
+}
+
+func TestOpenBitcaskStorage_Errors(t *testing.T) {
+	dir := t.TempDir()
+	s := openBitcask(t, dir, 4, BitcaskOptions{})
+	if err := s.Set(0, "key", 1.5); err == nil {
+		t.Errorf("bitcask.Set() of a value the codec does not support returned no error")
+	}
+	_ = s.Close()
+
+	if _, err := OpenBitcaskStorage(dir, 2, BitcaskOptions{}); err == nil {
+		t.Errorf("OpenBitcaskStorage() with fewer databases than the storage holds returned no error")
+	}
+	s = openBitcask(t, dir, 8, BitcaskOptions{})
+	defer s.Close()
+	if got := s.DbCount(); got != 8 {
+		t.Errorf("bitcask.DbCount() after adding databases = %d, want 8", got)
+	}
+}
+
+func TestBitcaskStorage_ConcurrentMerge(t *testing.T) {
+	dir := t.TempDir()
+	options := BitcaskOptions{MaxSegmentSize: 1024, MergeInterval: time.Hour}
+	s := openBitcask(t, dir, 2, options)
+	writers, iterations := 4, 500
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				key := fmt.Sprintf("writer_%d_key_%d", writer, i%10)
+				_ = s.Set(writer%2, key, i)
+				if i%7 == 0 {
+					_ = s.Delete(writer%2, key)
+				}
+				_, _ = s.Update(0, "counter", func(value any, exists bool) (any, error) {
+					if !exists {
+						return 1, nil
+					}
+					return value.(int) + 1, nil
+				})
+			}
+		}(w)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if err := s.merge(); err != nil {
+				t.Errorf("bitcask.merge() error = %v", err)
+			}
+		}
+	}()
+	wg.Wait()
+	<-done
+
+	want := dumpStorage(t, s)
+	if want["0/counter"].Value != writers*iterations {
+		t.Errorf("counter after concurrent merges = %v, want %d", want["0/counter"].Value, writers*iterations)
+	}
+	if err := s.merge(); err != nil {
+		t.Fatalf("bitcask.merge() error = %v", err)
+	}
+	_ = s.Close()
+	s = openBitcask(t, dir, 2, options)
+	defer s.Close()
+	if got := dumpStorage(t, s); !reflect.DeepEqual(got, want) {
+		t.Errorf("Bitcask storage reopened after concurrent merges = %v, want %v", got, want)
+	}
+}
+
+// segmentRecords returns the number of records held by the segment files of a directory.
+func segmentRecords(t *testing.T, dir string) int {
+	t.Helper()
+	records := 0
+	for _, name := range segmentIDs(t, dir, segmentExt) {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Unexpected error opening %s: %v", name, err)
+		}
+		_, _ = scanSegment(file, func(record, int64) { records++ })
+		_ = file.Close()
+	}
+	return records
+}
+
+func TestBitcaskStorage_Reclaim(t *testing.T) {
+	dir := t.TempDir()
+	s := openBitcask(t, dir, 2, BitcaskOptions{MaxSegmentSize: 1024, MergeInterval: time.Hour})
+	defer s.Close()
+	for i := 0; i < 200; i++ {
+		_ = s.Set(i%2, fmt.Sprintf("key_%03d", i), "value")
+	}
+	_ = s.Delete(1, "key_001")
+	_ = s.Flush(0)
+
+	// The segments only hold the live keys once the space is reclaimed, the active one included
+	if err := s.Reclaim(false); err != nil {
+		t.Fatalf("bitcask.Reclaim() error = %v", err)
+	}
+	if got := segmentRecords(t, dir); got != 99 {
+		t.Errorf("Records of the segments after bitcask.Reclaim() = %d, want the 99 live keys", got)
+	}
+	if got := len(dumpStorage(t, s)); got != 99 {
+		t.Errorf("Keys after bitcask.Reclaim() = %d, want 99", got)
+	}
+
+	_ = s.Flush(1)
+	if err := s.Reclaim(true); err != nil {
+		t.Fatalf("bitcask.Reclaim() error = %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); segmentRecords(t, dir) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Records of the segments after an asynchronous bitcask.Reclaim() = %d, want 0", segmentRecords(t, dir))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Number of keys sampled in every database to pick a key to evict, like the maxmemory-samples of Redis
+	evictionSampleSize = 5
+	// Estimated memory held by every key besides its name and value: its map entry, entry and access data
+	entryOverhead = 64
+	// Frequency of a new key, so that it is not evicted before being accessed a few times
+	lfuInitFrequency = 5
+	// How fast the frequency grows: the more accesses a key had, the less likely a new one increments it
+	lfuLogFactor = 10
+	// The frequency of a key decays by one for every such period without access
+	lfuDecayPeriod = time.Minute
+)
+
+// ErrOutOfMemory is returned by Evict when the keys hold more memory than the limit and none can be evicted.
+var ErrOutOfMemory = errors.New("used memory above maxmemory")
+
+// EvictionPolicy tells which keys are evicted when the keys hold more memory than the limit.
+type EvictionPolicy int
+
+const (
+	// NoEviction evicts no key, the writes that would use more memory fail instead
+	NoEviction EvictionPolicy = iota
+	// AllKeysLRU evicts the least recently used keys
+	AllKeysLRU
+	// AllKeysLFU evicts the least frequently used keys
+	AllKeysLFU
+	// AllKeysRandom evicts random keys
+	AllKeysRandom
+	// VolatileLRU evicts the least recently used keys having an expiration time
+	VolatileLRU
+	// VolatileLFU evicts the least frequently used keys having an expiration time
+	VolatileLFU
+	// VolatileRandom evicts random keys having an expiration time
+	VolatileRandom
+	// VolatileTTL evicts the keys expiring first
+	VolatileTTL
+)
+
+// evictionPolicyNames are the names of the policies, as Redis names them, in the order of the policies
+var evictionPolicyNames = []string{
+	"noeviction", "allkeys-lru", "allkeys-lfu", "allkeys-random", "volatile-lru", "volatile-lfu", "volatile-random",
+	"volatile-ttl",
+}
+
+func (p EvictionPolicy) String() string {
+	return evictionPolicyNames[p]
+}
+
+// LFU reports whether the policy evicts the least frequently used keys, the access frequency of the keys being
+// tracked in place of their last access time.
+func (p EvictionPolicy) LFU() bool {
+	return p == AllKeysLFU || p == VolatileLFU
+}
+
+// volatile reports whether the policy only evicts keys having an expiration time.
+func (p EvictionPolicy) volatile() bool {
+	return p >= VolatileLRU
+}
+
+// ParseEvictionPolicy parses the name of an eviction policy, an empty name being noeviction.
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return NoEviction, nil
+	}
+	for p, policyName := range evictionPolicyNames {
+		if name == policyName {
+			return EvictionPolicy(p), nil
+		}
+	}
+	return NoEviction, fmt.Errorf("unknown eviction policy %q", name)
+}
+
+// ParseMemory parses an amount of memory in bytes, followed by an optional unit the way Redis configures them:
+// k, m and g are powers of 1000, kb, mb and gb powers of 1024. An empty amount is 0.
+func ParseMemory(amount string) (int64, error) {
+	amount = strings.ToLower(strings.TrimSpace(amount))
+	if amount == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"b", 1},
+	} {
+		if strings.HasSuffix(amount, unit.suffix) {
+			amount, multiplier = strings.TrimSuffix(amount, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid amount of memory %q", amount)
+	}
+	return n * multiplier, nil
+}
+
+// memoryUsage returns the estimated number of bytes held by a key and its value.
+func memoryUsage(key string, value any) int64 {
+	size := entryOverhead + len(key)
+	switch v := value.(type) {
+	case string:
+		size += len(v)
+	case int:
+		size += 8
+	case Sizer:
+		size += v.MemoryUsage()
+	default:
+		size += 16
+	}
+	return int64(size)
+}
+
+// accessStats tracks the accesses to a key. It is updated by readers holding the read lock of the shard,
+// hence its atomic fields: concurrent accesses may lose an increment, which the approximate policies tolerate.
+type accessStats struct {
+	lastAccess atomic.Int64  // Unix time of the last access in nanoseconds
+	frequency  atomic.Uint32 // Logarithmic counter, saturating at 255
+}
+
+func newAccessStats(now time.Time) *accessStats {
+	a := &accessStats{}
+	a.lastAccess.Store(now.UnixNano())
+	a.frequency.Store(lfuInitFrequency)
+	return a
+}
+
+// decayedFrequency returns the frequency decayed by the time elapsed since the last access.
+func (a *accessStats) decayedFrequency(now time.Time) uint32 {
+	periods := now.Sub(time.Unix(0, a.lastAccess.Load())) / lfuDecayPeriod
+	frequency := a.frequency.Load()
+	if int64(periods) >= int64(frequency) {
+		return 0
+	}
+	return frequency - uint32(periods)
+}
+
+// touch records an access: the frequency is decayed, then incremented with a probability decreasing as it grows,
+// the way Redis approximates the access frequency in 8 bits.
+func (a *accessStats) touch(now time.Time) {
+	frequency := a.decayedFrequency(now)
+	if frequency < 255 {
+		base := max(float64(frequency)-lfuInitFrequency, 0)
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			frequency++
+		}
+	}
+	a.frequency.Store(frequency)
+	a.lastAccess.Store(now.UnixNano())
+}
+
+// memoryLimit is the memory accounting of an in-memory storage, shared by its shards.
+type memoryLimit struct {
+	used      atomic.Int64 // Estimated number of bytes held by the keys
+	maxMemory atomic.Int64 // 0 for no limit
+	mu        sync.Mutex   // Serializes evictions and guards policy
+	policy    EvictionPolicy
+}
+
+func (i inMemoryStorage) SetMaxMemory(maxMemory int64, policy EvictionPolicy) {
+	i.memory.mu.Lock()
+	defer i.memory.mu.Unlock()
+
+	i.memory.maxMemory.Store(maxMemory)
+	i.memory.policy = policy
+}
+
+func (i inMemoryStorage) EvictionPolicy() EvictionPolicy {
+	i.memory.mu.Lock()
+	defer i.memory.mu.Unlock()
+	return i.memory.policy
+}
+
+func (i inMemoryStorage) UsedMemory() int64 {
+	return i.memory.used.Load()
+}
+
+// Evict removes the best candidates out of samples of keys, the way Redis approximates its eviction policies
+// rather than ordering all keys.
+func (i inMemoryStorage) Evict(fn func(dbIndex int, key string)) error {
+	m := i.memory
+	if maxMemory := m.maxMemory.Load(); maxMemory == 0 || m.used.Load() <= maxMemory {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for maxMemory := m.maxMemory.Load(); maxMemory > 0 && m.used.Load() > maxMemory; {
+		if m.policy == NoEviction {
+			return ErrOutOfMemory
+		}
+		dbIndex, key, ok := i.evictionCandidate(m.policy)
+		if !ok {
+			return ErrOutOfMemory
+		}
+		if i.evictKey(dbIndex, key) {
+			fn(dbIndex, key)
+		}
+	}
+	return nil
+}
+
+// evictionCandidate samples keys of every database and returns the one the policy evicts first, false when
+// no key can be evicted.
+func (i inMemoryStorage) evictionCandidate(policy EvictionPolicy) (int, string, bool) {
+	bestDbIndex, bestKey, bestScore, found := 0, "", 0.0, false
+	for dbIndex := 0; dbIndex < i.dbCount; dbIndex++ {
+		for key, score := range i.evictionSample(dbIndex, policy) {
+			if !found || score > bestScore {
+				bestDbIndex, bestKey, bestScore, found = dbIndex, key, score, true
+			}
+		}
+	}
+	return bestDbIndex, bestKey, found
+}
+
+// evictionSample samples keys of a database starting from a random shard and returns their score, the higher
+// the sooner the policy evicts the key.
+func (i inMemoryStorage) evictionSample(dbIndex int, policy EvictionPolicy) map[string]float64 {
+	scores := make(map[string]float64, evictionSampleSize)
+	start := rand.Intn(shardCount)
+	for j := 0; j < shardCount && len(scores) < evictionSampleSize; j++ {
+		s := i.db[dbIndex][(start+j)%shardCount]
+		s.mu.RLock()
+		currentTime := now()
+		sample := func(key string) bool {
+			if len(scores) == evictionSampleSize {
+				return false
+			}
+			e := s.data[key]
+			switch policy {
+			case AllKeysLRU, VolatileLRU:
+				scores[key] = float64(currentTime.UnixNano() - e.access.lastAccess.Load())
+			case AllKeysLFU, VolatileLFU:
+				scores[key] = float64(255 - e.access.decayedFrequency(currentTime))
+			case VolatileTTL:
+				scores[key] = -float64(e.expireAt.UnixNano())
+			default:
+				scores[key] = rand.Float64()
+			}
+			return true
+		}
+		if policy.volatile() {
+			for key := range s.expires {
+				if !sample(key) {
+					break
+				}
+			}
+		} else {
+			for key := range s.data {
+				if !sample(key) {
+					break
+				}
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return scores
+}
+
+// evictKey removes a key unless it was removed since it was sampled, and reports whether it did.
+func (i inMemoryStorage) evictKey(dbIndex int, key string) bool {
+	s := i.shard(dbIndex, key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data[key]; !ok {
+		return false
+	}
+	s.delete(key)
+	return true
+}
+
+func (i inMemoryStorage) AccessInfo(dbIndex int, key string) (AccessInfo, error) {
+	s := i.shard(dbIndex, key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.data[key]
+	if !ok || e.expired(now()) {
+		return AccessInfo{}, &KeyNotFoundError{key: key}
+	}
+	return AccessInfo{
+		LastAccess: time.Unix(0, e.access.lastAccess.Load()),
+		Frequency:  int(e.access.decayedFrequency(now())),
+	}, nil
+}
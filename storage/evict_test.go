@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sizedValue int
+
+func (v sizedValue) MemoryUsage() int {
+	return int(v)
+}
+
+func TestParseMemory(t *testing.T) {
+	testCases := []struct {
+		amount  string
+		want    int64
+		wantErr bool
+	}{
+		{amount: "", want: 0},
+		{amount: "1024", want: 1024},
+		{amount: "100b", want: 100},
+		{amount: "2k", want: 2000},
+		{amount: "2KB", want: 2048},
+		{amount: "1mb", want: 1 << 20},
+		{amount: "3G", want: 3e9},
+		{amount: "-1", wantErr: true},
+		{amount: "1tb", wantErr: true},
+		{amount: "99999999999gb", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseMemory(tc.amount)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("ParseMemory(%q) = %d, %v, want %d, error %v", tc.amount, got, err, tc.want, tc.wantErr)
+		}
+	}
+
+	if p, err := ParseEvictionPolicy(" AllKeys-LRU "); p != AllKeysLRU || err != nil {
+		t.Errorf("ParseEvictionPolicy() = %v, %v, want allkeys-lru", p, err)
+	}
+	if _, err := ParseEvictionPolicy("lru"); err == nil {
+		t.Errorf("ParseEvictionPolicy() of an unknown policy returned no error")
+	}
+}
+
+func TestInMemoryStorage_UsedMemory(t *testing.T) {
+	db := NewInMemoryStorage(2)
+	defer db.Close()
+	evictor := db.(Evictor)
+
+	_ = db.Set(0, "key", "value")
+	_ = db.Set(1, "key", sizedValue(1000))
+	want := memoryUsage("key", "value") + memoryUsage("key", sizedValue(1000))
+	if got := evictor.UsedMemory(); got != want {
+		t.Errorf("inMemory.UsedMemory() = %d, want %d", got, want)
+	}
+
+	_, _ = db.Update(1, "key", func(value any, exists bool) (any, error) { return sizedValue(10), nil })
+	_ = db.Swap(0, 1)
+	_ = db.Delete(1, "key")
+	_, _ = db.Move(0, "key", 1)
+	_ = db.Flush(1)
+	if got := evictor.UsedMemory(); got != 0 {
+		t.Errorf("inMemory.UsedMemory() once all keys are removed = %d, want 0", got)
+	}
+}
+
+func TestInMemoryStorage_Evict(t *testing.T) {
+	value := strings.Repeat("x", 100)
+	keySize := memoryUsage("key_0", value)
+	testCases := []struct {
+		policy  EvictionPolicy
+		kept    string // Key the policy must not evict
+		wantErr error
+	}{
+		{policy: NoEviction, wantErr: ErrOutOfMemory},
+		{policy: AllKeysLRU, kept: "key_9"},
+		{policy: AllKeysLFU, kept: "key_0"},
+		{policy: AllKeysRandom},
+		{policy: VolatileLRU, kept: "key_9"},
+		{policy: VolatileTTL, kept: "key_9"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			current := setNow(t)
+			db := NewInMemoryStorage(2)
+			defer db.Close()
+			evictor := db.(Evictor)
+
+			// Keys are accessed one second apart and expire in the same order, key_0 is accessed the most
+			for i := 0; i < 10; i++ {
+				*current = current.Add(time.Second)
+				_ = db.SetWithExpiry(i%2, fmt.Sprintf("key_%d", i), value, current.Add(time.Hour))
+			}
+			for i := 0; i < 1000; i++ {
+				_, _ = db.Get(0, "key_0")
+			}
+			_ = db.Set(0, "persistent", value)
+
+			var evicted []string
+			evictor.SetMaxMemory(5*keySize, tc.policy)
+			err := evictor.Evict(func(dbIndex int, key string) {
+				evicted = append(evicted, key)
+			})
+			if err != tc.wantErr {
+				t.Fatalf("inMemory.Evict() error = %v, want %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := evictor.UsedMemory(); got > 5*keySize {
+				t.Errorf("inMemory.UsedMemory() after Evict = %d, want at most %d", got, 5*keySize)
+			}
+			if got := db.Size(0) + db.Size(1); got != 11-len(evicted) {
+				t.Errorf("inMemory.Evict() reported %d evicted keys, %d keys are left out of 11", len(evicted), got)
+			}
+			for _, key := range evicted {
+				if key == tc.kept || (tc.policy.volatile() && key == "persistent") {
+					t.Errorf("inMemory.Evict() with %v evicted %q", tc.policy, key)
+				}
+			}
+		})
+	}
+
+	// Volatile policies cannot evict persistent keys
+	db := NewInMemoryStorage(1)
+	defer db.Close()
+	_ = db.Set(0, "persistent", value)
+	db.(Evictor).SetMaxMemory(1, VolatileLRU)
+	if err := db.(Evictor).Evict(func(int, string) {}); !errors.Is(err, ErrOutOfMemory) {
+		t.Errorf("inMemory.Evict() without volatile keys error = %v, want %v", err, ErrOutOfMemory)
+	}
+}
+
+func TestInMemoryStorage_AccessInfo(t *testing.T) {
+	current := setNow(t)
+	db := NewInMemoryStorage(1)
+	defer db.Close()
+	evictor := db.(Evictor)
+
+	var notFoundErr *KeyNotFoundError
+	if _, err := evictor.AccessInfo(0, "missing"); !errors.As(err, &notFoundErr) {
+		t.Errorf("inMemory.AccessInfo() of a missing key error = %v, want a *KeyNotFoundError", err)
+	}
+
+	_ = db.Set(0, "key", "value")
+	created := *current
+	*current = current.Add(10 * time.Second)
+	info, _ := evictor.AccessInfo(0, "key")
+	if !info.LastAccess.Equal(created) || info.Frequency != lfuInitFrequency {
+		t.Errorf("inMemory.AccessInfo() of a new key = %+v, want the creation time and frequency %d", info, lfuInitFrequency)
+	}
+	if again, _ := evictor.AccessInfo(0, "key"); again != info {
+		t.Errorf("inMemory.AccessInfo() accessed the key: %+v, then %+v", info, again)
+	}
+
+	for i := 0; i < 10000; i++ {
+		_, _ = db.Get(0, "key")
+	}
+	info, _ = evictor.AccessInfo(0, "key")
+	if !info.LastAccess.Equal(*current) || info.Frequency <= lfuInitFrequency || info.Frequency > 255 {
+		t.Errorf("inMemory.AccessInfo() of an accessed key = %+v, want the current time and a higher frequency", info)
+	}
+
+	// The frequency decays while the key is not accessed, and modifying the key keeps it
+	frequency := info.Frequency
+	*current = current.Add(3 * lfuDecayPeriod)
+	_ = db.Set(0, "key", "new value")
+	if info, _ = evictor.AccessInfo(0, "key"); info.Frequency != frequency-3 {
+		t.Errorf("inMemory.AccessInfo() 3 decay periods later = %+v, want frequency %d", info, frequency-3)
+	}
+}
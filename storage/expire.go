@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// How often the active expiry runs
+	activeExpireInterval = 100 * time.Millisecond
+	// Number of keys having an expiration time sampled at once in a database
+	activeExpireSampleSize = 20
+	// Maximum number of samples per database and run, bounding the time spent by a run
+	activeExpireMaxSamples = 16
+)
+
+// now returns the current time, it is replaced in tests to control the expiration of keys
+var now = time.Now
+
+// expireKeys periodically removes expired keys until the storage is closed.
+//
+// Like Redis, it does not scan every key: for each database it samples keys having an expiration time
+// and removes the expired ones, sampling again as long as more than a quarter of the sample expired.
+// Expired keys missed by the sampling are still removed lazily when accessed.
+func (i inMemoryStorage) expireKeys() {
+	defer i.wg.Done()
+
+	ticker := time.NewTicker(activeExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.stop:
+			return
+		case <-ticker.C:
+			for dbIndex := 0; dbIndex < i.dbCount; dbIndex++ {
+				for n := 0; n < activeExpireMaxSamples; n++ {
+					sampled, expired := i.expireSample(dbIndex)
+					if expired*4 <= sampled {
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+// expireSample samples keys having an expiration time in the given database, starting from a random shard,
+// removes the expired ones and returns the number of sampled and removed keys.
+func (i inMemoryStorage) expireSample(dbIndex int) (int, int) {
+	sampled, expired := 0, 0
+	start := rand.Intn(shardCount)
+	for j := 0; j < shardCount && sampled < activeExpireSampleSize; j++ {
+		s := i.db[dbIndex][(start+j)%shardCount]
+		s.mu.Lock()
+		currentTime := now()
+		for key := range s.expires {
+			if sampled == activeExpireSampleSize {
+				break
+			}
+			sampled++
+			if s.data[key].expired(currentTime) {
+				s.delete(key)
+				expired++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return sampled, expired
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// setNow freezes the clock of the storage at the returned time for the duration of the test
+func setNow(t *testing.T) *time.Time {
+	current := time.Unix(1700000000, 0)
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = time.Now })
+	return &current
+}
+
+func TestInMemoryStorage_Expiry(t *testing.T) {
+	current := setNow(t)
+	db := NewInMemoryStorage(2)
+	defer db.Close()
+
+	expireAt := current.Add(10 * time.Second)
+	_ = db.SetWithExpiry(0, "expiring", "value", expireAt)
+	_ = db.Set(0, "persistent", "value")
+
+	if got, _ := db.ExpireTime(0, "expiring"); !got.Equal(expireAt) {
+		t.Errorf("inMemory.ExpireTime() = %v, want %v", got, expireAt)
+	}
+	if got, _ := db.ExpireTime(0, "persistent"); !got.IsZero() {
+		t.Errorf("inMemory.ExpireTime() of a persistent key = %v, want zero", got)
+	}
+
+	_, _ = db.Update(0, "expiring", func(value any, exists bool) (any, error) {
+		return "updated", nil
+	})
+	if got, _ := db.ExpireTime(0, "expiring"); !got.Equal(expireAt) {
+		t.Errorf("inMemory.ExpireTime() after Update = %v, want %v", got, expireAt)
+	}
+
+	*current = expireAt
+	var notFoundErr *KeyNotFoundError
+	if _, err := db.Get(0, "expiring"); !errors.As(err, &notFoundErr) {
+		t.Errorf("inMemory.Get() of an expired key error = %v, want a *KeyNotFoundError", err)
+	}
+	if _, err := db.ExpireTime(0, "expiring"); !errors.As(err, &notFoundErr) {
+		t.Errorf("inMemory.ExpireTime() of an expired key error = %v, want a *KeyNotFoundError", err)
+	}
+	if entries, _, _ := db.Scan(0, 0, 10); len(entries) != 1 || entries[0].Key != "persistent" {
+		t.Errorf("inMemory.Scan() returned %v, want only the persistent key", entries)
+	}
+	if got := len(db.(*inMemoryStorage).shard(0, "expiring").data); got != 0 {
+		t.Errorf("Expired key still stored after being accessed")
+	}
+}
+
+func TestInMemoryStorage_ExpirePersist(t *testing.T) {
+	current := setNow(t)
+	db := NewInMemoryStorage(2)
+	defer db.Close()
+
+	var notFoundErr *KeyNotFoundError
+	if err := db.Expire(0, "missing", current.Add(time.Second)); !errors.As(err, &notFoundErr) {
+		t.Errorf("inMemory.Expire() of a missing key error = %v, want a *KeyNotFoundError", err)
+	}
+
+	_ = db.Set(0, "key", "value")
+	if ok, err := db.Persist(0, "key"); ok || err != nil {
+		t.Errorf("inMemory.Persist() of a persistent key = %v, %v, want false, nil", ok, err)
+	}
+	_ = db.Expire(0, "key", current.Add(time.Second))
+	if ok, err := db.Persist(0, "key"); !ok || err != nil {
+		t.Errorf("inMemory.Persist() of an expiring key = %v, %v, want true, nil", ok, err)
+	}
+	if got, _ := db.ExpireTime(0, "key"); !got.IsZero() {
+		t.Errorf("inMemory.ExpireTime() after Persist = %v, want zero", got)
+	}
+
+	_ = db.SetWithExpiry(0, "key", "value", current.Add(time.Second))
+	_ = db.Set(0, "key", "new value")
+	if got, _ := db.ExpireTime(0, "key"); !got.IsZero() {
+		t.Errorf("inMemory.ExpireTime() after Set = %v, want zero", got)
+	}
+
+	if err := db.Expire(0, "key", current.Add(-time.Second)); err != nil {
+		t.Fatalf("inMemory.Expire() in the past error = %v", err)
+	}
+	if _, err := db.Get(0, "key"); !errors.As(err, &notFoundErr) {
+		t.Errorf("inMemory.Get() after Expire in the past error = %v, want a *KeyNotFoundError", err)
+	}
+}
+
+func TestInMemoryStorage_UpdateEntry(t *testing.T) {
+	current := setNow(t)
+	db := NewInMemoryStorage(1)
+	defer db.Close()
+
+	expireAt := current.Add(time.Second)
+	got, err := db.UpdateEntry(0, "key", func(e Entry, exists bool) (Entry, error) {
+		if exists {
+			t.Errorf("UpdateEntryFunc called with exists = true for a non-existing key")
+		}
+		return Entry{Value: "value", ExpireAt: expireAt}, nil
+	})
+	if err != nil || got.Key != "key" || got.Value != "value" {
+		t.Fatalf("inMemory.UpdateEntry() = %v, %v, want the new entry", got, err)
+	}
+	if got, _ := db.ExpireTime(0, "key"); !got.Equal(expireAt) {
+		t.Errorf("inMemory.ExpireTime() after UpdateEntry = %v, want %v", got, expireAt)
+	}
+
+	// The expiration time is replaced along with the value
+	_, _ = db.UpdateEntry(0, "key", func(e Entry, exists bool) (Entry, error) {
+		if !exists || e.Value != "value" || !e.ExpireAt.Equal(expireAt) {
+			t.Errorf("UpdateEntryFunc called with %v, %v, want the current entry", e, exists)
+		}
+		return Entry{Value: "new value"}, nil
+	})
+	if got, _ := db.ExpireTime(0, "key"); !got.IsZero() {
+		t.Errorf("inMemory.ExpireTime() after UpdateEntry without expiration time = %v, want zero", got)
+	}
+
+	var notFoundErr *KeyNotFoundError
+	_, _ = db.UpdateEntry(0, "key", func(e Entry, exists bool) (Entry, error) {
+		return Entry{Value: e.Value, ExpireAt: current.Add(-time.Second)}, nil
+	})
+	if _, err := db.Get(0, "key"); !errors.As(err, &notFoundErr) {
+		t.Errorf("inMemory.Get() after UpdateEntry in the past error = %v, want a *KeyNotFoundError", err)
+	}
+}
+
+func TestInMemoryStorage_ActiveExpiry(t *testing.T) {
+	current := setNow(t)
+	db := NewInMemoryStorage(1)
+	defer db.Close()
+	storage := db.(*inMemoryStorage)
+
+	for i := 0; i < 100; i++ {
+		_ = db.SetWithExpiry(0, fmt.Sprintf("expiring_%d", i), i, current.Add(time.Second))
+		_ = db.Set(0, fmt.Sprintf("persistent_%d", i), i)
+	}
+
+	if sampled, expired := storage.expireSample(0); sampled != activeExpireSampleSize || expired != 0 {
+		t.Errorf("expireSample() before expiration = %d, %d, want %d, 0", sampled, expired, activeExpireSampleSize)
+	}
+
+	*current = current.Add(time.Second)
+	removed := 0
+	for n := 0; n < 10; n++ {
+		_, expired := storage.expireSample(0)
+		removed += expired
+	}
+	if removed != 100 {
+		t.Errorf("expireSample() removed %d keys, want 100", removed)
+	}
+
+	count := 0
+	for _, s := range storage.db[0] {
+		count += len(s.data)
+		if len(s.expires) != 0 {
+			t.Errorf("Shard still tracks %d expiring keys", len(s.expires))
+		}
+	}
+	if count != 100 {
+		t.Errorf("Storage holds %d keys after active expiry, want 100", count)
+	}
+}
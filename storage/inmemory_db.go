@@ -3,70 +3,789 @@ package storage
 import (
 	"errors"
 	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 )
 
-// Underlying in-memory hashmap storage
+// Number of shards every database is split into, each one guarded by its own lock
+const shardCount = 64
+
+// Number of high bits of the hash of a key picking its scan bucket, the keys of every shard are split into
+// 1<<scanBucketBits buckets so that Scan only sorts the keys of the buckets its page is made of
+const scanBucketBits = 8
+
+// Keys of a shard split by scan bucket, a nil bucket holding none
+type scanBuckets [1 << scanBucketBits]map[string]struct{}
+
+// Value stored under a key, along with its expiration time
+type entry struct {
+	value    any
+	expireAt time.Time    // Zero when the key never expires
+	size     int64        // Estimated memory held by the key and its value
+	access   *accessStats // Shared by the successive entries of the key, until it is removed
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+// Part of a database holding the keys hashing to it
+type shard struct {
+	mu      sync.RWMutex
+	data    map[string]entry
+	expires map[string]struct{} // Keys of data having an expiration time, sampled by the active expiry
+	buckets scanBuckets         // Keys of data by scan bucket
+	size    int64               // Estimated memory held by the keys of data
+	memory  *memoryLimit        // Accounting of the memory held by all shards
+}
+
+func newShard(memory *memoryLimit) *shard {
+	return &shard{data: make(map[string]entry), expires: make(map[string]struct{}), memory: memory}
+}
+
+// get returns the entry of a key unless it does not exist or expired, and records the access to the key.
+// It must be called while holding the lock, possibly the read lock.
+func (s *shard) get(key string) (entry, bool) {
+	e, ok := s.data[key]
+	if !ok {
+		return entry{}, false
+	}
+	currentTime := now()
+	if e.expired(currentTime) {
+		return entry{}, false
+	}
+	e.access.touch(currentTime)
+	return e, true
+}
+
+// set stores the entry of a key, it must be called while holding the lock.
+//
+// An entry without access data gets the one of the key it replaces, so that modifying a key does not reset it.
+func (s *shard) set(key string, e entry) {
+	old, exists := s.data[key]
+	if e.access == nil {
+		if exists && !old.expired(now()) {
+			e.access = old.access
+		} else {
+			e.access = newAccessStats(now())
+		}
+	}
+	e.size = memoryUsage(key, e.value)
+	s.resize(e.size - old.size)
+
+	if !exists {
+		bucket := scanBucket(key)
+		if s.buckets[bucket] == nil {
+			s.buckets[bucket] = make(map[string]struct{})
+		}
+		s.buckets[bucket][key] = struct{}{}
+	}
+	s.data[key] = e
+	if e.expireAt.IsZero() {
+		delete(s.expires, key)
+	} else {
+		s.expires[key] = struct{}{}
+	}
+}
+
+// delete removes a key, it must be called while holding the lock.
+func (s *shard) delete(key string) {
+	s.resize(-s.data[key].size)
+	delete(s.data, key)
+	delete(s.expires, key)
+	delete(s.buckets[scanBucket(key)], key)
+}
+
+// resize accounts for memory held or released by the keys of the shard, it must be called while holding the lock.
+func (s *shard) resize(delta int64) {
+	s.size += delta
+	s.memory.used.Add(delta)
+}
+
+// Underlying in-memory hashmap storage.
+//
+// Every database is split into shards so that clients working on different keys
+// do not contend on the same lock, while reads of the same shard can run in parallel.
+// Expired keys are removed lazily when accessed and actively by a background sweeper.
 type inMemoryStorage struct {
 	dbCount int // Number of available databases
-	db      map[int]map[string]any
+	db      map[int][]*shard
+	memory  *memoryLimit
+	stop    chan struct{}
+	wg      *sync.WaitGroup
+}
+
+// shard returns the shard of the given database holding the key.
+func (i inMemoryStorage) shard(dbIndex int, key string) *shard {
+	return i.db[dbIndex][shardIndex(key)]
+}
+
+// keyHash returns the FNV-1a hash of a key.
+func keyHash(key string) uint32 {
+	hash := uint32(2166136261)
+	for j := 0; j < len(key); j++ {
+		hash ^= uint32(key[j])
+		hash *= 16777619
+	}
+	return hash
+}
+
+// shardIndex returns the index of the shard holding the key, picked with the hash of the key.
+func shardIndex(key string) int {
+	return int(keyHash(key) % shardCount)
+}
+
+// scanPosition returns the position of a key in the order Scan iterates over a database: the keys of the first
+// shard come first, ordered by their hash. The position of a key does not depend on the other keys, and positions
+// start at 1<<32 so that a cursor of 0 starts an iteration.
+func scanPosition(key string) uint64 {
+	hash := keyHash(key)
+	return uint64(hash%shardCount+1)<<32 | uint64(hash)
+}
+
+// scanBucket returns the scan bucket of the shard holding a key, picked with the high bits of its hash so that the
+// buckets follow the scan positions of the keys.
+func scanBucket(key string) int {
+	return int(keyHash(key) >> (32 - scanBucketBits))
+}
+
+// lockShards locks the shards of the given database holding the keys and returns the function unlocking them.
+//
+// Shards are always locked in the same order, so that concurrent multi-key operations cannot deadlock.
+func (i inMemoryStorage) lockShards(dbIndex int, keys []string, write bool) func() {
+	var used [shardCount]bool
+	for _, key := range keys {
+		used[shardIndex(key)] = true
+	}
+	var shards []*shard
+	for j, ok := range used {
+		if ok {
+			shards = append(shards, i.db[dbIndex][j])
+		}
+	}
+
+	for _, s := range shards {
+		if write {
+			s.mu.Lock()
+		} else {
+			s.mu.RLock()
+		}
+	}
+	return func() {
+		for _, s := range shards {
+			if write {
+				s.mu.Unlock()
+			} else {
+				s.mu.RUnlock()
+			}
+		}
+	}
 }
 
 func (i inMemoryStorage) Set(dbIndex int, key string, value any) error {
-	i.db[dbIndex][key] = value
+	return i.SetWithExpiry(dbIndex, key, value, time.Time{})
+}
+
+func (i inMemoryStorage) SetWithExpiry(dbIndex int, key string, value any, expireAt time.Time) error {
+	s := i.shard(dbIndex, key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.set(key, entry{value: value, expireAt: expireAt})
 	return nil
 }
 
 func (i inMemoryStorage) Get(dbIndex int, key string) (any, error) {
-	if val, ok := i.db[dbIndex][key]; ok {
-		return val, nil
-	} else {
-		return nil, &KeyNotFoundError{key: key}
+	s := i.shard(dbIndex, key)
+	s.mu.RLock()
+	e, ok := s.data[key]
+	found := ok && !e.expired(now())
+	if found {
+		e.access.touch(now())
+	}
+	s.mu.RUnlock()
+
+	if found {
+		return e.value, nil
+	}
+	if ok {
+		i.expireKey(s, key)
+	}
+	return nil, &KeyNotFoundError{key: key}
+}
+
+func (i inMemoryStorage) View(dbIndex int, key string, fn func(value any, exists bool) error) error {
+	s := i.shard(dbIndex, key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, exists := s.get(key)
+	return fn(e.value, exists)
+}
+
+func (i inMemoryStorage) ViewValues(dbIndex int, keys []string, fn func(values []any) error) error {
+	unlock := i.lockShards(dbIndex, keys, false)
+	defer unlock()
+
+	values := make([]any, len(keys))
+	for j, key := range keys {
+		e, _ := i.shard(dbIndex, key).get(key)
+		values[j] = e.value
+	}
+	return fn(values)
+}
+
+// expireKey removes a key found expired while holding the read lock of its shard, unless it changed in between.
+func (i inMemoryStorage) expireKey(s *shard, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.data[key]; ok && e.expired(now()) {
+		s.delete(key)
 	}
 }
 
 func (i inMemoryStorage) Delete(dbIndex int, key string) error {
-	if _, ok := i.db[dbIndex][key]; ok {
-		delete(i.db[dbIndex], key)
+	s := i.shard(dbIndex, key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.get(key); ok {
+		s.delete(key)
 		return nil
 	} else {
+		s.delete(key)
+		return &KeyNotFoundError{key: key}
+	}
+}
+
+func (i inMemoryStorage) MSet(dbIndex int, entries []Entry) error {
+	unlock := i.lockShards(dbIndex, entryKeys(entries), true)
+	defer unlock()
+
+	for _, e := range entries {
+		i.shard(dbIndex, e.Key).set(e.Key, entry{value: e.Value, expireAt: e.ExpireAt})
+	}
+	return nil
+}
+
+func (i inMemoryStorage) MSetNX(dbIndex int, entries []Entry) (bool, error) {
+	unlock := i.lockShards(dbIndex, entryKeys(entries), true)
+	defer unlock()
+
+	for _, e := range entries {
+		if _, ok := i.shard(dbIndex, e.Key).get(e.Key); ok {
+			return false, nil
+		}
+	}
+	for _, e := range entries {
+		i.shard(dbIndex, e.Key).set(e.Key, entry{value: e.Value, expireAt: e.ExpireAt})
+	}
+	return true, nil
+}
+
+func (i inMemoryStorage) MGet(dbIndex int, keys ...string) []any {
+	unlock := i.lockShards(dbIndex, keys, false)
+	defer unlock()
+
+	values := make([]any, len(keys))
+	for j, key := range keys {
+		if e, ok := i.shard(dbIndex, key).get(key); ok {
+			values[j] = e.value
+		}
+	}
+	return values
+}
+
+func (i inMemoryStorage) DeleteKeys(dbIndex int, keys ...string) int {
+	unlock := i.lockShards(dbIndex, keys, true)
+	defer unlock()
+
+	deleted := 0
+	for _, key := range keys {
+		s := i.shard(dbIndex, key)
+		if _, ok := s.get(key); ok {
+			deleted++
+		}
+		s.delete(key)
+	}
+	return deleted
+}
+
+func (i inMemoryStorage) Exists(dbIndex int, keys ...string) int {
+	unlock := i.lockShards(dbIndex, keys, false)
+	defer unlock()
+
+	count := 0
+	for _, key := range keys {
+		if _, ok := i.shard(dbIndex, key).get(key); ok {
+			count++
+		}
+	}
+	return count
+}
+
+func entryKeys(entries []Entry) []string {
+	keys := make([]string, len(entries))
+	for j, e := range entries {
+		keys[j] = e.Key
+	}
+	return keys
+}
+
+func (i inMemoryStorage) Update(dbIndex int, key string, fn UpdateFunc) (any, error) {
+	s := i.shard(dbIndex, key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, exists := s.get(key)
+	newValue, err := fn(e.value, exists)
+	if err != nil {
+		return nil, err
+	}
+	if newValue == nil {
+		s.delete(key)
+	} else {
+		s.set(key, entry{value: newValue, expireAt: e.expireAt})
+	}
+	return newValue, nil
+}
+
+func (i inMemoryStorage) UpdateValues(dbIndex int, keys []string, fn UpdateValuesFunc) error {
+	return i.UpdateEntries(dbIndex, keys, updateValues(fn))
+}
+
+// updateValues returns the UpdateEntriesFunc replacing the values of the entries with the ones computed by fn,
+// keeping their expiration times.
+func updateValues(fn UpdateValuesFunc) UpdateEntriesFunc {
+	return func(entries []Entry) ([]Entry, error) {
+		values := make([]any, len(entries))
+		for j, e := range entries {
+			values[j] = e.Value
+		}
+		newValues, err := fn(values)
+		if err != nil {
+			return nil, err
+		}
+		for j := range entries {
+			entries[j].Value = newValues[j]
+		}
+		return entries, nil
+	}
+}
+
+func (i inMemoryStorage) UpdateEntries(dbIndex int, keys []string, fn UpdateEntriesFunc) error {
+	unlock := i.lockShards(dbIndex, keys, true)
+	defer unlock()
+
+	entries := make([]Entry, len(keys))
+	for j, key := range keys {
+		e, _ := i.shard(dbIndex, key).get(key)
+		entries[j] = Entry{Key: key, Value: e.value, ExpireAt: e.expireAt}
+	}
+	newEntries, err := fn(entries)
+	if err != nil {
+		return err
+	}
+	for j, key := range keys {
+		s := i.shard(dbIndex, key)
+		updated := entry{value: newEntries[j].Value, expireAt: newEntries[j].ExpireAt}
+		if updated.value == nil || updated.expired(now()) {
+			s.delete(key)
+		} else {
+			s.set(key, updated)
+		}
+	}
+	return nil
+}
+
+func (i inMemoryStorage) UpdateEntry(dbIndex int, key string, fn UpdateEntryFunc) (Entry, error) {
+	s := i.shard(dbIndex, key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, exists := s.get(key)
+	newEntry, err := fn(Entry{Key: key, Value: e.value, ExpireAt: e.expireAt}, exists)
+	if err != nil {
+		return Entry{}, err
+	}
+	newEntry.Key = key
+	updated := entry{value: newEntry.Value, expireAt: newEntry.ExpireAt}
+	if newEntry.Value == nil || updated.expired(now()) {
+		s.delete(key)
+	} else {
+		s.set(key, updated)
+	}
+	return newEntry, nil
+}
+
+func (i inMemoryStorage) Expire(dbIndex int, key string, expireAt time.Time) error {
+	s := i.shard(dbIndex, key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.get(key)
+	if !ok {
 		return &KeyNotFoundError{key: key}
 	}
+	e.expireAt = expireAt
+	if e.expired(now()) {
+		s.delete(key)
+	} else {
+		s.set(key, e)
+	}
+	return nil
+}
+
+func (i inMemoryStorage) Persist(dbIndex int, key string) (bool, error) {
+	s := i.shard(dbIndex, key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.get(key)
+	if !ok {
+		return false, &KeyNotFoundError{key: key}
+	}
+	if e.expireAt.IsZero() {
+		return false, nil
+	}
+	s.set(key, entry{value: e.value})
+	return true, nil
+}
+
+func (i inMemoryStorage) ExpireTime(dbIndex int, key string) (time.Time, error) {
+	s := i.shard(dbIndex, key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.get(key)
+	if !ok {
+		return time.Time{}, &KeyNotFoundError{key: key}
+	}
+	return e.expireAt, nil
+}
+
+// lockPair locks the shards holding two keys of two databases, possibly the same, and returns the function
+// unlocking them. Shards are locked in the order of their database, then of their index, the way lockAll locks them.
+func (i inMemoryStorage) lockPair(dbIndex1 int, key1 string, dbIndex2 int, key2 string) (*shard, *shard, func()) {
+	s1, s2 := i.shard(dbIndex1, key1), i.shard(dbIndex2, key2)
+	if s1 == s2 {
+		s1.mu.Lock()
+		return s1, s2, s1.mu.Unlock
+	}
+	first, second := s1, s2
+	if dbIndex2 < dbIndex1 || (dbIndex2 == dbIndex1 && shardIndex(key2) < shardIndex(key1)) {
+		first, second = s2, s1
+	}
+	first.mu.Lock()
+	second.mu.Lock()
+	return s1, s2, func() {
+		second.mu.Unlock()
+		first.mu.Unlock()
+	}
+}
+
+func (i inMemoryStorage) Copy(srcIndex int, src string, dstIndex int, dst string, replace bool) (bool, error) {
+	srcShard, dstShard, unlock := i.lockPair(srcIndex, src, dstIndex, dst)
+	defer unlock()
+
+	e, ok := srcShard.get(src)
+	if !ok {
+		return false, &KeyNotFoundError{key: src}
+	}
+	if srcIndex == dstIndex && src == dst {
+		return false, nil
+	}
+	if _, exists := dstShard.get(dst); exists && !replace {
+		return false, nil
+	}
+	if c, ok := e.value.(Cloner); ok {
+		e.value = c.Clone()
+	}
+	e.access = nil
+	dstShard.set(dst, e)
+	return true, nil
+}
+
+func (i inMemoryStorage) Move(srcIndex int, key string, dstIndex int) (bool, error) {
+	srcShard, dstShard, unlock := i.lockPair(srcIndex, key, dstIndex, key)
+	defer unlock()
+
+	e, ok := srcShard.get(key)
+	if !ok {
+		return false, &KeyNotFoundError{key: key}
+	}
+	if _, exists := dstShard.get(key); exists || srcIndex == dstIndex {
+		return false, nil
+	}
+	srcShard.delete(key)
+	dstShard.set(key, e)
+	return true, nil
+}
+
+// lockAll locks all the shards of the given databases, in the order lockShards locks them, and returns the function
+// unlocking them.
+func (i inMemoryStorage) lockAll(dbIndexes ...int) func() {
+	sort.Ints(dbIndexes)
+	var shards []*shard
+	for j, dbIndex := range dbIndexes {
+		if j == 0 || dbIndex != dbIndexes[j-1] {
+			shards = append(shards, i.db[dbIndex]...)
+		}
+	}
+	for _, s := range shards {
+		s.mu.Lock()
+	}
+	return func() {
+		for _, s := range shards {
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Flush replaces the maps of every shard, the removed keys are then released by the garbage collector.
+func (i inMemoryStorage) Flush(dbIndex int) error {
+	defer i.lockAll(dbIndex)()
+	for _, s := range i.db[dbIndex] {
+		s.resize(-s.size)
+		s.data, s.expires = make(map[string]entry), make(map[string]struct{})
+		s.buckets = scanBuckets{}
+	}
+	return nil
+}
+
+// Reclaim returns the memory of the removed keys to the operating system, once the garbage collector released it.
+func (i inMemoryStorage) Reclaim(async bool) error {
+	if async {
+		go debug.FreeOSMemory()
+	} else {
+		debug.FreeOSMemory()
+	}
+	return nil
+}
+
+// Swap exchanges the maps of the shards of both databases, keys always hash to the shard of the same index.
+func (i inMemoryStorage) Swap(dbIndex1, dbIndex2 int) error {
+	defer i.lockAll(dbIndex1, dbIndex2)()
+	if dbIndex1 == dbIndex2 {
+		return nil
+	}
+	for j := 0; j < shardCount; j++ {
+		s1, s2 := i.db[dbIndex1][j], i.db[dbIndex2][j]
+		s1.data, s2.data = s2.data, s1.data
+		s1.expires, s2.expires = s2.expires, s1.expires
+		s1.buckets, s2.buckets = s2.buckets, s1.buckets
+		s1.size, s2.size = s2.size, s1.size
+	}
+	return nil
+}
+
+// Scan returns a page of the entries of the given database, leaving out the expired ones.
+//
+// Keys are ordered by their scan position and the cursor is the position of the first key of the page, so that
+// keys added or removed during an iteration do not move the others. Keys sharing a position are returned in the
+// same page. Only one shard is locked at a time, and only the keys of the scan buckets the page is made of are
+// sorted. Values modified in place are cloned while holding the lock of their shard.
+func (i inMemoryStorage) Scan(dbIndex int, cursor uint64, count int) ([]Entry, uint64, error) {
+	var page []Entry
+	for j := max(int(cursor>>32)-1, 0); j < shardCount; j++ {
+		if len(page) >= count {
+			return page, uint64(j+1) << 32, nil
+		}
+
+		var next uint64
+		s := i.db[dbIndex][j]
+		s.mu.RLock()
+		page, next = s.scan(page, max(cursor, uint64(j+1)<<32), count)
+		s.mu.RUnlock()
+		if next != 0 {
+			return page, next, nil
+		}
+	}
+	return page, 0, nil
+}
+
+// scan appends to page the entries of the shard from the given scan position, one of the shard, until the page holds
+// count entries and returns the cursor of the next page, 0 once the shard is complete. It must be called while
+// holding the read lock.
+func (s *shard) scan(page []Entry, cursor uint64, count int) ([]Entry, uint64) {
+	type positioned struct {
+		pos uint64
+		key string
+		e   entry
+	}
+	currentTime := now()
+	for b := int(uint32(cursor) >> (32 - scanBucketBits)); b < len(s.buckets); b++ {
+		if len(page) >= count {
+			return page, cursor>>32<<32 | uint64(b)<<(32-scanBucketBits)
+		}
+		var candidates []positioned
+		for k := range s.buckets[b] {
+			e := s.data[k]
+			if pos := scanPosition(k); pos >= cursor && !e.expired(currentTime) {
+				candidates = append(candidates, positioned{pos: pos, key: k, e: e})
+			}
+		}
+		sort.Slice(candidates, func(a, b int) bool {
+			if candidates[a].pos != candidates[b].pos {
+				return candidates[a].pos < candidates[b].pos
+			}
+			return candidates[a].key < candidates[b].key
+		})
+		for n, c := range candidates {
+			if len(page) >= count && c.pos != candidates[n-1].pos {
+				return page, c.pos
+			}
+			value := c.e.value
+			if c, ok := value.(Cloner); ok {
+				value = c.Clone()
+			}
+			page = append(page, Entry{Key: c.key, Value: value, ExpireAt: c.e.expireAt})
+		}
+	}
+	return page, 0
+}
+
+// Iterate locks one shard at a time, while fn is called with its entries.
+func (i inMemoryStorage) Iterate(dbIndex int, fn func(e Entry) bool) error {
+	for _, s := range i.db[dbIndex] {
+		if !s.iterate(fn) {
+			break
+		}
+	}
+	return nil
+}
+
+// iterate calls fn with the entries of the shard that are not expired while holding its read lock, and reports
+// whether fn always returned true.
+func (s *shard) iterate(fn func(e Entry) bool) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	currentTime := now()
+	for k, e := range s.data {
+		if e.expired(currentTime) {
+			continue
+		}
+		value := e.value
+		if c, ok := value.(Cloner); ok {
+			value = c.Clone()
+		}
+		if !fn(Entry{Key: k, Value: value, ExpireAt: e.expireAt}) {
+			return false
+		}
+	}
+	return true
 }
 
-func (i inMemoryStorage) FetchAll(dbIndex int) <-chan [2]any {
-	outputChan := make(chan [2]any)
-	go func() {
-		for k, v := range i.db[dbIndex] {
-			outputChan <- [2]any{k, v}
+// Keys locks one shard at a time, while fn is called with its keys.
+func (i inMemoryStorage) Keys(dbIndex int, fn func(key string) bool) error {
+	for _, s := range i.db[dbIndex] {
+		if !s.keys(fn) {
+			break
 		}
-		close(outputChan)
-	}()
-	return outputChan
+	}
+	return nil
+}
+
+// keys calls fn with the keys of the shard that are not expired while holding its read lock, and reports whether fn
+// always returned true.
+func (s *shard) keys(fn func(key string) bool) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	currentTime := now()
+	for k, e := range s.data {
+		if !e.expired(currentTime) && !fn(k) {
+			return false
+		}
+	}
+	return true
+}
+
+// RandomKey picks a random shard, then a random key of the first shard holding a key not expired from there.
+func (i inMemoryStorage) RandomKey(dbIndex int) (string, bool) {
+	start := rand.Intn(shardCount)
+	for j := 0; j < shardCount; j++ {
+		s := i.db[dbIndex][(start+j)%shardCount]
+		s.mu.RLock()
+		var keys []string
+		currentTime := now()
+		for k, e := range s.data {
+			if !e.expired(currentTime) {
+				keys = append(keys, k)
+			}
+		}
+		s.mu.RUnlock()
+		if len(keys) > 0 {
+			return keys[rand.Intn(len(keys))], true
+		}
+	}
+	return "", false
+}
+
+func (i inMemoryStorage) Size(dbIndex int) int {
+	size := 0
+	for _, s := range i.db[dbIndex] {
+		s.mu.RLock()
+		size += len(s.data)
+		s.mu.RUnlock()
+	}
+	return size
 }
 
 func (i inMemoryStorage) Select(dbIndex string) (int, error) {
+	return selectDB(dbIndex, i.dbCount)
+}
+
+// selectDB parses the index of one of dbCount databases.
+func selectDB(dbIndex string, dbCount int) (int, error) {
 	dbIndexInt, err := strconv.Atoi(dbIndex)
 	if err != nil {
 		return 0, fmt.Errorf("(error) ERR value is not an integer or out of range")
 	}
-	if dbIndexInt < 0 || dbIndexInt > i.dbCount-1 {
+	if dbIndexInt < 0 || dbIndexInt > dbCount-1 {
 		return 0, errors.New("(error) ERR DB index is out of range")
 	}
 	return dbIndexInt, nil
 }
 
+func (i inMemoryStorage) DbCount() int {
+	return i.dbCount
+}
+
+// Close stops the background removal of expired keys.
+func (i inMemoryStorage) Close() error {
+	close(i.stop)
+	i.wg.Wait()
+	return nil
+}
+
 func NewInMemoryStorage(dbCount int) Storage {
 	if dbCount == 0 {
 		dbCount = 16
 	}
-	db := make(map[int]map[string]any)
+	db := make(map[int][]*shard)
+	memory := &memoryLimit{}
 
 	for i := 0; i < dbCount; i++ {
-		db[i] = make(map[string]any)
+		db[i] = make([]*shard, shardCount)
+		for j := range db[i] {
+			db[i][j] = newShard(memory)
+		}
 	}
-	return &inMemoryStorage{
+	storage := &inMemoryStorage{
 		dbCount: dbCount,
 		db:      db,
+		memory:  memory,
+		stop:    make(chan struct{}),
+		wg:      &sync.WaitGroup{},
 	}
+	storage.wg.Add(1)
+	go storage.expireKeys()
+	return storage
 }
@@ -2,28 +2,37 @@ package storage
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewInMemoryStorage(t *testing.T) {
 	testCases := []struct {
 		name    string
 		dbCount int
-		want    Storage
+		want    int
 	}{
 		{
 			name:    "Zero dbCount should default to 16",
 			dbCount: 0,
-			want:    NewInMemoryStorage(0),
+			want:    16,
+		},
+		{
+			name:    "Non-zero dbCount",
+			dbCount: 4,
+			want:    4,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			got := NewInMemoryStorage(tc.dbCount)
-			if !reflect.DeepEqual(got, tc.want) {
-				t.Errorf("NewInMemory() = %v, want %v", got, tc.want)
+			defer got.Close()
+			if got.DbCount() != tc.want {
+				t.Errorf("NewInMemory().DbCount() = %v, want %v", got.DbCount(), tc.want)
 			}
 		})
 	}
@@ -33,6 +42,7 @@ func TestInMemoryDB_SetGet(t *testing.T) {
 
 	t.Run("Set a key-value pair", func(t *testing.T) {
 		db := NewInMemoryStorage(0)
+		defer db.Close()
 		dbIndex := 0
 		key := "key_1"
 		want := "value_1"
@@ -53,6 +63,7 @@ func TestInMemoryDB_SetGet(t *testing.T) {
 
 	t.Run("Update the value of exising key", func(t *testing.T) {
 		db := NewInMemoryStorage(0)
+		defer db.Close()
 		dbIndex := 0
 		key := "key_1"
 		want := "value_2"
@@ -72,6 +83,7 @@ func TestInMemoryDB_SetGet(t *testing.T) {
 
 	t.Run("Get the value of non-exising key", func(t *testing.T) {
 		db := NewInMemoryStorage(0)
+		defer db.Close()
 		dbIndex := 0
 		key := "invalid_key"
 		wantErr := KeyNotFoundError{key: key}
@@ -93,6 +105,7 @@ func TestInMemoryDB_SetGet(t *testing.T) {
 func TestInMemoryDB_Delete(t *testing.T) {
 	t.Run("Delete a non-existing key", func(t *testing.T) {
 		db := NewInMemoryStorage(0)
+		defer db.Close()
 		dbIndex := 0
 		key := "invalid_key"
 		wantErr := KeyNotFoundError{key: key}
@@ -111,6 +124,7 @@ func TestInMemoryDB_Delete(t *testing.T) {
 
 	t.Run("Delete an existing key", func(t *testing.T) {
 		db := NewInMemoryStorage(0)
+		defer db.Close()
 		dbIndex := 0
 		key := "key_3"
 		value := "value_3"
@@ -174,6 +188,7 @@ func TestInMemoryStorage_Select(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			db := NewInMemoryStorage(tc.dbCount)
+			defer db.Close()
 			got, err := db.Select(tc.dbIndex)
 			if err != nil {
 				if tc.wantErr == nil {
@@ -191,3 +206,451 @@ func TestInMemoryStorage_Select(t *testing.T) {
 		})
 	}
 }
+
+func TestInMemoryDB_Update(t *testing.T) {
+	t.Run("Update a non-existing key", func(t *testing.T) {
+		db := NewInMemoryStorage(0)
+		defer db.Close()
+		got, err := db.Update(0, "key", func(value any, exists bool) (any, error) {
+			if exists {
+				t.Errorf("UpdateFunc called with exists = true for a non-existing key")
+			}
+			return "created", nil
+		})
+		if err != nil || got != "created" {
+			t.Fatalf("inMemory.Update() = %v, %v, want %v, nil", got, err, "created")
+		}
+		if value, _ := db.Get(0, "key"); value != "created" {
+			t.Errorf("inMemory.Get() after Update = %v, want %v", value, "created")
+		}
+	})
+
+	t.Run("Update an existing key", func(t *testing.T) {
+		db := NewInMemoryStorage(0)
+		defer db.Close()
+		_ = db.Set(0, "key", 1)
+		got, err := db.Update(0, "key", func(value any, exists bool) (any, error) {
+			return value.(int) + 1, nil
+		})
+		if err != nil || got != 2 {
+			t.Fatalf("inMemory.Update() = %v, %v, want %v, nil", got, err, 2)
+		}
+	})
+
+	t.Run("Delete a key by returning nil", func(t *testing.T) {
+		db := NewInMemoryStorage(0)
+		defer db.Close()
+		_ = db.Set(0, "key", 1)
+		_, err := db.Update(0, "key", func(value any, exists bool) (any, error) {
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatalf("inMemory.Update() unexpected error: %v", err)
+		}
+		var notFoundErr *KeyNotFoundError
+		if _, err := db.Get(0, "key"); !errors.As(err, &notFoundErr) {
+			t.Errorf("inMemory.Get() after deleting Update = %v, want a *KeyNotFoundError", err)
+		}
+	})
+
+	t.Run("Error leaves the key untouched", func(t *testing.T) {
+		db := NewInMemoryStorage(0)
+		defer db.Close()
+		_ = db.Set(0, "key", 1)
+		wantErr := errors.New("update failed")
+		_, err := db.Update(0, "key", func(value any, exists bool) (any, error) {
+			return 10, wantErr
+		})
+		if err != wantErr {
+			t.Fatalf("inMemory.Update() error = %v, want %v", err, wantErr)
+		}
+		if value, _ := db.Get(0, "key"); value != 1 {
+			t.Errorf("inMemory.Get() after failed Update = %v, want %v", value, 1)
+		}
+	})
+}
+
+func TestInMemoryDB_MultiKey(t *testing.T) {
+	db := NewInMemoryStorage(1)
+	defer db.Close()
+
+	err := db.MSet(0, []Entry{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}, {Key: "a", Value: "3"}})
+	if err != nil {
+		t.Fatalf("inMemory.MSet() unexpected error: %v", err)
+	}
+	if got := db.MGet(0, "a", "missing", "b"); !reflect.DeepEqual(got, []any{"3", nil, "2"}) {
+		t.Errorf("inMemory.MGet() = %v, want [3 <nil> 2]", got)
+	}
+
+	// MSetNX sets none of the keys when one of them exists
+	set, err := db.MSetNX(0, []Entry{{Key: "c", Value: "4"}, {Key: "b", Value: "5"}})
+	if err != nil || set {
+		t.Errorf("inMemory.MSetNX() with an existing key = %v, %v, want false", set, err)
+	}
+	if got := db.Exists(0, "c"); got != 0 {
+		t.Errorf("inMemory.Exists(c) after a failed MSetNX = %d, want 0", got)
+	}
+	set, err = db.MSetNX(0, []Entry{{Key: "c", Value: "4"}, {Key: "d", Value: "5"}})
+	if err != nil || !set {
+		t.Errorf("inMemory.MSetNX() with new keys = %v, %v, want true", set, err)
+	}
+
+	if got := db.Exists(0, "a", "a", "missing", "d"); got != 3 {
+		t.Errorf("inMemory.Exists() = %d, want 3", got)
+	}
+	if got := db.DeleteKeys(0, "a", "missing", "c", "a"); got != 2 {
+		t.Errorf("inMemory.DeleteKeys() = %d, want 2", got)
+	}
+	if got := db.Exists(0, "a", "b", "c", "d"); got != 2 {
+		t.Errorf("inMemory.Exists() after DeleteKeys() = %d, want 2", got)
+	}
+}
+
+func TestInMemoryDB_UpdateValues(t *testing.T) {
+	db := NewInMemoryStorage(1)
+	defer db.Close()
+	_ = db.Set(0, "source", 10)
+	_ = db.Set(0, "deleted", 1)
+
+	err := db.UpdateValues(0, []string{"source", "destination", "deleted"}, func(values []any) ([]any, error) {
+		if !reflect.DeepEqual(values, []any{10, nil, 1}) {
+			t.Errorf("UpdateValuesFunc called with %v, want [10 <nil> 1]", values)
+		}
+		return []any{5, 5, nil}, nil
+	})
+	if err != nil {
+		t.Fatalf("inMemory.UpdateValues() unexpected error: %v", err)
+	}
+	if got := db.MGet(0, "source", "destination", "deleted"); !reflect.DeepEqual(got, []any{5, 5, nil}) {
+		t.Errorf("inMemory.MGet() after UpdateValues() = %v, want [5 5 <nil>]", got)
+	}
+
+	wantErr := errors.New("update failed")
+	err = db.UpdateValues(0, []string{"source", "destination"}, func(values []any) ([]any, error) {
+		return []any{nil, nil}, wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("inMemory.UpdateValues() error = %v, want %v", err, wantErr)
+	}
+	if got := db.Exists(0, "source", "destination"); got != 2 {
+		t.Errorf("inMemory.Exists() after a failed UpdateValues() = %d, want 2", got)
+	}
+}
+
+func TestInMemoryDB_UpdateEntries(t *testing.T) {
+	db := NewInMemoryStorage(1)
+	defer db.Close()
+	expireAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	_ = db.SetWithExpiry(0, "expiring", "value", expireAt)
+	_ = db.Set(0, "other", "value")
+
+	err := db.UpdateEntries(0, []string{"expiring", "other", "missing"}, func(entries []Entry) ([]Entry, error) {
+		want := []Entry{{Key: "expiring", Value: "value", ExpireAt: expireAt}, {Key: "other", Value: "value"}, {Key: "missing"}}
+		if !reflect.DeepEqual(entries, want) {
+			t.Errorf("UpdateEntriesFunc called with %v, want %v", entries, want)
+		}
+		return []Entry{{Value: "new"}, {Value: "new", ExpireAt: expireAt}, {Value: "new", ExpireAt: time.Unix(1, 0)}}, nil
+	})
+	if err != nil {
+		t.Fatalf("inMemory.UpdateEntries() unexpected error: %v", err)
+	}
+	if got, _ := db.ExpireTime(0, "expiring"); !got.IsZero() {
+		t.Errorf("inMemory.ExpireTime(expiring) after UpdateEntries() = %v, want no expiration time", got)
+	}
+	if got, _ := db.ExpireTime(0, "other"); !got.Equal(expireAt) {
+		t.Errorf("inMemory.ExpireTime(other) after UpdateEntries() = %v, want %v", got, expireAt)
+	}
+	if got := db.Exists(0, "expiring", "other", "missing"); got != 2 {
+		t.Errorf("inMemory.Exists() after UpdateEntries() = %d, want 2, the entry expiring in the past is deleted", got)
+	}
+
+	err = db.ViewValues(0, []string{"other", "missing"}, func(values []any) error {
+		if !reflect.DeepEqual(values, []any{"new", nil}) {
+			t.Errorf("ViewValues() called with %v, want [new <nil>]", values)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("inMemory.ViewValues() unexpected error: %v", err)
+	}
+}
+
+// clonedSlice is a value modified in place
+type clonedSlice []int
+
+func (c *clonedSlice) Clone() any {
+	clone := append(clonedSlice{}, *c...)
+	return &clone
+}
+
+func TestInMemoryDB_ViewAndClone(t *testing.T) {
+	db := NewInMemoryStorage(1)
+	defer db.Close()
+	value := &clonedSlice{1, 2}
+	_ = db.Set(0, "key", value)
+
+	err := db.View(0, "key", func(v any, exists bool) error {
+		if !exists || v != value {
+			t.Errorf("View() called with %v, %v, want the stored value", v, exists)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("inMemory.View() unexpected error: %v", err)
+	}
+	wantErr := errors.New("view failed")
+	if err := db.View(0, "missing", func(v any, exists bool) error { return wantErr }); err != wantErr {
+		t.Errorf("inMemory.View() error = %v, want %v", err, wantErr)
+	}
+
+	entries, _, _ := db.Scan(0, 0, 10)
+	for _, e := range entries {
+		if e.Value == value || !reflect.DeepEqual(e.Value, value) {
+			t.Errorf("inMemory.Scan() returned %v, want a clone of the stored value", e.Value)
+		}
+	}
+}
+
+func TestInMemoryDB_Scan(t *testing.T) {
+	db := NewInMemoryStorage(1)
+	defer db.Close()
+	if entries, cursor, err := db.Scan(0, 0, 10); len(entries) != 0 || cursor != 0 || err != nil {
+		t.Errorf("inMemory.Scan() of an empty database = %v, %d, %v, want no entries and cursor 0", entries, cursor, err)
+	}
+	if key, ok := db.RandomKey(0); ok {
+		t.Errorf("inMemory.RandomKey() of an empty database = %q, want none", key)
+	}
+
+	for i := 0; i < 1000; i++ {
+		_ = db.Set(0, fmt.Sprintf("stable_%d", i), i)
+		_ = db.Set(0, fmt.Sprintf("removed_%d", i), i)
+	}
+	if got := db.Size(0); got != 2000 {
+		t.Errorf("inMemory.Size() = %d, want 2000", got)
+	}
+	if key, ok := db.RandomKey(0); !ok || db.Exists(0, key) != 1 {
+		t.Errorf("inMemory.RandomKey() = %q, %v, want an existing key", key, ok)
+	}
+
+	// Keys are added and removed while iterating, the stable keys must all be returned
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_ = db.Delete(0, fmt.Sprintf("removed_%d", i%1000))
+			_ = db.Set(0, fmt.Sprintf("added_%d", i), i)
+		}
+	}()
+
+	seen := make(map[string]bool)
+	for cursor := uint64(0); ; {
+		var entries []Entry
+		var err error
+		entries, cursor, err = db.Scan(0, cursor, 7)
+		if err != nil {
+			t.Fatalf("inMemory.Scan() unexpected error: %v", err)
+		}
+		if cursor != 0 && len(entries) < 7 {
+			t.Errorf("inMemory.Scan() returned %d entries before the end of the iteration, want at least 7", len(entries))
+		}
+		for _, e := range entries {
+			seen[e.Key] = true
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	for i := 0; i < 1000; i++ {
+		if key := fmt.Sprintf("stable_%d", i); !seen[key] {
+			t.Fatalf("inMemory.Scan() iteration missed %q", key)
+		}
+	}
+	keys := 0
+	_ = db.Keys(0, func(string) bool {
+		keys++
+		return true
+	})
+	if size := db.Size(0); keys != size {
+		t.Errorf("inMemory.Keys() returned %d keys, want %d", keys, size)
+	}
+}
+
+func TestInMemoryDB_CopyMoveFlushSwap(t *testing.T) {
+	db := NewInMemoryStorage(2)
+	defer db.Close()
+	value := &clonedSlice{1, 2}
+	expireAt := time.Now().Add(time.Hour)
+	_ = db.SetWithExpiry(0, "key", value, expireAt)
+
+	var notFoundErr *KeyNotFoundError
+	if _, err := db.Copy(0, "missing", 1, "key", false); !errors.As(err, &notFoundErr) {
+		t.Errorf("inMemory.Copy() of a missing key error = %v, want a *KeyNotFoundError", err)
+	}
+	if ok, err := db.Copy(0, "key", 1, "copy", false); !ok || err != nil {
+		t.Errorf("inMemory.Copy() = %v, %v, want true", ok, err)
+	}
+	if got, _ := db.Get(1, "copy"); got == value || !reflect.DeepEqual(got, value) {
+		t.Errorf("inMemory.Copy() stored %v, want a clone of the copied value", got)
+	}
+	if got, _ := db.ExpireTime(1, "copy"); !got.Equal(expireAt) {
+		t.Errorf("inMemory.ExpireTime() of a copy = %v, want %v", got, expireAt)
+	}
+	if ok, _ := db.Copy(0, "key", 1, "copy", false); ok {
+		t.Errorf("inMemory.Copy() to an existing key without replace = true, want false")
+	}
+
+	if ok, err := db.Move(0, "key", 1); !ok || err != nil {
+		t.Errorf("inMemory.Move() = %v, %v, want true", ok, err)
+	}
+	if db.Exists(0, "key") != 0 || db.Exists(1, "key") != 1 {
+		t.Errorf("inMemory.Move() did not move the key")
+	}
+	_ = db.Set(0, "key", "value")
+	if ok, _ := db.Move(0, "key", 1); ok || db.Exists(0, "key") != 1 {
+		t.Errorf("inMemory.Move() to a database holding the key = %v, want false and the key kept", ok)
+	}
+
+	_ = db.Swap(0, 1)
+	if got, _ := db.Get(0, "key"); got != value {
+		t.Errorf("inMemory.Get() after Swap = %v, want %v", got, value)
+	}
+	if got := db.Size(1); got != 1 {
+		t.Errorf("inMemory.Size() of the swapped database = %d, want 1", got)
+	}
+	_ = db.Flush(0)
+	if got := db.Size(0) + db.Size(1); got != 1 {
+		t.Errorf("inMemory.Size() of both databases after Flush = %d, want 1", got)
+	}
+}
+
+func TestInMemoryDB_MultiKeyAtomicity(t *testing.T) {
+	db := NewInMemoryStorage(1)
+	defer db.Close()
+	keys := []string{"key_1", "key_2", "key_3", "key_4"}
+	iterations := 1000
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				var entries []Entry
+				for _, key := range keys {
+					entries = append(entries, Entry{Key: key, Value: writer*iterations + i})
+				}
+				_ = db.MSet(0, entries)
+			}
+		}(w)
+	}
+	for i := 0; i < iterations; i++ {
+		values := db.MGet(0, keys...)
+		for _, value := range values[1:] {
+			if value != values[0] {
+				t.Fatalf("inMemory.MGet() = %v, want the values of a single MSet", values)
+			}
+		}
+	}
+	wg.Wait()
+}
+
+func TestInMemoryStorage_ConcurrentClients(t *testing.T) {
+	db := NewInMemoryStorage(4)
+	defer db.Close()
+	clients := 32
+	iterations := 500
+	counters := []string{"counter_1", "counter_2", "counter_3"}
+
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			dbIndex := client % db.DbCount()
+			for i := 0; i < iterations; i++ {
+				key := fmt.Sprintf("client_%d_key_%d", client, i%10)
+				_ = db.Set(dbIndex, key, i)
+				_, _ = db.Get(dbIndex, key)
+				if i%3 == 0 {
+					_ = db.Delete(dbIndex, key)
+				}
+
+				_, err := db.Update(0, counters[i%len(counters)], func(value any, exists bool) (any, error) {
+					if !exists {
+						return 1, nil
+					}
+					return value.(int) + 1, nil
+				})
+				if err != nil {
+					t.Errorf("inMemory.Update() unexpected error: %v", err)
+				}
+
+				if i%100 == 0 {
+					for cursor := uint64(0); ; {
+						if _, cursor, _ = db.Scan(dbIndex, cursor, 10); cursor == 0 {
+							break
+						}
+					}
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, counter := range counters {
+		value, err := db.Get(0, counter)
+		if err != nil {
+			t.Fatalf("inMemory.Get(%q) unexpected error: %v", counter, err)
+		}
+		total += value.(int)
+	}
+	if total != clients*iterations {
+		t.Errorf("Sum of the counters = %d, want %d", total, clients*iterations)
+	}
+}
+
+func BenchmarkInMemoryStorage_Scan(b *testing.B) {
+	db := NewInMemoryStorage(1)
+	defer db.Close()
+	for i := 0; i < 100000; i++ {
+		_ = db.Set(0, fmt.Sprintf("key_%d", i), i)
+	}
+
+	b.ResetTimer()
+	cursor := uint64(0)
+	for i := 0; i < b.N; i++ {
+		_, cursor, _ = db.Scan(0, cursor, 10)
+	}
+}
+
+func BenchmarkInMemoryStorage_Parallel(b *testing.B) {
+	db := NewInMemoryStorage(0)
+	defer db.Close()
+	for i := 0; i < 10000; i++ {
+		_ = db.Set(0, fmt.Sprintf("key_%d", i), i)
+	}
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := fmt.Sprintf("key_%d", i%10000)
+			if i%4 == 0 {
+				_ = db.Set(0, key, i)
+			} else {
+				_, _ = db.Get(0, key)
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,1072 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMemtableSize = 4 << 20
+	defaultTableSize    = 2 << 20
+	defaultBlockSize    = 4 << 10
+	defaultL0Tables     = 4
+	defaultLevelSize    = 10 << 20
+
+	lsmLevels          = 7     // Number of levels of the tables, the last one is never compacted
+	lsmLevelMultiplier = 10    // Ratio between the sizes of two consecutive levels
+	lsmCursorCount     = 65536 // Number of cursors of Scan remembered
+)
+
+// LSMOptions configures an LSM-tree storage, the zero value of a field selecting its default.
+type LSMOptions struct {
+	// Codec encodes the values other than strings and integers, which cannot be stored without it
+	Codec Codec
+	// Size of the memtable beyond which it is written to a table of level 0, 4 MiB by default
+	MemtableSize int64
+	// Size of the tables written by compactions, 2 MiB by default
+	TableSize int64
+	// Size of the data blocks of the tables, the unit they are read by, 4 KiB by default
+	BlockSize int
+	// Number of tables of level 0 from which they are compacted into level 1, 4 by default
+	L0Tables int
+	// Size of the tables of level 1 beyond which one of them is compacted into level 2, 10 MiB by default, every
+	// next level holding 10 times more
+	LevelSize int64
+	// Whether every write is flushed to disk before returning, rather than when the memtable is written to a table
+	SyncWrites bool
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// lsmChange is a modification of a key applied by apply: its new value and expiration time, or its removal when
+// value is nil.
+type lsmChange struct {
+	dbIndex  int
+	key      string
+	value    []byte
+	expireAt int64
+}
+
+// lsmCursor is where a page of Scan starts: a key of a database.
+type lsmCursor struct {
+	dbIndex int
+	key     string
+}
+
+// lsmStorage is a log-structured merge-tree: writes are appended to a WAL and applied to a memtable, which is
+// written to a table of level 0 once it is full. Tables are sorted by key and immutable, a background compaction
+// merges them into the next level when a level grows too large, so that every level but level 0 is a sorted run
+// of tables that do not overlap, each level holding older versions of the keys than the previous one.
+//
+// Keys are ordered, which Range and Scan iterate over. Like the records of bitcaskStorage, entries carry the
+// physical identifier of their database, which Flush and Swap change in the manifest, and the versions of the
+// databases flushed are left to the compaction.
+type lsmStorage struct {
+	dir     string
+	dbCount int
+	options LSMOptions
+
+	mu             sync.RWMutex
+	memtable       *memtable
+	wal            *segment // WAL of the writes held by the memtable
+	walIDs         []uint32 // WAL files replayed when opening the storage, removed once the memtable is flushed
+	levels         [lsmLevels][]*sstable
+	physical       []uint32 // Physical identifier of every database
+	nextPhysical   uint32
+	nextFileID     uint32
+	nextSeq        uint64
+	compactPointer [lsmLevels]string // Largest key of the last table of every level compacted into the next one
+	sizes          []int             // Number of keys of every database, the expired ones not removed yet included
+
+	cursorMu   sync.Mutex
+	cursors    map[uint64]lsmCursor
+	cursorIDs  []uint64 // Identifiers of the cursors from the oldest, dropped beyond lsmCursorCount
+	nextCursor uint64
+
+	compactMu sync.Mutex    // Serializes compactions
+	pending   chan struct{} // Signals the background compaction that a table was added to level 0
+	reclaims  chan struct{} // Signals the background compaction that Reclaim was called
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// OpenLSMStorage opens the LSM-tree storage of the given directory, creating it if needed, and starts the
+// background compaction of its tables.
+//
+// The writes of the WAL files are replayed, up to the first one cut short by a crash, then written to a table so
+// that new writes go to a new WAL file. Files left by a flush or a compaction interrupted by a crash are removed.
+func OpenLSMStorage(dir string, dbCount int, options LSMOptions) (Storage, error) {
+	if dbCount == 0 {
+		dbCount = 16
+	}
+	if options.MemtableSize <= 0 {
+		options.MemtableSize = defaultMemtableSize
+	}
+	if options.TableSize <= 0 {
+		options.TableSize = defaultTableSize
+	}
+	if options.BlockSize <= 0 {
+		options.BlockSize = defaultBlockSize
+	}
+	if options.L0Tables <= 0 {
+		options.L0Tables = defaultL0Tables
+	}
+	if options.LevelSize <= 0 {
+		options.LevelSize = defaultLevelSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	l := &lsmStorage{
+		dir:      dir,
+		dbCount:  dbCount,
+		options:  options,
+		memtable: newMemtable(),
+		cursors:  make(map[uint64]lsmCursor),
+		pending:  make(chan struct{}, 1),
+		reclaims: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	err := l.load()
+	if err == nil {
+		err = l.flush()
+	}
+	if err != nil {
+		l.closeFiles()
+		return nil, fmt.Errorf("error opening LSM-tree storage %s: %v", dir, err)
+	}
+
+	l.wg.Add(1)
+	go l.compactLevels()
+	l.signalCompaction()
+	return l, nil
+}
+
+// The manifest lists the tables of every level, level 0 from the newest, along with the WAL file of the memtable:
+//
+//	next <next file identifier> <next physical identifier>
+//	dbs <physical identifier of every database>
+//	wal <identifier>
+//	table <level> <identifier>
+//
+// It is rewritten by every flush and compaction, the files it does not list are left by an interrupted one.
+type lsmManifest struct {
+	nextFileID   uint32
+	nextPhysical uint32
+	physical     []uint32
+	wal          uint32
+	tables       [lsmLevels][]uint32
+}
+
+// readLSMManifest reads the manifest of a directory, false when it does not exist.
+func readLSMManifest(dir string) (lsmManifest, bool, error) {
+	var m lsmManifest
+	content, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return m, false, fmt.Errorf("invalid manifest: empty line")
+		}
+		ids := make([]uint32, len(fields)-1)
+		for j, field := range fields[1:] {
+			id, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return m, false, fmt.Errorf("invalid manifest: %v", err)
+			}
+			ids[j] = uint32(id)
+		}
+		switch {
+		case fields[0] == "next" && len(ids) == 2:
+			m.nextFileID, m.nextPhysical = ids[0], ids[1]
+		case fields[0] == "dbs":
+			m.physical = ids
+		case fields[0] == "wal" && len(ids) == 1:
+			m.wal = ids[0]
+		case fields[0] == "table" && len(ids) == 2 && ids[0] < lsmLevels:
+			m.tables[ids[0]] = append(m.tables[ids[0]], ids[1])
+		default:
+			return m, false, fmt.Errorf("invalid manifest line %q", line)
+		}
+	}
+	return m, true, nil
+}
+
+func writeLSMManifest(dir string, m lsmManifest) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "next %d %d\ndbs", m.nextFileID, m.nextPhysical)
+	for _, id := range m.physical {
+		fmt.Fprintf(&b, " %d", id)
+	}
+	fmt.Fprintf(&b, "\nwal %d\n", m.wal)
+	for level, ids := range m.tables {
+		for _, id := range ids {
+			fmt.Fprintf(&b, "table %d %d\n", level, id)
+		}
+	}
+	return writeFileAtomically(filepath.Join(dir, manifestName), []byte(b.String()))
+}
+
+// saveManifest writes the manifest listing the given tables, databases and WAL file. It must be called while
+// holding the lock.
+func (l *lsmStorage) saveManifest(levels [lsmLevels][]*sstable, physical []uint32, wal uint32) error {
+	m := lsmManifest{nextFileID: l.nextFileID, nextPhysical: l.nextPhysical, physical: physical, wal: wal}
+	for level, tables := range levels {
+		for _, t := range tables {
+			m.tables[level] = append(m.tables[level], t.id)
+		}
+	}
+	return writeLSMManifest(l.dir, m)
+}
+
+// load opens the tables listed by the manifest and replays the WAL files into the memtable, assigning the
+// physical identifiers of the databases the storage does not hold yet.
+func (l *lsmStorage) load() error {
+	m, ok, err := readLSMManifest(l.dir)
+	if err != nil {
+		return err
+	}
+	if len(m.physical) > l.dbCount {
+		return fmt.Errorf("the storage holds %d databases, more than %d", len(m.physical), l.dbCount)
+	}
+	if !ok {
+		m.nextFileID = 1
+	}
+	l.physical, l.nextPhysical, l.nextFileID = m.physical, m.nextPhysical, m.nextFileID
+	for len(l.physical) < l.dbCount {
+		l.physical = append(l.physical, l.nextPhysical)
+		l.nextPhysical++
+	}
+
+	listed := make(map[uint32]bool)
+	for level, ids := range m.tables {
+		for _, id := range ids {
+			t, err := openTable(l.dir, id)
+			if err != nil {
+				return fmt.Errorf("error opening table %d: %v", id, err)
+			}
+			l.levels[level] = append(l.levels[level], t)
+			l.nextSeq = max(l.nextSeq, t.maxSeq+1)
+			listed[id] = true
+		}
+	}
+	for level := 1; level < lsmLevels; level++ {
+		tables := l.levels[level]
+		sort.Slice(tables, func(a, c int) bool { return tables[a].smallest < tables[c].smallest })
+	}
+
+	dirEntries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		ext := filepath.Ext(name)
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 32)
+		switch {
+		case ext == tmpExt:
+			// Left by a crash while writing the manifest
+			_ = os.Remove(filepath.Join(l.dir, name))
+		case err != nil:
+		case ext == tableExt && !listed[uint32(id)], ext == walExt && uint32(id) < m.wal:
+			// Left by a crash during a flush or a compaction, before or after the manifest was written
+			_ = os.Remove(filepath.Join(l.dir, name))
+		case ext == walExt:
+			l.walIDs = append(l.walIDs, uint32(id))
+		}
+	}
+	sort.Slice(l.walIDs, func(a, c int) bool { return l.walIDs[a] < l.walIDs[c] })
+
+	for _, id := range l.walIDs {
+		if err := l.replay(id); err != nil {
+			return err
+		}
+		l.nextFileID = max(l.nextFileID, id+1)
+	}
+	return l.countKeys()
+}
+
+// countKeys counts the keys of every database by reading them all once, the storage then keeps count as keys are
+// added and removed.
+func (l *lsmStorage) countKeys() error {
+	dbIndexes := make(map[uint32]int, len(l.physical))
+	for dbIndex, db := range l.physical {
+		dbIndexes[db] = dbIndex
+	}
+	l.sizes = make([]int, l.dbCount)
+	it := l.iterator("")
+	for ; it.valid(); it.next() {
+		db, _ := splitInternalKey(it.entry().key)
+		if dbIndex, ok := dbIndexes[db]; ok && !it.entry().tombstone {
+			l.sizes[dbIndex]++
+		}
+	}
+	return it.err()
+}
+
+// replay applies the records of a WAL file to the memtable.
+func (l *lsmStorage) replay(id uint32) error {
+	file, err := os.Open(segmentPath(l.dir, id, walExt))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = scanSegment(file, func(r record, _ int64) {
+		l.memtable.put(lsmEntry{
+			key: internalKey(r.db, r.key), seq: r.seq, expireAt: r.expireAt,
+			tombstone: r.flags&recordTombstone != 0, value: r.value,
+		})
+		l.nextSeq = max(l.nextSeq, r.seq+1)
+	})
+	return err
+}
+
+// closeFiles closes the WAL and the tables.
+func (l *lsmStorage) closeFiles() {
+	if l.wal != nil {
+		_ = l.wal.file.Close()
+	}
+	for _, tables := range l.levels {
+		for _, t := range tables {
+			_ = t.file.Close()
+		}
+	}
+}
+
+// find returns the newest version of an internal key, looking into the memtable, then into the tables of every
+// level from level 0. It must be called while holding the lock, possibly the read lock.
+func (l *lsmStorage) find(ikey string) (lsmEntry, bool, error) {
+	if e, ok := l.memtable.get(ikey); ok {
+		return e, true, nil
+	}
+	for _, t := range l.levels[0] {
+		if e, ok, err := t.get(ikey); ok || err != nil {
+			return e, ok, err
+		}
+	}
+	for _, tables := range l.levels[1:] {
+		j := sort.Search(len(tables), func(j int) bool { return tables[j].largest >= ikey })
+		if j == len(tables) {
+			continue
+		}
+		if e, ok, err := tables[j].get(ikey); ok || err != nil {
+			return e, ok, err
+		}
+	}
+	return lsmEntry{}, false, nil
+}
+
+// lookup returns the entry of a key unless it does not exist or expired.
+// It must be called while holding the lock, possibly the read lock.
+func (l *lsmStorage) lookup(dbIndex int, key string) (lsmEntry, bool, error) {
+	e, ok, err := l.find(internalKey(l.physical[dbIndex], key))
+	if err != nil || !ok || e.tombstone || e.expired(now()) {
+		return lsmEntry{}, false, err
+	}
+	return e, true, nil
+}
+
+// get returns the value of a key and its entry, false when it does not exist or expired.
+// It must be called while holding the lock, possibly the read lock.
+func (l *lsmStorage) get(dbIndex int, key string) (any, lsmEntry, bool, error) {
+	e, ok, err := l.lookup(dbIndex, key)
+	if err != nil || !ok {
+		return nil, e, false, err
+	}
+	value, err := decodeValue(l.options.Codec, e.value)
+	if err != nil {
+		return nil, e, false, err
+	}
+	return value, e, true, nil
+}
+
+// apply appends the changes to the WAL as one batch, then applies them to the memtable, which is written to a
+// table once full, and counts the keys added and removed. Removing a key that does not exist writes no tombstone.
+// It must be called while holding the lock.
+func (l *lsmStorage) apply(changes ...lsmChange) error {
+	var records []record
+	sizes := make(map[int]int)
+	written := make(map[string]bool) // Whether the keys set or removed by the batch exist once it is applied
+	for _, c := range changes {
+		r := record{expireAt: c.expireAt, db: l.physical[c.dbIndex], key: c.key, value: c.value}
+		ikey := internalKey(r.db, r.key)
+		exists, ok := written[ikey]
+		if !ok {
+			exists = l.written(ikey)
+		}
+		written[ikey] = c.value != nil
+		switch {
+		case c.value == nil && !exists:
+			continue
+		case c.value == nil:
+			r.flags, r.expireAt = recordTombstone, 0
+			sizes[c.dbIndex]--
+		case !exists:
+			sizes[c.dbIndex]++
+		}
+		records = append(records, r)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	var buf []byte
+	for j := range records {
+		records[j].seq = l.nextSeq
+		l.nextSeq++
+		if j < len(records)-1 {
+			records[j].flags |= recordBatch
+		}
+		buf = records[j].appendTo(buf)
+	}
+	if _, err := l.wal.file.WriteAt(buf, l.wal.size); err != nil {
+		return err
+	}
+	if l.options.SyncWrites {
+		if err := l.wal.file.Sync(); err != nil {
+			return err
+		}
+	}
+	l.wal.size += int64(len(buf))
+
+	for _, r := range records {
+		l.memtable.put(lsmEntry{
+			key: internalKey(r.db, r.key), seq: r.seq, expireAt: r.expireAt,
+			tombstone: r.flags&recordTombstone != 0, value: r.value,
+		})
+	}
+	for dbIndex, delta := range sizes {
+		l.sizes[dbIndex] += delta
+	}
+	if l.memtable.size >= l.options.MemtableSize {
+		// The writes are in the WAL, the next write tries again
+		if err := l.flush(); err != nil {
+			log.Printf("Error flushing the memtable of %s: %v", l.dir, err)
+		}
+	}
+	return nil
+}
+
+// written reports whether an internal key has a version that is not removed, even if expired, which Size counts
+// and a removal writes a tombstone for. A key that cannot be read is assumed to have one.
+func (l *lsmStorage) written(ikey string) bool {
+	e, ok, err := l.find(ikey)
+	return err != nil || (ok && !e.tombstone)
+}
+
+func (l *lsmStorage) Set(dbIndex int, key string, value any) error {
+	return l.SetWithExpiry(dbIndex, key, value, time.Time{})
+}
+
+func (l *lsmStorage) SetWithExpiry(dbIndex int, key string, value any, expireAt time.Time) error {
+	data, err := encodeValue(l.options.Codec, value)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.apply(lsmChange{dbIndex: dbIndex, key: key, value: data, expireAt: unixNano(expireAt)})
+}
+
+func (l *lsmStorage) Get(dbIndex int, key string) (any, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	value, _, ok, err := l.get(dbIndex, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &KeyNotFoundError{key: key}
+	}
+	return value, nil
+}
+
+func (l *lsmStorage) View(dbIndex int, key string, fn func(value any, exists bool) error) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	value, _, ok, err := l.get(dbIndex, key)
+	if err != nil {
+		return err
+	}
+	return fn(value, ok)
+}
+
+func (l *lsmStorage) ViewValues(dbIndex int, keys []string, fn func(values []any) error) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	values := make([]any, len(keys))
+	for j, key := range keys {
+		value, _, _, err := l.get(dbIndex, key)
+		if err != nil {
+			return err
+		}
+		values[j] = value
+	}
+	return fn(values)
+}
+
+func (l *lsmStorage) Delete(dbIndex int, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok, err := l.lookup(dbIndex, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &KeyNotFoundError{key: key}
+	}
+	return l.apply(lsmChange{dbIndex: dbIndex, key: key})
+}
+
+// encodeEntries returns the changes setting the given entries.
+func (l *lsmStorage) encodeEntries(dbIndex int, entries []Entry) ([]lsmChange, error) {
+	changes := make([]lsmChange, len(entries))
+	for j, e := range entries {
+		data, err := encodeValue(l.options.Codec, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		changes[j] = lsmChange{dbIndex: dbIndex, key: e.Key, value: data, expireAt: unixNano(e.ExpireAt)}
+	}
+	return changes, nil
+}
+
+func (l *lsmStorage) MSet(dbIndex int, entries []Entry) error {
+	changes, err := l.encodeEntries(dbIndex, entries)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.apply(changes...)
+}
+
+func (l *lsmStorage) MSetNX(dbIndex int, entries []Entry) (bool, error) {
+	changes, err := l.encodeEntries(dbIndex, entries)
+	if err != nil {
+		return false, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, e := range entries {
+		if _, ok, err := l.lookup(dbIndex, e.Key); ok || err != nil {
+			return false, err
+		}
+	}
+	if err := l.apply(changes...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// MGet returns nil for the values that cannot be read, along with the missing ones.
+func (l *lsmStorage) MGet(dbIndex int, keys ...string) []any {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	values := make([]any, len(keys))
+	for j, key := range keys {
+		values[j], _, _, _ = l.get(dbIndex, key)
+	}
+	return values
+}
+
+// DeleteKeys returns 0 when the tombstones cannot be written, the keys are then left untouched.
+func (l *lsmStorage) DeleteKeys(dbIndex int, keys ...string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	deleted := 0
+	seen := make(map[string]bool, len(keys))
+	changes := make([]lsmChange, len(keys))
+	for j, key := range keys {
+		if _, ok, _ := l.lookup(dbIndex, key); ok && !seen[key] {
+			deleted++
+		}
+		seen[key] = true
+		changes[j] = lsmChange{dbIndex: dbIndex, key: key}
+	}
+	if err := l.apply(changes...); err != nil {
+		return 0
+	}
+	return deleted
+}
+
+// Exists does not count the keys that cannot be read.
+func (l *lsmStorage) Exists(dbIndex int, keys ...string) int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	count := 0
+	for _, key := range keys {
+		if _, ok, _ := l.lookup(dbIndex, key); ok {
+			count++
+		}
+	}
+	return count
+}
+
+func (l *lsmStorage) Update(dbIndex int, key string, fn UpdateFunc) (any, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	value, e, exists, err := l.get(dbIndex, key)
+	if err != nil {
+		return nil, err
+	}
+	newValue, err := fn(value, exists)
+	if err != nil {
+		return nil, err
+	}
+	c := lsmChange{dbIndex: dbIndex, key: key, expireAt: e.expireAt}
+	if newValue != nil {
+		if c.value, err = encodeValue(l.options.Codec, newValue); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.apply(c); err != nil {
+		return nil, err
+	}
+	return newValue, nil
+}
+
+func (l *lsmStorage) UpdateValues(dbIndex int, keys []string, fn UpdateValuesFunc) error {
+	return l.UpdateEntries(dbIndex, keys, updateValues(fn))
+}
+
+func (l *lsmStorage) UpdateEntries(dbIndex int, keys []string, fn UpdateEntriesFunc) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]Entry, len(keys))
+	for j, key := range keys {
+		value, e, _, err := l.get(dbIndex, key)
+		if err != nil {
+			return err
+		}
+		entries[j] = Entry{Key: key, Value: value, ExpireAt: e.expireTime()}
+	}
+	newEntries, err := fn(entries)
+	if err != nil {
+		return err
+	}
+	changes := make([]lsmChange, len(keys))
+	for j, key := range keys {
+		if changes[j], err = l.change(dbIndex, key, newEntries[j]); err != nil {
+			return err
+		}
+	}
+	return l.apply(changes...)
+}
+
+// change returns the change setting the entry of a key, or removing the key when the entry has no value or
+// expired.
+func (l *lsmStorage) change(dbIndex int, key string, e Entry) (lsmChange, error) {
+	c := lsmChange{dbIndex: dbIndex, key: key}
+	if e.Value == nil || (!e.ExpireAt.IsZero() && !now().Before(e.ExpireAt)) {
+		return c, nil
+	}
+	data, err := encodeValue(l.options.Codec, e.Value)
+	c.value, c.expireAt = data, unixNano(e.ExpireAt)
+	return c, err
+}
+
+func (l *lsmStorage) UpdateEntry(dbIndex int, key string, fn UpdateEntryFunc) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	value, e, exists, err := l.get(dbIndex, key)
+	if err != nil {
+		return Entry{}, err
+	}
+	newEntry, err := fn(Entry{Key: key, Value: value, ExpireAt: e.expireTime()}, exists)
+	if err != nil {
+		return Entry{}, err
+	}
+	newEntry.Key = key
+	c, err := l.change(dbIndex, key, newEntry)
+	if err != nil {
+		return Entry{}, err
+	}
+	if err := l.apply(c); err != nil {
+		return Entry{}, err
+	}
+	return newEntry, nil
+}
+
+// setExpiry writes the value of an existing key with another expiration time, removing the key when it is in
+// the past. It must be called while holding the lock.
+func (l *lsmStorage) setExpiry(dbIndex int, key string, e lsmEntry, expireAt time.Time) error {
+	if !expireAt.IsZero() && !now().Before(expireAt) {
+		return l.apply(lsmChange{dbIndex: dbIndex, key: key})
+	}
+	return l.apply(lsmChange{dbIndex: dbIndex, key: key, value: e.value, expireAt: unixNano(expireAt)})
+}
+
+func (l *lsmStorage) Expire(dbIndex int, key string, expireAt time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok, err := l.lookup(dbIndex, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &KeyNotFoundError{key: key}
+	}
+	return l.setExpiry(dbIndex, key, e, expireAt)
+}
+
+func (l *lsmStorage) Persist(dbIndex int, key string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok, err := l.lookup(dbIndex, key)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, &KeyNotFoundError{key: key}
+	}
+	if e.expireAt == 0 {
+		return false, nil
+	}
+	if err := l.setExpiry(dbIndex, key, e, time.Time{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (l *lsmStorage) ExpireTime(dbIndex int, key string) (time.Time, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	e, ok, err := l.lookup(dbIndex, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ok {
+		return time.Time{}, &KeyNotFoundError{key: key}
+	}
+	return e.expireTime(), nil
+}
+
+// Copy copies the encoded value of the key, which is never decoded.
+func (l *lsmStorage) Copy(srcIndex int, src string, dstIndex int, dst string, replace bool) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok, err := l.lookup(srcIndex, src)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, &KeyNotFoundError{key: src}
+	}
+	if srcIndex == dstIndex && src == dst {
+		return false, nil
+	}
+	_, exists, err := l.lookup(dstIndex, dst)
+	if err != nil || (exists && !replace) {
+		return false, err
+	}
+	if err := l.apply(lsmChange{dbIndex: dstIndex, key: dst, value: e.value, expireAt: e.expireAt}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Move writes the key to the other database and its tombstone as one batch.
+func (l *lsmStorage) Move(srcIndex int, key string, dstIndex int) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok, err := l.lookup(srcIndex, key)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, &KeyNotFoundError{key: key}
+	}
+	_, exists, err := l.lookup(dstIndex, key)
+	if err != nil || exists || srcIndex == dstIndex {
+		return false, err
+	}
+	err = l.apply(
+		lsmChange{dbIndex: dstIndex, key: key, value: e.value, expireAt: e.expireAt},
+		lsmChange{dbIndex: srcIndex, key: key},
+	)
+	return err == nil, err
+}
+
+// Flush gives the database a new physical identifier, the versions of the previous one are left to the
+// compaction.
+func (l *lsmStorage) Flush(dbIndex int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	physical := append([]uint32(nil), l.physical...)
+	physical[dbIndex] = l.nextPhysical
+	l.nextPhysical++
+	if err := l.saveManifest(l.levels, physical, l.wal.id); err != nil {
+		return err
+	}
+	l.physical = physical
+	l.sizes[dbIndex] = 0
+	return nil
+}
+
+// Swap exchanges the physical identifiers of the databases.
+func (l *lsmStorage) Swap(dbIndex1, dbIndex2 int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if dbIndex1 == dbIndex2 {
+		return nil
+	}
+	physical := append([]uint32(nil), l.physical...)
+	physical[dbIndex1], physical[dbIndex2] = physical[dbIndex2], physical[dbIndex1]
+	if err := l.saveManifest(l.levels, physical, l.wal.id); err != nil {
+		return err
+	}
+	l.physical = physical
+	l.sizes[dbIndex1], l.sizes[dbIndex2] = l.sizes[dbIndex2], l.sizes[dbIndex1]
+	return nil
+}
+
+// iterator returns an iterator over the newest version of the keys of the memtable and of every table, from the
+// given internal key. It must be called while holding the lock, possibly the read lock, until the iteration ends.
+func (l *lsmStorage) iterator(start string) lsmIterator {
+	children := []lsmIterator{l.memtable.iterator(start)}
+	for _, t := range l.levels[0] {
+		children = append(children, t.iterator(start))
+	}
+	for _, tables := range l.levels[1:] {
+		if len(tables) > 0 {
+			children = append(children, newLevelIterator(tables, start))
+		}
+	}
+	return newMergingIterator(children...)
+}
+
+// iterate calls fn with the entries of the keys of a database at least start and less than end, an empty end
+// meaning no upper bound, in the order of their key until fn returns false. Removed and expired keys are left out.
+// It must be called while holding the lock, possibly the read lock.
+func (l *lsmStorage) iterate(dbIndex int, start, end string, fn func(e lsmEntry) bool) error {
+	db := l.physical[dbIndex]
+	to := internalKey(db+1, "")
+	if end != "" {
+		to = internalKey(db, end)
+	}
+	currentTime := now()
+	it := l.iterator(internalKey(db, start))
+	for ; it.valid() && it.entry().key < to; it.next() {
+		if e := it.entry(); !e.tombstone && !e.expired(currentTime) && !fn(e) {
+			return nil
+		}
+	}
+	return it.err()
+}
+
+// entry returns the entry of a key of the storage from its version.
+func (l *lsmStorage) entry(e lsmEntry) (Entry, error) {
+	value, err := decodeValue(l.options.Codec, e.value)
+	_, key := splitInternalKey(e.key)
+	return Entry{Key: key, Value: value, ExpireAt: e.expireTime()}, err
+}
+
+// Range reads the values while holding the read lock, during which writes wait.
+func (l *lsmStorage) Range(dbIndex int, start, end string, fn func(e Entry) bool) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var decodeErr error
+	err := l.iterate(dbIndex, start, end, func(e lsmEntry) bool {
+		var entry Entry
+		if entry, decodeErr = l.entry(e); decodeErr != nil {
+			return false
+		}
+		return fn(entry)
+	})
+	if err != nil {
+		return err
+	}
+	return decodeErr
+}
+
+// Iterate ranges over all the keys of the database.
+func (l *lsmStorage) Iterate(dbIndex int, fn func(e Entry) bool) error {
+	return l.Range(dbIndex, "", "", fn)
+}
+
+// Keys ranges over all the keys of the database in order without decoding their values.
+func (l *lsmStorage) Keys(dbIndex int, fn func(key string) bool) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.iterate(dbIndex, "", "", func(e lsmEntry) bool {
+		_, key := splitInternalKey(e.key)
+		return fn(key)
+	})
+}
+
+// Scan iterates over the keys in key order. A cursor stands for the key its page starts from, which does not fit in
+// the 64 bits of a cursor: only the cursors of the last lsmCursorCount pages are remembered, an unknown cursor
+// returns an error. The full passes over a database made by the server use Iterate, which remembers none.
+func (l *lsmStorage) Scan(dbIndex int, cursor uint64, count int) ([]Entry, uint64, error) {
+	start := ""
+	if cursor != 0 {
+		l.cursorMu.Lock()
+		c, ok := l.cursors[cursor]
+		l.cursorMu.Unlock()
+		if !ok || c.dbIndex != dbIndex {
+			return nil, 0, errInvalidCursor
+		}
+		start = c.key
+	}
+
+	l.mu.RLock()
+	var page []Entry
+	var next string
+	more := false
+	var decodeErr error
+	err := l.iterate(dbIndex, start, "", func(e lsmEntry) bool {
+		if len(page) >= max(count, 1) {
+			_, next = splitInternalKey(e.key)
+			more = true
+			return false
+		}
+		var entry Entry
+		if entry, decodeErr = l.entry(e); decodeErr != nil {
+			return false
+		}
+		page = append(page, entry)
+		return true
+	})
+	l.mu.RUnlock()
+	if err == nil {
+		err = decodeErr
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if !more {
+		return page, 0, nil
+	}
+	return page, l.saveCursor(lsmCursor{dbIndex: dbIndex, key: next}), nil
+}
+
+// saveCursor returns a new cursor standing for the given key, forgetting the oldest one beyond lsmCursorCount.
+func (l *lsmStorage) saveCursor(c lsmCursor) uint64 {
+	l.cursorMu.Lock()
+	defer l.cursorMu.Unlock()
+
+	l.nextCursor++
+	l.cursors[l.nextCursor] = c
+	l.cursorIDs = append(l.cursorIDs, l.nextCursor)
+	if len(l.cursorIDs) > lsmCursorCount {
+		delete(l.cursors, l.cursorIDs[0])
+		l.cursorIDs = l.cursorIDs[1:]
+	}
+	return l.nextCursor
+}
+
+// RandomKey picks a random key of the memtable or of one of the tables holding keys of the database, then
+// returns the first key of the database from there, wrapping around to its first key.
+func (l *lsmStorage) RandomKey(dbIndex int) (string, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	db := l.physical[dbIndex]
+	from, to := internalKey(db, ""), internalKey(db+1, "")
+	var tables []*sstable
+	for _, level := range l.levels {
+		for _, t := range level {
+			if t.overlaps(from, to) {
+				tables = append(tables, t)
+			}
+		}
+	}
+	picked, ok := "", false
+	if j := rand.Intn(len(tables) + 1); j == len(tables) {
+		picked, ok = l.memtable.random(from, to)
+	} else {
+		picked, ok, _ = tables[j].random(from, to)
+	}
+
+	var key string
+	found := false
+	first := func(e lsmEntry) bool {
+		_, key = splitInternalKey(e.key)
+		found = true
+		return false
+	}
+	if ok {
+		_, start := splitInternalKey(picked)
+		_ = l.iterate(dbIndex, start, "", first)
+	}
+	if !found {
+		_ = l.iterate(dbIndex, "", "", first)
+	}
+	return key, found
+}
+
+// Size returns the number of keys counted as they are added and removed, expired keys being removed by a deletion
+// or by the compaction of the last level holding them.
+func (l *lsmStorage) Size(dbIndex int) int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.sizes[dbIndex]
+}
+
+func (l *lsmStorage) Select(dbIndex string) (int, error) {
+	return selectDB(dbIndex, l.dbCount)
+}
+
+func (l *lsmStorage) DbCount() int {
+	return l.dbCount
+}
+
+// Close stops the background compaction and flushes the WAL to disk, the memtable is rebuilt from it when the
+// storage is opened.
+func (l *lsmStorage) Close() error {
+	close(l.stop)
+	l.wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.wal.file.Sync()
+	if closeErr := l.wal.file.Close(); err == nil {
+		err = closeErr
+	}
+	for _, tables := range l.levels {
+		for _, t := range tables {
+			if closeErr := t.file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
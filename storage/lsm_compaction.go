@@ -0,0 +1,374 @@
+package storage
+
+import (
+	"log"
+	"os"
+	"sort"
+)
+
+// flush writes the memtable to a new table of level 0 and replaces the WAL by a new one. The memtable and the
+// WAL files backing it are only dropped once the manifest lists the table. It must be called while holding the
+// lock.
+func (l *lsmStorage) flush() error {
+	var table *sstable
+	if l.memtable.count > 0 {
+		w, err := createTable(l.dir, l.nextFileID, l.options.BlockSize)
+		if err != nil {
+			return err
+		}
+		l.nextFileID++
+		for node := l.memtable.seek("", nil); node != nil && err == nil; node = node.next[0] {
+			err = w.add(node.entry)
+		}
+		if err == nil {
+			table, err = w.finish()
+		}
+		if err != nil {
+			w.abort()
+			return err
+		}
+	}
+	abort := func() {
+		if table != nil {
+			_ = table.file.Close()
+			_ = os.Remove(segmentPath(l.dir, table.id, tableExt))
+		}
+	}
+
+	file, err := os.OpenFile(segmentPath(l.dir, l.nextFileID, walExt), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		abort()
+		return err
+	}
+	wal := &segment{id: l.nextFileID, file: file}
+	l.nextFileID++
+	levels := l.levels
+	if table != nil {
+		levels[0] = append([]*sstable{table}, levels[0]...)
+	}
+	if err := l.saveManifest(levels, l.physical, wal.id); err != nil {
+		abort()
+		_ = file.Close()
+		_ = os.Remove(segmentPath(l.dir, wal.id, walExt))
+		return err
+	}
+
+	if l.wal != nil {
+		_ = l.wal.file.Close()
+		l.walIDs = append(l.walIDs, l.wal.id)
+	}
+	for _, id := range l.walIDs {
+		_ = os.Remove(segmentPath(l.dir, id, walExt))
+	}
+	l.levels, l.wal, l.walIDs, l.memtable = levels, wal, nil, newMemtable()
+	if table != nil {
+		l.signalCompaction()
+	}
+	return nil
+}
+
+func (l *lsmStorage) signalCompaction() {
+	select {
+	case l.pending <- struct{}{}:
+	default:
+	}
+}
+
+// compactLevels compacts the levels whenever a table is added to level 0, and all of them when Reclaim asks to,
+// until the storage is closed.
+func (l *lsmStorage) compactLevels() {
+	defer l.wg.Done()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.pending:
+			if err := l.compact(); err != nil {
+				log.Printf("Error compacting the tables of %s: %v", l.dir, err)
+			}
+		case <-l.reclaims:
+			if err := l.compactAll(); err != nil {
+				log.Printf("Error compacting the tables of %s: %v", l.dir, err)
+			}
+		}
+	}
+}
+
+// Reclaim flushes the memtable and compacts every level into the next one, so that the versions of the removed
+// keys are dropped.
+func (l *lsmStorage) Reclaim(async bool) error {
+	if !async {
+		return l.compactAll()
+	}
+	select {
+	case l.reclaims <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// compactAll flushes the memtable, then compacts all the tables of every level with all the tables of the next one,
+// down to the last level.
+func (l *lsmStorage) compactAll() error {
+	l.mu.Lock()
+	err := l.flush()
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+	for level := 0; level < lsmLevels-1; level++ {
+		l.mu.Lock()
+		c := compaction{
+			level:    level,
+			inputs:   append([]*sstable(nil), l.levels[level]...),
+			overlaps: append([]*sstable(nil), l.levels[level+1]...),
+			bottom:   true,
+		}
+		for _, tables := range l.levels[level+2:] {
+			if len(tables) > 0 {
+				c.bottom = false
+			}
+		}
+		l.mu.Unlock()
+		if len(c.inputs)+len(c.overlaps) == 0 {
+			continue
+		}
+		if err := l.runCompaction(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compaction merges tables of a level with the tables of the next level they overlap into new tables of the next
+// level.
+type compaction struct {
+	level    int
+	inputs   []*sstable // Tables of the level
+	overlaps []*sstable // Tables of the next level
+	bottom   bool       // Whether no deeper level holds keys of the tables, which then drop tombstones
+}
+
+// compact runs compactions until no level needs one, or the storage is closed.
+func (l *lsmStorage) compact() error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	for {
+		select {
+		case <-l.stop:
+			return nil
+		default:
+		}
+		c, ok := l.pickCompaction()
+		if !ok {
+			return nil
+		}
+		if err := l.runCompaction(c); err != nil {
+			return err
+		}
+	}
+}
+
+// maxLevelSize returns the size of the tables of a level other than level 0 beyond which it is compacted.
+func (l *lsmStorage) maxLevelSize(level int) int64 {
+	size := l.options.LevelSize
+	for j := 1; j < level; j++ {
+		size *= lsmLevelMultiplier
+	}
+	return size
+}
+
+// pickCompaction returns the compaction of the level having the highest score, false when no score reaches 1:
+// the number of tables of level 0 relative to L0Tables, the size of the tables of the other levels relative to
+// their maximum size. A level other than level 0 compacts a single table, the one after the table it compacted
+// last, so that the compactions go around its keys.
+func (l *lsmStorage) pickCompaction() (compaction, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c := compaction{level: -1}
+	best := float64(len(l.levels[0])) / float64(l.options.L0Tables)
+	if best >= 1 {
+		c.level = 0
+	}
+	for level := 1; level < lsmLevels-1; level++ {
+		size := int64(0)
+		for _, t := range l.levels[level] {
+			size += t.size
+		}
+		if score := float64(size) / float64(l.maxLevelSize(level)); score >= 1 && score > best {
+			c.level, best = level, score
+		}
+	}
+	switch {
+	case c.level == 0:
+		c.inputs = append([]*sstable(nil), l.levels[0]...)
+	case c.level > 0:
+		tables := l.levels[c.level]
+		j := sort.Search(len(tables), func(j int) bool { return tables[j].smallest > l.compactPointer[c.level] })
+		if j == len(tables) {
+			j = 0
+		}
+		c.inputs = []*sstable{tables[j]}
+		l.compactPointer[c.level] = tables[j].largest
+	}
+	if c.level < 0 {
+		return c, false
+	}
+
+	smallest, largest := c.inputs[0].smallest, c.inputs[0].largest
+	for _, t := range c.inputs {
+		smallest, largest = min(smallest, t.smallest), max(largest, t.largest)
+	}
+	for _, t := range l.levels[c.level+1] {
+		if t.overlaps(smallest, largest) {
+			c.overlaps = append(c.overlaps, t)
+			smallest, largest = min(smallest, t.smallest), max(largest, t.largest)
+		}
+	}
+	c.bottom = true
+	for _, tables := range l.levels[c.level+2:] {
+		for _, t := range tables {
+			if t.overlaps(smallest, largest) {
+				c.bottom = false
+			}
+		}
+	}
+	return c, true
+}
+
+// uncount stops counting the keys of the given expired versions left out by a compaction, unless a newer version
+// was written since. It must be called while holding the lock, before the compaction replaces its tables.
+func (l *lsmStorage) uncount(expired []lsmEntry) {
+	dbIndexes := make(map[uint32]int, len(l.physical))
+	for dbIndex, db := range l.physical {
+		dbIndexes[db] = dbIndex
+	}
+	for _, e := range expired {
+		db, _ := splitInternalKey(e.key)
+		dbIndex, ok := dbIndexes[db]
+		if !ok {
+			continue
+		}
+		if newest, found, err := l.find(e.key); err == nil && found && newest.seq == e.seq {
+			l.sizes[dbIndex]--
+		}
+	}
+}
+
+// runCompaction writes the newest version of every key of the tables of a compaction to new tables of the next
+// level, then replaces the tables by them in the manifest and removes them.
+//
+// Writes go on during the compaction: the tables flushed in the meantime are added to level 0 and hold newer
+// versions. The versions of the databases flushed are left out, as well as the tombstones and the expired keys
+// when no deeper level holds older versions of their key. Expired keys whose newest version is left out are no
+// longer counted by Size.
+func (l *lsmStorage) runCompaction(c compaction) error {
+	l.mu.RLock()
+	live := make(map[uint32]bool, len(l.physical))
+	for _, db := range l.physical {
+		live[db] = true
+	}
+	l.mu.RUnlock()
+
+	var children []lsmIterator
+	for _, t := range c.inputs {
+		children = append(children, t.iterator(""))
+	}
+	children = append(children, newLevelIterator(c.overlaps, ""))
+	it := newMergingIterator(children...)
+
+	var outputs []*sstable
+	var expired []lsmEntry
+	var w *tableWriter
+	var err error
+	currentTime := now()
+	for ; it.valid() && err == nil; it.next() {
+		e := it.entry()
+		if db, _ := splitInternalKey(e.key); !live[db] {
+			continue
+		}
+		if c.bottom && !e.tombstone && e.expired(currentTime) {
+			expired = append(expired, lsmEntry{key: e.key, seq: e.seq})
+			continue
+		}
+		if c.bottom && e.tombstone {
+			continue
+		}
+		if w == nil {
+			l.mu.Lock()
+			id := l.nextFileID
+			l.nextFileID++
+			l.mu.Unlock()
+			if w, err = createTable(l.dir, id, l.options.BlockSize); err != nil {
+				break
+			}
+		}
+		if err = w.add(e); err == nil && w.size() >= l.options.TableSize {
+			var t *sstable
+			if t, err = w.finish(); err == nil {
+				outputs, w = append(outputs, t), nil
+			}
+		}
+	}
+	if err == nil {
+		err = it.err()
+	}
+	if err == nil && w != nil {
+		var t *sstable
+		if t, err = w.finish(); err == nil {
+			outputs, w = append(outputs, t), nil
+		}
+	}
+	if err == nil {
+		err = syncDir(l.dir)
+	}
+	removeOutputs := func() {
+		if w != nil {
+			w.abort()
+		}
+		for _, t := range outputs {
+			_ = t.file.Close()
+			_ = os.Remove(segmentPath(l.dir, t.id, tableExt))
+		}
+	}
+	if err != nil {
+		removeOutputs()
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	replaced := make(map[*sstable]bool)
+	for _, t := range append(c.inputs, c.overlaps...) {
+		replaced[t] = true
+	}
+	levels := l.levels
+	for _, level := range []int{c.level, c.level + 1} {
+		levels[level] = nil
+		for _, t := range l.levels[level] {
+			if !replaced[t] {
+				levels[level] = append(levels[level], t)
+			}
+		}
+	}
+	next := append(levels[c.level+1], outputs...)
+	sort.Slice(next, func(a, b int) bool { return next[a].smallest < next[b].smallest })
+	levels[c.level+1] = next
+	if err := l.saveManifest(levels, l.physical, l.wal.id); err != nil {
+		removeOutputs()
+		return err
+	}
+	l.uncount(expired)
+	l.levels = levels
+	for t := range replaced {
+		_ = t.file.Close()
+		_ = os.Remove(segmentPath(l.dir, t.id, tableExt))
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"math/rand"
+	"time"
+)
+
+// lsmEntry is a version of a key of an LSM-tree storage: its encoded value, or its removal when it is a tombstone.
+//
+// The key is an internal key, the big-endian physical identifier of the database followed by the key, so that the
+// keys of a database are contiguous once sorted.
+type lsmEntry struct {
+	key       string
+	seq       uint64
+	expireAt  int64 // Unix time in nanoseconds, 0 when the key never expires
+	tombstone bool
+	value     []byte
+}
+
+func (e lsmEntry) expired(now time.Time) bool {
+	return e.expireAt != 0 && now.UnixNano() >= e.expireAt
+}
+
+func (e lsmEntry) expireTime() time.Time {
+	if e.expireAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, e.expireAt)
+}
+
+// size returns the approximate number of bytes held by the entry in a memtable.
+func (e lsmEntry) size() int64 {
+	return int64(len(e.key) + len(e.value) + 48)
+}
+
+func internalKey(db uint32, key string) string {
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], db)
+	return string(prefix[:]) + key
+}
+
+// splitInternalKey returns the physical identifier of the database and the key of an internal key.
+func splitInternalKey(ikey string) (uint32, string) {
+	return binary.BigEndian.Uint32([]byte(ikey[:4])), ikey[4:]
+}
+
+const memtableMaxHeight = 12
+
+type memtableNode struct {
+	entry lsmEntry
+	next  []*memtableNode
+}
+
+// memtable holds the latest writes of an LSM-tree storage, the latest version of every key, in a skiplist sorted
+// by key. It must only be modified while holding the lock of the storage.
+type memtable struct {
+	head   *memtableNode
+	height int
+	count  int
+	size   int64 // Approximate number of bytes held by the entries
+}
+
+func newMemtable() *memtable {
+	return &memtable{head: &memtableNode{next: make([]*memtableNode, memtableMaxHeight)}, height: 1}
+}
+
+// seek returns the first node whose key is not less than key, nil when there is none. When prev is not nil, it
+// is filled with the last node before it at every level of the skiplist.
+func (m *memtable) seek(key string, prev []*memtableNode) *memtableNode {
+	node := m.head
+	for level := m.height - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].entry.key < key {
+			node = node.next[level]
+		}
+		if prev != nil {
+			prev[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+func (m *memtable) get(key string) (lsmEntry, bool) {
+	node := m.seek(key, nil)
+	if node == nil || node.entry.key != key {
+		return lsmEntry{}, false
+	}
+	return node.entry, true
+}
+
+// put stores a version of a key, replacing the one the memtable holds.
+func (m *memtable) put(e lsmEntry) {
+	prev := make([]*memtableNode, memtableMaxHeight)
+	node := m.seek(e.key, prev)
+	if node != nil && node.entry.key == e.key {
+		m.size += e.size() - node.entry.size()
+		node.entry = e
+		return
+	}
+
+	height := 1
+	for height < memtableMaxHeight && rand.Intn(4) == 0 {
+		height++
+	}
+	for ; m.height < height; m.height++ {
+		prev[m.height] = m.head
+	}
+	node = &memtableNode{entry: e, next: make([]*memtableNode, height)}
+	for level := 0; level < height; level++ {
+		node.next[level] = prev[level].next[level]
+		prev[level].next[level] = node
+	}
+	m.count++
+	m.size += e.size()
+}
+
+// random returns the key of a random entry whose key is at least from and less than to, false when there is none.
+// It walks the entries of the range.
+func (m *memtable) random(from, to string) (string, bool) {
+	var keys []string
+	for node := m.seek(from, nil); node != nil && node.entry.key < to; node = node.next[0] {
+		keys = append(keys, node.entry.key)
+	}
+	if len(keys) == 0 {
+		return "", false
+	}
+	return keys[rand.Intn(len(keys))], true
+}
+
+func (m *memtable) iterator(start string) lsmIterator {
+	return &memtableIterator{node: m.seek(start, nil)}
+}
+
+// lsmIterator iterates over the entries of a memtable or of tables in the order of their key, starting from the
+// first entry it is positioned on.
+type lsmIterator interface {
+	// valid reports whether the iterator is positioned on an entry, false once exhausted or after an error.
+	valid() bool
+	entry() lsmEntry
+	next()
+	err() error
+}
+
+type memtableIterator struct {
+	node *memtableNode
+}
+
+func (it *memtableIterator) valid() bool     { return it.node != nil }
+func (it *memtableIterator) entry() lsmEntry { return it.node.entry }
+func (it *memtableIterator) next()           { it.node = it.node.next[0] }
+func (it *memtableIterator) err() error      { return nil }
+
+// mergingIterator merges iterators each holding at most one version of a key, and returns only the version of
+// every key having the highest sequence number.
+type mergingIterator struct {
+	heap    iteratorHeap
+	current lsmEntry
+	ok      bool
+	e       error
+}
+
+func newMergingIterator(children ...lsmIterator) *mergingIterator {
+	m := &mergingIterator{}
+	for _, child := range children {
+		if child.valid() {
+			m.heap = append(m.heap, child)
+		} else if err := child.err(); err != nil {
+			m.e = err
+		}
+	}
+	heap.Init(&m.heap)
+	m.next()
+	return m
+}
+
+func (m *mergingIterator) valid() bool     { return m.ok }
+func (m *mergingIterator) entry() lsmEntry { return m.current }
+func (m *mergingIterator) err() error      { return m.e }
+
+// next moves to the newest version of the next key, moving every iterator positioned on the current key.
+func (m *mergingIterator) next() {
+	m.ok = false
+	if m.e != nil || len(m.heap) == 0 {
+		return
+	}
+	m.current, m.ok = m.heap[0].entry(), true
+	for len(m.heap) > 0 && m.heap[0].entry().key == m.current.key {
+		child := m.heap[0]
+		child.next()
+		if child.valid() {
+			heap.Fix(&m.heap, 0)
+			continue
+		}
+		if err := child.err(); err != nil {
+			m.e, m.ok = err, false
+			return
+		}
+		heap.Pop(&m.heap)
+	}
+}
+
+// iteratorHeap orders iterators by the key of their entry, then by decreasing sequence number.
+type iteratorHeap []lsmIterator
+
+func (h iteratorHeap) Len() int { return len(h) }
+
+func (h iteratorHeap) Less(a, b int) bool {
+	ea, eb := h[a].entry(), h[b].entry()
+	if ea.key != eb.key {
+		return ea.key < eb.key
+	}
+	return ea.seq > eb.seq
+}
+
+func (h iteratorHeap) Swap(a, b int) { h[a], h[b] = h[b], h[a] }
+
+func (h *iteratorHeap) Push(x any) { *h = append(*h, x.(lsmIterator)) }
+
+func (h *iteratorHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
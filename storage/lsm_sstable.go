@@ -0,0 +1,517 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// Files of an LSM-tree storage directory, named after their identifier: the WAL files backing the memtable and
+// the tables. The directory also holds a manifest listing the tables of every level.
+const (
+	walExt   = ".log"
+	tableExt = ".sst"
+)
+
+// A table holds entries sorted by key, at most one per key, in data blocks followed by an index block, a bloom
+// filter and a footer:
+//
+//	data blocks | index block | bloom filter | footer
+//
+// Every entry of a data block is encoded as
+//
+//	key length (uvarint) | key | seq (uvarint) | expireAt (varint) | flags (1) | value length (uvarint) | value
+//
+// flags holding recordTombstone for a tombstone. The index block holds the smallest key of the table, then the
+// last key, offset and size of every data block. The footer holds the offset and size of the index block and of
+// the bloom filter, the highest sequence number of the table and tableMagic, as big-endian integers. Every block
+// ends with the big-endian CRC-32 (IEEE) of its content.
+const (
+	tableFooterSize        = 48
+	tableMagic      uint64 = 0x6b766462_6c736d31
+)
+
+var errCorruptTable = errors.New("corrupt table")
+
+// blockHandle locates a block of a table, its size counting its checksum.
+type blockHandle struct {
+	lastKey string
+	offset  int64
+	size    int64
+}
+
+// sstable is an immutable table of an LSM-tree storage, whose index and bloom filter are kept in memory so that
+// reading a key takes at most one read.
+type sstable struct {
+	id                uint32
+	file              *os.File
+	size              int64
+	smallest, largest string
+	maxSeq            uint64
+	index             []blockHandle
+	bloom             bloomFilter
+}
+
+func (t *sstable) overlaps(smallest, largest string) bool {
+	return t.smallest <= largest && smallest <= t.largest
+}
+
+// findBlock returns the index of the first block whose last key is not less than key, len(t.index) when there
+// is none.
+func (t *sstable) findBlock(key string) int {
+	return sort.Search(len(t.index), func(j int) bool { return t.index[j].lastKey >= key })
+}
+
+func (t *sstable) readBlock(j int) ([]lsmEntry, error) {
+	data, err := readChecksummed(t.file, t.index[j].offset, t.index[j].size)
+	if err != nil {
+		return nil, err
+	}
+	var entries []lsmEntry
+	for len(data) > 0 {
+		e, n := decodeTableEntry(data)
+		if n <= 0 {
+			return nil, errCorruptTable
+		}
+		entries = append(entries, e)
+		data = data[n:]
+	}
+	return entries, nil
+}
+
+// get returns the entry of a key, false when the table does not hold it.
+func (t *sstable) get(key string) (lsmEntry, bool, error) {
+	if key < t.smallest || key > t.largest || !t.bloom.mayContain(key) {
+		return lsmEntry{}, false, nil
+	}
+	j := t.findBlock(key)
+	if j == len(t.index) {
+		return lsmEntry{}, false, nil
+	}
+	entries, err := t.readBlock(j)
+	if err != nil {
+		return lsmEntry{}, false, err
+	}
+	n := sort.Search(len(entries), func(n int) bool { return entries[n].key >= key })
+	if n == len(entries) || entries[n].key != key {
+		return lsmEntry{}, false, nil
+	}
+	return entries[n], true, nil
+}
+
+// random returns the key of a random entry of a random block holding keys at least from and less than to,
+// false when the block holds none.
+func (t *sstable) random(from, to string) (string, bool, error) {
+	first, last := t.findBlock(from), min(t.findBlock(to), len(t.index)-1)
+	if first > last {
+		return "", false, nil
+	}
+	entries, err := t.readBlock(first + rand.Intn(last-first+1))
+	if err != nil {
+		return "", false, err
+	}
+	var keys []string
+	for _, e := range entries {
+		if e.key >= from && e.key < to {
+			keys = append(keys, e.key)
+		}
+	}
+	if len(keys) == 0 {
+		return "", false, nil
+	}
+	return keys[rand.Intn(len(keys))], true, nil
+}
+
+func (t *sstable) iterator(start string) lsmIterator {
+	it := &tableIterator{table: t, block: t.findBlock(start)}
+	it.load()
+	for it.valid() && it.entries[it.pos].key < start {
+		it.pos++
+	}
+	return it
+}
+
+// tableIterator iterates over the entries of a table, reading one block at a time.
+type tableIterator struct {
+	table   *sstable
+	block   int
+	entries []lsmEntry
+	pos     int
+	e       error
+}
+
+func (it *tableIterator) load() {
+	it.entries, it.pos = nil, 0
+	if it.block < len(it.table.index) {
+		it.entries, it.e = it.table.readBlock(it.block)
+	}
+}
+
+func (it *tableIterator) valid() bool     { return it.e == nil && it.pos < len(it.entries) }
+func (it *tableIterator) entry() lsmEntry { return it.entries[it.pos] }
+func (it *tableIterator) err() error      { return it.e }
+
+func (it *tableIterator) next() {
+	if it.pos++; it.pos == len(it.entries) {
+		it.block++
+		it.load()
+	}
+}
+
+// levelIterator iterates over the tables of a level other than level 0, which are sorted and do not overlap,
+// opening a table once the previous one is exhausted.
+type levelIterator struct {
+	tables  []*sstable
+	index   int
+	current lsmIterator
+}
+
+func newLevelIterator(tables []*sstable, start string) lsmIterator {
+	index := sort.Search(len(tables), func(j int) bool { return tables[j].largest >= start })
+	it := &levelIterator{tables: tables, index: index}
+	if index < len(tables) {
+		it.current = tables[index].iterator(start)
+	}
+	return it
+}
+
+func (it *levelIterator) valid() bool     { return it.current != nil && it.current.valid() }
+func (it *levelIterator) entry() lsmEntry { return it.current.entry() }
+
+func (it *levelIterator) err() error {
+	if it.current == nil {
+		return nil
+	}
+	return it.current.err()
+}
+
+func (it *levelIterator) next() {
+	it.current.next()
+	if !it.current.valid() && it.current.err() == nil && it.index+1 < len(it.tables) {
+		it.index++
+		it.current = it.tables[it.index].iterator("")
+	}
+}
+
+// tableWriter writes a new table, whose entries must be added in the order of their key.
+type tableWriter struct {
+	id        uint32
+	path      string
+	file      *os.File
+	writer    *bufio.Writer
+	blockSize int
+	offset    int64
+	block     []byte
+	smallest  string
+	lastKey   string
+	index     []blockHandle
+	hashes    []uint64
+	maxSeq    uint64
+}
+
+func createTable(dir string, id uint32, blockSize int) (*tableWriter, error) {
+	path := segmentPath(dir, id, tableExt)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{id: id, path: path, file: file, writer: bufio.NewWriterSize(file, 64<<10), blockSize: blockSize}, nil
+}
+
+// size returns the number of bytes written so far.
+func (w *tableWriter) size() int64 {
+	return w.offset + int64(len(w.block))
+}
+
+func (w *tableWriter) add(e lsmEntry) error {
+	if len(w.hashes) == 0 {
+		w.smallest = e.key
+	}
+	flags := byte(0)
+	if e.tombstone {
+		flags = recordTombstone
+	}
+	w.block = binary.AppendUvarint(w.block, uint64(len(e.key)))
+	w.block = append(w.block, e.key...)
+	w.block = binary.AppendUvarint(w.block, e.seq)
+	w.block = binary.AppendVarint(w.block, e.expireAt)
+	w.block = append(w.block, flags)
+	w.block = binary.AppendUvarint(w.block, uint64(len(e.value)))
+	w.block = append(w.block, e.value...)
+	w.lastKey, w.maxSeq = e.key, max(w.maxSeq, e.seq)
+	w.hashes = append(w.hashes, bloomHash(e.key))
+	if len(w.block) >= w.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+func (w *tableWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	h, err := w.writeBlock(w.block)
+	if err != nil {
+		return err
+	}
+	h.lastKey = w.lastKey
+	w.index = append(w.index, h)
+	w.block = w.block[:0]
+	return nil
+}
+
+// writeBlock writes a block followed by its checksum and returns where it is.
+func (w *tableWriter) writeBlock(data []byte) (blockHandle, error) {
+	data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+	if _, err := w.writer.Write(data); err != nil {
+		return blockHandle{}, err
+	}
+	h := blockHandle{offset: w.offset, size: int64(len(data))}
+	w.offset += h.size
+	return h, nil
+}
+
+// finish writes the index block, the bloom filter and the footer, flushes the table to disk and returns it open
+// for reading. At least one entry must have been added.
+func (w *tableWriter) finish() (*sstable, error) {
+	if err := w.flushBlock(); err != nil {
+		return nil, err
+	}
+	index := binary.AppendUvarint(nil, uint64(len(w.smallest)))
+	index = append(index, w.smallest...)
+	for _, h := range w.index {
+		index = binary.AppendUvarint(index, uint64(len(h.lastKey)))
+		index = append(index, h.lastKey...)
+		index = binary.AppendUvarint(index, uint64(h.offset))
+		index = binary.AppendUvarint(index, uint64(h.size))
+	}
+	indexHandle, err := w.writeBlock(index)
+	if err != nil {
+		return nil, err
+	}
+	bloom := newBloomFilter(w.hashes)
+	bloomHandle, err := w.writeBlock(append([]byte(nil), bloom...))
+	if err != nil {
+		return nil, err
+	}
+
+	footer := make([]byte, 0, tableFooterSize)
+	for _, n := range []uint64{
+		uint64(indexHandle.offset), uint64(indexHandle.size), uint64(bloomHandle.offset), uint64(bloomHandle.size),
+		w.maxSeq, tableMagic,
+	} {
+		footer = binary.BigEndian.AppendUint64(footer, n)
+	}
+	if _, err := w.writer.Write(footer); err != nil {
+		return nil, err
+	}
+	if err := w.writer.Flush(); err != nil {
+		return nil, err
+	}
+	if err := w.file.Sync(); err != nil {
+		return nil, err
+	}
+	return &sstable{
+		id: w.id, file: w.file, size: w.offset + tableFooterSize, smallest: w.smallest, largest: w.lastKey,
+		maxSeq: w.maxSeq, index: w.index, bloom: bloom,
+	}, nil
+}
+
+// abort closes and removes the table being written.
+func (w *tableWriter) abort() {
+	_ = w.file.Close()
+	_ = os.Remove(w.path)
+}
+
+// openTable opens a table and reads its index and bloom filter.
+func openTable(dir string, id uint32) (*sstable, error) {
+	file, err := os.Open(segmentPath(dir, id, tableExt))
+	if err != nil {
+		return nil, err
+	}
+	t, err := readTable(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	t.id = id
+	return t, nil
+}
+
+func readTable(file *os.File) (*sstable, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < tableFooterSize {
+		return nil, errCorruptTable
+	}
+	footer := make([]byte, tableFooterSize)
+	if _, err := file.ReadAt(footer, size-tableFooterSize); err != nil {
+		return nil, err
+	}
+	fields := make([]int64, 6)
+	for j := range fields {
+		fields[j] = int64(binary.BigEndian.Uint64(footer[8*j:]))
+	}
+	if uint64(fields[5]) != tableMagic {
+		return nil, errCorruptTable
+	}
+	for _, h := range [][2]int64{{fields[0], fields[1]}, {fields[2], fields[3]}} {
+		if h[0] < 0 || h[1] < 4 || h[0]+h[1] > size-tableFooterSize {
+			return nil, errCorruptTable
+		}
+	}
+
+	t := &sstable{file: file, size: size, maxSeq: uint64(fields[4])}
+	index, err := readChecksummed(file, fields[0], fields[1])
+	if err != nil {
+		return nil, err
+	}
+	smallest, n := decodeString(index)
+	if n <= 0 {
+		return nil, errCorruptTable
+	}
+	t.smallest, index = smallest, index[n:]
+	for len(index) > 0 {
+		var h blockHandle
+		if h.lastKey, n = decodeString(index); n <= 0 {
+			return nil, errCorruptTable
+		}
+		index = index[n:]
+		offset, n := binary.Uvarint(index)
+		if n <= 0 {
+			return nil, errCorruptTable
+		}
+		index = index[n:]
+		blockSize, n := binary.Uvarint(index)
+		if n <= 0 {
+			return nil, errCorruptTable
+		}
+		index = index[n:]
+		h.offset, h.size = int64(offset), int64(blockSize)
+		t.index = append(t.index, h)
+	}
+	if len(t.index) == 0 {
+		return nil, errCorruptTable
+	}
+	t.largest = t.index[len(t.index)-1].lastKey
+
+	bloom, err := readChecksummed(file, fields[2], fields[3])
+	if err != nil {
+		return nil, err
+	}
+	t.bloom = bloom
+	return t, nil
+}
+
+// readChecksummed reads a block of a table and checks its checksum, it returns the block without it.
+func readChecksummed(file *os.File, offset, size int64) ([]byte, error) {
+	if size < 4 {
+		return nil, errCorruptTable
+	}
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	data, sum := data[:size-4], data[size-4:]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(sum) {
+		return nil, errCorruptTable
+	}
+	return data, nil
+}
+
+// decodeString decodes a string prefixed by its length, it returns the number of bytes read, 0 when data is
+// too short.
+func decodeString(data []byte) (string, int) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < length {
+		return "", 0
+	}
+	return string(data[n : n+int(length)]), n + int(length)
+}
+
+// decodeTableEntry decodes the first entry of a data block, it returns the number of bytes read, 0 when the
+// entry is corrupt.
+func decodeTableEntry(data []byte) (lsmEntry, int) {
+	var e lsmEntry
+	key, read := decodeString(data)
+	if read <= 0 {
+		return e, 0
+	}
+	e.key = key
+	seq, n := binary.Uvarint(data[read:])
+	if n <= 0 {
+		return e, 0
+	}
+	read += n
+	expireAt, n := binary.Varint(data[read:])
+	if n <= 0 || read+n >= len(data) {
+		return e, 0
+	}
+	read += n
+	e.seq, e.expireAt, e.tombstone = seq, expireAt, data[read]&recordTombstone != 0
+	read++
+	length, n := binary.Uvarint(data[read:])
+	if n <= 0 || uint64(len(data)-read-n) < length {
+		return e, 0
+	}
+	read += n
+	e.value = data[read : read+int(length)]
+	return e, read + int(length)
+}
+
+// bloomFilter tells whether a table may hold a key, with bloomBitsPerKey bits per key of the table probed
+// bloomProbes times through double hashing, which makes about 1% of false positives.
+type bloomFilter []byte
+
+const (
+	bloomBitsPerKey = 10
+	bloomProbes     = 7
+)
+
+// bloomHash returns the 64-bit FNV-1a hash of a key.
+func bloomHash(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for j := 0; j < len(key); j++ {
+		h ^= uint64(key[j])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func newBloomFilter(hashes []uint64) bloomFilter {
+	bits := max(len(hashes)*bloomBitsPerKey, 64)
+	f := make(bloomFilter, (bits+7)/8)
+	for _, h := range hashes {
+		f.probe(h, func(bit uint64) bool {
+			f[bit/8] |= 1 << (bit % 8)
+			return true
+		})
+	}
+	return f
+}
+
+// probe calls fn with the bits of a hash until it returns false, and reports whether it never did.
+func (f bloomFilter) probe(h uint64, fn func(bit uint64) bool) bool {
+	bits := uint64(len(f)) * 8
+	h1, h2 := h&0xffffffff, h>>32
+	for j := uint64(0); j < bloomProbes; j++ {
+		if !fn((h1 + j*h2) % bits) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f bloomFilter) mayContain(key string) bool {
+	if len(f) == 0 {
+		return true
+	}
+	return f.probe(bloomHash(key), func(bit uint64) bool { return f[bit/8]&(1<<(bit%8)) != 0 })
+}
@@ -0,0 +1,592 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smallLSMOptions makes the storage flush and compact after a few writes.
+var smallLSMOptions = LSMOptions{MemtableSize: 1024, TableSize: 1024, BlockSize: 128, L0Tables: 2, LevelSize: 2048}
+
+func openLSM(t *testing.T, dir string, dbCount int, options LSMOptions) *lsmStorage {
+	t.Helper()
+	options.Codec = testCodec{}
+	s, err := OpenLSMStorage(dir, dbCount, options)
+	if err != nil {
+		t.Fatalf("OpenLSMStorage() error = %v", err)
+	}
+	return s.(*lsmStorage)
+}
+
+// TestLSMStorage_MatchesInMemory checks the LSM-tree storage against the in-memory one while compacting its
+// tables.
+func TestLSMStorage_MatchesInMemory(t *testing.T) {
+	dir := t.TempDir()
+	testMatchesInMemory(t, func() Storage {
+		return openLSM(t, dir, 3, smallLSMOptions)
+	}, func(s Storage) error {
+		l := s.(*lsmStorage)
+		l.checkSizes(t)
+		err := l.compact()
+		l.checkSizes(t)
+		return err
+	})
+}
+
+// checkSizes checks that the number of keys of every database counted by the storage is the number of keys with a
+// version that is not removed.
+func (l *lsmStorage) checkSizes(t *testing.T) {
+	t.Helper()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for dbIndex, db := range l.physical {
+		want := 0
+		it := l.iterator(internalKey(db, ""))
+		for ; it.valid() && it.entry().key < internalKey(db+1, ""); it.next() {
+			if !it.entry().tombstone {
+				want++
+			}
+		}
+		if l.sizes[dbIndex] != want {
+			t.Fatalf("lsm.Size(%d) = %d, want %d", dbIndex, l.sizes[dbIndex], want)
+		}
+	}
+}
+
+func TestLSMStorage_Range(t *testing.T) {
+	dir := t.TempDir()
+	s := openLSM(t, dir, 2, smallLSMOptions)
+	defer s.Close()
+
+	// The keys are spread over the memtable and the tables of several levels, some of them overwritten or removed
+	want := make(map[string]any)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key_%03d", r.Intn(300))
+		switch i % 5 {
+		case 0:
+			_ = s.Delete(0, key)
+			delete(want, key)
+		default:
+			_ = s.Set(0, key, i)
+			want[key] = i
+		}
+		_ = s.Set(1, key, "other")
+		if i%400 == 0 {
+			if err := s.compact(); err != nil {
+				t.Fatalf("lsm.compact() error = %v", err)
+			}
+		}
+	}
+	_ = s.SetWithExpiry(0, "key_000", "expired", now().Add(-time.Second))
+	delete(want, "key_000")
+	if levels := s.levelCount(); levels < 2 {
+		t.Fatalf("Levels holding tables = %d, want at least 2", levels)
+	}
+
+	var keys []string
+	for key := range want {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var got []string
+	err := s.Range(0, "", "", func(e Entry) bool {
+		if e.Value != want[e.Key] {
+			t.Errorf("lsm.Range() entry %s = %v, want %v", e.Key, e.Value, want[e.Key])
+		}
+		got = append(got, e.Key)
+		return true
+	})
+	if err != nil || !reflect.DeepEqual(got, keys) {
+		t.Fatalf("lsm.Range() keys = %v, %v, want %v", got, err, keys)
+	}
+
+	// Bounds and early stop
+	got = nil
+	_ = s.Range(0, "key_100", "key_200", func(e Entry) bool {
+		got = append(got, e.Key)
+		return len(got) < 5
+	})
+	var bounded []string
+	for _, key := range keys {
+		if key >= "key_100" && key < "key_200" && len(bounded) < 5 {
+			bounded = append(bounded, key)
+		}
+	}
+	if !reflect.DeepEqual(got, bounded) {
+		t.Errorf("lsm.Range(key_100, key_200) stopped after 5 = %v, want %v", got, bounded)
+	}
+
+	// Scan pages follow the order of the keys
+	got = nil
+	cursor := uint64(0)
+	for {
+		page, next, err := s.Scan(0, cursor, 7)
+		if err != nil {
+			t.Fatalf("lsm.Scan() error = %v", err)
+		}
+		for _, e := range page {
+			got = append(got, e.Key)
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	if !reflect.DeepEqual(got, keys) {
+		t.Errorf("lsm.Scan() keys = %v, want %v", got, keys)
+	}
+	if _, _, err := s.Scan(1, cursor, 7); !errors.Is(err, errInvalidCursor) {
+		t.Errorf("lsm.Scan() with a cursor of another database error = %v, want %v", err, errInvalidCursor)
+	}
+	if key, ok := s.RandomKey(0); !ok || want[key] == nil {
+		t.Errorf("lsm.RandomKey() = %q, %v, want an existing key", key, ok)
+	}
+
+	// The expired key is counted until the compaction of the last level removes it
+	if got := s.Size(0); got != len(keys)+1 {
+		t.Errorf("lsm.Size() = %d, want %d", got, len(keys)+1)
+	}
+	if err := s.compactAll(); err != nil {
+		t.Fatalf("lsm.compactAll() error = %v", err)
+	}
+	if got := s.Size(0); got != len(keys) {
+		t.Errorf("lsm.Size() after compacting all levels = %d, want %d", got, len(keys))
+	}
+}
+
+// levelCount returns the number of levels holding tables.
+func (l *lsmStorage) levelCount() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	count := 0
+	for _, tables := range l.levels {
+		if len(tables) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func TestLSMStorage_Compaction(t *testing.T) {
+	dir := t.TempDir()
+	s := openLSM(t, dir, 2, smallLSMOptions)
+
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 50; i++ {
+			_ = s.Set(i%2, fmt.Sprintf("key_%02d", i), fmt.Sprintf("value_%d_%d", i, round))
+		}
+	}
+	for i := 0; i < 50; i += 3 {
+		_ = s.Delete(i%2, fmt.Sprintf("key_%02d", i))
+	}
+	_ = s.Flush(1)
+	_ = s.Set(1, "list", testList{"a", "b"})
+	want := dumpStorage(t, s)
+	if err := s.compact(); err != nil {
+		t.Fatalf("lsm.compact() error = %v", err)
+	}
+
+	s.mu.RLock()
+	if len(s.levels[0]) >= smallLSMOptions.L0Tables {
+		t.Errorf("Tables of level 0 after compaction = %d, want fewer than %d", len(s.levels[0]), smallLSMOptions.L0Tables)
+	}
+	tables, live := 0, 0
+	for level, run := range s.levels[1:] {
+		for j := 1; j < len(run); j++ {
+			if run[j-1].largest >= run[j].smallest {
+				t.Errorf("Tables %d and %d of level %d overlap", run[j-1].id, run[j].id, level+1)
+			}
+		}
+	}
+	for _, level := range s.levels {
+		tables += len(level)
+	}
+	s.mu.RUnlock()
+	if got := dumpStorage(t, s); !reflect.DeepEqual(got, want) {
+		t.Errorf("LSM-tree storage after compaction = %v, want %v", got, want)
+	}
+
+	// The tables hold neither the overwritten values nor the flushed database, and the manifest lists them all
+	for _, path := range segmentIDs(t, dir, tableExt) {
+		id, _ := strconv.ParseUint(strings.TrimSuffix(path, tableExt), 10, 32)
+		table, err := openTable(dir, uint32(id))
+		if err != nil {
+			t.Fatalf("openTable() error = %v", err)
+		}
+		for it := table.iterator(""); it.valid(); it.next() {
+			live++
+		}
+		_ = table.file.Close()
+	}
+	if files := len(segmentIDs(t, dir, tableExt)); files != tables {
+		t.Errorf("Table files after compaction = %d, want the %d tables of the levels", files, tables)
+	}
+	if live >= 500 {
+		t.Errorf("Entries of the tables after compaction = %d, want far fewer than the 1000 values written", live)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("lsm.Close() error = %v", err)
+	}
+	s = openLSM(t, dir, 2, smallLSMOptions)
+	defer s.Close()
+	if got := dumpStorage(t, s); !reflect.DeepEqual(got, want) {
+		t.Errorf("LSM-tree storage reopened after compaction = %v, want %v", got, want)
+	}
+}
+
+// TestLSMStorage_TornWAL cuts the WAL at every offset, standing for a crash in the middle of a write, and checks
+// that the storage then holds the writes completed before the cut, each batch entirely or not at all.
+func TestLSMStorage_TornWAL(t *testing.T) {
+	dir := t.TempDir()
+	s := openLSM(t, dir, 2, LSMOptions{})
+	writes := []func(){
+		func() { _ = s.Set(0, "a", "1") },
+		func() {
+			_ = s.MSet(0, []Entry{{Key: "b", Value: 2}, {Key: "c", Value: testList{"x"}}, {Key: "d", Value: "4"}})
+		},
+		func() { _ = s.Delete(0, "a") },
+		func() { _ = s.DeleteKeys(0, "b", "c") },
+		func() { _, _ = s.Move(0, "d", 1) },
+		func() { _ = s.SetWithExpiry(0, "e", "5", now().Add(time.Hour)) },
+	}
+	// states[n] holds the entries once the first n writes are complete, sizes[n] the size of the WAL
+	states := []map[string]Entry{dumpStorage(t, s)}
+	sizes := []int64{0}
+	for _, write := range writes {
+		write()
+		states = append(states, dumpStorage(t, s))
+		sizes = append(sizes, s.wal.size)
+	}
+	walPath := segmentPath(dir, s.wal.id, walExt)
+	if err := s.Close(); err != nil {
+		t.Fatalf("lsm.Close() error = %v", err)
+	}
+	wal, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for cut := 0; cut <= len(wal); cut++ {
+		crashed := t.TempDir()
+		if err := os.WriteFile(filepath.Join(crashed, manifestName), manifest, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(crashed, filepath.Base(walPath)), wal[:cut], 0644); err != nil {
+			t.Fatal(err)
+		}
+		complete := 0
+		for complete+1 < len(sizes) && sizes[complete+1] <= int64(cut) {
+			complete++
+		}
+		reopened := openLSM(t, crashed, 2, LSMOptions{})
+		if got := dumpStorage(t, reopened); !reflect.DeepEqual(got, states[complete]) {
+			t.Errorf("LSM-tree storage with the WAL cut at %d = %v, want %v", cut, got, states[complete])
+		}
+		_ = reopened.Close()
+	}
+}
+
+// crashDirEnv names the directory of the storage written by the child process of TestLSMStorage_CrashRecovery.
+const crashDirEnv = "KVDB_LSM_CRASH_DIR"
+
+// crashWrite is the write number i of TestLSMStorage_CrashRecovery: it sets or removes a pair of keys as one
+// batch, then records i under "last".
+func crashWrite(s Storage, i int) error {
+	k := i % 20
+	keys := []string{fmt.Sprintf("a_%d", k), fmt.Sprintf("b_%d", k)}
+	if i%7 == 3 {
+		s.DeleteKeys(0, keys...)
+	} else if err := s.MSet(0, []Entry{{Key: keys[0], Value: i}, {Key: keys[1], Value: fmt.Sprintf("%040d", i)}}); err != nil {
+		return err
+	}
+	return s.Set(0, "last", i)
+}
+
+// crashExpected returns the value of a_k once the first n writes of TestLSMStorage_CrashRecovery are complete,
+// nil when the key does not exist.
+func crashExpected(k, n int) any {
+	for i := n; i > 0; i-- {
+		if i%20 == k {
+			if i%7 == 3 {
+				return nil
+			}
+			return i
+		}
+	}
+	return nil
+}
+
+// runCrashWriter writes until the process is killed, printing the number of every write once acknowledged.
+func runCrashWriter(dir string) {
+	options := smallLSMOptions
+	options.SyncWrites, options.Codec = true, testCodec{}
+	s, err := OpenLSMStorage(dir, 1, options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	last, _ := s.Get(0, "last")
+	i, _ := last.(int)
+	for i++; ; i++ {
+		if err := crashWrite(s, i); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("ack %d\n", i)
+	}
+}
+
+// TestLSMStorage_CrashRecovery kills a process writing to the storage at random points, during writes, flushes
+// and compactions, and checks every time that the storage holds every acknowledged write and a consistent prefix
+// of the writes.
+func TestLSMStorage_CrashRecovery(t *testing.T) {
+	if dir := os.Getenv(crashDirEnv); dir != "" {
+		runCrashWriter(dir)
+		return
+	}
+	if testing.Short() {
+		t.Skip("skipping crash recovery test in short mode")
+	}
+
+	dir := t.TempDir()
+	r := rand.New(rand.NewSource(1))
+	acked := 0
+	for round := 0; round < 12; round++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestLSMStorage_CrashRecovery$")
+		cmd.Env = append(os.Environ(), crashDirEnv+"="+dir)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		lastAck := make(chan int)
+		go func() {
+			last := acked
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				if n, err := strconv.Atoi(strings.TrimPrefix(scanner.Text(), "ack ")); err == nil {
+					last = n
+				}
+			}
+			lastAck <- last
+		}()
+
+		select {
+		case <-time.After(time.Duration(50+r.Intn(200)) * time.Millisecond):
+			_ = cmd.Process.Kill()
+			acked = <-lastAck
+			_ = cmd.Wait()
+		case <-lastAck:
+			_ = cmd.Wait()
+			t.Fatalf("Writer exited before being killed: %s", stderr.String())
+		}
+
+		s := openLSM(t, dir, 1, LSMOptions{})
+		value, _ := s.Get(0, "last")
+		last, _ := value.(int)
+		if last < acked || last > acked+1 {
+			t.Fatalf("Last write after a crash = %d, want %d or the next one", last, acked)
+		}
+		entries := dumpStorage(t, s)
+		keys := 1
+		for k := 0; k < 20; k++ {
+			a, b := entries[fmt.Sprintf("0/a_%d", k)].Value, entries[fmt.Sprintf("0/b_%d", k)].Value
+			want := crashExpected(k, last)
+			// The batch of the next write may be complete without the write of "last"
+			if a != want && (last+1)%20 == k {
+				want = crashExpected(k, last+1)
+			}
+			if a != want {
+				t.Fatalf("a_%d after a crash at write %d = %v, want %v", k, last, a, want)
+			}
+			if a != nil {
+				keys += 2
+				if b != fmt.Sprintf("%040d", a) {
+					t.Fatalf("b_%d after a crash at write %d = %v, want it set along with a_%d = %v", k, last, b, k, a)
+				}
+			}
+		}
+		if len(entries) != keys {
+			t.Fatalf("Keys after a crash at write %d = %d, want %d", last, len(entries), keys)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("lsm.Close() error = %v", err)
+		}
+	}
+	if acked < 100 {
+		t.Errorf("Acknowledged writes = %d, want the writer to flush and compact the storage", acked)
+	}
+}
+
+func TestOpenLSMStorage_Errors(t *testing.T) {
+	dir := t.TempDir()
+	s := openLSM(t, dir, 4, smallLSMOptions)
+	if err := s.Set(0, "key", 1.5); err == nil {
+		t.Errorf("lsm.Set() of a value the codec does not support returned no error")
+	}
+	for i := 0; i < 100; i++ {
+		_ = s.Set(0, fmt.Sprintf("key_%d", i), i)
+	}
+	_ = s.Close()
+
+	if _, err := OpenLSMStorage(dir, 2, LSMOptions{}); err == nil {
+		t.Errorf("OpenLSMStorage() with fewer databases than the storage holds returned no error")
+	}
+	s = openLSM(t, dir, 8, smallLSMOptions)
+	if got := s.DbCount(); got != 8 {
+		t.Errorf("lsm.DbCount() after adding databases = %d, want 8", got)
+	}
+	_ = s.Close()
+
+	// A table listed by the manifest whose footer is corrupt
+	tables := segmentIDs(t, dir, tableExt)
+	path := filepath.Join(dir, tables[0])
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLSMStorage(dir, 8, LSMOptions{}); err == nil {
+		t.Errorf("OpenLSMStorage() with a corrupt table returned no error")
+	}
+}
+
+func TestLSMStorage_ConcurrentCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s := openLSM(t, dir, 2, smallLSMOptions)
+	writers, iterations := 4, 300
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				key := fmt.Sprintf("writer_%d_key_%d", writer, i%10)
+				_ = s.Set(writer%2, key, i)
+				if i%7 == 0 {
+					_ = s.Delete(writer%2, key)
+				}
+				_, _ = s.Update(0, "counter", func(value any, exists bool) (any, error) {
+					if !exists {
+						return 1, nil
+					}
+					return value.(int) + 1, nil
+				})
+			}
+		}(w)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if err := s.compact(); err != nil {
+				t.Errorf("lsm.compact() error = %v", err)
+			}
+			previous := ""
+			err := s.Range(1, "", "", func(e Entry) bool {
+				if e.Key <= previous {
+					t.Errorf("lsm.Range() returned %q after %q", e.Key, previous)
+				}
+				previous = e.Key
+				return true
+			})
+			if err != nil {
+				t.Errorf("lsm.Range() error = %v", err)
+			}
+		}
+	}()
+	wg.Wait()
+	<-done
+
+	want := dumpStorage(t, s)
+	if want["0/counter"].Value != writers*iterations {
+		t.Errorf("counter after concurrent compactions = %v, want %d", want["0/counter"].Value, writers*iterations)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("lsm.Close() error = %v", err)
+	}
+	s = openLSM(t, dir, 2, smallLSMOptions)
+	defer s.Close()
+	if got := dumpStorage(t, s); !reflect.DeepEqual(got, want) {
+		t.Errorf("LSM-tree storage reopened after concurrent compactions = %v, want %v", got, want)
+	}
+}
+
+// tableEntries returns the number of entries held by the table files of a directory.
+func tableEntries(t *testing.T, dir string) int {
+	t.Helper()
+	entries := 0
+	for _, path := range segmentIDs(t, dir, tableExt) {
+		id, _ := strconv.ParseUint(strings.TrimSuffix(path, tableExt), 10, 32)
+		table, err := openTable(dir, uint32(id))
+		if err != nil {
+			t.Fatalf("openTable() error = %v", err)
+		}
+		for it := table.iterator(""); it.valid(); it.next() {
+			entries++
+		}
+		_ = table.file.Close()
+	}
+	return entries
+}
+
+func TestLSMStorage_Reclaim(t *testing.T) {
+	dir := t.TempDir()
+	s := openLSM(t, dir, 2, smallLSMOptions)
+	defer s.Close()
+	for i := 0; i < 200; i++ {
+		_ = s.Set(i%2, fmt.Sprintf("key_%03d", i), "value")
+	}
+	_ = s.Delete(1, "key_001")
+	_ = s.Flush(0)
+
+	// The tables only hold the live keys once the space is reclaimed
+	if err := s.Reclaim(false); err != nil {
+		t.Fatalf("lsm.Reclaim() error = %v", err)
+	}
+	if got := tableEntries(t, dir); got != 99 {
+		t.Errorf("Entries of the tables after lsm.Reclaim() = %d, want the 99 live keys", got)
+	}
+	want := dumpStorage(t, s)
+	if len(want) != 99 {
+		t.Errorf("Keys after lsm.Reclaim() = %d, want 99", len(want))
+	}
+
+	_ = s.Flush(1)
+	if err := s.Reclaim(true); err != nil {
+		t.Fatalf("lsm.Reclaim() error = %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); tableEntries(t, dir) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Entries of the tables after an asynchronous lsm.Reclaim() = %d, want 0", tableEntries(t, dir))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,6 +1,9 @@
 package storage
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type KeyNotFoundError struct {
 	key string
@@ -10,11 +13,169 @@ func (k *KeyNotFoundError) Error() string {
 	return fmt.Sprintf("Key %q not found in storage", k.key)
 }
 
-// Storage Interface representing the underlying storage of the database
+// NewKeyNotFoundError returns the error reported when the given key does not exist.
+func NewKeyNotFoundError(key string) error {
+	return &KeyNotFoundError{key: key}
+}
+
+// UpdateFunc computes the new value of a key from its current value, if it exists.
+// Returning a nil value deletes the key, returning an error leaves it untouched.
+type UpdateFunc func(value any, exists bool) (any, error)
+
+// UpdateEntryFunc computes the new entry of a key from its current one, if it exists.
+// The key of the returned entry is ignored. Returning an entry with a nil value deletes the key,
+// returning an error leaves it untouched.
+type UpdateEntryFunc func(e Entry, exists bool) (Entry, error)
+
+// UpdateValuesFunc computes the new values of several keys from their current values, nil for the missing keys.
+// Returning a nil value deletes the key, returning an error leaves all of them untouched.
+type UpdateValuesFunc func(values []any) ([]any, error)
+
+// UpdateEntriesFunc computes the new entries of several keys from their current ones, the entries of the missing keys
+// having a nil value. The keys of the returned entries are ignored. Returning an entry with a nil value deletes
+// the key, returning an error leaves all of them untouched.
+type UpdateEntriesFunc func(entries []Entry) ([]Entry, error)
+
+// Cloner is implemented by the values modified in place by the commands holding the lock of their key, such as
+// lists. The storage clones them whenever it hands them out of the lock, e.g. from Scan and Iterate to snapshot the
+// databases, so that they can be read while the key is being modified.
+type Cloner interface {
+	Clone() any
+}
+
+// Codec encodes the values the storage does not know how to encode, for the storages keeping them on disk.
+type Codec interface {
+	Encode(value any) ([]byte, error)
+	Decode(data []byte) (any, error)
+}
+
+// Sizer is implemented by the values holding more memory than their length, such as lists. The storage accounts
+// for the memory of the keys from MemoryUsage, an estimate of the number of bytes held by the value that should
+// not depend on the number of its elements to compute.
+type Sizer interface {
+	MemoryUsage() int
+}
+
+// AccessInfo is the data tracked about the accesses to a key, from which the LRU and LFU policies pick the keys
+// to evict.
+type AccessInfo struct {
+	LastAccess time.Time
+	Frequency  int // Logarithmic access counter from 0 to 255, decayed by one every minute the key is not accessed
+}
+
+// Evictor is implemented by the storages bounding the memory held by their keys, which they evict according to
+// an eviction policy.
+type Evictor interface {
+	// SetMaxMemory sets the number of bytes the keys may hold, 0 for no limit, and how keys are evicted beyond it.
+	SetMaxMemory(maxMemory int64, policy EvictionPolicy)
+	// EvictionPolicy returns the policy set by SetMaxMemory.
+	EvictionPolicy() EvictionPolicy
+	// UsedMemory returns the estimated number of bytes held by the keys of all databases.
+	UsedMemory() int64
+	// Evict removes keys until the memory held by the keys is below the limit and calls fn with every removed key.
+	// It returns ErrOutOfMemory when the policy does not allow removing enough keys.
+	Evict(fn func(dbIndex int, key string)) error
+	// AccessInfo returns the access data of an existing key, without accessing it.
+	AccessInfo(dbIndex int, key string) (AccessInfo, error)
+}
+
+// Reclaimer is implemented by the storages holding on to the space of the removed keys until a background task
+// reclaims it.
+type Reclaimer interface {
+	// Reclaim releases the space still held by the removed keys before returning, or has the background task of the
+	// storage release it when async is true.
+	Reclaim(async bool) error
+}
+
+// OrderedStorage is implemented by the storages keeping the keys of every database sorted, which can iterate over
+// a range of keys in order.
+type OrderedStorage interface {
+	// Range calls fn with the entries of a database whose key is at least start and less than end, an empty end
+	// meaning no upper bound, in the order of their key until fn returns false. fn must neither modify the values
+	// nor use the storage.
+	Range(dbIndex int, start, end string, fn func(e Entry) bool) error
+}
+
+// Entry is a key-value pair along with its expiration time, which is zero when the key never expires.
+type Entry struct {
+	Key      string
+	Value    any
+	ExpireAt time.Time
+}
+
+// Storage Interface representing the underlying storage of the database.
+//
+// Implementations must be safe for concurrent use by multiple goroutines.
+// Expired keys behave exactly as if they did not exist.
 type Storage interface {
+	// Set sets the value of a key and removes its expiration time, if any.
 	Set(dbIndex int, key string, value any) error
+	// SetWithExpiry sets the value of a key that expires at the given time.
+	SetWithExpiry(dbIndex int, key string, value any, expireAt time.Time) error
 	Get(dbIndex int, key string) (any, error)
+	// View calls fn with the value of a key, if it exists, while no other goroutine modifies the key,
+	// which is how values modified in place are read. fn must not modify the value.
+	View(dbIndex int, key string, fn func(value any, exists bool) error) error
+	// ViewValues calls fn with the values of several keys, nil for the missing ones, while no other goroutine
+	// modifies them. fn must not modify the values.
+	ViewValues(dbIndex int, keys []string, fn func(values []any) error) error
 	Delete(dbIndex int, key string) error
-	FetchAll(dbIndex int) <-chan [2]any
+	// MSet atomically sets the values of several keys along with their expiration time.
+	MSet(dbIndex int, entries []Entry) error
+	// MSetNX atomically sets the values of several keys unless one of them exists, and reports whether it did.
+	MSetNX(dbIndex int, entries []Entry) (bool, error)
+	// MGet atomically returns the values of several keys, nil for the ones that do not exist.
+	MGet(dbIndex int, keys ...string) []any
+	// DeleteKeys atomically deletes several keys and returns the number of keys that existed.
+	DeleteKeys(dbIndex int, keys ...string) int
+	// Exists returns the number of the given keys that exist, a key given several times is counted as many times.
+	Exists(dbIndex int, keys ...string) int
+	// Update atomically replaces the value of a key with the one computed by fn and returns it.
+	// The expiration time of the key is kept.
+	Update(dbIndex int, key string, fn UpdateFunc) (any, error)
+	// UpdateValues atomically replaces the values of several keys with the ones computed by fn, keeping their
+	// expiration times. A key given several times gets the last of its new values.
+	UpdateValues(dbIndex int, keys []string, fn UpdateValuesFunc) error
+	// UpdateEntries atomically replaces the values and the expiration times of several keys with the ones
+	// computed by fn. A key given several times gets the last of its new entries.
+	UpdateEntries(dbIndex int, keys []string, fn UpdateEntriesFunc) error
+	// UpdateEntry atomically replaces the value and the expiration time of a key with the ones computed by fn
+	// and returns the new entry.
+	UpdateEntry(dbIndex int, key string, fn UpdateEntryFunc) (Entry, error)
+	// Expire sets the expiration time of an existing key, a time in the past deletes it.
+	Expire(dbIndex int, key string, expireAt time.Time) error
+	// Persist removes the expiration time of an existing key and reports whether it had one.
+	Persist(dbIndex int, key string) (bool, error)
+	// ExpireTime returns the expiration time of an existing key, zero when it never expires.
+	ExpireTime(dbIndex int, key string) (time.Time, error)
+	// Copy atomically copies the entry of a key to a key of a database, possibly the source one, unless the
+	// destination exists and replace is not set, and reports whether it did. Values implementing Cloner are cloned.
+	Copy(srcIndex int, src string, dstIndex int, dst string, replace bool) (bool, error)
+	// Move atomically moves the entry of a key to another database unless the key exists there, and reports whether
+	// it did.
+	Move(srcIndex int, key string, dstIndex int) (bool, error)
+	// Flush removes all the keys of a database.
+	Flush(dbIndex int) error
+	// Swap atomically exchanges the keys of two databases.
+	Swap(dbIndex1, dbIndex2 int) error
+	// Scan returns a page of at least count entries of a database, unless the iteration ends, starting at the given
+	// cursor, along with the cursor of the next page. A cursor of 0 starts an iteration and is returned once it is
+	// complete. Every key present in the database from the start of an iteration to its end is returned at least
+	// once, whatever is modified in the meantime. The values implementing Cloner are cloned.
+	Scan(dbIndex int, cursor uint64, count int) ([]Entry, uint64, error)
+	// Iterate calls fn with the entries of a database until fn returns false, leaving out the expired keys. Unlike
+	// Scan it keeps no state between calls, for the full passes over a database such as snapshots. The values
+	// implementing Cloner are cloned. fn must not use the storage.
+	Iterate(dbIndex int, fn func(e Entry) bool) error
+	// Keys calls fn with the keys of a database until fn returns false, leaving out the expired keys, without reading
+	// their values. fn must not use the storage.
+	Keys(dbIndex int, fn func(key string) bool) error
+	// RandomKey returns a random key of a database, false when it holds none.
+	RandomKey(dbIndex int) (string, bool)
+	// Size returns the number of keys of a database, counting the expired keys not removed yet.
+	Size(dbIndex int) int
 	Select(dbIndex string) (int, error)
+	DbCount() int
+	// Close releases the resources held by the storage, it must not be used afterwards.
+	Close() error
 }
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Types of the values stored in the records: strings and integers are encoded by the storage, the other
+// values by the codec.
+const (
+	valueString byte = iota
+	valueInt
+	valueCodec
+)
+
+// encodeValue encodes a value for the storages keeping the values on disk, through the codec unless it is a string
+// or an integer.
+func encodeValue(codec Codec, value any) ([]byte, error) {
+	switch v := value.(type) {
+	case string:
+		return append([]byte{valueString}, v...), nil
+	case int:
+		return binary.AppendVarint([]byte{valueInt}, int64(v)), nil
+	}
+	if codec == nil {
+		return nil, fmt.Errorf("unsupported value type %T without a codec", value)
+	}
+	data, err := codec.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{valueCodec}, data...), nil
+}
+
+func decodeValue(codec Codec, data []byte) (any, error) {
+	if len(data) == 0 {
+		return nil, errCorruptRecord
+	}
+	switch data[0] {
+	case valueString:
+		return string(data[1:]), nil
+	case valueInt:
+		v, n := binary.Varint(data[1:])
+		if n <= 0 || n != len(data)-1 {
+			return nil, errCorruptRecord
+		}
+		return int(v), nil
+	case valueCodec:
+		if codec == nil {
+			return nil, errors.New("cannot decode a value without a codec")
+		}
+		return codec.Decode(data[1:])
+	}
+	return nil, fmt.Errorf("unknown value type 0x%02x", data[0])
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
@@ -7,8 +7,10 @@ import (
 	"os"
 )
 
-func RunCLI(db domain.KeyValueDB) {
+func RunCLI(db *domain.KeyValueDB) {
 	reader := bufio.NewReader(os.Stdin)
+	session := db.NewSession()
+	defer db.CloseSession(session)
 
 	for {
 		fmt.Print("> ")
@@ -22,7 +24,7 @@ func RunCLI(db domain.KeyValueDB) {
 		if err != nil {
 			fmt.Println(err)
 		} else {
-			result := db.Execute(0, cmd)
+			result := db.Execute(session, cmd)
 			writer := bufio.NewWriter(os.Stdout)
 			PrintDbResult(writer, result)
 		}
@@ -3,6 +3,7 @@ package ui
 import (
 	"errors"
 	"kvdb/domain"
+	"reflect"
 	"testing"
 )
 
@@ -17,49 +18,49 @@ func Test_getCommand(t *testing.T) {
 		{
 			name:       "SET command - one word value",
 			input:      "SET key value",
-			want:       domain.Command{Keyword: "SET", Key: "key", Value: "value"},
+			want:       domain.Command{Keyword: "SET", Args: []string{"key", "value"}},
 			wantErrMsg: "",
 		},
 		{
 			name:       "SET command - argument with extra spaces",
 			input:      " SET  key  value ",
-			want:       domain.Command{Keyword: "SET", Key: "key", Value: "value"},
+			want:       domain.Command{Keyword: "SET", Args: []string{"key", "value"}},
 			wantErrMsg: "",
 		},
 		{
 			name:       "GET command - one word key",
 			input:      " GET key",
-			want:       domain.Command{Keyword: "GET", Key: "key"},
+			want:       domain.Command{Keyword: "GET", Args: []string{"key"}},
 			wantErrMsg: "",
 		},
 		{
 			name:       "GET command - lowercase keyword",
 			input:      " get key",
-			want:       domain.Command{Keyword: "GET", Key: "key"},
+			want:       domain.Command{Keyword: "GET", Args: []string{"key"}},
 			wantErrMsg: "",
 		},
 		{
 			name:       "GET command - multiword key in quotes",
 			input:      "GET \"multi key\"",
-			want:       domain.Command{Keyword: "GET", Key: "multi key"},
+			want:       domain.Command{Keyword: "GET", Args: []string{"multi key"}},
 			wantErrMsg: "",
 		},
 		{
 			name:       "GET command - multiword key with extra spaces in quotes",
 			input:      "GET \"multi  key\"",
-			want:       domain.Command{Keyword: "GET", Key: "multi  key"},
+			want:       domain.Command{Keyword: "GET", Args: []string{"multi  key"}},
 			wantErrMsg: "",
 		},
 		{
 			name:       "GET command - 5 word key with extra spaces in quotes",
 			input:      "GET \"one two  three four  key\"",
-			want:       domain.Command{Keyword: "GET", Key: "one two  three four  key"},
+			want:       domain.Command{Keyword: "GET", Args: []string{"one two  three four  key"}},
 			wantErrMsg: "",
 		},
 		{
 			name:       "SET command - multiword key and value in quotes",
 			input:      "SET \"multi word key\" \"multi word value\"",
-			want:       domain.Command{Keyword: "SET", Key: "multi word key", Value: "multi word value"},
+			want:       domain.Command{Keyword: "SET", Args: []string{"multi word key", "multi word value"}},
 			wantErrMsg: "",
 		},
 		{
@@ -69,16 +70,16 @@ func Test_getCommand(t *testing.T) {
 			wantErrMsg: "(error) ERR Syntax error: arguments has no closing quote",
 		},
 		{
-			name:       "SET command - syntax error",
-			input:      "SET key value1 value2",
-			want:       domain.Command{},
-			wantErrMsg: "(error) ERR Syntax error",
+			name:       "SET command - with options",
+			input:      "SET key value EX 10",
+			want:       domain.Command{Keyword: "SET", Args: []string{"key", "value", "EX", "10"}},
+			wantErrMsg: "",
 		},
 		{
-			name:       "SET command - syntax error - too many arguments",
+			name:       "SET command - multiword option in quotes",
 			input:      "SET \"multi word key\" \"multi word value1\" \"multi word value2\"",
-			want:       domain.Command{},
-			wantErrMsg: "(error) ERR Syntax error",
+			want:       domain.Command{Keyword: "SET", Args: []string{"multi word key", "multi word value1", "multi word value2"}},
+			wantErrMsg: "",
 		},
 	}
 
@@ -96,7 +97,7 @@ func Test_getCommand(t *testing.T) {
 				t.Fatalf("getCommand(%q) = %v, want Error %v", tc.input, gotErr, tc.wantErrMsg)
 			}
 
-			if got != tc.want {
+			if !reflect.DeepEqual(got, tc.want) {
 				t.Errorf("getCommand(%q) = %v, want %v", tc.input, got, tc.want)
 			}
 		})
@@ -0,0 +1,317 @@
+package ui
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"kvdb/domain"
+	"kvdb/storage"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newReplicationServer starts a RESP server with its own database and returns the port it listens on
+func newReplicationServer(t *testing.T) string {
+	t.Helper()
+	dataStorage := storage.NewInMemoryStorage(4)
+	t.Cleanup(func() { _ = dataStorage.Close() })
+	db := domain.NewKeyValueDB(dataStorage)
+	server := NewTcpServer("0", db, RESP)
+	t.Cleanup(server.Stop)
+	// The connections of the replicas are only closed once the replication stops
+	t.Cleanup(db.CloseReplication)
+
+	return strconv.Itoa(server.listener.Addr().(*net.TCPAddr).Port)
+}
+
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialClient(t *testing.T, port string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// do sends a command and returns its reply: the line of simple strings, errors and integers with their prefix, the
+// content of bulk strings, nil for nil replies and a []any for arrays
+func (c *testClient) do(args ...string) any {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(encodeCommand(args))); err != nil {
+		c.t.Fatalf("Error sending %q: %v", args, err)
+	}
+	reply, err := readTestReply(c.reader)
+	if err != nil {
+		c.t.Fatalf("Error reading reply to %q: %v", args, err)
+	}
+	return reply
+}
+
+func encodeCommand(args []string) string {
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return cmd
+}
+
+func readTestReply(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		length, _ := strconv.Atoi(line[1:])
+		if length < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:length]), nil
+	case '*':
+		count, _ := strconv.Atoi(line[1:])
+		elems := []any{}
+		for i := 0; i < count; i++ {
+			elem, err := readTestReply(reader)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		}
+		return elems, nil
+	}
+	return line, nil
+}
+
+// waitFor fails the test unless the condition becomes true within a few seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func linkUp(client *testClient) func() bool {
+	return func() bool {
+		return strings.Contains(client.do("INFO", "replication").(string), "master_link_status:up")
+	}
+}
+
+func TestReplication_SyncAndStream(t *testing.T) {
+	masterPort := newReplicationServer(t)
+	replicaPort := newReplicationServer(t)
+	master := dialClient(t, masterPort)
+	replica := dialClient(t, replicaPort)
+
+	// The replica loads the data written before it connected from the snapshot of the master
+	master.do("SET", "key", "value")
+	master.do("RPUSH", "list", "a", "b")
+	master.do("SELECT", "1")
+	master.do("SET", "expiring", "value", "PX", "100000")
+	replica.do("SET", "stale", "value")
+	if got := replica.do("REPLICAOF", "127.0.0.1", masterPort); got != "+OK" {
+		t.Fatalf("Reply to REPLICAOF = %v, want +OK", got)
+	}
+	waitFor(t, "the replica to synchronize", linkUp(replica))
+
+	// Then it applies the commands the master executes, in every database
+	master.do("INCR", "counter")
+	master.do("SELECT", "0")
+	master.do("DEL", "key")
+	master.do("MULTI")
+	master.do("HSET", "hash", "field", "value")
+	master.do("LPOP", "list")
+	master.do("EXEC")
+	master.do("SELECT", "2")
+	master.do("SET", "last", "done")
+	replica.do("SELECT", "2")
+	waitFor(t, "the replica to apply the last command", func() bool { return replica.do("GET", "last") == "done" })
+
+	testCases := []struct {
+		args []string
+		want any
+	}{
+		{args: []string{"SELECT", "0"}, want: "+OK"},
+		{args: []string{"GET", "stale"}, want: nil},
+		{args: []string{"GET", "key"}, want: nil},
+		{args: []string{"LRANGE", "list", "0", "-1"}, want: []any{"b"}},
+		{args: []string{"HGET", "hash", "field"}, want: "value"},
+		{args: []string{"SELECT", "1"}, want: "+OK"},
+		{args: []string{"GET", "expiring"}, want: "value"},
+		{args: []string{"GET", "counter"}, want: "1"},
+		{args: []string{"SET", "key", "value"}, want: "-READONLY You can't write against a read only replica."},
+		{args: []string{"REPLICAOF", "127.0.0.1", masterPort}, want: "+OK Already connected to specified master"},
+	}
+	for _, tc := range testCases {
+		if got := replica.do(tc.args...); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Reply of the replica to %q = %v, want %v", tc.args, got, tc.want)
+		}
+	}
+	if ttl, _ := strconv.Atoi(strings.TrimPrefix(replica.do("PTTL", "expiring").(string), ":")); ttl <= 0 {
+		t.Errorf("PTTL expiring on the replica = %d, want a positive time to live", ttl)
+	}
+
+	// The replica acknowledges the offset it processed, which catches up with the one of the master
+	var role []any
+	waitFor(t, "the replica to acknowledge the stream", func() bool {
+		role = master.do("ROLE").([]any)
+		replicas := role[2].([]any)
+		return len(replicas) == 1 && ":"+replicas[0].([]any)[2].(string) == role[1]
+	})
+	if replicas := role[2].([]any); replicas[0].([]any)[1] != replicaPort {
+		t.Errorf("ROLE of the master = %v, want replica listening on port %s", role, replicaPort)
+	}
+	// The lag is the number of seconds since the last acknowledgement, which the replica sends every second
+	info := master.do("INFO", "replication").(string)
+	want := fmt.Sprintf("slave0:ip=127.0.0.1,port=%s,state=online,offset=%s,lag=", replicaPort, strings.TrimPrefix(role[1].(string), ":"))
+	if lag, ok := infoNumber(info, want); !strings.Contains(info, "connected_slaves:1\r\n") || !ok || lag > 1 {
+		t.Errorf("INFO replication of the master = %q, want 1 replica and %q followed by at most 1", info, want)
+	}
+
+	got := replica.do("ROLE").([]any)
+	if len(got) != 5 || got[0] != "slave" || got[1] != "127.0.0.1" || got[2] != ":"+masterPort || got[3] != "connected" {
+		t.Errorf("ROLE of the replica = %v, want slave 127.0.0.1 %s connected <offset>", got, masterPort)
+	}
+	// The master last sent data when it streamed this write, or when it pinged the replica since
+	master.do("SET", "last", "again")
+	replica.do("SELECT", "2")
+	waitFor(t, "the replica to apply the write", func() bool { return replica.do("GET", "last") == "again" })
+	info = replica.do("INFO", "replication").(string)
+	if seconds, ok := infoNumber(info, "master_last_io_seconds_ago:"); !ok || seconds > 1 {
+		t.Errorf("INFO replication of the replica = %q, want master_last_io_seconds_ago at most 1", info)
+	}
+	processed, _ := infoNumber(info, "slave_repl_offset:")
+	if offset, ok := infoNumber(info, "master_repl_offset:"); !ok || processed == 0 || offset != processed {
+		t.Errorf("INFO replication of the replica = %q, want master_repl_offset equal to a positive slave_repl_offset", info)
+	}
+}
+
+// infoNumber returns the number ending the line of an INFO reply starting with the given prefix
+func infoNumber(info, prefix string) (int, bool) {
+	for _, line := range strings.Split(info, "\r\n") {
+		if value, found := strings.CutPrefix(line, prefix); found {
+			number, err := strconv.Atoi(value)
+			return number, err == nil
+		}
+	}
+	return 0, false
+}
+
+func TestReplication_ChangeMaster(t *testing.T) {
+	firstPort := newReplicationServer(t)
+	secondPort := newReplicationServer(t)
+	replicaPort := newReplicationServer(t)
+	first := dialClient(t, firstPort)
+	second := dialClient(t, secondPort)
+	replica := dialClient(t, replicaPort)
+
+	first.do("SET", "first", "value")
+	second.do("SET", "second", "value")
+	replica.do("REPLICAOF", "127.0.0.1", firstPort)
+	waitFor(t, "the replica to synchronize", func() bool { return replica.do("GET", "first") == "value" })
+
+	// The content of the replica is replaced by the one of its new master
+	replica.do("REPLICAOF", "127.0.0.1", secondPort)
+	waitFor(t, "the replica to synchronize with its new master", func() bool { return replica.do("GET", "second") == "value" })
+	if got := replica.do("EXISTS", "first"); got != ":0" {
+		t.Errorf("Reply of the replica to EXISTS first = %v, want :0", got)
+	}
+	first.do("SET", "late", "value")
+	second.do("SET", "streamed", "value")
+	waitFor(t, "the replica to apply the stream of its new master", func() bool { return replica.do("GET", "streamed") == "value" })
+	if got := replica.do("GET", "late"); got != nil {
+		t.Errorf("Reply of the replica to GET late = %v, want nil", got)
+	}
+
+	// Once a master again, it keeps its data and accepts writes
+	if got := replica.do("REPLICAOF", "NO", "ONE"); got != "+OK" {
+		t.Fatalf("Reply to REPLICAOF NO ONE = %v, want +OK", got)
+	}
+	if got := replica.do("SET", "own", "value"); got != "+OK" {
+		t.Errorf("Reply of the former replica to SET = %v, want +OK", got)
+	}
+	if got := replica.do("ROLE").([]any); got[0] != "master" {
+		t.Errorf("ROLE of the former replica = %v, want master", got)
+	}
+	if got := replica.do("DBSIZE"); got != ":3" {
+		t.Errorf("Reply of the former replica to DBSIZE = %v, want :3", got)
+	}
+}
+
+func TestReplication_ChainedReplicas(t *testing.T) {
+	masterPort := newReplicationServer(t)
+	replicaPort := newReplicationServer(t)
+	chainedPort := newReplicationServer(t)
+	master := dialClient(t, masterPort)
+	replica := dialClient(t, replicaPort)
+	chained := dialClient(t, chainedPort)
+
+	// A replica not synchronized with its master cannot synchronize replicas of its own, which retry
+	replica.do("REPLICAOF", "127.0.0.1", masterPort)
+	chained.do("REPLICAOF", "127.0.0.1", replicaPort)
+	waitFor(t, "the replica to synchronize", linkUp(replica))
+	waitFor(t, "the chained replica to synchronize", linkUp(chained))
+
+	for i := 0; i < 100; i++ {
+		master.do("RPUSH", "list", strconv.Itoa(i))
+	}
+	waitFor(t, "the chained replica to apply the stream", func() bool { return chained.do("LLEN", "list") == ":100" })
+	if got := chained.do("LINDEX", "list", "-1"); got != "99" {
+		t.Errorf("Reply of the chained replica to LINDEX list -1 = %v, want 99", got)
+	}
+}
+
+func TestReplication_ConcurrentWrites(t *testing.T) {
+	masterPort := newReplicationServer(t)
+	replicaPort := newReplicationServer(t)
+	replica := dialClient(t, replicaPort)
+	replica.do("REPLICAOF", "127.0.0.1", masterPort)
+	waitFor(t, "the replica to synchronize", linkUp(replica))
+
+	// The clients have to run in parallel for their writes to interleave
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		client := dialClient(t, masterPort)
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := client.conn.Write([]byte(encodeCommand([]string{"RPUSH", "list", strconv.Itoa(id*100 + j)}))); err != nil {
+					return
+				}
+				if _, err := readTestReply(client.reader); err != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The replica applies the writes in the order the master applied them
+	waitFor(t, "the replica to apply the stream", func() bool { return replica.do("LLEN", "list") == ":400" })
+	master := dialClient(t, masterPort)
+	if got, want := replica.do("LRANGE", "list", "0", "-1"), master.do("LRANGE", "list", "0", "-1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("LRANGE list on the replica differs from the one on the master")
+	}
+}
@@ -0,0 +1,295 @@
+package ui
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"kvdb/domain"
+	"strconv"
+	"strings"
+)
+
+// Protocol identifies the wire protocol a TcpServer speaks with its clients.
+type Protocol string
+
+const (
+	// RESP is the Redis serialization protocol (version 2) understood by redis-cli
+	// and standard Redis client libraries.
+	RESP Protocol = "resp"
+	// TEXT is the legacy prompt-based line protocol meant for nc/telnet users.
+	TEXT Protocol = "text"
+)
+
+const (
+	maxBulkLength      = 512 * 1024 * 1024
+	maxMultiBulkLength = 1024 * 1024
+	// Number of bytes or arguments allocated before reading them, beyond which the buffers grow with the data read so
+	// that a client cannot make the server allocate the maximum lengths by merely announcing them
+	maxPreallocLength = 64 * 1024
+)
+
+// ParseProtocol converts the given name into a Protocol, defaulting to RESP when the name is empty.
+func ParseProtocol(name string) (Protocol, error) {
+	switch Protocol(strings.ToLower(strings.TrimSpace(name))) {
+	case "", RESP:
+		return RESP, nil
+	case TEXT:
+		return TEXT, nil
+	}
+	return "", fmt.Errorf("unknown protocol %q, expected %q or %q", name, RESP, TEXT)
+}
+
+// ProtocolError is returned when a client sends a request that does not follow the RESP specification.
+type ProtocolError struct {
+	msg string
+}
+
+func (p *ProtocolError) Error() string {
+	return fmt.Sprintf("(error) ERR Protocol error: %s", p.msg)
+}
+
+type respReader struct {
+	reader *bufio.Reader
+}
+
+func newRespReader(reader io.Reader) *respReader {
+	return &respReader{reader: bufio.NewReader(reader)}
+}
+
+// ReadCommand reads the next request from the connection and returns its arguments.
+//
+// Requests starting with '*' are parsed as RESP multibulk arrays of bulk strings, any other line is
+// treated as an inline command and split on spaces the same way the text protocol does.
+// An empty inline line yields an empty slice so the caller can simply skip it.
+func (r *respReader) ReadCommand() ([]string, error) {
+	prefix, err := r.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if prefix[0] != '*' {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		return splitArgs(line)
+	}
+
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > maxMultiBulkLength {
+		return nil, &ProtocolError{msg: "invalid multibulk length"}
+	}
+	if count <= 0 {
+		return []string{}, nil
+	}
+
+	args := make([]string, 0, min(count, maxPreallocLength))
+	for i := 0; i < count; i++ {
+		arg, err := r.readBulkString()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func (r *respReader) readBulkString() (string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return "", err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return "", &ProtocolError{msg: fmt.Sprintf("expected '$', got '%s'", truncate(line, 1))}
+	}
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length < 0 || length > maxBulkLength {
+		return "", &ProtocolError{msg: "invalid bulk length"}
+	}
+
+	var bulk strings.Builder
+	bulk.Grow(min(length, maxPreallocLength))
+	if _, err := io.CopyN(&bulk, r.reader, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	var crlf [2]byte
+	if _, err := io.ReadFull(r.reader, crlf[:]); err != nil {
+		return "", err
+	}
+	if crlf != [2]byte{'\r', '\n'} {
+		return "", &ProtocolError{msg: "bulk string is not terminated by CRLF"}
+	}
+	return bulk.String(), nil
+}
+
+func (r *respReader) readLine() (string, error) {
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+type respWriter struct {
+	writer  *bufio.Writer
+	version int // RESP version negotiated with HELLO, either 2 or 3
+}
+
+func newRespWriter(writer io.Writer) *respWriter {
+	return &respWriter{writer: bufio.NewWriter(writer), version: 2}
+}
+
+// WriteResult encodes the result of KeyValueDB.Execute (or any error raised while reading the
+// request) using the negotiated RESP version and flushes it to the client.
+func (w *respWriter) WriteResult(result any) error {
+	w.writeResult(result)
+	return w.writer.Flush()
+}
+
+func (w *respWriter) writeResult(result any) {
+	switch res := result.(type) {
+	case []domain.DBResult:
+		w.writeDBResult(domain.NewArrayResult(res...))
+	case domain.DBResult:
+		w.writeDBResult(res)
+	case error:
+		w.writeError(res.Error())
+	case nil:
+		w.writeNil()
+	default:
+		w.writeSimpleString(fmt.Sprintf("%v", res))
+	}
+}
+
+// writeDBResult encodes a DBResult according to its ReplyType.
+//
+// RESP3 types are downgraded when the connection speaks RESP2: maps become flat arrays of
+// alternating keys and values, sets and pushes become arrays, doubles, big numbers and verbatim
+// strings become bulk strings and booleans become the integers 1 and 0.
+func (w *respWriter) writeDBResult(res domain.DBResult) {
+	switch res.Kind() {
+	case domain.NilReply:
+		w.writeNil()
+	case domain.IntegerReply:
+		w.writeLine(':', res.Text())
+	case domain.ErrorReply:
+		if res.Err != nil {
+			w.writeError(res.Err.Error())
+		} else {
+			w.writeError(res.Text())
+		}
+	case domain.StatusReply:
+		w.writeSimpleString(res.Response)
+	case domain.DoubleReply:
+		if w.version < 3 {
+			w.writeBulkString(res.Text())
+		} else {
+			w.writeLine(',', res.Text())
+		}
+	case domain.BigNumberReply:
+		if w.version < 3 {
+			w.writeBulkString(res.Text())
+		} else {
+			w.writeLine('(', res.Text())
+		}
+	case domain.BooleanReply:
+		switch {
+		case w.version < 3:
+			w.writeLine(':', res.Text())
+		case res.Value == true:
+			w.writeLine('#', "t")
+		default:
+			w.writeLine('#', "f")
+		}
+	case domain.VerbatimReply:
+		if w.version < 3 {
+			w.writeBulkString(res.Text())
+		} else {
+			format := truncate(res.Response+"txt", 3)
+			text := res.Text()
+			fmt.Fprintf(w.writer, "=%d\r\n%s:%s\r\n", len(text)+4, format, text)
+		}
+	case domain.ArrayReply, domain.SetReply, domain.MapReply, domain.PushReply:
+		w.writeAggregate(res)
+	default:
+		w.writeBulkString(res.Text())
+	}
+}
+
+func (w *respWriter) writeAggregate(res domain.DBResult) {
+	elems := res.Elements()
+	prefix := byte('*')
+	length := len(elems)
+	if w.version >= 3 {
+		switch res.Kind() {
+		case domain.MapReply:
+			prefix = '%'
+			length /= 2
+		case domain.SetReply:
+			prefix = '~'
+		case domain.PushReply:
+			prefix = '>'
+		}
+	}
+
+	w.writeLine(prefix, strconv.Itoa(length))
+	for _, elem := range elems {
+		w.writeDBResult(elem)
+	}
+}
+
+func (w *respWriter) writeLine(prefix byte, s string) {
+	w.writer.WriteByte(prefix)
+	w.writer.WriteString(s)
+	w.writer.WriteString("\r\n")
+}
+
+func (w *respWriter) writeSimpleString(s string) {
+	w.writeLine('+', strings.NewReplacer("\r", " ", "\n", " ").Replace(s))
+}
+
+func (w *respWriter) writeError(msg string) {
+	w.writeLine('-', strings.NewReplacer("\r", " ", "\n", " ").Replace(respErrorMessage(msg)))
+}
+
+func (w *respWriter) writeBulkString(s string) {
+	fmt.Fprintf(w.writer, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (w *respWriter) writeNil() {
+	if w.version >= 3 {
+		w.writer.WriteString("_\r\n")
+	} else {
+		w.writer.WriteString("$-1\r\n")
+	}
+}
+
+// respErrorMessage strips the "(error) " prefix used by the text protocol and makes sure the
+// message starts with an error code such as ERR, as RESP clients expect.
+func respErrorMessage(msg string) string {
+	msg = strings.TrimPrefix(msg, "(error) ")
+	code, _, _ := strings.Cut(msg, " ")
+	if code == "" || strings.ToUpper(code) != code {
+		return "ERR " + msg
+	}
+	return msg
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func isProtocolError(err error) bool {
+	var protocolErr *ProtocolError
+	return errors.As(err, &protocolErr)
+}
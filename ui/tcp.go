@@ -2,37 +2,42 @@ package ui
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"kvdb/domain"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 type TcpServer struct {
 	listener net.Listener
 	shutdown chan struct{}
 	wg       sync.WaitGroup
-	db       domain.KeyValueDB
+	protocol Protocol
 }
 
-func NewTcpServer(port string, db domain.KeyValueDB) *TcpServer {
+// NewTcpServer starts listening on the given port and serves clients using the given protocol.
+func NewTcpServer(port string, db *domain.KeyValueDB, protocol Protocol) *TcpServer {
 	s := &TcpServer{
 		shutdown: make(chan struct{}),
+		protocol: protocol,
 	}
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
 	if err != nil {
 		log.Fatalf("Failed to startup TCP server: %v\n", err)
 	}
-	fmt.Println("TCP server started and Listening on port", port)
+	fmt.Printf("TCP server started and Listening on port %s (protocol: %s)\n", port, protocol)
 	s.listener = listener
+	db.SetListeningPort(listener.Addr().(*net.TCPAddr).Port)
 
 	s.wg.Add(1)
 	go s.serve(db)
 	return s
 }
 
-func (s *TcpServer) serve(db domain.KeyValueDB) {
+func (s *TcpServer) serve(db *domain.KeyValueDB) {
 	defer s.wg.Done()
 
 	for {
@@ -65,15 +70,106 @@ func (s *TcpServer) Stop() {
 	fmt.Println("Server stopped.")
 }
 
-func (s *TcpServer) handleConnection(conn net.Conn, db domain.KeyValueDB) {
+func (s *TcpServer) handleConnection(conn net.Conn, db *domain.KeyValueDB) {
 	defer conn.Close()
 
+	session := db.NewSession()
+	defer db.CloseSession(session)
+	if s.protocol == TEXT {
+		s.handleTextConnection(conn, db, session)
+	} else {
+		s.handleRespConnection(conn, db, session)
+	}
+}
+
+// handleRespConnection serves a client speaking RESP until it disconnects or sends DISCONNECT.
+//
+// Connections start with RESP2 and switch to RESP3 when the client sends HELLO 3. A replica sending SYNC is served
+// by the database until it disconnects.
+func (s *TcpServer) handleRespConnection(conn net.Conn, db *domain.KeyValueDB, session *domain.Session) {
+	reader := newRespReader(conn)
+	writer := newRespWriter(conn)
+	for {
+		args, err := reader.ReadCommand()
+		if err != nil {
+			if isProtocolError(err) {
+				_ = writer.WriteResult(err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		var result any
+		command, err := commandFromArgs(args)
+		if err != nil {
+			result = err
+		} else if command.Keyword == domain.DISCONNECT {
+			_ = writer.WriteResult(domain.NewStatusResult("OK"))
+			return
+		} else if command.Keyword == domain.SYNC {
+			// The connection streams the writes to the replica from now on, unless it cannot be synchronized
+			err := db.ServeReplica(session, command, conn, reader.reader)
+			if err == nil {
+				return
+			}
+			result = err
+		} else {
+			result = execute(conn, reader.reader, db, session, command)
+			writer.version = session.Protocol
+		}
+
+		if err := writer.WriteResult(result); err != nil {
+			log.Printf("Error writing reply: %v\n", err)
+			return
+		}
+	}
+}
+
+// execute runs a command on behalf of the client of the given connection.
+//
+// While a blocking command waits, the connection is read ahead to notice the client disconnecting, which closes the
+// Done channel of the session so that the command does not pop an element that would never be received. The commands
+// the client pipelines in the meantime are left in the reader.
+func execute(conn net.Conn, reader *bufio.Reader, db *domain.KeyValueDB, session *domain.Session, command domain.Command) any {
+	if !command.IsBlocking() {
+		return db.Execute(session, command)
+	}
+
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		for reader.Buffered() < reader.Size() {
+			if _, err := reader.Peek(reader.Buffered() + 1); err != nil {
+				var netErr net.Error
+				if !errors.As(err, &netErr) || !netErr.Timeout() {
+					close(done)
+				}
+				return
+			}
+		}
+	}()
+
+	session.Done = done
+	result := db.Execute(session, command)
+	session.Done = nil
+
+	// Interrupt the read ahead, the connection is read again by the caller
+	_ = conn.SetReadDeadline(time.Now())
+	<-watched
+	_ = conn.SetReadDeadline(time.Time{})
+	return result
+}
+
+// handleTextConnection serves a client using the prompt-based text protocol.
+func (s *TcpServer) handleTextConnection(conn net.Conn, db *domain.KeyValueDB, session *domain.Session) {
 	reader := bufio.NewReader(conn)
 	writer := bufio.NewWriter(conn)
-	dbIndex := 0
 	for {
-		if dbIndex > 0 {
-			fmt.Fprintf(writer, "[%d]>", dbIndex)
+		if session.DbIndex > 0 {
+			fmt.Fprintf(writer, "[%d]>", session.DbIndex)
 		} else {
 			fmt.Fprintf(writer, ">")
 		}
@@ -95,8 +191,7 @@ func (s *TcpServer) handleConnection(conn net.Conn, db domain.KeyValueDB) {
 		}
 		var result any
 		if command.Keyword != domain.DISCONNECT {
-			result = db.Execute(dbIndex, command)
-			dbIndex = getDbIndex(result)
+			result = execute(conn, reader, db, session, command)
 			PrintDbResult(writer, result)
 		} else {
 			result = fmt.Sprintln("Connection closed.")
@@ -106,15 +201,3 @@ func (s *TcpServer) handleConnection(conn net.Conn, db domain.KeyValueDB) {
 
 	}
 }
-
-func getDbIndex(result any) int {
-	switch res := result.(type) {
-	case []domain.DBResult:
-		if len(res) > 0 {
-			return res[0].DbIndex
-		}
-	case domain.DBResult:
-		return res.DbIndex
-	}
-	return 0
-}
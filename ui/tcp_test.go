@@ -0,0 +1,208 @@
+package ui
+
+import (
+	"bufio"
+	"fmt"
+	"kvdb/domain"
+	"kvdb/storage"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, protocol Protocol) (*TcpServer, string) {
+	t.Helper()
+	db := domain.NewKeyValueDB(storage.NewInMemoryStorage(4))
+	server := NewTcpServer("0", db, protocol)
+	t.Cleanup(server.Stop)
+	return server, server.listener.Addr().String()
+}
+
+// sendCommand sends a RESP multibulk command and returns the first line of the reply
+func sendCommand(t *testing.T, conn net.Conn, reader *bufio.Reader, args ...string) string {
+	t.Helper()
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		t.Fatalf("Error sending %q: %v", args, err)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error reading reply to %q: %v", args, err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+func TestTcpServer_RespClient(t *testing.T) {
+	_, addr := newTestServer(t, RESP)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	testCases := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"SET", "key", "10"}, want: "+OK"},
+		{args: []string{"INCR", "key"}, want: ":11"},
+		{args: []string{"GET", "missing"}, want: "$-1"},
+		{args: []string{"SELECT", "1"}, want: "+OK"},
+		{args: []string{"GET", "key"}, want: "$-1"},
+		{args: []string{"SET", "other", "value"}, want: "+OK"},
+		{args: []string{"SELECT", "9"}, want: "-ERR DB index is out of range"},
+		{args: []string{"GET", "other"}, want: "$5"},
+		{args: []string{"HELLO", "3"}, want: "%7"},
+		{args: []string{"GET", "missing"}, want: "_"},
+		{args: []string{"PUT", "key"}, want: "-ERR unknown command PUT"},
+		{args: []string{"DISCONNECT"}, want: "+OK"},
+	}
+	for _, tc := range testCases {
+		got := sendCommand(t, conn, reader, tc.args...)
+		if got != tc.want {
+			t.Errorf("Reply to %q = %q, want %q", tc.args, got, tc.want)
+		}
+		if strings.HasPrefix(got, "$") && got != "$-1" {
+			// Skip the content of the bulk string
+			_, _ = reader.ReadString('\n')
+		}
+		if tc.args[0] == "HELLO" {
+			// Skip the server information map, which ends with the empty modules array
+			for line := ""; line != "*0\r\n"; {
+				line, _ = reader.ReadString('\n')
+			}
+		}
+	}
+}
+
+func TestTcpServer_ConcurrentClients(t *testing.T) {
+	_, addr := newTestServer(t, RESP)
+	clients := 16
+	iterations := 100
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	sendCommand(t, conn, reader, "SET", "counter", "0")
+
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Errorf("Error connecting to server: %v", err)
+				return
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+
+			key := fmt.Sprintf("key_%d", client)
+			for i := 0; i < iterations; i++ {
+				sendCommand(t, conn, reader, "SET", key, "value")
+				sendCommand(t, conn, reader, "INCRBY", "counter", "1")
+			}
+		}(c)
+	}
+
+	wg.Wait()
+
+	got := sendCommand(t, conn, reader, "GET", "counter")
+	if want := fmt.Sprintf("$%d", len(fmt.Sprint(clients*iterations))); got != want {
+		t.Fatalf("Reply to GET counter = %q, want %q", got, want)
+	}
+	value, _ := reader.ReadString('\n')
+	if want := fmt.Sprintf("%d\r\n", clients*iterations); value != want {
+		t.Errorf("Value of counter = %q, want %q", value, want)
+	}
+}
+
+func TestTcpServer_BlockingClient(t *testing.T) {
+	_, addr := newTestServer(t, RESP)
+	blocked, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer blocked.Close()
+	pusher, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer pusher.Close()
+
+	if _, err := blocked.Write([]byte("*3\r\n$5\r\nBLPOP\r\n$4\r\nlist\r\n$1\r\n5\r\n")); err != nil {
+		t.Fatalf("Error sending BLPOP: %v", err)
+	}
+	reply := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(blocked).ReadString('\n')
+		reply <- strings.TrimSuffix(line, "\r\n")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case got := <-reply:
+		t.Fatalf("Reply to BLPOP on an empty list = %q, want the client to block", got)
+	default:
+	}
+
+	if got := sendCommand(t, pusher, bufio.NewReader(pusher), "RPUSH", "list", "a"); got != ":1" {
+		t.Fatalf("Reply to RPUSH = %q, want :1", got)
+	}
+	select {
+	case got := <-reply:
+		if got != "*2" {
+			t.Errorf("Reply to BLPOP = %q, want *2", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("BLPOP still blocked after RPUSH")
+	}
+}
+
+func TestTcpServer_BlockedClientDisconnects(t *testing.T) {
+	_, addr := newTestServer(t, RESP)
+	_, port, _ := net.SplitHostPort(addr)
+	worker := dialClient(t, port)
+	client := dialClient(t, port)
+	blockedClients := func(count int) func() bool {
+		return func() bool {
+			return strings.Contains(client.do("INFO", "clients").(string), fmt.Sprintf("blocked_clients:%d", count))
+		}
+	}
+
+	// The commands pipelined after a blocking one run once it is served
+	if _, err := worker.conn.Write([]byte(encodeCommand([]string{"BLPOP", "jobs", "0"}) + encodeCommand([]string{"PING"}))); err != nil {
+		t.Fatalf("Error sending BLPOP: %v", err)
+	}
+	waitFor(t, "the worker to block", blockedClients(1))
+	client.do("RPUSH", "jobs", "job1")
+	for _, want := range []any{[]any{"jobs", "job1"}, "+PONG"} {
+		if got, err := readTestReply(worker.reader); err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("Reply of the worker = %v, %v, want %v", got, err, want)
+		}
+	}
+
+	// A worker disconnecting while blocked does not pop the next job
+	if _, err := worker.conn.Write([]byte(encodeCommand([]string{"BLPOP", "jobs", "0"}))); err != nil {
+		t.Fatalf("Error sending BLPOP: %v", err)
+	}
+	waitFor(t, "the worker to block", blockedClients(1))
+	_ = worker.conn.Close()
+	waitFor(t, "the command of the worker to be cancelled", blockedClients(0))
+	if got := client.do("RPUSH", "jobs", "job2"); got != ":1" {
+		t.Errorf("Reply to RPUSH = %v, want :1", got)
+	}
+	if got := client.do("LPOP", "jobs"); got != "job2" {
+		t.Errorf("Reply to LPOP = %v, want job2", got)
+	}
+}
@@ -14,18 +14,15 @@ import (
 // The function takes a writer (*bufio.Writer) and a result (any) as parameters.
 // The result can be either a slice of DBResult objects ([]domain.DBResult) or a single DBResult object (domain.DBResult).
 // It writes the result(s) to the writer in a formatted manner.
-// If the result is a slice, it iterates over each DBResult object and writes its SimpleMsg() value to the writer.
+// A slice is printed as an array reply, i.e. each DBResult object is numbered and written on its own line.
 // If the result is a single object, it writes the SimpleMsg() value of that object to the writer.
 // The function returns nothing.
 func PrintDbResult(writer *bufio.Writer, result any) {
+	if res, ok := result.([]domain.DBResult); ok {
+		result = domain.NewArrayResult(res...)
+	}
+
 	switch res := result.(type) {
-	case []domain.DBResult:
-		for i, dbResult := range res {
-			_, err := fmt.Fprintf(writer, "%d) %v\n", i+1, dbResult.SimpleMsg())
-			if err != nil {
-				log.Fatalln(err)
-			}
-		}
 	case domain.DBResult:
 		_, err := fmt.Fprintf(writer, "%v\n", res.SimpleMsg())
 		if err != nil {
@@ -46,17 +43,40 @@ func PrintDbResult(writer *bufio.Writer, result any) {
 
 // getCommand parses the input string and returns a domain.Command and an error.
 //
+// It splits the input into arguments with splitArgs and builds the command from them with commandFromArgs.
+func getCommand(input string) (domain.Command, error) {
+	args, err := splitArgs(input)
+	if err != nil {
+		return domain.Command{}, err
+	}
+	return commandFromArgs(args)
+}
+
+// commandFromArgs builds a domain.Command from a list of arguments.
+//
+// The first argument is the keyword (uppercased), the remaining ones are the command arguments
+// whose number is checked by the validation of the command.
+func commandFromArgs(args []string) (domain.Command, error) {
+	if len(args) == 0 {
+		return domain.Command{}, nil
+	}
+	return domain.Command{Keyword: strings.ToUpper(args[0]), Args: args[1:]}, nil
+}
+
+// splitArgs splits the input string into its individual arguments.
+//
 // It takes an input string and trims any leading or trailing whitespace.
 // The input string is then split into individual words using space as the delimiter.
 // The function iterates over the words, checking for opening and closing quotes to handle quoted arguments correctly.
 // If a closing quote is missing, an error is returned.
-// The keyword variable is set to the first word in uppercase.
-// The remaining words are appended to the args slice, either as individual arguments or as a single argument if enclosed in quotes.
-// Finally, a domain.Command is created with the keyword and args, and returned along with any error encountered.
-func getCommand(input string) (domain.Command, error) {
-	var keyword string
-	var args []any
+// The first word is always returned as-is, the remaining words are appended to the args slice,
+// either as individual arguments or as a single argument if enclosed in quotes.
+func splitArgs(input string) ([]string, error) {
+	var args []string
 	input = strings.TrimSpace(input)
+	if input == "" {
+		return args, nil
+	}
 
 	// Split the input into there individual words
 	words := strings.Split(input, " ")
@@ -95,16 +115,12 @@ func getCommand(input string) (domain.Command, error) {
 				}
 			}
 		} else {
-			keyword = strings.ToUpper(word)
+			args = append(args, word)
 		}
 	}
 
 	if foundOpeningQuote && !foundClosingQuote {
-		return domain.Command{}, errors.New("(error) ERR Syntax error: arguments has no closing quote")
-	}
-
-	if len(args) > 2 {
-		return domain.Command{}, errors.New("(error) ERR Syntax error")
+		return nil, errors.New("(error) ERR Syntax error: arguments has no closing quote")
 	}
-	return domain.NewCommand(keyword, args...), nil
+	return args, nil
 }